@@ -0,0 +1,98 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/client-go/1.4/pkg/util/wait"
+)
+
+// Jitter factor of the delay before retrying a failed provision, so that
+// claims that failed together aren't all retried together.
+const provisionRetryJitter = 0.5
+
+// provisionBackoff tracks failed provisions per claim, or failed deletes per
+// volume, so that they are retried with exponential backoff and jitter rather
+// than on every update of the claim or volume.
+type provisionBackoff struct {
+	lock    sync.Mutex
+	initial time.Duration
+	max     time.Duration
+	entries map[string]*backoffEntry
+}
+
+type backoffEntry struct {
+	failures  int
+	delay     time.Duration
+	nextRetry time.Time
+}
+
+func newProvisionBackoff(initial, max time.Duration) *provisionBackoff {
+	return &provisionBackoff{
+		initial: initial,
+		max:     max,
+		entries: make(map[string]*backoffEntry),
+	}
+}
+
+// safeToRetry returns whether the provision with the given key may be
+// attempted now and, if not, when it may be.
+func (b *provisionBackoff) safeToRetry(key string) (bool, time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	entry, ok := b.entries[key]
+	if !ok || !time.Now().Before(entry.nextRetry) {
+		return true, time.Time{}
+	}
+	return false, entry.nextRetry
+}
+
+// failed records a failure of the provision with the given key and returns how
+// many times in a row it has failed and how long until it may be retried.
+func (b *provisionBackoff) failed(key string) (int, time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	entry, ok := b.entries[key]
+	if !ok {
+		entry = &backoffEntry{}
+		b.entries[key] = entry
+	}
+	entry.failures++
+	if entry.delay == 0 {
+		entry.delay = b.initial
+	} else {
+		entry.delay *= 2
+	}
+	if entry.delay > b.max {
+		entry.delay = b.max
+	}
+	delay := wait.Jitter(entry.delay, provisionRetryJitter)
+	entry.nextRetry = time.Now().Add(delay)
+	return entry.failures, delay
+}
+
+// reset forgets the failures of the provision with the given key.
+func (b *provisionBackoff) reset(key string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.entries, key)
+}
@@ -24,6 +24,7 @@ package controller
 import (
 	"fmt"
 	"os/exec"
+	"reflect"
 	"strings"
 	"time"
 
@@ -31,6 +32,8 @@ import (
 
 	// TODO get rid of this and use https://github.com/kubernetes/kubernetes/pull/32718
 	"github.com/wongma7/nfs-provisioner/framework"
+	"github.com/wongma7/nfs-provisioner/logging"
+	"github.com/wongma7/nfs-provisioner/tracing"
 	"k8s.io/client-go/1.4/kubernetes"
 	core_v1 "k8s.io/client-go/1.4/kubernetes/typed/core/v1"
 	"k8s.io/client-go/1.4/pkg/api"
@@ -40,8 +43,6 @@ import (
 	"k8s.io/client-go/1.4/pkg/watch"
 	"k8s.io/client-go/1.4/tools/cache"
 	"k8s.io/client-go/1.4/tools/record"
-
-	"k8s.io/kubernetes/pkg/util/goroutinemap"
 )
 
 // annClass annotation represents the storage class associated with a resource:
@@ -54,6 +55,10 @@ import (
 //   volume belongs.
 const annClass = "volume.beta.kubernetes.io/storage-class"
 
+// annAlphaClass is the alpha predecessor of annClass, still set on claims by
+// older Kubernetes versions and clients.
+const annAlphaClass = "volume.alpha.kubernetes.io/storage-class"
+
 // This annotation is added to a PV that has been dynamically provisioned by
 // Kubernetes. Its value is name of volume plugin that created the volume.
 // It serves both user (to show where a PV comes from) and Kubernetes (to
@@ -68,6 +73,11 @@ const createProvisionedPVRetryCount = 5
 // Interval between retries when we create a PV object for a provisioned volume.
 const createProvisionedPVInterval = 10 * time.Second
 
+// Initial and maximum delays before retrying a failed provision, doubling
+// after every consecutive failure.
+const initialProvisionRetryDelay = 10 * time.Second
+const maxProvisionRetryDelay = 5 * time.Minute
+
 // ProvisionController is a controller that provisions PersistentVolumes for
 // PersistentVolumeClaims.
 type ProvisionController struct {
@@ -78,6 +88,16 @@ type ProvisionController struct {
 	// annStorageProvisioner to set & watch for, respectively
 	provisionerName string
 
+	// Other names the provisioner goes by, e.g. ones it was deployed under in
+	// the past. Claims requesting a StorageClass with one of these as its
+	// provisioner field are provisioned for too, and volumes with one of these
+	// as their annDynamicallyProvisioned are deleted and updated too.
+	provisionerAliases []string
+
+	// The annotations a claim may request its class with, in order of
+	// precedence. A provisioned volume gets the annotation its claim used.
+	classAnnotations []string
+
 	// The provisioner the controller will use to provision and delete volumes.
 	// Presumably this implementer of Provisioner carries its own
 	// volume-specific options and such that it needs in order to provision
@@ -97,18 +117,34 @@ type ProvisionController struct {
 
 	eventRecorder record.EventRecorder
 
-	// Map of scheduled/running operations.
-	runningOperations goroutinemap.GoRoutineMap
+	// Queue of scheduled/running operations and the number of workers running
+	// them in parallel.
+	runningOperations *operationQueue
+	workerThreads     int
+
+	// How often to re-list claims, volumes and classes from the API server and
+	// handle them all again, in case watch events were missed. Zero disables
+	// it.
+	fullResyncPeriod time.Duration
 
 	createProvisionedPVRetryCount int
 	createProvisionedPVInterval   time.Duration
+
+	// Backoff of failed provisions, per claim
+	provisionBackoff *provisionBackoff
+	// Backoff of failed deletes, per volume
+	deleteBackoff *provisionBackoff
 }
 
 func NewProvisionController(
 	client kubernetes.Interface,
 	resyncPeriod time.Duration,
+	fullResyncPeriod time.Duration,
 	provisionerName string,
+	provisionerAliases []string,
+	classAnnotations []string,
 	provisioner Provisioner,
+	workerThreads int,
 ) *ProvisionController {
 	broadcaster := record.NewBroadcaster()
 	broadcaster.StartRecordingToSink(&core_v1.EventSinkImpl{Interface: client.Core().Events(v1.NamespaceAll)})
@@ -124,11 +160,17 @@ func NewProvisionController(
 	controller := &ProvisionController{
 		client:                        client,
 		provisionerName:               provisionerName,
+		provisionerAliases:            provisionerAliases,
+		classAnnotations:              classAnnotations,
 		provisioner:                   provisioner,
 		eventRecorder:                 eventRecorder,
-		runningOperations:             goroutinemap.NewGoRoutineMap(false /* exponentialBackOffOnError */),
+		runningOperations:             newOperationQueue(),
+		workerThreads:                 workerThreads,
+		fullResyncPeriod:              fullResyncPeriod,
 		createProvisionedPVRetryCount: createProvisionedPVRetryCount,
 		createProvisionedPVInterval:   createProvisionedPVInterval,
+		provisionBackoff:              newProvisionBackoff(initialProvisionRetryDelay, maxProvisionRetryDelay),
+		deleteBackoff:                 newProvisionBackoff(initialProvisionRetryDelay, maxProvisionRetryDelay),
 	}
 
 	controller.claimSource = &cache.ListWatch{
@@ -146,7 +188,7 @@ func NewProvisionController(
 		framework.ResourceEventHandlerFuncs{
 			AddFunc:    controller.addClaim,
 			UpdateFunc: controller.updateClaim,
-			DeleteFunc: nil,
+			DeleteFunc: controller.deleteClaim,
 		},
 	)
 
@@ -165,7 +207,7 @@ func NewProvisionController(
 		framework.ResourceEventHandlerFuncs{
 			AddFunc:    nil,
 			UpdateFunc: controller.updateVolume,
-			DeleteFunc: nil,
+			DeleteFunc: controller.deleteVolume,
 		},
 	)
 
@@ -188,12 +230,81 @@ func NewProvisionController(
 	return controller
 }
 
+// Run starts the controller. It returns once stopCh is closed and the
+// operations that were running at the time have finished.
 func (ctrl *ProvisionController) Run(stopCh <-chan struct{}) {
 	glog.Info("Starting nfs provisioner controller!")
 	go ctrl.claimController.Run(stopCh)
 	go ctrl.volumeController.Run(stopCh)
 	go ctrl.classReflector.RunUntil(stopCh)
+	ctrl.runningOperations.Run(ctrl.workerThreads, stopCh)
+	if ctrl.fullResyncPeriod > 0 {
+		go ctrl.fullResyncLoop(stopCh)
+	}
 	<-stopCh
+
+	// Let running operations finish so that no volume is left half
+	// provisioned or deleted
+	glog.Info("Stopping nfs provisioner controller, waiting for running operations to finish")
+	ctrl.runningOperations.WaitForRunning()
+}
+
+// Operations returns the names of the provision, delete and update operations
+// that are queued and running, e.g. for troubleshooting a live controller.
+func (ctrl *ProvisionController) Operations() (queued []string, running []string) {
+	return ctrl.runningOperations.List()
+}
+
+// fullResyncLoop does a full resync every fullResyncPeriod until stopCh is
+// closed.
+func (ctrl *ProvisionController) fullResyncLoop(stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(ctrl.fullResyncPeriod):
+			ctrl.fullResync()
+		}
+	}
+}
+
+// fullResync lists all classes, claims and volumes from the API server and
+// handles the claims and volumes as if they were just updated. Unlike the
+// informers' resyncs, which replay their caches, this catches claims and
+// volumes whose watch events were missed, e.g. during API server hiccups.
+func (ctrl *ProvisionController) fullResync() {
+	glog.V(4).Infof("Starting full resync")
+
+	classes, err := ctrl.client.Storage().StorageClasses().List(api.ListOptions{})
+	if err != nil {
+		glog.Errorf("Error listing StorageClasses for full resync: %v", err)
+	} else {
+		objs := make([]interface{}, 0, len(classes.Items))
+		for i := range classes.Items {
+			objs = append(objs, &classes.Items[i])
+		}
+		if err := ctrl.classes.Replace(objs, classes.ResourceVersion); err != nil {
+			glog.Errorf("Error replacing StorageClasses in cache for full resync: %v", err)
+		}
+	}
+
+	claims, err := ctrl.client.Core().PersistentVolumeClaims(v1.NamespaceAll).List(api.ListOptions{})
+	if err != nil {
+		glog.Errorf("Error listing PersistentVolumeClaims for full resync: %v", err)
+	} else {
+		for i := range claims.Items {
+			ctrl.addClaim(&claims.Items[i])
+		}
+	}
+
+	volumes, err := ctrl.client.Core().PersistentVolumes().List(api.ListOptions{})
+	if err != nil {
+		glog.Errorf("Error listing PersistentVolumes for full resync: %v", err)
+	} else {
+		for i := range volumes.Items {
+			ctrl.updateVolume(&volumes.Items[i], &volumes.Items[i])
+		}
+	}
 }
 
 // On add claim, check if the added claim should have a volume provisioned for
@@ -206,6 +317,10 @@ func (ctrl *ProvisionController) addClaim(obj interface{}) {
 	}
 
 	if ctrl.shouldProvision(claim) {
+		if ok, nextRetry := ctrl.provisionBackoff.safeToRetry(string(claim.UID)); !ok {
+			glog.V(4).Infof("provisioning for claim %q failed recently, not retrying until %v", claimToClaimKey(claim), nextRetry)
+			return
+		}
 		opName := fmt.Sprintf("provision-%s[%s]", claimToClaimKey(claim), string(claim.UID))
 		ctrl.scheduleOperation(opName, func() error {
 			ctrl.provisionClaimOperation(claim)
@@ -220,6 +335,34 @@ func (ctrl *ProvisionController) updateClaim(oldObj, newObj interface{}) {
 	ctrl.addClaim(newObj)
 }
 
+// On delete claim, forget any failures provisioning for it.
+func (ctrl *ProvisionController) deleteClaim(obj interface{}) {
+	if unknown, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = unknown.Obj
+	}
+	claim, ok := obj.(*v1.PersistentVolumeClaim)
+	if !ok {
+		glog.Errorf("Expected PersistentVolumeClaim but deleteClaim received %+v", obj)
+		return
+	}
+
+	ctrl.provisionBackoff.reset(string(claim.UID))
+}
+
+// On delete volume, forget any failures deleting it.
+func (ctrl *ProvisionController) deleteVolume(obj interface{}) {
+	if unknown, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = unknown.Obj
+	}
+	volume, ok := obj.(*v1.PersistentVolume)
+	if !ok {
+		glog.Errorf("Expected PersistentVolume but deleteVolume received %+v", obj)
+		return
+	}
+
+	ctrl.deleteBackoff.reset(volume.Name)
+}
+
 // On update volume, check if the updated volume should be deleted and delete if
 // so. Updates occur at least every resyncPeriod.
 func (ctrl *ProvisionController) updateVolume(oldObj, newObj interface{}) {
@@ -230,11 +373,30 @@ func (ctrl *ProvisionController) updateVolume(oldObj, newObj interface{}) {
 	}
 
 	if ctrl.shouldDelete(volume) {
+		if ok, nextRetry := ctrl.deleteBackoff.safeToRetry(volume.Name); !ok {
+			glog.V(4).Infof("deleting volume %q failed recently, not retrying until %v", volume.Name, nextRetry)
+			return
+		}
 		opName := fmt.Sprintf("delete-%s[%s]", volume.Name, string(volume.UID))
 		ctrl.scheduleOperation(opName, func() error {
 			ctrl.deleteVolumeOperation(volume)
 			return nil
 		})
+		return
+	}
+
+	oldVolume, ok := oldObj.(*v1.PersistentVolume)
+	if !ok {
+		glog.Errorf("Expected PersistentVolume but handler received %#v", oldObj)
+		return
+	}
+
+	if updater, ok := ctrl.provisioner.(Updater); ok && ctrl.shouldUpdate(oldVolume, volume) {
+		opName := fmt.Sprintf("update-%s[%s]", volume.Name, string(volume.UID))
+		ctrl.scheduleOperation(opName, func() error {
+			ctrl.updateVolumeOperation(updater, volume)
+			return nil
+		})
 	}
 }
 
@@ -249,7 +411,7 @@ func (ctrl *ProvisionController) shouldProvision(claim *v1.PersistentVolumeClaim
 		return false
 	}
 
-	claimClass := getClaimClass(claim)
+	_, claimClass := ctrl.getClaimClass(claim)
 	classObj, found, err := ctrl.classes.GetByKey(claimClass)
 	if err != nil {
 		glog.Errorf("Error getting StorageClass %q: %v", claimClass, err)
@@ -265,7 +427,7 @@ func (ctrl *ProvisionController) shouldProvision(claim *v1.PersistentVolumeClaim
 		return false
 	}
 
-	if class.Provisioner != ctrl.provisionerName {
+	if !ctrl.isProvisioner(class.Provisioner) {
 		return false
 	}
 
@@ -286,26 +448,59 @@ func (ctrl *ProvisionController) shouldDelete(volume *v1.PersistentVolume) bool
 		return false
 	}
 
-	if ann := volume.Annotations[annDynamicallyProvisioned]; ann != ctrl.provisionerName {
+	if ann := volume.Annotations[annDynamicallyProvisioned]; !ctrl.isProvisioner(ann) {
 		return false
 	}
 
 	return true
 }
 
+// shouldUpdate returns whether the volume's annotations changed, ignoring
+// resyncs, and the volume was provisioned by this provisioner.
+func (ctrl *ProvisionController) shouldUpdate(oldVolume, volume *v1.PersistentVolume) bool {
+	if ann := volume.Annotations[annDynamicallyProvisioned]; !ctrl.isProvisioner(ann) {
+		return false
+	}
+
+	return !reflect.DeepEqual(oldVolume.Annotations, volume.Annotations)
+}
+
+// isProvisioner returns whether the given provisioner name is this
+// provisioner's name or one of its aliases.
+func (ctrl *ProvisionController) isProvisioner(name string) bool {
+	if name == ctrl.provisionerName {
+		return true
+	}
+	for _, alias := range ctrl.provisionerAliases {
+		if name == alias {
+			return true
+		}
+	}
+	return false
+}
+
 func (ctrl *ProvisionController) provisionClaimOperation(claim *v1.PersistentVolumeClaim) {
 	// Most code here is identical to that found in controller.go of kube's PV controller...
-	claimClass := getClaimClass(claim)
-	glog.Infof("provisionClaimOperation [%s] started, class: %q", claimToClaimKey(claim), claimClass)
+	classAnnotation, claimClass := ctrl.getClaimClass(claim)
+	start := time.Now()
+	fields := logging.Fields{logging.Operation: "provision", logging.PVC: claim.Name, logging.Namespace: claim.Namespace}
+	logging.Info("provisionClaimOperation started", fields.With(logging.Fields{"class": claimClass}))
+	span := tracing.Start("provision", nil)
+	defer span.Finish(nil)
+	span.SetTag(logging.PVC, claim.Name)
+	span.SetTag(logging.Namespace, claim.Namespace)
+	span.SetTag("class", claimClass)
 
 	//  A previous doProvisionClaim may just have finished while we were waiting for
 	//  the locks. Check that PV (with deterministic name) hasn't been provisioned
 	//  yet.
 	pvName := ctrl.getProvisionedVolumeNameForClaim(claim)
+	fields[logging.PV] = pvName
+	span.SetTag(logging.PV, pvName)
 	volume, err := ctrl.client.Core().PersistentVolumes().Get(pvName)
 	if err == nil && volume != nil {
 		// Volume has been already provisioned, nothing to do.
-		glog.Infof("provisionClaimOperation [%s]: volume already exists, skipping", claimToClaimKey(claim))
+		logging.Info("volume already exists, skipping", fields)
 		return
 	}
 
@@ -313,22 +508,22 @@ func (ctrl *ProvisionController) provisionClaimOperation(claim *v1.PersistentVol
 	// provisioned)
 	claimRef, err := v1.GetReference(claim)
 	if err != nil {
-		glog.Errorf("unexpected error getting claim reference: %v", err)
+		logging.Error("unexpected error getting claim reference", fields.With(logging.Fields{logging.Err: err}))
 		return
 	}
 
 	classObj, found, err := ctrl.classes.GetByKey(claimClass)
 	if err != nil {
-		glog.Errorf("Error getting StorageClass %q: %v", claimClass, err)
+		logging.Error("error getting StorageClass", fields.With(logging.Fields{"class": claimClass, logging.Err: err}))
 		return
 	}
 	if !found {
-		glog.Errorf("StorageClass %q not found", claimClass)
+		logging.Error("StorageClass not found", fields.With(logging.Fields{"class": claimClass}))
 		return
 	}
 	storageClass, ok := classObj.(*v1beta1.StorageClass)
 	if !ok {
-		glog.Errorf("Cannot convert object to StorageClass: %+v", classObj)
+		logging.Error(fmt.Sprintf("cannot convert object to StorageClass: %+v", classObj), fields)
 		return
 	}
 
@@ -338,34 +533,57 @@ func (ctrl *ProvisionController) provisionClaimOperation(claim *v1.PersistentVol
 		PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
 		PVName:     pvName,
 		Parameters: storageClass.Parameters,
+		Selector:   claim.Spec.Selector,
+		PVC:        claim,
+		Span:       span,
+	}
+
+	if validator, ok := ctrl.provisioner.(Validator); ok {
+		if err := validator.Validate(options); err != nil {
+			failures, delay := ctrl.provisionBackoff.failed(string(claim.UID))
+			strerr := fmt.Sprintf("Invalid claim or StorageClass %q, not provisioning volume: %v. Retrying in %v (attempt %d)", storageClass.Name, err, delay, failures)
+			logging.Error("invalid claim or StorageClass", fields.With(logging.Fields{"class": storageClass.Name, logging.Err: err}))
+			ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", strerr)
+			return
+		}
 	}
 
 	volume, err = ctrl.provisioner.Provision(options)
 	if err != nil {
-		strerr := fmt.Sprintf("Failed to provision volume with StorageClass %q: %v", storageClass.Name, err)
-		glog.Errorf("Failed to provision volume for claim %q with StorageClass %q: %v", claimToClaimKey(claim), claim.Name, err)
+		failures, delay := ctrl.provisionBackoff.failed(string(claim.UID))
+		strerr := fmt.Sprintf("Failed to provision volume with StorageClass %q: %v. Retrying in %v (attempt %d)", storageClass.Name, err, delay, failures)
+		logging.Error("failed to provision volume", fields.With(logging.Fields{"class": storageClass.Name, logging.Duration: time.Since(start), logging.Err: err}))
 		ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", strerr)
 		return
 	}
+	ctrl.provisionBackoff.reset(string(claim.UID))
 
-	glog.Infof("volume %q for claim %q created", volume.Name, claimToClaimKey(claim))
+	logging.Info("volume created", fields)
 
 	// Set ClaimRef and the PV controller will bind and set annBoundByController for us
 	volume.Spec.ClaimRef = claimRef
 
 	setAnnotation(&volume.ObjectMeta, annDynamicallyProvisioned, ctrl.provisionerName)
-	setAnnotation(&volume.ObjectMeta, annClass, claimClass)
+	setAnnotation(&volume.ObjectMeta, classAnnotation, claimClass)
 
 	// Try to create the PV object several times
 	for i := 0; i < ctrl.createProvisionedPVRetryCount; i++ {
-		glog.Infof("provisionClaimOperation [%s]: trying to save volume %s", claimToClaimKey(claim), volume.Name)
-		if _, err = ctrl.client.Core().PersistentVolumes().Create(volume); err == nil {
+		logging.Info("trying to save volume", fields)
+		var saved *v1.PersistentVolume
+		createSpan := tracing.Start("create PV", span)
+		saved, err = ctrl.client.Core().PersistentVolumes().Create(volume)
+		createSpan.Finish(err)
+		if err == nil {
 			// Save succeeded.
-			glog.Infof("volume %q for claim %q saved", volume.Name, claimToClaimKey(claim))
+			logging.Info("volume saved", fields)
+			ctrl.eventRecorder.Event(saved, v1.EventTypeNormal, "ProvisioningSucceeded", fmt.Sprintf("Successfully provisioned volume for claim %s with StorageClass %q", claimToClaimKey(claim), storageClass.Name))
+			if committer, ok := ctrl.provisioner.(Committer); ok {
+				committer.Commit(saved)
+			}
 			break
 		}
 		// Save failed, try again after a while.
-		glog.Infof("failed to save volume %q for claim %q: %v", volume.Name, claimToClaimKey(claim), err)
+		logging.Info("failed to save volume", fields.With(logging.Fields{logging.Err: err}))
 		time.Sleep(ctrl.createProvisionedPVInterval)
 	}
 
@@ -375,17 +593,17 @@ func (ctrl *ProvisionController) provisionClaimOperation(claim *v1.PersistentVol
 		// Emit some event here and try to delete the storage asset several
 		// times.
 		strerr := fmt.Sprintf("Error creating provisioned PV object for claim %s: %v. Deleting the volume.", claimToClaimKey(claim), err)
-		glog.Info(strerr)
+		logging.Error("error creating provisioned PV object, deleting the volume", fields.With(logging.Fields{logging.Err: err}))
 		ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", strerr)
 
 		for i := 0; i < ctrl.createProvisionedPVRetryCount; i++ {
 			if err = ctrl.provisioner.Delete(volume); err == nil {
 				// Delete succeeded
-				glog.Infof("provisionClaimOperation [%s]: cleaning volume %s succeeded", claimToClaimKey(claim), volume.Name)
+				logging.Info("cleaning volume succeeded", fields)
 				break
 			}
 			// Delete failed, try again after a while.
-			glog.Infof("failed to delete volume %q: %v", volume.Name, err)
+			logging.Info("failed to delete volume", fields.With(logging.Fields{logging.Err: err}))
 			time.Sleep(ctrl.createProvisionedPVInterval)
 		}
 
@@ -393,16 +611,20 @@ func (ctrl *ProvisionController) provisionClaimOperation(claim *v1.PersistentVol
 			// Delete failed several times. There is an orphaned volume and there
 			// is nothing we can do about it.
 			strerr := fmt.Sprintf("Error cleaning provisioned volume for claim %s: %v. Please delete manually.", claimToClaimKey(claim), err)
-			glog.Info(strerr)
+			logging.Error("error cleaning provisioned volume, please delete manually", fields.With(logging.Fields{logging.Duration: time.Since(start), logging.Err: err}))
 			ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningCleanupFailed", strerr)
 		}
 	} else {
-		glog.Infof("volume %q provisioned for claim %q", volume.Name, claimToClaimKey(claim))
+		logging.Info("volume provisioned", fields.With(logging.Fields{logging.Duration: time.Since(start)}))
 	}
 }
 
 func (ctrl *ProvisionController) deleteVolumeOperation(volume *v1.PersistentVolume) {
-	glog.Infof("deleteVolumeOperation [%s] started", volume.Name)
+	start := time.Now()
+	fields := volumeFields("delete", volume)
+	logging.Info("deleteVolumeOperation started", fields)
+	span := startVolumeSpan("delete", volume)
+	defer span.Finish(nil)
 
 	// This method may have been waiting for a volume lock for some time.
 	// Our check does not have to be as sophisticated as PV controller's, we can
@@ -410,36 +632,98 @@ func (ctrl *ProvisionController) deleteVolumeOperation(volume *v1.PersistentVolu
 	// ours to delete
 	newVolume, err := ctrl.client.Core().PersistentVolumes().Get(volume.Name)
 	if err != nil {
-		glog.Infof("error reading peristent volume %q: %v", volume.Name, err)
+		logging.Info("error reading persistent volume", fields.With(logging.Fields{logging.Err: err}))
 		return
 	}
 	if !ctrl.shouldDelete(newVolume) {
-		glog.Infof("volume %q no longer needs deletion, skipping", volume.Name)
+		logging.Info("volume no longer needs deletion, skipping", fields)
 		return
 	}
 
-	if err := ctrl.provisioner.Delete(volume); err != nil {
-		// Delete failed, emit an event.
-		glog.Infof("deletion of volume %q failed: %v", volume.Name, err)
-		ctrl.eventRecorder.Event(volume, v1.EventTypeWarning, "VolumeFailedDelete", err.Error())
+	deleteSpan := tracing.Start("Delete", span)
+	err = ctrl.provisioner.Delete(volume)
+	deleteSpan.Finish(err)
+	if err != nil {
+		// Delete failed, emit an event. The volume stays released, so it's
+		// retried once the backoff has passed.
+		failures, delay := ctrl.deleteBackoff.failed(volume.Name)
+		logging.Error("deletion of volume failed", fields.With(logging.Fields{logging.Duration: time.Since(start), logging.Err: err}))
+		ctrl.eventRecorder.Event(volume, v1.EventTypeWarning, "VolumeFailedDelete", fmt.Sprintf("%v. Retrying in %v (attempt %d)", err, delay, failures))
 		return
 	}
+	ctrl.deleteBackoff.reset(volume.Name)
 
-	glog.Infof("deleteVolumeOperation [%s]: success", volume.Name)
+	logging.Info("deleteVolumeOperation succeeded", fields.With(logging.Fields{logging.Duration: time.Since(start)}))
 	// Delete the volume
-	if err = ctrl.client.Core().PersistentVolumes().Delete(volume.Name, nil); err != nil {
+	deleteSpan = tracing.Start("delete PV", span)
+	err = ctrl.client.Core().PersistentVolumes().Delete(volume.Name, nil)
+	deleteSpan.Finish(err)
+	if err != nil {
 		// Oops, could not delete the volume and therefore the controller will
 		// try to delete the volume again on next update.
-		glog.Infof("failed to delete volume %q from database: %v", volume.Name, err)
+		logging.Info("failed to delete volume from database", fields.With(logging.Fields{logging.Err: err}))
 		return
 	}
 
 	return
 }
 
-// getProvisionedVolumeNameForClaim returns PV.Name for the provisioned volume.
+func (ctrl *ProvisionController) updateVolumeOperation(updater Updater, volume *v1.PersistentVolume) {
+	start := time.Now()
+	fields := volumeFields("update", volume)
+	logging.Info("updateVolumeOperation started", fields)
+	span := startVolumeSpan("update", volume)
+	defer span.Finish(nil)
+
+	// Update the storage asset to match the latest version of the volume, which
+	// may have changed again while this method was waiting
+	newVolume, err := ctrl.client.Core().PersistentVolumes().Get(volume.Name)
+	if err != nil {
+		logging.Info("error reading persistent volume", fields.With(logging.Fields{logging.Err: err}))
+		return
+	}
+
+	updateSpan := tracing.Start("Update", span)
+	err = updater.Update(newVolume)
+	updateSpan.Finish(err)
+	if err != nil {
+		// Update failed, emit an event.
+		logging.Error("update of volume failed", fields.With(logging.Fields{logging.Duration: time.Since(start), logging.Err: err}))
+		ctrl.eventRecorder.Event(newVolume, v1.EventTypeWarning, "VolumeFailedUpdate", err.Error())
+		return
+	}
+
+	logging.Info("updateVolumeOperation succeeded", fields.With(logging.Fields{logging.Duration: time.Since(start)}))
+}
+
+// startVolumeSpan starts the root span of the given operation on the given
+// volume, tagged like volumeFields.
+func startVolumeSpan(operation string, volume *v1.PersistentVolume) *tracing.Span {
+	span := tracing.Start(operation, nil)
+	for k, v := range volumeFields(operation, volume) {
+		span.SetTag(k, fmt.Sprint(v))
+	}
+	return span
+}
+
+// volumeFields returns the fields to log messages about the given operation on
+// the given volume with: the volume and, if it's bound, its claim.
+func volumeFields(operation string, volume *v1.PersistentVolume) logging.Fields {
+	fields := logging.Fields{logging.Operation: operation, logging.PV: volume.Name}
+	if ref := volume.Spec.ClaimRef; ref != nil {
+		fields[logging.PVC] = ref.Name
+		fields[logging.Namespace] = ref.Namespace
+	}
+	return fields
+}
+
+// getProvisionedVolumeNameForClaim returns PV.Name for the provisioned volume:
+// the one the provisioner names it, if it's a Namer, or else pvc-<claim UID>.
 // The name must be unique.
 func (ctrl *ProvisionController) getProvisionedVolumeNameForClaim(claim *v1.PersistentVolumeClaim) string {
+	if namer, ok := ctrl.provisioner.(Namer); ok {
+		return namer.VolumeName(claim)
+	}
 	return "pvc-" + string(claim.UID)
 }
 
@@ -448,10 +732,10 @@ func (ctrl *ProvisionController) getProvisionedVolumeNameForClaim(claim *v1.Pers
 func (ctrl *ProvisionController) scheduleOperation(operationName string, operation func() error) {
 	glog.Infof("scheduleOperation[%s]", operationName)
 
-	err := ctrl.runningOperations.Run(operationName, operation)
+	err := ctrl.runningOperations.Add(operationName, operation)
 	if err != nil {
-		if goroutinemap.IsAlreadyExists(err) {
-			glog.Infof("operation %q is already running, skipping", operationName)
+		if isAlreadyExists(err) {
+			glog.Infof("operation %q is already queued or running, skipping", operationName)
 		} else {
 			glog.Errorf("error scheduling operaion %q: %v", operationName, err)
 		}
@@ -470,17 +754,39 @@ func setAnnotation(obj *v1.ObjectMeta, ann string, value string) {
 	obj.Annotations[ann] = value
 }
 
-// getClaimClass returns name of class that is requested by given claim.
-// Request for `nil` class is interpreted as request for class "",
-// i.e. for a classless PV.
-func getClaimClass(claim *v1.PersistentVolumeClaim) string {
+// getClaimClass returns the annotation with which the given claim requests a
+// class and the name of the class. If the claim has none of the annotations
+// the controller looks at, the returned annotation is the first of them and
+// the class is empty.
+func (ctrl *ProvisionController) getClaimClass(claim *v1.PersistentVolumeClaim) (string, string) {
 	// TODO: change to PersistentVolumeClaim.Spec.Class value when this
 	// attribute is introduced.
-	if class, found := claim.Annotations[annClass]; found {
-		return class
+	for _, ann := range ctrl.classAnnotations {
+		if class, found := claim.Annotations[ann]; found {
+			return ann, class
+		}
 	}
 
-	return ""
+	if len(ctrl.classAnnotations) == 0 {
+		return annClass, ""
+	}
+	return ctrl.classAnnotations[0], ""
+}
+
+// ParseClassAnnotations parses which annotations a claim may request its class
+// with: "beta" for volume.beta.kubernetes.io/storage-class, "alpha" for
+// volume.alpha.kubernetes.io/storage-class, or "both", in which case beta
+// takes precedence.
+func ParseClassAnnotations(s string) ([]string, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "beta":
+		return []string{annClass}, nil
+	case "alpha":
+		return []string{annAlphaClass}, nil
+	case "both":
+		return []string{annClass, annAlphaClass}, nil
+	}
+	return nil, fmt.Errorf("invalid class annotations %q, must be beta, alpha or both", s)
 }
 
 func claimToClaimKey(claim *v1.PersistentVolumeClaim) string {
@@ -18,7 +18,9 @@ package controller
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -119,6 +121,28 @@ func TestController(t *testing.T) {
 			provisioner:     newBadTestProvisioner(),
 			expectedVolumes: []v1.PersistentVolume(nil),
 		},
+		{
+			name: "provisioner rejects claim-1: provision isn't called",
+			objs: []runtime.Object{
+				newStorageClass("class-1", "foo.bar/baz"),
+				newClaim("claim-1", "uid-1-1", "class-1", ""),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     &invalidTestProvisioner{},
+			expectedVolumes: []v1.PersistentVolume(nil),
+		},
+		{
+			name: "provision for claim-1 with the name the provisioner names it",
+			objs: []runtime.Object{
+				newStorageClass("class-1", "foo.bar/baz"),
+				newClaim("claim-1", "uid-1-1", "class-1", ""),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     &namingTestProvisioner{},
+			expectedVolumes: []v1.PersistentVolume{
+				*withName(newProvisionedVolume(newStorageClass("class-1", "foo.bar/baz"), newClaim("claim-1", "uid-1-1", "class-1", "")), "claim-1-uid-1-1"),
+			},
+		},
 		{
 			name: "provisioner fails to delete volume-1: pv is not deleted",
 			objs: []runtime.Object{
@@ -168,7 +192,7 @@ func TestController(t *testing.T) {
 			}
 		}
 		resyncPeriod := 100 * time.Millisecond
-		ctrl := NewProvisionController(client, resyncPeriod, test.provisionerName, test.provisioner)
+		ctrl := NewProvisionController(client, resyncPeriod, 0, test.provisionerName, nil, []string{annClass}, test.provisioner, 2)
 
 		ctrl.createProvisionedPVInterval = 10 * time.Millisecond
 
@@ -187,10 +211,145 @@ func TestController(t *testing.T) {
 	}
 }
 
+func TestFullResync(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	resyncPeriod := 100 * time.Millisecond
+	ctrl := NewProvisionController(client, resyncPeriod, resyncPeriod, "foo.bar/baz", nil, []string{annClass}, newTestProvisioner(), 2)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go ctrl.Run(stopCh)
+	time.Sleep(2 * resyncPeriod)
+
+	// The fake watches never send events, so the informers and reflector
+	// won't know about objects created after they've listed, as if the watch
+	// events were missed
+	if _, err := client.Storage().StorageClasses().Create(newStorageClass("class-1", "foo.bar/baz")); err != nil {
+		t.Fatalf("error creating class: %v", err)
+	}
+	if _, err := client.Core().PersistentVolumeClaims(v1.NamespaceDefault).Create(newClaim("claim-1", "uid-1-1", "class-1", "")); err != nil {
+		t.Fatalf("error creating claim: %v", err)
+	}
+	if _, err := client.Core().PersistentVolumes().Create(newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz"})); err != nil {
+		t.Fatalf("error creating volume: %v", err)
+	}
+
+	time.Sleep(3 * resyncPeriod)
+	ctrl.runningOperations.Wait()
+
+	expectedVolumes := []v1.PersistentVolume{
+		*newProvisionedVolume(newStorageClass("class-1", "foo.bar/baz"), newClaim("claim-1", "uid-1-1", "class-1", "")),
+	}
+	pvList, _ := client.Core().PersistentVolumes().List(api.ListOptions{})
+	if !reflect.DeepEqual(expectedVolumes, pvList.Items) {
+		t.Errorf("expected PVs:\n %v\n but got:\n %v\n", expectedVolumes, pvList.Items)
+	}
+}
+
+func TestGetClaimClass(t *testing.T) {
+	tests := []struct {
+		name               string
+		classAnnotations   []string
+		annotations        map[string]string
+		expectedAnnotation string
+		expectedClass      string
+	}{
+		{
+			name:               "beta",
+			classAnnotations:   []string{annClass},
+			annotations:        map[string]string{annClass: "class-1", annAlphaClass: "class-2"},
+			expectedAnnotation: annClass,
+			expectedClass:      "class-1",
+		},
+		{
+			name:               "alpha",
+			classAnnotations:   []string{annAlphaClass},
+			annotations:        map[string]string{annClass: "class-1", annAlphaClass: "class-2"},
+			expectedAnnotation: annAlphaClass,
+			expectedClass:      "class-2",
+		},
+		{
+			name:               "both, beta takes precedence",
+			classAnnotations:   []string{annClass, annAlphaClass},
+			annotations:        map[string]string{annClass: "class-1", annAlphaClass: "class-2"},
+			expectedAnnotation: annClass,
+			expectedClass:      "class-1",
+		},
+		{
+			name:               "both, only alpha",
+			classAnnotations:   []string{annClass, annAlphaClass},
+			annotations:        map[string]string{annAlphaClass: "class-2"},
+			expectedAnnotation: annAlphaClass,
+			expectedClass:      "class-2",
+		},
+		{
+			name:               "beta, only alpha",
+			classAnnotations:   []string{annClass},
+			annotations:        map[string]string{annAlphaClass: "class-2"},
+			expectedAnnotation: annClass,
+			expectedClass:      "",
+		},
+	}
+	for _, test := range tests {
+		client := fake.NewSimpleClientset()
+		ctrl := NewProvisionController(client, 100*time.Millisecond, 0, "foo.bar/baz", nil, test.classAnnotations, newTestProvisioner(), 2)
+		claim := newClaim("claim-1", "1-1", "", "")
+		claim.Annotations = test.annotations
+
+		annotation, class := ctrl.getClaimClass(claim)
+		if test.expectedAnnotation != annotation || test.expectedClass != class {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected annotation %q and class %q but got %q and %q\n", test.expectedAnnotation, test.expectedClass, annotation, class)
+		}
+	}
+}
+
+func TestParseClassAnnotations(t *testing.T) {
+	tests := []struct {
+		name                string
+		s                   string
+		expectedAnnotations []string
+		expectError         bool
+	}{
+		{
+			name:                "beta",
+			s:                   "beta",
+			expectedAnnotations: []string{annClass},
+		},
+		{
+			name:                "alpha",
+			s:                   "Alpha",
+			expectedAnnotations: []string{annAlphaClass},
+		},
+		{
+			name:                "both",
+			s:                   "both",
+			expectedAnnotations: []string{annClass, annAlphaClass},
+		},
+		{
+			name:        "invalid",
+			s:           "gamma",
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		annotations, err := ParseClassAnnotations(test.s)
+		if test.expectError != (err != nil) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected error %v but got %v\n", test.expectError, err)
+		}
+		if !test.expectError && !reflect.DeepEqual(test.expectedAnnotations, annotations) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected annotations %v but got %v\n", test.expectedAnnotations, annotations)
+		}
+	}
+}
+
 func TestShouldProvision(t *testing.T) {
 	tests := []struct {
 		name            string
 		provisionerName string
+		aliases         []string
 		class           *v1beta1.StorageClass
 		claim           *v1.PersistentVolumeClaim
 		expectedShould  bool
@@ -223,12 +382,20 @@ func TestShouldProvision(t *testing.T) {
 			claim:           newClaim("claim-1", "1-1", "class-1", ""),
 			expectedShould:  false,
 		},
+		{
+			name:            "class requests an alias",
+			provisionerName: "foo.bar/baz",
+			aliases:         []string{"foo.bar/old", "abc.def/ghi"},
+			class:           newStorageClass("class-1", "abc.def/ghi"),
+			claim:           newClaim("claim-1", "1-1", "class-1", ""),
+			expectedShould:  true,
+		},
 	}
 	for _, test := range tests {
 		client := fake.NewSimpleClientset(test.claim)
 		resyncPeriod := 100 * time.Millisecond
 		provisioner := newTestProvisioner()
-		ctrl := NewProvisionController(client, resyncPeriod, test.provisionerName, provisioner)
+		ctrl := NewProvisionController(client, resyncPeriod, 0, test.provisionerName, test.aliases, []string{annClass}, provisioner, 2)
 
 		err := ctrl.classes.Add(test.class)
 		if err != nil {
@@ -248,6 +415,7 @@ func TestShouldDelete(t *testing.T) {
 	tests := []struct {
 		name            string
 		provisionerName string
+		aliases         []string
 		volume          *v1.PersistentVolume
 		expectedShould  bool
 	}{
@@ -276,12 +444,19 @@ func TestShouldDelete(t *testing.T) {
 			volume:          newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "abc.def/ghi"}),
 			expectedShould:  false,
 		},
+		{
+			name:            "provisioned under an alias",
+			provisionerName: "foo.bar/baz",
+			aliases:         []string{"abc.def/ghi"},
+			volume:          newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "abc.def/ghi"}),
+			expectedShould:  true,
+		},
 	}
 	for _, test := range tests {
 		client := fake.NewSimpleClientset()
 		resyncPeriod := 100 * time.Millisecond
 		provisioner := newTestProvisioner()
-		ctrl := NewProvisionController(client, resyncPeriod, test.provisionerName, provisioner)
+		ctrl := NewProvisionController(client, resyncPeriod, 0, test.provisionerName, test.aliases, []string{annClass}, provisioner, 2)
 
 		should := ctrl.shouldDelete(test.volume)
 		if test.expectedShould != should {
@@ -291,6 +466,189 @@ func TestShouldDelete(t *testing.T) {
 	}
 }
 
+func TestShouldUpdate(t *testing.T) {
+	tests := []struct {
+		name            string
+		provisionerName string
+		oldVolume       *v1.PersistentVolume
+		volume          *v1.PersistentVolume
+		expectedShould  bool
+	}{
+		{
+			name:            "should update",
+			provisionerName: "foo.bar/baz",
+			oldVolume:       newVolume("volume-1", v1.VolumeBound, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz"}),
+			volume:          newVolume("volume-1", v1.VolumeBound, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz", "foo": "bar"}),
+			expectedShould:  true,
+		},
+		{
+			name:            "resync",
+			provisionerName: "foo.bar/baz",
+			oldVolume:       newVolume("volume-1", v1.VolumeBound, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz"}),
+			volume:          newVolume("volume-1", v1.VolumeBound, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz"}),
+			expectedShould:  false,
+		},
+		{
+			name:            "not this provisioner's job",
+			provisionerName: "foo.bar/baz",
+			oldVolume:       newVolume("volume-1", v1.VolumeBound, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "abc.def/ghi"}),
+			volume:          newVolume("volume-1", v1.VolumeBound, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "abc.def/ghi", "foo": "bar"}),
+			expectedShould:  false,
+		},
+	}
+	for _, test := range tests {
+		client := fake.NewSimpleClientset()
+		resyncPeriod := 100 * time.Millisecond
+		provisioner := newTestProvisioner()
+		ctrl := NewProvisionController(client, resyncPeriod, 0, test.provisionerName, nil, []string{annClass}, provisioner, 2)
+
+		should := ctrl.shouldUpdate(test.oldVolume, test.volume)
+		if test.expectedShould != should {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected should update %v but got %v\n", test.expectedShould, should)
+		}
+	}
+}
+
+func TestProvisionBackoff(t *testing.T) {
+	b := newProvisionBackoff(100*time.Millisecond, 300*time.Millisecond)
+
+	if ok, _ := b.safeToRetry("uid-1"); !ok {
+		t.Errorf("expected safe to retry before any failure")
+	}
+
+	// Delays double up to the max, plus up to provisionRetryJitter of jitter
+	expectedDelays := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}
+	for i, expected := range expectedDelays {
+		failures, delay := b.failed("uid-1")
+		if failures != i+1 {
+			t.Errorf("expected %d failures but got %d", i+1, failures)
+		}
+		if delay < expected || delay > time.Duration(float64(expected)*(1+provisionRetryJitter)) {
+			t.Errorf("expected delay %v plus jitter but got %v", expected, delay)
+		}
+	}
+	if ok, _ := b.safeToRetry("uid-1"); ok {
+		t.Errorf("expected not safe to retry right after a failure")
+	}
+	if ok, _ := b.safeToRetry("uid-2"); !ok {
+		t.Errorf("expected failures of one claim not to affect another")
+	}
+
+	b.reset("uid-1")
+	if ok, _ := b.safeToRetry("uid-1"); !ok {
+		t.Errorf("expected safe to retry after reset")
+	}
+}
+
+func TestDeleteBackoff(t *testing.T) {
+	client := fake.NewSimpleClientset(newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz"}))
+	resyncPeriod := 100 * time.Millisecond
+	provisioner := &countingTestProvisioner{}
+	ctrl := NewProvisionController(client, resyncPeriod, 0, "foo.bar/baz", nil, []string{annClass}, provisioner, 2)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go ctrl.Run(stopCh)
+	time.Sleep(5 * resyncPeriod)
+	ctrl.runningOperations.Wait()
+
+	// The failed delete mustn't be retried on every resync
+	if deletes := provisioner.getDeletes(); deletes != 1 {
+		t.Errorf("expected 1 delete before the backoff passed but got %d", deletes)
+	}
+	if ok, _ := ctrl.deleteBackoff.safeToRetry("volume-1"); ok {
+		t.Errorf("expected not safe to retry right after a failed delete")
+	}
+
+	ctrl.deleteVolume(newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, nil))
+	if ok, _ := ctrl.deleteBackoff.safeToRetry("volume-1"); !ok {
+		t.Errorf("expected safe to retry after the volume was deleted")
+	}
+}
+
+func TestOperationQueue(t *testing.T) {
+	q := newOperationQueue()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	var lock sync.Mutex
+	running, maxRunning, ran := 0, 0, 0
+	operation := func() error {
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		lock.Lock()
+		running--
+		ran++
+		lock.Unlock()
+		return nil
+	}
+
+	for i := 0; i < 6; i++ {
+		if err := q.Add(fmt.Sprintf("op-%d", i), operation); err != nil {
+			t.Errorf("unexpected error adding operation: %v", err)
+		}
+	}
+	if err := q.Add("op-0", operation); !isAlreadyExists(err) {
+		t.Errorf("expected already exists error adding duplicate operation but got %v", err)
+	}
+
+	q.Run(2, stopCh)
+	q.Wait()
+
+	if ran != 6 {
+		t.Errorf("expected 6 operations to run but %d did", ran)
+	}
+	if maxRunning > 2 {
+		t.Errorf("expected at most 2 operations to run at once but %d did", maxRunning)
+	}
+}
+
+func TestOperationQueueShutdown(t *testing.T) {
+	q := newOperationQueue()
+	stopCh := make(chan struct{})
+
+	started := make(chan struct{})
+	var lock sync.Mutex
+	ran := 0
+	operation := func() error {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		lock.Lock()
+		ran++
+		lock.Unlock()
+		return nil
+	}
+	q.Add("op-0", operation)
+	q.Add("op-1", func() error {
+		lock.Lock()
+		ran++
+		lock.Unlock()
+		return nil
+	})
+
+	q.Run(1, stopCh)
+	<-started
+	queued, running := q.List()
+	if !reflect.DeepEqual(queued, []string{"op-1"}) || !reflect.DeepEqual(running, []string{"op-0"}) {
+		t.Errorf("expected op-1 queued and op-0 running but got %v and %v", queued, running)
+	}
+	close(stopCh)
+	q.WaitForRunning()
+
+	// The running operation finished and the queued one was never started
+	lock.Lock()
+	defer lock.Unlock()
+	if ran != 1 {
+		t.Errorf("expected 1 operation to run but %d did", ran)
+	}
+}
+
 func newStorageClass(name, provisioner string) *v1beta1.StorageClass {
 	return &v1beta1.StorageClass{
 		ObjectMeta: v1.ObjectMeta{
@@ -379,6 +737,12 @@ func newProvisionedVolume(storageClass *v1beta1.StorageClass, claim *v1.Persiste
 	return volume
 }
 
+// withName returns the given volume renamed to the given name.
+func withName(volume *v1.PersistentVolume, name string) *v1.PersistentVolume {
+	volume.Name = name
+	return volume
+}
+
 func newTestProvisioner() Provisioner {
 	return &testProvisioner{}
 }
@@ -432,3 +796,48 @@ func (p *badTestProvisioner) Provision(options VolumeOptions) (*v1.PersistentVol
 func (p *badTestProvisioner) Delete(volume *v1.PersistentVolume) error {
 	return errors.New("fake error")
 }
+
+// invalidTestProvisioner rejects every volume's options, but would provision
+// them if asked to.
+type invalidTestProvisioner struct {
+	testProvisioner
+}
+
+var _ Validator = &invalidTestProvisioner{}
+
+func (p *invalidTestProvisioner) Validate(options VolumeOptions) error {
+	return errors.New("fake error")
+}
+
+// namingTestProvisioner names volumes after their claims.
+type namingTestProvisioner struct {
+	testProvisioner
+}
+
+var _ Namer = &namingTestProvisioner{}
+
+func (p *namingTestProvisioner) VolumeName(claim *v1.PersistentVolumeClaim) string {
+	return claim.Name + "-" + string(claim.UID)
+}
+
+// countingTestProvisioner fails to delete volumes, counting the attempts.
+type countingTestProvisioner struct {
+	badTestProvisioner
+	lock    sync.Mutex
+	deletes int
+}
+
+var _ Provisioner = &countingTestProvisioner{}
+
+func (p *countingTestProvisioner) Delete(volume *v1.PersistentVolume) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.deletes++
+	return errors.New("fake error")
+}
+
+func (p *countingTestProvisioner) getDeletes() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.deletes
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// operationQueue is a work queue of named operations that a fixed number of
+// workers run in the order they were added. An operation with the same name as
+// one that's already queued or running isn't added again.
+type operationQueue struct {
+	lock     sync.Mutex
+	cond     *sync.Cond
+	queue    []string
+	queued   map[string]func() error
+	running  map[string]bool
+	shutdown bool
+}
+
+func newOperationQueue() *operationQueue {
+	q := &operationQueue{
+		queued:  make(map[string]func() error),
+		running: make(map[string]bool),
+	}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+// errAlreadyExists is returned by Add if an operation with the same name is
+// already queued or running.
+type errAlreadyExists struct {
+	name string
+}
+
+func (err errAlreadyExists) Error() string {
+	return fmt.Sprintf("operation %q is already queued or running", err.name)
+}
+
+func isAlreadyExists(err error) bool {
+	_, ok := err.(errAlreadyExists)
+	return ok
+}
+
+// Add queues the given operation.
+func (q *operationQueue) Add(name string, operation func() error) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if _, ok := q.queued[name]; ok || q.running[name] {
+		return errAlreadyExists{name}
+	}
+	q.queue = append(q.queue, name)
+	q.queued[name] = operation
+	q.cond.Broadcast()
+	return nil
+}
+
+// Run starts the given number of workers, which run queued operations until
+// stopCh is closed.
+func (q *operationQueue) Run(workers int, stopCh <-chan struct{}) {
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	go func() {
+		<-stopCh
+		q.lock.Lock()
+		q.shutdown = true
+		q.cond.Broadcast()
+		q.lock.Unlock()
+	}()
+}
+
+func (q *operationQueue) work() {
+	for {
+		q.lock.Lock()
+		for len(q.queue) == 0 && !q.shutdown {
+			q.cond.Wait()
+		}
+		if q.shutdown {
+			q.lock.Unlock()
+			return
+		}
+		name := q.queue[0]
+		q.queue = q.queue[1:]
+		operation := q.queued[name]
+		delete(q.queued, name)
+		q.running[name] = true
+		q.lock.Unlock()
+
+		if err := operation(); err != nil {
+			glog.Errorf("operation %q failed with: %v", name, err)
+		}
+
+		q.lock.Lock()
+		delete(q.running, name)
+		q.cond.Broadcast()
+		q.lock.Unlock()
+	}
+}
+
+// List returns the names of the queued operations, in the order they'll run,
+// and of the running ones, sorted.
+func (q *operationQueue) List() ([]string, []string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	queued := append([]string{}, q.queue...)
+	running := []string{}
+	for name := range q.running {
+		running = append(running, name)
+	}
+	sort.Strings(running)
+	return queued, running
+}
+
+// Wait blocks until no operations are queued or running, or the queue is shut
+// down. This is typically necessary during tests - the test should wait until
+// all operations finish and evaluate results after that.
+func (q *operationQueue) Wait() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for (len(q.queue) != 0 || len(q.running) != 0) && !q.shutdown {
+		q.cond.Wait()
+	}
+}
+
+// WaitForRunning blocks until no operations are running. Once the queue is
+// shut down, queued operations are never run, so it waits only for the ones
+// that were running.
+func (q *operationQueue) WaitForRunning() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for len(q.running) != 0 {
+		q.cond.Wait()
+	}
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package controller
 
 import (
+	"github.com/wongma7/nfs-provisioner/tracing"
 	"k8s.io/client-go/1.4/pkg/api/resource"
 	"k8s.io/client-go/1.4/pkg/api/unversioned"
 	"k8s.io/client-go/1.4/pkg/api/v1"
@@ -31,10 +32,54 @@ type Provisioner interface {
 	// for the volume
 	Provision(VolumeOptions) (*v1.PersistentVolume, error)
 	// Delete removes the storage asset that was created by Provision backing the
-	// given PV. Does not delete the PV object itself.
+	// given PV. Does not delete the PV object itself, which the controller
+	// deletes once it succeeds. It is called for PVs this provisioner
+	// provisioned that are released or failed and have the Delete reclaim
+	// policy. If it fails, it's retried with exponential backoff for as long as
+	// the PV needs deleting, so it must be idempotent, e.g. succeed if the
+	// storage asset was already partly removed.
 	Delete(*v1.PersistentVolume) error
 }
 
+// Updater is an optional interface a Provisioner can implement to update the
+// storage asset backing a PV it created when the PV object changes, e.g. its
+// annotations are edited.
+type Updater interface {
+	// Update makes the storage asset backing the given PV match the PV. It must
+	// be idempotent since it may be called with a PV that already matches.
+	Update(*v1.PersistentVolume) error
+}
+
+// Validator is an optional interface a Provisioner can implement to reject the
+// options of a volume it can't provision before Provision is called, e.g.
+// because the class has a parameter it doesn't support, so that it doesn't
+// have to undo side effects of Provision like half-created storage assets.
+type Validator interface {
+	// Validate returns why a volume can't be provisioned for the given options,
+	// or nil if it may be. It must not have side effects. It's called again
+	// whenever provisioning is retried, since e.g. a Secret the class refers to
+	// may have been created meanwhile.
+	Validate(VolumeOptions) error
+}
+
+// Committer is an optional interface a Provisioner can implement to be told
+// when the PV of a volume it provisioned has been created, e.g. so that it can
+// stop tracking the volume as half-created.
+type Committer interface {
+	// Commit is called with the PV once it has been created.
+	Commit(*v1.PersistentVolume)
+}
+
+// Namer is an optional interface a Provisioner can implement to name the PVs
+// it provisions, e.g. after their claims, instead of pvc-<claim UID>.
+type Namer interface {
+	// VolumeName returns the name of the PV to provision for the given claim.
+	// It must always return the same name for the same claim, since the
+	// controller checks whether the claim's PV already exists by its name, and
+	// different names for different claims, e.g. by including the claim's UID.
+	VolumeName(*v1.PersistentVolumeClaim) string
+}
+
 // VolumeOptions contains option information about a volume
 // https://github.com/kubernetes/kubernetes/blob/release-1.4/pkg/volume/plugins.go
 type VolumeOptions struct {
@@ -51,4 +96,9 @@ type VolumeOptions struct {
 	Parameters map[string]string
 	// Volume selector from PersistentVolumeClaim
 	Selector *unversioned.LabelSelector
+	// PVC is the claim the volume is being provisioned for
+	PVC *v1.PersistentVolumeClaim
+	// Span is the span of the provision operation, for the provisioner to trace
+	// its own under. Nil if tracing is off.
+	Span *tracing.Span
 }
@@ -0,0 +1,269 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package election elects one of several provisioner replicas sharing the
+// backing storage as the leader, which serves NFS, by holding a lease recorded
+// in an annotation of the Endpoints of the provisioner's service. The leader
+// also points the Endpoints at itself, so the service must have no selector.
+package election
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/kubernetes"
+	"k8s.io/client-go/1.4/pkg/api/errors"
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/util/wait"
+)
+
+// LeaderAnnotation is the annotation of the Endpoints the lease is recorded
+// in, the same one Kubernetes components' leader election uses.
+const LeaderAnnotation = "control-plane.alpha.kubernetes.io/leader"
+
+// record is the lease recorded in LeaderAnnotation.
+type record struct {
+	HolderIdentity       string           `json:"holderIdentity"`
+	LeaseDurationSeconds int              `json:"leaseDurationSeconds"`
+	AcquireTime          unversioned.Time `json:"acquireTime"`
+	RenewTime            unversioned.Time `json:"renewTime"`
+	LeaderTransitions    int              `json:"leaderTransitions"`
+}
+
+// Elector acquires and renews the lease of an identity, e.g. a pod name.
+type Elector struct {
+	client        kubernetes.Interface
+	namespace     string
+	name          string
+	identity      string
+	leaseDuration time.Duration
+
+	// The address and ports the leader sets as the Endpoints' only subset
+	address string
+	ports   []v1.EndpointPort
+
+	// The last record seen and when it was seen. Leases expire leaseDuration
+	// after they were last seen renewed, by the local clock, so that the
+	// replicas' clocks needn't agree.
+	observed     record
+	observedTime time.Time
+
+	now func() time.Time
+}
+
+// NewElector returns an elector of the given identity for the lease in the
+// given Endpoints, which the leader points at the given address and ports.
+func NewElector(client kubernetes.Interface, namespace, name, identity string, leaseDuration time.Duration, address string, ports []v1.EndpointPort) *Elector {
+	return &Elector{
+		client:        client,
+		namespace:     namespace,
+		name:          name,
+		identity:      identity,
+		leaseDuration: leaseDuration,
+		address:       address,
+		ports:         ports,
+		now:           time.Now,
+	}
+}
+
+// EndpointPorts returns the ports the given service's Endpoints should have:
+// its ports' target ports, or the ports themselves if the target ports aren't
+// numbers.
+func EndpointPorts(service *v1.Service) []v1.EndpointPort {
+	ports := []v1.EndpointPort{}
+	for _, port := range service.Spec.Ports {
+		target := port.TargetPort.IntValue()
+		if target == 0 {
+			target = int(port.Port)
+		}
+		ports = append(ports, v1.EndpointPort{Name: port.Name, Port: int32(target), Protocol: port.Protocol})
+	}
+	return ports
+}
+
+// Acquire blocks until the lease is acquired, trying every retryPeriod, and
+// returns true, or until stopCh is closed and returns false.
+func (e *Elector) Acquire(retryPeriod time.Duration, stopCh <-chan struct{}) bool {
+	for {
+		acquired, err := e.tryAcquireOrRenew()
+		if err != nil {
+			glog.Errorf("error acquiring leader lease %s/%s: %v", e.namespace, e.name, err)
+		}
+		if acquired {
+			glog.Infof("acquired leader lease %s/%s as %s", e.namespace, e.name, e.identity)
+			return true
+		}
+		select {
+		case <-stopCh:
+			return false
+		case <-time.After(retryPeriod):
+		}
+	}
+}
+
+// Renew renews the lease every retryPeriod until stopCh is closed. If it
+// fails to for leaseDuration less retryPeriod, so before a standby can have
+// seen the lease expire, it calls onLost, which should stop serving
+// immediately.
+func (e *Elector) Renew(retryPeriod time.Duration, onLost func(), stopCh <-chan struct{}) {
+	renewed := e.now()
+	wait.Until(func() {
+		ok, err := e.tryAcquireOrRenew()
+		if err != nil {
+			glog.Errorf("error renewing leader lease %s/%s: %v", e.namespace, e.name, err)
+		}
+		if ok {
+			renewed = e.now()
+		} else if e.now().Sub(renewed) >= e.leaseDuration-retryPeriod {
+			onLost()
+		}
+	}, retryPeriod, stopCh)
+}
+
+// Release gives up the lease so that a standby can take over without waiting
+// for it to expire. It must be called once the leader has stopped serving.
+func (e *Elector) Release() error {
+	endpoints, err := e.client.Core().Endpoints(e.namespace).Get(e.name)
+	if err != nil {
+		return fmt.Errorf("error getting endpoints %s/%s: %v", e.namespace, e.name, err)
+	}
+	current, err := getRecord(endpoints)
+	if err != nil || current.HolderIdentity != e.identity {
+		return err
+	}
+	current.HolderIdentity = ""
+	current.LeaseDurationSeconds = 1
+	if err := setRecord(endpoints, current); err != nil {
+		return err
+	}
+	if _, err := e.client.Core().Endpoints(e.namespace).Update(endpoints); err != nil {
+		return fmt.Errorf("error updating endpoints %s/%s: %v", e.namespace, e.name, err)
+	}
+	return nil
+}
+
+// tryAcquireOrRenew records the lease as held by the identity, pointing the
+// Endpoints at the address, unless another identity holds a lease that hasn't
+// expired. It returns whether the identity holds the lease.
+func (e *Elector) tryAcquireOrRenew() (bool, error) {
+	now := e.now()
+	mine := record{
+		HolderIdentity:       e.identity,
+		LeaseDurationSeconds: int(e.leaseDuration / time.Second),
+		AcquireTime:          unversioned.NewTime(now),
+		RenewTime:            unversioned.NewTime(now),
+	}
+
+	endpoints, err := e.client.Core().Endpoints(e.namespace).Get(e.name)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return false, fmt.Errorf("error getting endpoints %s/%s: %v", e.namespace, e.name, err)
+		}
+		endpoints = &v1.Endpoints{ObjectMeta: v1.ObjectMeta{Namespace: e.namespace, Name: e.name}}
+		if err := e.claim(endpoints, mine); err != nil {
+			return false, err
+		}
+		if _, err := e.client.Core().Endpoints(e.namespace).Create(endpoints); err != nil {
+			return false, fmt.Errorf("error creating endpoints %s/%s: %v", e.namespace, e.name, err)
+		}
+		e.observe(mine, now)
+		return true, nil
+	}
+
+	current, err := getRecord(endpoints)
+	if err != nil {
+		return false, err
+	}
+	if !sameRecord(current, e.observed) {
+		e.observe(current, now)
+	}
+	if current.HolderIdentity != "" && current.HolderIdentity != e.identity &&
+		e.observedTime.Add(time.Duration(current.LeaseDurationSeconds)*time.Second).After(now) {
+		return false, nil
+	}
+
+	if current.HolderIdentity == e.identity {
+		mine.AcquireTime = current.AcquireTime
+		mine.LeaderTransitions = current.LeaderTransitions
+	} else {
+		mine.LeaderTransitions = current.LeaderTransitions + 1
+	}
+	if err := e.claim(endpoints, mine); err != nil {
+		return false, err
+	}
+	// The update fails with a conflict if another replica changed the
+	// Endpoints since they were gotten, so only one can take over
+	if _, err := e.client.Core().Endpoints(e.namespace).Update(endpoints); err != nil {
+		return false, fmt.Errorf("error updating endpoints %s/%s: %v", e.namespace, e.name, err)
+	}
+	e.observe(mine, now)
+	return true, nil
+}
+
+// claim sets the given record on the given Endpoints and, if the elector has
+// an address, points them at it.
+func (e *Elector) claim(endpoints *v1.Endpoints, r record) error {
+	if err := setRecord(endpoints, r); err != nil {
+		return err
+	}
+	if e.address != "" {
+		endpoints.Subsets = []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: e.address}},
+			Ports:     e.ports,
+		}}
+	}
+	return nil
+}
+
+// sameRecord returns whether the given records are of the same renewal of the
+// same holder's lease.
+func sameRecord(a, b record) bool {
+	return a.HolderIdentity == b.HolderIdentity && a.RenewTime.Equal(b.RenewTime) && a.LeaderTransitions == b.LeaderTransitions
+}
+
+func (e *Elector) observe(r record, t time.Time) {
+	e.observed = r
+	e.observedTime = t
+}
+
+// getRecord returns the record in the given Endpoints' LeaderAnnotation, or an
+// empty one if there is none.
+func getRecord(endpoints *v1.Endpoints) (record, error) {
+	var r record
+	ann, ok := endpoints.Annotations[LeaderAnnotation]
+	if !ok {
+		return r, nil
+	}
+	if err := json.Unmarshal([]byte(ann), &r); err != nil {
+		return record{}, fmt.Errorf("error decoding annotation %s of endpoints %s/%s: %v", LeaderAnnotation, endpoints.Namespace, endpoints.Name, err)
+	}
+	return r, nil
+}
+
+func setRecord(endpoints *v1.Endpoints, r record) error {
+	ann, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("error encoding annotation %s: %v", LeaderAnnotation, err)
+	}
+	if endpoints.Annotations == nil {
+		endpoints.Annotations = map[string]string{}
+	}
+	endpoints.Annotations[LeaderAnnotation] = string(ann)
+	return nil
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package election
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/util/intstr"
+)
+
+func TestElector(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	ports := []v1.EndpointPort{{Name: "nfs", Port: 2049, Protocol: v1.ProtocolTCP}}
+	now := time.Date(2016, 11, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	a := NewElector(client, "default", "nfs-provisioner", "a", 15*time.Second, "10.0.0.1", ports)
+	a.now = clock
+	b := NewElector(client, "default", "nfs-provisioner", "b", 15*time.Second, "10.0.0.2", ports)
+	b.now = clock
+
+	tests := []struct {
+		name      string
+		elector   *Elector
+		advance   time.Duration
+		expected  bool
+		holder    string
+		address   string
+		transited int
+	}{
+		{name: "a acquires missing endpoints", elector: a, expected: true, holder: "a", address: "10.0.0.1"},
+		{name: "b can't acquire held lease", elector: b, advance: 5 * time.Second, expected: false, holder: "a", address: "10.0.0.1"},
+		{name: "a renews", elector: a, advance: 5 * time.Second, expected: true, holder: "a", address: "10.0.0.1"},
+		// b first saw a's renewal now, so the lease expires 15s from now
+		{name: "b can't acquire renewed lease", elector: b, advance: 10 * time.Second, expected: false, holder: "a", address: "10.0.0.1"},
+		{name: "b acquires expired lease", elector: b, advance: 15 * time.Second, expected: true, holder: "b", address: "10.0.0.2", transited: 1},
+		{name: "a can't acquire b's lease", elector: a, expected: false, holder: "b", address: "10.0.0.2", transited: 1},
+	}
+	for _, test := range tests {
+		now = now.Add(test.advance)
+		acquired, err := test.elector.tryAcquireOrRenew()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if acquired != test.expected {
+			t.Errorf("%s: expected acquired %v, got %v", test.name, test.expected, acquired)
+		}
+		endpoints, _ := client.Core().Endpoints("default").Get("nfs-provisioner")
+		r, _ := getRecord(endpoints)
+		if r.HolderIdentity != test.holder || r.LeaderTransitions != test.transited {
+			t.Errorf("%s: expected holder %s with %d transitions, got %+v", test.name, test.holder, test.transited, r)
+		}
+		if len(endpoints.Subsets) != 1 || endpoints.Subsets[0].Addresses[0].IP != test.address {
+			t.Errorf("%s: expected endpoints pointing at %s, got %+v", test.name, test.address, endpoints.Subsets)
+		}
+	}
+
+	if err := b.Release(); err != nil {
+		t.Fatalf("unexpected error releasing: %v", err)
+	}
+	if acquired, _ := a.tryAcquireOrRenew(); !acquired {
+		t.Errorf("expected a to acquire released lease")
+	}
+}
+
+func TestEndpointPorts(t *testing.T) {
+	service := &v1.Service{Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+		{Name: "nfs", Port: 2049, Protocol: v1.ProtocolTCP},
+		{Name: "mountd", Port: 20048, TargetPort: intstr.FromInt(20049), Protocol: v1.ProtocolTCP},
+		{Name: "rpcbind", Port: 111, TargetPort: intstr.FromString("rpcbind"), Protocol: v1.ProtocolUDP},
+	}}}
+	expected := []v1.EndpointPort{
+		{Name: "nfs", Port: 2049, Protocol: v1.ProtocolTCP},
+		{Name: "mountd", Port: 20049, Protocol: v1.ProtocolTCP},
+		{Name: "rpcbind", Port: 111, Protocol: v1.ProtocolUDP},
+	}
+	got := EndpointPorts(service)
+	if len(got) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], got[i])
+		}
+	}
+}
@@ -0,0 +1,376 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package ganesha parses and serializes NFS Ganesha config files, so that
+// blocks can be added, updated, and removed structurally, and calls NFS
+// Ganesha's D-Bus methods.
+package ganesha
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Block is a named block, e.g. EXPORT { ... }, containing parameters, sub-blocks
+// and comments in the order they appear. A whole config file is represented by
+// a Block with an empty name.
+type Block struct {
+	Name    string
+	Entries []*Entry
+}
+
+// Entry is exactly one of a parameter, a sub-block, or a comment. Comments
+// include directives like %include, which are preserved verbatim.
+type Entry struct {
+	Param   *Param
+	Block   *Block
+	Comment string
+}
+
+// Param is a parameter, e.g. Export_Id = 1;
+type Param struct {
+	Key   string
+	Value string
+}
+
+// NewBlock returns a block with the given name and parameters, in the given
+// order. params must be key, value pairs.
+func NewBlock(name string, params ...string) *Block {
+	b := &Block{Name: name}
+	for i := 0; i+1 < len(params); i += 2 {
+		b.Set(params[i], params[i+1])
+	}
+	return b
+}
+
+// Get returns the value of the parameter with the given key. Keys are case
+// insensitive like in ganesha.
+func (b *Block) Get(key string) (string, bool) {
+	for _, e := range b.Entries {
+		if e.Param != nil && strings.EqualFold(e.Param.Key, key) {
+			return e.Param.Value, true
+		}
+	}
+	return "", false
+}
+
+// Set sets the value of the parameter with the given key, adding it if it
+// doesn't exist yet.
+func (b *Block) Set(key, value string) {
+	for _, e := range b.Entries {
+		if e.Param != nil && strings.EqualFold(e.Param.Key, key) {
+			e.Param.Value = value
+			return
+		}
+	}
+	b.Entries = append(b.Entries, &Entry{Param: &Param{Key: key, Value: value}})
+}
+
+// Unset removes the parameter with the given key, if it exists.
+func (b *Block) Unset(key string) {
+	for i, e := range b.Entries {
+		if e.Param != nil && strings.EqualFold(e.Param.Key, key) {
+			b.Entries = append(b.Entries[:i], b.Entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// Blocks returns the sub-blocks with the given name.
+func (b *Block) Blocks(name string) []*Block {
+	blocks := []*Block{}
+	for _, e := range b.Entries {
+		if e.Block != nil && strings.EqualFold(e.Block.Name, name) {
+			blocks = append(blocks, e.Block)
+		}
+	}
+	return blocks
+}
+
+// AddBlock appends the given sub-block.
+func (b *Block) AddBlock(block *Block) {
+	b.Entries = append(b.Entries, &Entry{Block: block})
+}
+
+// RemoveBlocks removes the sub-blocks for which match returns true and
+// returns how many were removed.
+func (b *Block) RemoveBlocks(match func(*Block) bool) int {
+	removed := 0
+	entries := b.Entries[:0]
+	for _, e := range b.Entries {
+		if e.Block != nil && match(e.Block) {
+			removed++
+			continue
+		}
+		entries = append(entries, e)
+	}
+	b.Entries = entries
+	return removed
+}
+
+// Exports returns the EXPORT sub-blocks.
+func (b *Block) Exports() []*Block {
+	return b.Blocks("EXPORT")
+}
+
+// ExportId returns the Export_Id of an EXPORT block.
+func (b *Block) ExportId() (uint16, error) {
+	value, ok := b.Get("Export_Id")
+	if !ok {
+		return 0, fmt.Errorf("block %s has no Export_Id", b.Name)
+	}
+	id, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("block %s has invalid Export_Id %q: %v", b.Name, value, err)
+	}
+	return uint16(id), nil
+}
+
+// Export returns the EXPORT sub-block with the given Export_Id, or nil if there
+// is none.
+func (b *Block) Export(exportId uint16) *Block {
+	for _, export := range b.Exports() {
+		if id, err := export.ExportId(); err == nil && id == exportId {
+			return export
+		}
+	}
+	return nil
+}
+
+// RemoveExport removes the EXPORT sub-blocks with the given Export_Id and
+// returns how many were removed.
+func (b *Block) RemoveExport(exportId uint16) int {
+	return b.RemoveBlocks(func(block *Block) bool {
+		if !strings.EqualFold(block.Name, "EXPORT") {
+			return false
+		}
+		id, err := block.ExportId()
+		return err == nil && id == exportId
+	})
+}
+
+// String serializes the block. If the block has no name, i.e. it represents a
+// whole config file, only its entries are serialized.
+func (b *Block) String() string {
+	var buf bytes.Buffer
+	if b.Name == "" {
+		for i, e := range b.Entries {
+			// Separate top-level blocks from whatever follows them
+			if i > 0 && b.Entries[i-1].Block != nil {
+				buf.WriteString("\n")
+			}
+			writeEntry(&buf, e, 0)
+		}
+	} else {
+		writeBlock(&buf, b, 0)
+	}
+	return buf.String()
+}
+
+func writeBlock(buf *bytes.Buffer, b *Block, depth int) {
+	indent := strings.Repeat("\t", depth)
+	buf.WriteString(indent + b.Name + "\n" + indent + "{\n")
+	for _, e := range b.Entries {
+		writeEntry(buf, e, depth+1)
+	}
+	buf.WriteString(indent + "}\n")
+}
+
+func writeEntry(buf *bytes.Buffer, e *Entry, depth int) {
+	indent := strings.Repeat("\t", depth)
+	switch {
+	case e.Block != nil:
+		writeBlock(buf, e.Block, depth)
+	case e.Param != nil:
+		buf.WriteString(indent + e.Param.Key + " = " + e.Param.Value + ";\n")
+	default:
+		buf.WriteString(indent + e.Comment + "\n")
+	}
+}
+
+// ReadFile parses the config file at the given path.
+func ReadFile(path string) (*Block, error) {
+	read, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := Parse(read)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing ganesha config %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// Parse parses a config file's contents.
+func Parse(data []byte) (*Block, error) {
+	p := &parser{data: data, line: 1}
+	config := &Block{}
+	if err := p.parseEntries(config, false); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+type parser struct {
+	data []byte
+	pos  int
+	line int
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.data)
+}
+
+func (p *parser) peek() byte {
+	return p.data[p.pos]
+}
+
+func (p *parser) next() byte {
+	c := p.data[p.pos]
+	p.pos++
+	if c == '\n' {
+		p.line++
+	}
+	return c
+}
+
+func (p *parser) skipSpace() {
+	for !p.eof() && isSpace(p.peek()) {
+		p.next()
+	}
+}
+
+// restOfLine consumes and returns the rest of the current line.
+func (p *parser) restOfLine() string {
+	start := p.pos
+	for !p.eof() && p.peek() != '\n' {
+		p.next()
+	}
+	return strings.TrimSpace(string(p.data[start:p.pos]))
+}
+
+// parseEntries parses entries into block until EOF, or until the closing brace
+// if inBlock is true.
+func (p *parser) parseEntries(block *Block, inBlock bool) error {
+	for {
+		p.skipSpace()
+		if p.eof() {
+			if inBlock {
+				return p.errorf("unexpected end of file in block %s", block.Name)
+			}
+			return nil
+		}
+
+		switch c := p.peek(); {
+		case c == '}':
+			if !inBlock {
+				return p.errorf("unexpected '}'")
+			}
+			p.next()
+			p.skipSpace()
+			if !p.eof() && p.peek() == ';' {
+				p.next()
+			}
+			return nil
+		case c == '#' || c == '%':
+			block.Entries = append(block.Entries, &Entry{Comment: p.restOfLine()})
+		case isIdent(c):
+			entry, err := p.parseEntry()
+			if err != nil {
+				return err
+			}
+			block.Entries = append(block.Entries, entry)
+		default:
+			return p.errorf("unexpected character %q", c)
+		}
+	}
+}
+
+// parseEntry parses a parameter or a block starting with an identifier.
+func (p *parser) parseEntry() (*Entry, error) {
+	start := p.pos
+	for !p.eof() && isIdent(p.peek()) {
+		p.next()
+	}
+	name := string(p.data[start:p.pos])
+
+	p.skipSpace()
+	if p.eof() {
+		return nil, p.errorf("unexpected end of file after %s", name)
+	}
+	switch p.next() {
+	case '{':
+		block := &Block{Name: name}
+		if err := p.parseEntries(block, true); err != nil {
+			return nil, err
+		}
+		return &Entry{Block: block}, nil
+	case '=':
+		value, err := p.parseValue(name)
+		if err != nil {
+			return nil, err
+		}
+		return &Entry{Param: &Param{Key: name, Value: value}}, nil
+	default:
+		return nil, p.errorf("expected '{' or '=' after %s", name)
+	}
+}
+
+// parseValue parses a parameter value up to and including its terminating
+// semicolon. Semicolons and hashes in quoted strings don't count.
+func (p *parser) parseValue(key string) (string, error) {
+	var value bytes.Buffer
+	inQuotes := false
+	for {
+		if p.eof() {
+			return "", p.errorf("unexpected end of file in value of %s", key)
+		}
+		c := p.peek()
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+		case inQuotes:
+		case c == ';':
+			p.next()
+			v := strings.TrimSpace(value.String())
+			if v == "" {
+				return "", p.errorf("empty value for %s", key)
+			}
+			return v, nil
+		case c == '#':
+			p.restOfLine()
+			continue
+		case c == '{' || c == '}' || c == '=':
+			return "", p.errorf("missing ';' after value of %s", key)
+		}
+		value.WriteByte(p.next())
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isIdent(c byte) bool {
+	return c == '_' || c == '-' || c == '.' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
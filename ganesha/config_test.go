@@ -0,0 +1,158 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ganesha
+
+import (
+	"testing"
+)
+
+const defaultConfig = `###################################################
+#
+# EXPORT
+#
+###################################################
+
+EXPORT
+{
+	# Export Id (mandatory, each EXPORT must have a unique Export_Id)
+	Export_Id = 0;
+
+	# Exported path (mandatory)
+	Path = /nonexistent;
+	Pseudo = /nonexistent;   # trailing comment
+	Access_Type = RW;
+
+	# Exporting FSAL
+	FSAL {
+		Name = VFS;
+	}
+}
+
+%include "/etc/ganesha/extra.conf"
+NFS_Core_Param
+{
+	MNT_Port = 20048;
+	Protocols = 3, 4;
+}
+`
+
+func TestParse(t *testing.T) {
+	config, err := Parse([]byte(defaultConfig))
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %v", err)
+	}
+
+	exports := config.Exports()
+	if len(exports) != 1 {
+		t.Fatalf("expected 1 export but got %d", len(exports))
+	}
+	id, err := exports[0].ExportId()
+	if err != nil || id != 0 {
+		t.Errorf("expected Export_Id 0 but got %v, error: %v", id, err)
+	}
+	if pseudo, _ := exports[0].Get("pseudo"); pseudo != "/nonexistent" {
+		t.Errorf("expected Pseudo /nonexistent but got %q", pseudo)
+	}
+	fsals := exports[0].Blocks("FSAL")
+	if len(fsals) != 1 {
+		t.Fatalf("expected 1 FSAL but got %d", len(fsals))
+	}
+	if name, _ := fsals[0].Get("Name"); name != "VFS" {
+		t.Errorf("expected FSAL Name VFS but got %q", name)
+	}
+	core := config.Blocks("NFS_Core_Param")
+	if len(core) != 1 {
+		t.Fatalf("expected 1 NFS_Core_Param but got %d", len(core))
+	}
+	if protocols, _ := core[0].Get("Protocols"); protocols != "3, 4" {
+		t.Errorf("expected Protocols 3, 4 but got %q", protocols)
+	}
+
+	// Serializing and parsing again should be lossless
+	reparsed, err := Parse([]byte(config.String()))
+	if err != nil {
+		t.Fatalf("unexpected error parsing serialized config: %v", err)
+	}
+	if config.String() != reparsed.String() {
+		t.Errorf("expected serialized config:\n%s\nbut got:\n%s", config.String(), reparsed.String())
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{
+			name:   "unclosed block",
+			config: "EXPORT {\n\tExport_Id = 1;\n",
+		},
+		{
+			name:   "unexpected closing brace",
+			config: "Export_Id = 1;\n}\n",
+		},
+		{
+			name:   "missing semicolon",
+			config: "EXPORT {\n\tExport_Id = 1\n\tPath = /foo;\n}\n",
+		},
+		{
+			name:   "missing value",
+			config: "EXPORT {\n\tExport_Id = ;\n}\n",
+		},
+		{
+			name:   "missing equals",
+			config: "EXPORT {\n\tExport_Id 1;\n}\n",
+		},
+	}
+	for _, test := range tests {
+		if _, err := Parse([]byte(test.config)); err == nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected error but got none")
+		}
+	}
+}
+
+func TestAddRemoveExport(t *testing.T) {
+	config, err := Parse([]byte(defaultConfig))
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %v", err)
+	}
+
+	export := NewBlock("EXPORT", "Export_Id", "1", "Path", "/export/foo")
+	export.AddBlock(NewBlock("FSAL", "Name", "VFS"))
+	config.AddBlock(export)
+
+	reparsed, err := Parse([]byte(config.String()))
+	if err != nil {
+		t.Fatalf("unexpected error parsing serialized config: %v", err)
+	}
+	if found := reparsed.Export(1); found == nil {
+		t.Errorf("expected export 1 but it wasn't found")
+	} else if path, _ := found.Get("Path"); path != "/export/foo" {
+		t.Errorf("expected export 1 path /export/foo but got %q", path)
+	}
+
+	if removed := reparsed.RemoveExport(1); removed != 1 {
+		t.Errorf("expected 1 export removed but got %d", removed)
+	}
+	if reparsed.Export(1) != nil {
+		t.Errorf("expected export 1 to be removed but it was found")
+	}
+	if reparsed.Export(0) == nil {
+		t.Errorf("expected export 0 to be kept but it wasn't found")
+	}
+}
@@ -0,0 +1,251 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ganesha
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/guelfey/go.dbus"
+)
+
+// The D-Bus name of NFS Ganesha and the paths of its objects.
+const (
+	BusName        = "org.ganesha.nfsd"
+	ExportMgrPath  = "/org/ganesha/nfsd/ExportMgr"
+	AdminPath      = "/org/ganesha/nfsd/admin"
+	dbusBusName    = "org.freedesktop.DBus"
+	dbusObjectPath = "/org/freedesktop/DBus"
+)
+
+// How long to wait for a reply to a D-Bus call, and how many times and how
+// often to retry a call that didn't reach NFS Ganesha.
+var (
+	callTimeout       = 30 * time.Second
+	callRetries       = 3
+	callRetryInterval = 1 * time.Second
+)
+
+var (
+	connLock sync.Mutex
+	conn     *dbus.Conn
+	// The address of the bus NFS Ganesha is on, if not the system bus
+	busAddress string
+)
+
+// How long to wait for a TCP connection to a remote bus
+const dialTimeout = 10 * time.Second
+
+// SetBusAddress sets the D-Bus address of the bus NFS Ganesha is on, e.g.
+// "tcp:host=storage-1,port=5555" for an NFS Ganesha on another host. An
+// empty address means the system bus. The next call connects to it.
+func SetBusAddress(address string) {
+	connLock.Lock()
+	defer connLock.Unlock()
+	busAddress = address
+	if conn != nil {
+		conn.Close()
+		conn = nil
+	}
+}
+
+// dialBus opens a new private connection to the bus NFS Ganesha is on. Unlike
+// the shared one from dbus.SystemBus, it can be closed and replaced if it
+// breaks. It's called with connLock held.
+var dialBus = func() (*dbus.Conn, error) {
+	c, methods, err := dialAddress(busAddress)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Auth(methods); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := c.Hello(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// dialAddress connects to the bus at the given address and returns the
+// authentication mechanisms to try, nil for the defaults. The vendored D-Bus
+// library only supports unix transports, so a tcp one is dialed here. Over
+// TCP, EXTERNAL authentication only works through a bridge to a unix socket,
+// e.g. socat or an SSH tunnel, which the bus authenticates as the bridge's
+// user, otherwise the bus must allow ANONYMOUS.
+func dialAddress(address string) (*dbus.Conn, []dbus.Auth, error) {
+	if address == "" {
+		c, err := dbus.SystemBusPrivate()
+		return c, nil, err
+	}
+	if !strings.HasPrefix(address, "tcp:") {
+		c, err := dbus.Dial(address)
+		return c, nil, err
+	}
+	hostPort, err := parseTCPAddress(address)
+	if err != nil {
+		return nil, nil, err
+	}
+	nc, err := net.DialTimeout("tcp", hostPort, dialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := dbus.NewConn(nc)
+	if err != nil {
+		nc.Close()
+		return nil, nil, err
+	}
+	return c, []dbus.Auth{dbus.AuthExternal(strconv.Itoa(os.Getuid())), authAnonymous{}}, nil
+}
+
+// parseTCPAddress returns the host:port of the given D-Bus tcp address, e.g.
+// "tcp:host=localhost,port=5555".
+func parseTCPAddress(address string) (string, error) {
+	host, port := "", ""
+	for _, kv := range strings.Split(strings.TrimPrefix(address, "tcp:"), ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return "", fmt.Errorf("invalid key-value pair %q in dbus address %s", kv, address)
+		}
+		switch parts[0] {
+		case "host":
+			host = parts[1]
+		case "port":
+			port = parts[1]
+		}
+	}
+	if host == "" || port == "" {
+		return "", fmt.Errorf("dbus address %s must have a host and a port", address)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// authAnonymous implements the ANONYMOUS authentication mechanism, which the
+// vendored D-Bus library doesn't.
+type authAnonymous struct{}
+
+func (a authAnonymous) FirstData() ([]byte, []byte, dbus.AuthStatus) {
+	return []byte("ANONYMOUS"), []byte(hex.EncodeToString([]byte("nfs-provisioner"))), dbus.AuthOk
+}
+
+func (a authAnonymous) HandleData(b []byte) ([]byte, dbus.AuthStatus) {
+	return nil, dbus.AuthError
+}
+
+// getConn returns the cached bus connection, connecting if there is
+// none.
+func getConn() (*dbus.Conn, error) {
+	connLock.Lock()
+	defer connLock.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+	c, err := dialBus()
+	if err != nil {
+		if busAddress != "" {
+			return nil, fmt.Errorf("error connecting to dbus bus %s: %v", busAddress, err)
+		}
+		return nil, fmt.Errorf("error connecting to dbus system bus: %v", err)
+	}
+	conn = c
+	return conn, nil
+}
+
+// resetConn closes and forgets the given connection if it's the cached one, so
+// that the next call reconnects.
+func resetConn(c *dbus.Conn) {
+	connLock.Lock()
+	defer connLock.Unlock()
+	if conn == c {
+		conn.Close()
+		conn = nil
+	}
+}
+
+// Call calls the given method of NFS Ganesha's object at the given path over
+// the system bus and waits for the reply, for at most callTimeout. The
+// returned call's Err is set if the call failed.
+func Call(path, method string, args ...interface{}) *dbus.Call {
+	return call(BusName, path, method, args...)
+}
+
+// IsRunning returns whether NFS Ganesha is running, i.e. owns its D-Bus name.
+func IsRunning() (bool, error) {
+	var running bool
+	c := call(dbusBusName, dbusObjectPath, "org.freedesktop.DBus.NameHasOwner", BusName)
+	if err := c.Store(&running); err != nil {
+		return false, fmt.Errorf("error calling org.freedesktop.DBus.NameHasOwner: %v", err)
+	}
+	return running, nil
+}
+
+// call calls the given method, reconnecting and retrying up to callRetries
+// times if the call surely didn't reach its destination, i.e. the connection is
+// broken or the destination isn't on the bus, e.g. because it's restarting. A
+// call that timed out isn't retried since it may have been carried out, but the
+// connection is reset in case it's stale.
+func call(dest, path, method string, args ...interface{}) *dbus.Call {
+	var result *dbus.Call
+	for i := 0; i <= callRetries; i++ {
+		if i > 0 {
+			glog.Warningf("dbus call %s failed, retrying: %v", method, result.Err)
+			time.Sleep(callRetryInterval)
+		}
+
+		c, err := getConn()
+		if err != nil {
+			result = &dbus.Call{Destination: dest, Path: dbus.ObjectPath(path), Method: method, Args: args, Err: err}
+			continue
+		}
+
+		ch := make(chan *dbus.Call, 1)
+		c.Object(dest, dbus.ObjectPath(path)).Go(method, 0, ch, args...)
+		select {
+		case result = <-ch:
+		case <-time.After(callTimeout):
+			resetConn(c)
+			return &dbus.Call{Destination: dest, Path: dbus.ObjectPath(path), Method: method, Args: args, Err: fmt.Errorf("timed out after %v waiting for reply", callTimeout)}
+		}
+
+		if result.Err == nil || !isRetryable(result.Err) {
+			return result
+		}
+		if _, ok := result.Err.(dbus.Error); !ok {
+			// The connection itself failed
+			resetConn(c)
+		}
+	}
+	return result
+}
+
+// isRetryable returns whether a call that failed with the given error surely
+// didn't reach its destination.
+func isRetryable(err error) bool {
+	if dbusErr, ok := err.(dbus.Error); ok {
+		return dbusErr.Name == "org.freedesktop.DBus.Error.ServiceUnknown" ||
+			dbusErr.Name == "org.freedesktop.DBus.Error.Disconnected"
+	}
+	return true
+}
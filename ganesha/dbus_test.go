@@ -0,0 +1,159 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ganesha
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/guelfey/go.dbus"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{
+			name:     "connection error",
+			err:      errors.New("dbus: connection closed by user"),
+			expected: true,
+		},
+		{
+			name:     "ganesha not on the bus",
+			err:      dbus.Error{Name: "org.freedesktop.DBus.Error.ServiceUnknown"},
+			expected: true,
+		},
+		{
+			name:     "no reply",
+			err:      dbus.Error{Name: "org.freedesktop.DBus.Error.NoReply"},
+			expected: false,
+		},
+		{
+			name:     "ganesha error",
+			err:      dbus.Error{Name: "org.freedesktop.DBus.Error.InvalidArgs"},
+			expected: false,
+		},
+	}
+	for _, test := range tests {
+		if retryable := isRetryable(test.err); retryable != test.expected {
+			t.Errorf("test case: %s: expected retryable %v but got %v", test.name, test.expected, retryable)
+		}
+	}
+}
+
+func TestParseTCPAddress(t *testing.T) {
+	tests := []struct {
+		address     string
+		expected    string
+		expectError bool
+	}{
+		{address: "tcp:host=storage-1,port=5555", expected: "storage-1:5555"},
+		{address: "tcp:host=::1,port=5555,family=ipv6", expected: "[::1]:5555"},
+		{address: "tcp:host=storage-1", expectError: true},
+		{address: "tcp:storage-1:5555", expectError: true},
+	}
+	for _, test := range tests {
+		hostPort, err := parseTCPAddress(test.address)
+		if test.expectError {
+			if err == nil {
+				t.Errorf("address %s: expected error but got none", test.address)
+			}
+			continue
+		}
+		if err != nil || hostPort != test.expected {
+			t.Errorf("address %s: expected %s but got %s, error %v", test.address, test.expected, hostPort, err)
+		}
+	}
+}
+
+func TestDialTCPAnonymous(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer l.Close()
+
+	// A bus that only allows anonymous clients. Neither end closes the
+	// connection, as the vendored D-Bus library panics closing a connection
+	// the other end already closed.
+	authed := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		r := bufio.NewReader(c)
+		r.ReadByte()
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "AUTH ANONYMOUS"):
+				c.Write([]byte("OK 1234deadbeef\r\n"))
+			case strings.HasPrefix(line, "AUTH"):
+				c.Write([]byte("REJECTED EXTERNAL ANONYMOUS\r\n"))
+			case strings.HasPrefix(line, "BEGIN"):
+				authed <- line
+				return
+			}
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	c, methods, err := dialAddress("tcp:host=127.0.0.1,port=" + port)
+	if err != nil {
+		t.Fatalf("unexpected error dialing: %v", err)
+	}
+	if err := c.Auth(methods); err != nil {
+		t.Errorf("unexpected error authenticating: %v", err)
+	}
+	select {
+	case <-authed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("timed out waiting for authentication")
+	}
+}
+
+func TestCallRetriesConnecting(t *testing.T) {
+	oldDial, oldInterval := dialBus, callRetryInterval
+	defer func() {
+		dialBus, callRetryInterval = oldDial, oldInterval
+	}()
+	callRetryInterval = time.Millisecond
+
+	dials := 0
+	dialBus = func() (*dbus.Conn, error) {
+		dials++
+		return nil, errors.New("no bus")
+	}
+
+	c := Call(ExportMgrPath, "org.ganesha.nfsd.exportmgr.AddExport", "/export/vfs.conf", "export(path = /export/foo)")
+	if c.Err == nil {
+		t.Errorf("expected error calling without a bus but got none")
+	}
+	if dials != callRetries+1 {
+		t.Errorf("expected %d attempts to connect but got %d", callRetries+1, dials)
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ganesha
+
+import (
+	"fmt"
+)
+
+// ClientMgrPath is the path of NFS Ganesha's D-Bus object managing clients.
+const ClientMgrPath = "/org/ganesha/nfsd/ClientMgr"
+
+// exportProtocols are the protocols ShowExports reports, in order, for each
+// export whether it has been accessed with them.
+var exportProtocols = []string{"NFSv3", "MNT", "NLM4", "RQUOTA", "NFSv40", "NFSv41", "NFSv42", "9P"}
+
+// ioProtocols are the protocols NFS Ganesha keeps per-export I/O statistics
+// of, which can be gotten with org.ganesha.nfsd.exportstats.Get<protocol>IO.
+var ioProtocols = map[string]bool{"NFSv3": true, "NFSv40": true, "NFSv41": true, "NFSv42": true}
+
+// ExportInfo is an export NFS Ganesha serves.
+type ExportInfo struct {
+	ExportId uint16
+	Path     string
+	// The protocols the export has been accessed with, of which there are I/O
+	// statistics
+	Protocols []string
+}
+
+// IOStats are the statistics of reads or writes to an export.
+type IOStats struct {
+	// Bytes requested and actually transferred
+	Requested   uint64
+	Transferred uint64
+	// Operations and failed operations
+	Ops    uint64
+	Errors uint64
+	// Average latency of an operation, in milliseconds
+	Latency float64
+}
+
+// ShowExports gets the exports NFS Ganesha serves.
+func ShowExports() ([]ExportInfo, error) {
+	call := Call(ExportMgrPath, "org.ganesha.nfsd.exportmgr.ShowExports")
+	if call.Err != nil {
+		return nil, fmt.Errorf("error calling org.ganesha.nfsd.exportmgr.ShowExports: %v", call.Err)
+	}
+	return parseShowExports(call.Body)
+}
+
+// GetIOStats gets the read and write statistics of the given export for the
+// given protocol, one of the Protocols of its ExportInfo. ok is false if NFS
+// Ganesha has no statistics, e.g. because the export hasn't been accessed with
+// the protocol.
+func GetIOStats(exportId uint16, protocol string) (read, write IOStats, ok bool, err error) {
+	if !ioProtocols[protocol] {
+		return IOStats{}, IOStats{}, false, fmt.Errorf("no I/O statistics for protocol %s", protocol)
+	}
+	method := "org.ganesha.nfsd.exportstats.Get" + protocol + "IO"
+	call := Call(ExportMgrPath, method, exportId)
+	if call.Err != nil {
+		return IOStats{}, IOStats{}, false, fmt.Errorf("error calling %s: %v", method, call.Err)
+	}
+	return parseIOStats(call.Body)
+}
+
+// CountClients gets the number of clients NFS Ganesha knows of.
+func CountClients() (int, error) {
+	call := Call(ClientMgrPath, "org.ganesha.nfsd.clientmgr.ShowClients")
+	if call.Err != nil {
+		return 0, fmt.Errorf("error calling org.ganesha.nfsd.clientmgr.ShowClients: %v", call.Err)
+	}
+	if len(call.Body) < 2 {
+		return 0, fmt.Errorf("unexpected reply to ShowClients: %v", call.Body)
+	}
+	clients, ok := call.Body[1].([][]interface{})
+	if !ok {
+		return 0, fmt.Errorf("unexpected reply to ShowClients: %v", call.Body)
+	}
+	return len(clients), nil
+}
+
+// parseShowExports parses the reply to ShowExports: a timestamp and, for
+// every export, its id, path, whether it has been accessed with each of
+// exportProtocols and when it was last accessed.
+func parseShowExports(body []interface{}) ([]ExportInfo, error) {
+	if len(body) < 2 {
+		return nil, fmt.Errorf("unexpected reply to ShowExports: %v", body)
+	}
+	entries, ok := body[1].([][]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply to ShowExports: %v", body)
+	}
+
+	exports := []ExportInfo{}
+	for _, entry := range entries {
+		if len(entry) < 2 {
+			return nil, fmt.Errorf("unexpected export in reply to ShowExports: %v", entry)
+		}
+		id, ok := entry[0].(uint16)
+		if !ok {
+			return nil, fmt.Errorf("unexpected export id in reply to ShowExports: %v", entry[0])
+		}
+		path, ok := entry[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected export path in reply to ShowExports: %v", entry[1])
+		}
+		export := ExportInfo{ExportId: id, Path: path, Protocols: []string{}}
+		for i, protocol := range exportProtocols {
+			if accessed, ok := valueAt(entry, i+2).(bool); ok && accessed && ioProtocols[protocol] {
+				export.Protocols = append(export.Protocols, protocol)
+			}
+		}
+		exports = append(exports, export)
+	}
+	return exports, nil
+}
+
+// parseIOStats parses the reply to Get<protocol>IO: whether there are
+// statistics, an error message, a timestamp and the read and write
+// statistics.
+func parseIOStats(body []interface{}) (IOStats, IOStats, bool, error) {
+	status, ok := valueAt(body, 0).(bool)
+	if !ok {
+		return IOStats{}, IOStats{}, false, fmt.Errorf("unexpected I/O statistics reply: %v", body)
+	}
+	if !status {
+		return IOStats{}, IOStats{}, false, nil
+	}
+	read, err := parseIOStruct(valueAt(body, 3))
+	if err != nil {
+		return IOStats{}, IOStats{}, false, fmt.Errorf("unexpected read statistics: %v", err)
+	}
+	write, err := parseIOStruct(valueAt(body, 4))
+	if err != nil {
+		return IOStats{}, IOStats{}, false, fmt.Errorf("unexpected write statistics: %v", err)
+	}
+	return read, write, true, nil
+}
+
+// parseIOStruct parses the struct of the bytes requested, bytes transferred,
+// operations, errors and average latency of reads or writes.
+func parseIOStruct(v interface{}) (IOStats, error) {
+	fields, ok := v.([]interface{})
+	if !ok || len(fields) < 5 {
+		return IOStats{}, fmt.Errorf("%v", v)
+	}
+	stats := IOStats{}
+	for i, field := range []*uint64{&stats.Requested, &stats.Transferred, &stats.Ops, &stats.Errors} {
+		n, ok := fields[i].(uint64)
+		if !ok {
+			return IOStats{}, fmt.Errorf("%v", v)
+		}
+		*field = n
+	}
+	latency, ok := fields[4].(float64)
+	if !ok {
+		return IOStats{}, fmt.Errorf("%v", v)
+	}
+	stats.Latency = latency
+	return stats, nil
+}
+
+func valueAt(values []interface{}, i int) interface{} {
+	if i < len(values) {
+		return values[i]
+	}
+	return nil
+}
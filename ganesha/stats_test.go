@@ -0,0 +1,110 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ganesha
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseShowExports(t *testing.T) {
+	timestamp := []interface{}{uint64(1), uint64(2)}
+	tests := []struct {
+		name            string
+		body            []interface{}
+		expectedExports []ExportInfo
+		expectError     bool
+	}{
+		{
+			name: "exports",
+			body: []interface{}{timestamp, [][]interface{}{
+				{uint16(0), "/nonexistent", false, false, false, false, false, false, false, false, timestamp},
+				{uint16(1), "/export/pvc-1", true, true, true, false, false, true, false, false, timestamp},
+			}},
+			expectedExports: []ExportInfo{
+				{ExportId: 0, Path: "/nonexistent", Protocols: []string{}},
+				{ExportId: 1, Path: "/export/pvc-1", Protocols: []string{"NFSv3", "NFSv41"}},
+			},
+		},
+		{
+			name:        "bad reply",
+			body:        []interface{}{timestamp, "exports"},
+			expectError: true,
+		},
+		{
+			name:        "bad export id",
+			body:        []interface{}{timestamp, [][]interface{}{{"1", "/export/pvc-1"}}},
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		exports, err := parseShowExports(test.body)
+		if test.expectError != (err != nil) {
+			t.Errorf("test case: %s: expected error %v but got %v", test.name, test.expectError, err)
+			continue
+		}
+		if !test.expectError && !reflect.DeepEqual(test.expectedExports, exports) {
+			t.Errorf("test case: %s: expected exports %v but got %v", test.name, test.expectedExports, exports)
+		}
+	}
+}
+
+func TestParseIOStats(t *testing.T) {
+	timestamp := []interface{}{uint64(1), uint64(2)}
+	tests := []struct {
+		name          string
+		body          []interface{}
+		expectedRead  IOStats
+		expectedWrite IOStats
+		expectedOk    bool
+		expectError   bool
+	}{
+		{
+			name: "stats",
+			body: []interface{}{true, "OK", timestamp,
+				[]interface{}{uint64(100), uint64(90), uint64(10), uint64(1), 0.5},
+				[]interface{}{uint64(200), uint64(200), uint64(20), uint64(0), 1.5},
+			},
+			expectedRead:  IOStats{Requested: 100, Transferred: 90, Ops: 10, Errors: 1, Latency: 0.5},
+			expectedWrite: IOStats{Requested: 200, Transferred: 200, Ops: 20, Errors: 0, Latency: 1.5},
+			expectedOk:    true,
+		},
+		{
+			name:       "no stats",
+			body:       []interface{}{false, "Export does not have any NFSv3 activity", timestamp},
+			expectedOk: false,
+		},
+		{
+			name:        "bad stats",
+			body:        []interface{}{true, "OK", timestamp, []interface{}{uint64(100)}, []interface{}{}},
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		read, write, ok, err := parseIOStats(test.body)
+		if test.expectError != (err != nil) {
+			t.Errorf("test case: %s: expected error %v but got %v", test.name, test.expectError, err)
+			continue
+		}
+		if test.expectError {
+			continue
+		}
+		if test.expectedOk != ok || test.expectedRead != read || test.expectedWrite != write {
+			t.Errorf("test case: %s: expected %v, %v, %v but got %v, %v, %v", test.name, test.expectedRead, test.expectedWrite, test.expectedOk, read, write, ok)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ganesha
+
+import (
+	"fmt"
+	"strings"
+)
+
+// accessTypes are the values ganesha accepts for Access_Type.
+var accessTypes = map[string]bool{
+	"none":      true,
+	"rw":        true,
+	"ro":        true,
+	"mdonly":    true,
+	"mdonly_ro": true,
+}
+
+// ValidateExport checks that the given EXPORT block has everything ganesha
+// requires of an export, so that a bad block is rejected before ganesha is
+// asked to load it.
+func ValidateExport(export *Block) error {
+	if !strings.EqualFold(export.Name, "EXPORT") {
+		return fmt.Errorf("block %s is not an EXPORT", export.Name)
+	}
+	id, err := export.ExportId()
+	if err != nil {
+		return err
+	}
+
+	path, ok := export.Get("Path")
+	if !ok {
+		return fmt.Errorf("EXPORT %d has no Path", id)
+	}
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("EXPORT %d has relative Path %q", id, path)
+	}
+	if pseudo, ok := export.Get("Pseudo"); ok && !strings.HasPrefix(pseudo, "/") {
+		return fmt.Errorf("EXPORT %d has relative Pseudo %q", id, pseudo)
+	}
+
+	if err := validateAccessType(export); err != nil {
+		return fmt.Errorf("EXPORT %d: %v", id, err)
+	}
+	for _, client := range export.Blocks("CLIENT") {
+		if clients, ok := client.Get("Clients"); !ok || strings.Trim(clients, `" `) == "" {
+			return fmt.Errorf("EXPORT %d has a CLIENT with no Clients", id)
+		}
+		if err := validateAccessType(client); err != nil {
+			return fmt.Errorf("EXPORT %d CLIENT: %v", id, err)
+		}
+	}
+
+	fsals := export.Blocks("FSAL")
+	if len(fsals) != 1 {
+		return fmt.Errorf("EXPORT %d must have exactly one FSAL, has %d", id, len(fsals))
+	}
+	if name, ok := fsals[0].Get("Name"); !ok || name == "" {
+		return fmt.Errorf("EXPORT %d has an FSAL with no Name", id)
+	}
+
+	return nil
+}
+
+func validateAccessType(b *Block) error {
+	accessType, ok := b.Get("Access_Type")
+	if !ok {
+		return nil
+	}
+	if !accessTypes[strings.ToLower(accessType)] {
+		return fmt.Errorf("invalid Access_Type %q", accessType)
+	}
+	return nil
+}
+
+// Validate checks that the config's serialization parses back and that its
+// EXPORT blocks are valid and don't conflict with each other.
+func (b *Block) Validate() error {
+	reparsed, err := Parse([]byte(b.String()))
+	if err != nil {
+		return fmt.Errorf("config doesn't parse back: %v", err)
+	}
+
+	ids := map[uint16]bool{}
+	pseudos := map[string]uint16{}
+	for _, export := range reparsed.Exports() {
+		if err := ValidateExport(export); err != nil {
+			return err
+		}
+		id, _ := export.ExportId()
+		if ids[id] {
+			return fmt.Errorf("more than one EXPORT has Export_Id %d", id)
+		}
+		ids[id] = true
+		if pseudo, ok := export.Get("Pseudo"); ok {
+			if other, ok := pseudos[pseudo]; ok {
+				return fmt.Errorf("EXPORTs %d and %d have the same Pseudo %s", other, id, pseudo)
+			}
+			pseudos[pseudo] = id
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ganesha
+
+import (
+	"testing"
+)
+
+const validExport = `EXPORT
+{
+	Export_Id = 1;
+	Path = /export/foo;
+	Pseudo = /export/foo;
+	Access_Type = RW;
+	FSAL
+	{
+		Name = VFS;
+	}
+}
+`
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		expectError bool
+	}{
+		{
+			name:   "valid",
+			config: validExport,
+		},
+		{
+			name:   "valid with clients",
+			config: "EXPORT { Export_Id = 1; Path = /export/foo; Access_Type = None; CLIENT { Clients = 10.0.0.1; Access_Type = RO; } FSAL { Name = VFS; } }",
+		},
+		{
+			name:        "no Export_Id",
+			config:      "EXPORT { Path = /export/foo; FSAL { Name = VFS; } }",
+			expectError: true,
+		},
+		{
+			name:   "default config",
+			config: defaultConfig,
+		},
+		{
+			name:        "relative Path",
+			config:      "EXPORT { Export_Id = 1; Path = export/foo; FSAL { Name = VFS; } }",
+			expectError: true,
+		},
+		{
+			name:        "invalid Access_Type",
+			config:      "EXPORT { Export_Id = 1; Path = /export/foo; Access_Type = RWX; FSAL { Name = VFS; } }",
+			expectError: true,
+		},
+		{
+			name:        "CLIENT with no Clients",
+			config:      "EXPORT { Export_Id = 1; Path = /export/foo; CLIENT { Access_Type = RO; } FSAL { Name = VFS; } }",
+			expectError: true,
+		},
+		{
+			name:        "no FSAL",
+			config:      "EXPORT { Export_Id = 1; Path = /export/foo; }",
+			expectError: true,
+		},
+		{
+			name:        "duplicate Export_Id",
+			config:      validExport + validExport,
+			expectError: true,
+		},
+		{
+			name:        "duplicate Pseudo",
+			config:      validExport + "EXPORT { Export_Id = 2; Path = /export/bar; Pseudo = /export/foo; FSAL { Name = VFS; } }",
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		config, err := Parse([]byte(test.config))
+		if err != nil {
+			t.Fatalf("test case %s: unexpected error parsing config: %v", test.name, err)
+		}
+		err = config.Validate()
+		if test.expectError && err == nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected error but got none")
+		} else if !test.expectError && err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestValidateUnparseable(t *testing.T) {
+	// A value that can't be serialized so that it parses back
+	config := &Block{}
+	export := NewBlock("EXPORT", "Export_Id", "1", "Path", "/export/foo } ")
+	export.AddBlock(NewBlock("FSAL", "Name", "VFS"))
+	config.AddBlock(export)
+	if err := config.Validate(); err == nil {
+		t.Errorf("expected error but got none")
+	}
+}
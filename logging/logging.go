@@ -0,0 +1,172 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package logging logs messages with consistent fields, e.g. the PV and
+// operation a message is about, either through glog as text or as JSON lines
+// that cluster log pipelines can index.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// The names of the fields messages are logged with.
+const (
+	PV        = "pv"
+	PVC       = "pvc"
+	Namespace = "namespace"
+	Operation = "operation"
+	Duration  = "duration"
+	Err       = "error"
+)
+
+// Fields are the fields of a message, by name.
+type Fields map[string]interface{}
+
+// With returns a copy of the fields with the given fields added.
+func (f Fields) With(fields Fields) Fields {
+	with := Fields{}
+	for k, v := range f {
+		with[k] = v
+	}
+	for k, v := range fields {
+		with[k] = v
+	}
+	return with
+}
+
+// The formats messages can be logged in.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var (
+	mutex  sync.Mutex
+	format = FormatText
+)
+
+// SetFormat sets the format messages are logged in, text or json. Text
+// messages are logged through glog, with their fields appended as key=value.
+// JSON messages are written to stderr directly, one object per line with the
+// fields time, level and msg besides the message's own.
+func SetFormat(f string) error {
+	if f != FormatText && f != FormatJSON {
+		return fmt.Errorf("invalid log format %q, valid formats are: %s, %s", f, FormatText, FormatJSON)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	format = f
+	return nil
+}
+
+// Info logs the given message with the given fields at info level.
+func Info(msg string, fields Fields) {
+	log("info", msg, fields)
+}
+
+// Warning logs the given message with the given fields at warning level.
+func Warning(msg string, fields Fields) {
+	log("warning", msg, fields)
+}
+
+// Error logs the given message with the given fields at error level.
+func Error(msg string, fields Fields) {
+	log("error", msg, fields)
+}
+
+func log(level, msg string, fields Fields) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if format == FormatJSON {
+		line, err := formatJSON(time.Now(), level, msg, fields)
+		if err != nil {
+			glog.Errorf("error formatting log message %q as JSON: %v", msg, err)
+			return
+		}
+		os.Stderr.Write(line)
+		return
+	}
+
+	// Depth 2 to attribute the message to the caller of Info etc.
+	line := formatText(msg, fields)
+	switch level {
+	case "warning":
+		glog.WarningDepth(2, line)
+	case "error":
+		glog.ErrorDepth(2, line)
+	default:
+		glog.InfoDepth(2, line)
+	}
+}
+
+// formatJSON returns the given message as a JSON object on its own line.
+func formatJSON(t time.Time, level, msg string, fields Fields) ([]byte, error) {
+	object := map[string]interface{}{}
+	for k, v := range fields {
+		object[k] = value(v)
+	}
+	object["time"] = t.UTC().Format(time.RFC3339Nano)
+	object["level"] = level
+	object["msg"] = msg
+	line, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// formatText returns the given message followed by its fields as key=value,
+// sorted by key, values quoted if they're empty or contain spaces or quotes.
+func formatText(msg string, fields Fields) string {
+	keys := []string{}
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	line := msg
+	for _, k := range keys {
+		v := fmt.Sprint(value(fields[k]))
+		if v == "" || strings.ContainsAny(v, " \t\n\"") {
+			v = fmt.Sprintf("%q", v)
+		}
+		line += " " + k + "=" + v
+	}
+	return line
+}
+
+// value returns the given field value as it should be logged: errors by their
+// message and durations as e.g. 1.5s rather than by their structure or number
+// of nanoseconds.
+func value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	}
+	return v
+}
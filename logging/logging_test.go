@@ -0,0 +1,81 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFormatText(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      string
+		fields   Fields
+		expected string
+	}{
+		{
+			name:     "no fields",
+			msg:      "started",
+			expected: "started",
+		},
+		{
+			name:     "sorted fields",
+			msg:      "volume provisioned",
+			fields:   Fields{PVC: "claim-1", Namespace: "default", PV: "pvc-1", Duration: 1500 * time.Millisecond},
+			expected: "volume provisioned duration=1.5s namespace=default pv=pvc-1 pvc=claim-1",
+		},
+		{
+			name:     "quoted fields",
+			msg:      "volume not deleted",
+			fields:   Fields{PV: "", Err: errors.New("say \"hi\"")},
+			expected: `volume not deleted error="say \"hi\"" pv=""`,
+		},
+	}
+	for _, test := range tests {
+		if got := formatText(test.msg, test.fields); got != test.expected {
+			t.Errorf("test case: %s: expected %q, got %q", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestFormatJSON(t *testing.T) {
+	tm := time.Date(2016, 11, 1, 12, 0, 0, 0, time.UTC)
+	fields := Fields{PV: "pvc-1", Operation: "delete", Duration: 2 * time.Second, Err: errors.New("busy"), "msg": "overridden"}
+	expected := `{"duration":"2s","error":"busy","level":"error","msg":"volume not deleted","operation":"delete","pv":"pvc-1","time":"2016-11-01T12:00:00Z"}` + "\n"
+
+	got, err := formatJSON(tm, "error", "volume not deleted", fields)
+	if err != nil {
+		t.Fatalf("unexpected error formatting JSON: %v", err)
+	}
+	if string(got) != expected {
+		t.Errorf("expected %q, got %q", expected, string(got))
+	}
+}
+
+func TestSetFormat(t *testing.T) {
+	defer SetFormat(FormatText)
+	for _, f := range []string{FormatText, FormatJSON} {
+		if err := SetFormat(f); err != nil {
+			t.Errorf("unexpected error setting format %s: %v", f, err)
+		}
+	}
+	if err := SetFormat("xml"); err == nil {
+		t.Errorf("expected error setting format xml")
+	}
+}
@@ -17,16 +17,38 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"text/template"
 	"time"
 
+	"github.com/ghodss/yaml"
 	"github.com/golang/glog"
 	"github.com/wongma7/nfs-provisioner/controller"
+	"github.com/wongma7/nfs-provisioner/election"
+	"github.com/wongma7/nfs-provisioner/ganesha"
+	"github.com/wongma7/nfs-provisioner/logging"
+	"github.com/wongma7/nfs-provisioner/metrics"
 	"github.com/wongma7/nfs-provisioner/server"
+	"github.com/wongma7/nfs-provisioner/tracing"
+	"github.com/wongma7/nfs-provisioner/version"
 	vol "github.com/wongma7/nfs-provisioner/volume"
 	"k8s.io/client-go/1.4/kubernetes"
+	"k8s.io/client-go/1.4/kubernetes/fake"
 	"k8s.io/client-go/1.4/pkg/util/validation"
 	"k8s.io/client-go/1.4/pkg/util/validation/field"
 	"k8s.io/client-go/1.4/pkg/util/wait"
@@ -35,59 +57,1156 @@ import (
 )
 
 var (
-	provisioner = flag.String("provisioner", "matthew/nfs", "Name of the provisioner. The provisioner will only provision volumes for claims that request a StorageClass with a provisioner field set equal to this name.")
-	master      = flag.String("master", "", "Master URL to build a client config from. Either this or kubeconfig needs to be set if the provisioner is being run out of cluster.")
-	kubeconfig  = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file. Either this or master needs to be set if the provisioner is being run out of cluster.")
-	runServer   = flag.Bool("run-server", true, "If the provisioner is responsible for running the NFS server, i.e. starting and stopping NFS Ganesha. Default true.")
-	useGanesha  = flag.Bool("use-ganesha", true, "If the provisioner will create volumes using NFS Ganesha (D-Bus method calls) as opposed to using the kernel NFS server ('exportfs'). If run-server is true, this must be true. Default true.")
+	provisioner        = flag.String("provisioner", "matthew/nfs", "Name of the provisioner. The provisioner will only provision volumes for claims that request a StorageClass with a provisioner field set equal to this name.")
+	provisionerAliases = flag.String("provisioner-aliases", "", "Comma-separated list of other names of the provisioner, e.g. names it was deployed under in the past. The provisioner will also provision volumes for claims that request a StorageClass with a provisioner field set equal to one of these, and delete volumes provisioned under one of these. Default empty.")
+	classAnnotation    = flag.String("storage-class-annotation", "beta", "Which annotation claims request their StorageClass with: beta for volume.beta.kubernetes.io/storage-class, alpha for volume.alpha.kubernetes.io/storage-class, or both, in which case beta takes precedence. Provisioned PVs get the annotation their claim used. Default beta.")
+	annotationDomain   = flag.String("annotation-domain", "", "The domain, e.g. nfs.provisioner.kubernetes.io, the EXPORT_block and Export_Id annotations the provisioner puts on PVs are namespaced under, e.g. nfs.provisioner.kubernetes.io/EXPORT_block, instead of their legacy keys without one. On startup, the annotations of existing PVs are moved from their legacy keys, which are still read until they are. Changing the domain once it's set leaves PVs' annotations under the old one. Default empty, i.e. the legacy keys.")
+	master             = flag.String("master", "", "Master URL to build a client config from. If neither this nor kubeconfig is set and the provisioner isn't run in a cluster, the kubeconfig of the KUBECONFIG env or ~/.kube/config is used.")
+	kubeconfig         = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file. If neither this nor master is set and the provisioner isn't run in a cluster, the kubeconfig of the KUBECONFIG env or ~/.kube/config is used.")
+	stubExportsFile    = flag.String("stub-exports-file", "", "Path to a file the provisioner only records exports in, in the format of /etc/exports, instead of exporting them through an NFS server, e.g. to run it on a developer's machine against a remote cluster with kubeconfig to debug provisioning. PVs get the machine's address as their server unless server-hostname is set. use-ganesha and kernel-nfsv4-root are ignored. Requires run-server to be false. Default empty, i.e. export through the NFS server.")
+	runServer          = flag.Bool("run-server", true, "If the provisioner is responsible for running the NFS server, i.e. starting and stopping NFS Ganesha or, if use-ganesha is false, starting the kernel NFS server and its lock management. Default true.")
+	serverAsChildren   = flag.Bool("server-as-children", false, "If the provisioner will run the NFS server's processes, i.e. rpcbind, rpc.statd, dbus-daemon and NFS Ganesha, in the foreground as its own children instead of letting them daemonize, each started once the previous one is ready and all stopped when the provisioner stops, so that the container has a single process tree with the provisioner at its root. Only applies if run-server is true. Default false.")
+	useGanesha         = flag.Bool("use-ganesha", true, "If the provisioner will create volumes using NFS Ganesha (D-Bus method calls) as opposed to using the kernel NFS server ('exportfs'). Default true.")
+	additionalExporter = flag.Bool("additional-exporter", false, "If the provisioner will also export through the NFS server use-ganesha doesn't pick, i.e. the kernel NFS server if use-ganesha is true and NFS Ganesha otherwise, so that both are active in one deployment. Volumes are exported through the one a StorageClass's exporter parameter, ganesha or kernel, names, or else the one use-ganesha picks. run-server only runs the one use-ganesha picks, the other must already be running: the kernel NFS server of the node, or an NFS Ganesha reading its exports from vfs.conf in the export-dir and reachable at ganesha-dbus-address. Requires additional-exporter-server. Default false.")
+	additionalServer   = flag.String("additional-exporter-server", "", "The hostname or IP to put as the server of PVs exported through the additional exporter, i.e. of its NFS server, which serves on the standard ports. Only applies if additional-exporter is true. Default empty.")
+	useExportResource  = flag.Bool("use-export-resource", false, "If the provisioner will record every export it creates in an NfsExport ThirdPartyResource object in its namespace and use the objects instead of the state file in the export-dir and PV annotations as the source of truth for deleting exports. The namespace must be passed in via the POD_NAMESPACE env. Default false, i.e. the resource is opt-in and the state file and PV annotations stay the source of truth.")
+	exportDir          = flag.String("export-dir", "/export", "The directory the provisioner creates the directory of every PV in and exports, and keeps the NFS Ganesha config file, vfs.conf, in. Several provisioners, each with its own provisioner name, so that claims are routed to them by StorageClass, its own export-dir, which mustn't be inside another's, and its own range of exportIds, can export through the same NFS server, e.g. the kernel NFS server of a node or an NFS Ganesha run by one of them, which each adds its exports to over D-Bus from the vfs.conf in its own export-dir, so that NFS capacity scales horizontally. Default /export.")
+	minExportId        = flag.Int("min-export-id", 1, "The lowest exportId, i.e. Export_Id of NFS Ganesha exports and fsid of kernel exports, the provisioner assigns. Provisioners exporting through the same NFS server must have ranges that don't overlap. Default 1.")
+	maxExportId        = flag.Int("max-export-id", 65535, "The highest exportId the provisioner assigns. Default 65535.")
+	extraExportDirs    = flag.String("additional-export-dirs", "", "Comma-separated list of more directories, e.g. mounts of other disks, besides export-dir that the provisioner creates the directories of PVs in and exports, each of which mustn't be inside another or export-dir. The state file, directory pool and snapshots stay in export-dir, so only the directories of PVs in export-dir can be snapshotted. Can't be set with fsal-root. Default empty, i.e. only export-dir.")
+	placementPolicy    = flag.String("placement-policy", vol.PlacementMostFreeSpace, "How the provisioner picks which of export-dir and additional-export-dirs, among those with enough unreserved space, to create the directory of a PV in unless its StorageClass's exportDir parameter names one: most-free-space, the one with the most bytes both available and not reserved by other PVs; round-robin, each in turn; or class-pinned, export-dir. Default most-free-space.")
+	namespaceDirs      = flag.Bool("namespace-dirs", false, "If the provisioner will create the directory of each PV in a directory of its claim's namespace in the export directory it picks, e.g. /export/<namespace>/<pv name>, so that admins can apply per-tenant filesystem quotas, e.g. XFS project quotas, to the namespace's directory and browse data by tenant. Namespace directories are created as needed and kept once their PVs are deleted. Existing PVs' directories stay where they are. Default false.")
+	namespaceQuotas    = flag.String("namespace-quotas", "", "Path to a file, e.g. mounted from a ConfigMap, of the quota of each namespace: a YAML map of namespaces to the total capacity, e.g. 100Gi, of the PVs the provisioner provisions for their claims, with * for every namespace not listed. A claim that would push its namespace over its quota is refused with a NamespaceQuotaExceeded event. The file is read on every claim, so that edits of the ConfigMap apply without restarting, and checked when the provisioner starts. Default empty, i.e. no quotas.")
+	claimLabels        = flag.String("claim-labels", "", "Comma-separated list of the keys of the labels of claims to copy onto their PVs, e.g. team,cost-center,app, so that PVs can be attributed to and selected by tenant tooling. Labels the claim's selector requires win over copied ones. Default empty.")
+	claimAnnotations   = flag.String("claim-annotations", "", "Comma-separated list of the keys of the annotations of claims to copy onto their PVs. The provisioner's own annotations win over copied ones. Default empty.")
+	pvNameTemplate     = flag.String("pv-name-template", "", "Go template that the names of PVs, and so of their directories, are generated from instead of pvc-<claim UID>, so that listing the export directory is meaningful, e.g. {{.Namespace}}-{{.Name}}-{{.UID}}. The template is executed with the fields Namespace, Name and UID of the claim. Names are lowercased and characters PV names can't contain replaced with -, and names that don't contain the claim's UID get it as a suffix so that they're unique. Existing PVs keep their names. Default empty, i.e. pvc-<claim UID>.")
+	dryRun             = flag.Bool("dry-run", false, "If the provisioner will only validate claims, i.e. their StorageClass's parameters, capacity and the NFS server to put in their PVs, and log and report in a ProvisioningFailed event on the claim what provisioning them would do, without creating, deleting or updating any directory, export or PV, e.g. to test StorageClasses with a provisioner of its own name. On startup, exports aren't reconciled or imported. Requires run-server to be false. Default false.")
+	importExports      = flag.Bool("import-exports", false, "If the provisioner will, on startup, adopt the exports in its config file, i.e. the ganesha config or /etc/exports, that back existing PVs whose paths are in the export-dir, e.g. ones created by another instance or an older version of the provisioner: reserve their exportIds, record them and set the PVs' annotations to the ones it sets on the PVs it provisions, so that it manages them as its own. Default false.")
+	directoryPoolSize  = flag.Int("directory-pool-size", 0, "How many directories for each set of the directory parameters of StorageClasses, i.e. gid, permissions, owner and mode, the provisioner keeps set up ahead of claims in a .pool directory in the export-dir, so that creating a volume's directory is just a rename, cutting provisioning latency for bursty workloads. Directories of a set are only pooled once a claim has asked for it, except those of the default parameters. If set to 0, directories are created on demand. Default 0.")
+	snapshotBackend    = flag.String("snapshot-backend", "", "The filesystem export-dir is on whose snapshots PVs' directories can be snapshotted with, btrfs, in which case export-dir must be the root of a btrfs subvolume, or zfs, in which case it must be in a mounted ZFS dataset. A PV's snapshots are asked for with its nfs-provisioner.kubernetes.io/snapshots annotation and exported read-only. Default empty, i.e. no snapshots.")
+	serverHostname     = flag.String("server-hostname", "", "The hostname or IP to put as the server of provisioned PVs, e.g. a VIP or external load balancer in front of the provisioner, instead of the one discovered from the pod IP, service cluster IP or node name. Default empty, i.e. discover it.")
+	useServiceDNS      = flag.Bool("use-service-dns", false, "If the provisioner will put the DNS name of the service passed in via the SERVICE_NAME env, <service>.<namespace>.svc.cluster.local, as the server of provisioned PVs instead of the service's cluster IP, so that the PVs stay mountable if the service is re-created with a different IP. Default false.")
+	useLoadBalancer    = flag.Bool("use-load-balancer", false, "If the service passed in via the SERVICE_NAME env is of type LoadBalancer, whether the provisioner will wait for it to be assigned an ingress point and put the ingress IP or hostname as the server of provisioned PVs, so that clients outside the cluster network can mount them. Default false.")
+	servicePorts       = flag.String("service-ports", "", "Comma-separated list of ports, of the form <port>/<protocol>, the service passed in via the SERVICE_NAME env must have for the provisioner to use it. E.g. for NFSv4-only deployments, 2049/TCP. If set to empty, the ports aren't validated. Default <nfs-port>/TCP,<mount-port>/TCP,111/UDP,111/TCP.")
+	nfsPort            = flag.Int("nfs-port", vol.DefaultNFSPort, "The port the NFS server serves NFS on. If run-server is true, NFS Ganesha is configured to serve on it. If not the standard 2049, provisioned PVs get a mount option for it. Default 2049.")
+	mountPort          = flag.Int("mount-port", vol.DefaultMountPort, "The port the NFS server serves mountd on. If run-server is true, NFS Ganesha is configured to serve on it. If not the standard 20048, provisioned PVs get a mount option for it. Default 20048.")
+	minorVersions      = flag.String("nfs-minor-versions", "", "Comma-separated list of the NFSv4 minor versions the NFS server serves, e.g. 0,1 so that clients can use NFSv4.1 sessions. Only applies if run-server is true. Default empty, i.e. NFS Ganesha's default.")
+	enablePNFS         = flag.Bool("enable-pnfs", false, "If the NFS server acts as a pNFS metadata and data server, so that NFSv4.1 and later clients can use pNFS layouts. Only applies if run-server is true and requires one of nfs-minor-versions to be at least 1, if set. Default false.")
+	gracePeriod        = flag.Duration("grace-period", 0, "How long the NFSv4 grace period, during which clients reclaim their locks after the NFS server restarts, lasts. Only applies if run-server is true. The grace period is restarted once the provisioner has re-added any exports missing from the config file, so that clients can reclaim locks on all of them. Default 0, i.e. NFS Ganesha's default of 90s.")
+	superviseInterval  = flag.Duration("supervise-interval", 10*time.Second, "How often the provisioner checks that NFS Ganesha is running, restarting it and re-adding exports if it isn't, so that clients recover from a crash without admin intervention. Only applies if run-server is true. If set to 0, NFS Ganesha isn't supervised. Default 10s.")
+	ganeshaLogFile     = flag.String("ganesha-log-file", "/var/log/ganesha.log", "Where NFS Ganesha logs to: a file path, STDOUT, STDERR or SYSLOG. Only applies if run-server is true. Default /var/log/ganesha.log.")
+	ganeshaLogLevel    = flag.String("ganesha-log-level", "", "The level NFS Ganesha logs at, one of NULL, FATAL, MAJ, CRIT, WARN, EVENT, INFO, DEBUG, MID_DEBUG or FULL_DEBUG. If run-server is true, it's set in the config file so that it applies from startup. If use-ganesha is true, it's also set on the running NFS Ganesha using D-Bus, so that it applies to an NFS Ganesha the provisioner doesn't run as well. Default empty, i.e. NFS Ganesha's default of EVENT.")
+	ganeshaDBusAddress = flag.String("ganesha-dbus-address", "", "The D-Bus address of the bus NFS Ganesha is on, if it runs on another host than the provisioner, e.g. tcp:host=storage-1,port=5555, or unix:path=/run/ganesha-bus.sock for a socket forwarded from it over SSH. The export-dir's vfs.conf must be at the same path on that host, e.g. on shared storage, and so must the export-dir unless fsal-root is set. Only applies if use-ganesha is true and run-server is false. Default empty, i.e. the local system bus.")
+	cacheEntriesHWMark = flag.Int("cache-entries-hwmark", 0, "The number of entries NFS Ganesha tries to keep its metadata cache under, e.g. raised for exports with many files or lowered to save memory. Only applies if run-server is true. Default 0, i.e. NFS Ganesha's default of 100000.")
+	attrExpiration     = flag.Duration("cache-attr-expiration", 0, "How long NFS Ganesha caches the attributes of files before getting them from the filesystem again. Only applies if run-server is true. Default 0, i.e. NFS Ganesha's default of 60s.")
+	exportClients      = flag.String("export-clients", "", "Comma-separated list of client IPs, networks or hostnames exports are restricted to, unless a StorageClass's clients parameter or a claim's Clients annotation specifies others. Default empty, i.e. exports are restricted to the pod CIDRs of the cluster's nodes, listed at most once a minute, and service-cidr, unless allow-any-client is true. If no node has a pod CIDR, ganesha exports aren't restricted and kernel exports fail.")
+	serviceCIDR        = flag.String("service-cidr", "", "The cluster's service CIDR, e.g. 10.96.0.0/12, exports are restricted to along with the pod CIDRs of the cluster's nodes if export-clients is empty. Default empty, i.e. only the pod CIDRs.")
+	allowAnyClient     = flag.Bool("allow-any-client", false, "If exports aren't restricted to the pod CIDRs of the cluster's nodes and service-cidr if export-clients is empty, so that anybody who can reach the NFS server can mount them. Default false.")
+	kernelNFSv4Root    = flag.String("kernel-nfsv4-root", "", "If set, the directory, e.g. /nfs4root, the provisioner exports as the NFSv4 pseudo-root with fsid=0 so that kernel exports are NFSv4 only. Each PV's directory is bind-mounted under it at its own path and the bind mount is exported, so that PVs are mounted by the same path, with the nfsvers=4 mount option, and clients need to reach only the NFS port. Only applies if use-ganesha is false. Default empty, i.e. NFSv3 and NFSv4 exports.")
+	lockdPort          = flag.Int("lockd-port", 0, "The port the kernel lock manager, lockd, listens on for NFSv3 file locking. Only applies if run-server is true and use-ganesha is false. Default 0, i.e. a random port registered with rpcbind.")
+	statdPort          = flag.Int("statd-port", 0, "The port rpc.statd listens on. Only applies if run-server is true and use-ganesha is false. Default 0, i.e. a random port registered with rpcbind.")
+	statdOutgoingPort  = flag.Int("statd-outgoing-port", 0, "The port rpc.statd sends reboot notifications to clients from. Only applies if run-server is true and use-ganesha is false. Default 0, i.e. a random port.")
+	statdHostname      = flag.String("statd-hostname", "", "The hostname rpc.statd identifies the NFS server to clients by, e.g. the service's DNS name, so that clients recognize its reboot notifications and reclaim their locks after the pod is rescheduled. Only applies if run-server is true and use-ganesha is false. Default empty, i.e. the pod's hostname.")
+	nfsdThreads        = flag.Int("nfsd-threads", 0, "The number of threads the kernel's nfsd runs, e.g. raised for many concurrent clients. Only applies if run-server is true and use-ganesha is false. Default 0, i.e. rpc.nfsd's default of 8.")
+	exportBatchWindow  = flag.Duration("export-batch-window", 0, "How long the provisioner collects the kernel exports and unexports of volumes being provisioned and deleted after the first of them before syncing them all with a single exportfs -r, instead of running exportfs for each client of each, to improve throughput when many claims arrive together. Each provisioning then takes up to this much longer. exportfs -r also drops exports of this NFS server that aren't in /etc/exports or /etc/exports.d. Only applies if use-ganesha is false. If set to 0, exports aren't batched. Default 0.")
+	nfsdVersions       = flag.String("nfsd-versions", "", "Comma-separated list of the NFS versions the kernel NFS server serves, of 2, 3, 4, 4.1 and 4.2, e.g. 4,4.1,4.2 for NFSv4 only. Only applies if run-server is true and use-ganesha is false. Default empty, i.e. rpc.nfsd's default or, if kernel-nfsv4-root is set, 4, 4.1 and 4.2.")
+	krb5Keytab         = flag.String("krb5-keytab", "", "Path to a Kerberos keytab, e.g. mounted from a Secret, containing the nfs/<server> principal the NFS server accepts Kerberos-secured mounts with, for StorageClasses whose sec parameter is krb5, krb5i or krb5p. /etc/krb5.conf must be set up for the realm too. Only applies if run-server is true. Default empty, i.e. Kerberos isn't set up.")
+	unprivileged       = flag.Bool("unprivileged", false, "If the provisioner will avoid operations only root can do, so that the pod can run under a restrictive PodSecurityPolicy or SecurityContextConstraints: it grants a StorageClass's gid access to directories with ACLs, which the export directory's filesystem must support, instead of chgrp'ing them and, if run-server is true, it runs NFS Ganesha with only the capabilities it needs to serve files. Default false.")
+	watchConfig        = flag.Bool("watch-config", false, "If the provisioner will watch its config files, i.e. the ganesha config or /etc/exports and /etc/exports.d, with inotify and, whenever they're edited, re-add the exports of its PVs that went missing and warn, with an event on the PV, about entries of its PVs that were edited outside the provisioner, which it would fail to remove when their PVs are deleted, and about entries in the export-dir that are no PV's. Default false.")
+	verifyInterval     = flag.Duration("verify-exports-interval", time.Minute, "How often the provisioner checks that the export of every PV it provisioned is in its config file and served by the NFS server, with the kernel active with its options, as listed by exportfs -v, and with NFS Ganesha shown over D-Bus, re-adding and exporting it again and emitting an event on its PV if it isn't, e.g. because another agent ran exportfs or RemoveExport. If set to 0, exports aren't checked. Default 1m.")
+	useNodePort        = flag.Bool("use-node-port", false, "If the service passed in via the SERVICE_NAME env is of type NodePort, whether the provisioner will put the IP of its node, passed in via the NODE_NAME env, as the server of provisioned PVs and the service's node ports in their mount options, so that clients outside the pod network can mount them. Default false.")
+	resyncPeriod       = flag.Duration("resync-period", 15*time.Second, "How often the provisioner re-handles every claim and volume in its cache, e.g. to retry provisioning. Default 15s.")
+	fullResyncPeriod   = flag.Duration("full-resync-period", 5*time.Minute, "How often the provisioner re-lists every claim, volume and StorageClass from the API server and handles them again, so that claims and volumes whose watch events were missed, e.g. during API server hiccups, aren't left unprovisioned or undeleted forever. If set to 0, only the caches are resynced. Default 5m.")
+	unexportOnShutdown = flag.Bool("unexport-on-shutdown", false, "If the provisioner will unexport all of its exports when it receives SIGTERM or SIGINT, after letting running provision and delete operations finish. The exports stay in the config file and are re-exported when the provisioner restarts. If false, exports are left in place so that existing mounts survive restarts of the provisioner, as long as the NFS server keeps running. Default false.")
+	metricsAddress     = flag.String("metrics-address", "", "The address, e.g. :9090, on which the provisioner serves metrics in the Prometheus text format at /metrics, including NFS Ganesha's per-export I/O statistics labeled by PV and the provisioner's build as the nfs_provisioner_build_info metric, and the build as JSON at /version. Default empty, i.e. metrics aren't served.")
+	healthAddress      = flag.String("health-address", "", "The address, e.g. :8080, on which the provisioner serves a liveness probe at /healthz, which fails if NFS Ganesha isn't on D-Bus or the kernel NFS server isn't running or the export directory isn't writable, a readiness probe at /readyz, which also fails if the API server isn't reachable, and its build as JSON at /version. It can be the same as metrics-address. Default empty, i.e. probes aren't served.")
+	showVersion        = flag.Bool("version", false, "If the provisioner will only print its build, i.e. the git commit it was built from, its build date, Go version and the features it supports, and exit. Default false.")
+	driftInterval      = flag.Duration("drift-interval", 5*time.Minute, "How often the provisioner compares the exports NFS Ganesha or the kernel serves with the ones its PVs imply, serving the number of PVs whose exports are missing and of exports without PVs as the nfs_provisioner_export_drift metric and emitting an ExportDrift event on PVs whose exports have gone missing. If set to 0, drift isn't detected. Default 5m.")
+	usageInterval      = flag.Duration("usage-interval", 5*time.Minute, "How often the provisioner measures the bytes and inodes used by each PV's directory, served as metrics, along with each PV's capacity, labeled by PV, PVC and namespace. Measuring walks every directory, so it shouldn't be too frequent for volumes with many files. Only applies if metrics-address is set. If set to 0, usage isn't measured. Default 5m.")
+	exportTemplate     = flag.String("export-template", "", "Path to a file, e.g. mounted from a ConfigMap, containing a Go template that NFS Ganesha EXPORT blocks are created from instead of the default block, so that arbitrary ganesha directives can be added. The template is executed with the fields ExportId, Path, Pseudo, Squash and FilesystemId. Only applies if use-ganesha is true. Default empty, i.e. the default block.")
+	fsal               = flag.String("fsal", "VFS", "The NFS Ganesha FSAL exports use, of the form <name>[,<key>=<value>...], e.g. GLUSTER,Hostname=gluster.example.com,Volume=vol0 or CEPH, so that the provisioner can front other filesystems NFS Ganesha supports. The filesystem must be mounted at export-dir so that the provisioner can create directories in it. Only applies if use-ganesha is true. Default VFS.")
+	fsalRoot           = flag.String("fsal-root", "", "The path of export-dir in the filesystem of the FSAL, e.g. / if the root of a Gluster volume is mounted at export-dir, which exports' Path is relative to. Exports' Pseudo stays the path in export-dir, so clients must mount provisioned PVs with NFSv4. Only applies if use-ganesha is true. Default empty, i.e. the same path, as with VFS.")
+	auditLog           = flag.String("audit-log", "", "Path to a file, e.g. on a persistent volume, the provisioner appends a JSON line to for every export it adds, updates, removes or unexports, with the time, the action, the operation that did it, e.g. provision, delete or reconcile, and the export's PV, claim, path and block, e.g. to find out what removed an export. Default empty, i.e. no audit log.")
+	leaderElect        = flag.Bool("leader-elect", false, "If the provisioner will run as one of several replicas sharing the storage mounted at export-dir, of which only the leader, elected with a lease in the endpoints of the service passed in via the SERVICE_NAME env, runs the NFS server and provisions. The leader points the endpoints at its pod IP, passed in via the POD_IP env, so the service must have no selector. A standby takes over once the leader's lease expires, re-adding the exports of all PVs and starting the NFS server, so that existing mounts recover. Default false.")
+	leaseDuration      = flag.Duration("leader-elect-lease-duration", 15*time.Second, "How long a standby waits after last seeing the leader renew its lease before taking over, and how long the leader keeps serving without being able to renew it before it exits. Only applies if leader-elect is true. Default 15s.")
+	debugSocket        = flag.String("debug-socket", "", "Path to a unix socket, only accessible to the user the provisioner runs as, on which the provisioner serves its internal state as JSON at /debug/state, e.g. with curl --unix-socket <path> http://localhost/debug/state: the exports in the config file with the gids their directories are owned by, the exportIds in use and the next one, and the queued and running operations, for troubleshooting a live instance with kubectl exec. The exports subcommand prints the exports it serves. Default empty, i.e. the state isn't served.")
+	traceFile          = flag.String("trace-file", "", "Path to a file the provisioner appends a span to, as a Zipkin v2 JSON line, for every provision, delete and update operation and each of its stages, e.g. the API calls and creating the directory and exporting it over D-Bus or with exportfs, so that a log agent can send them to a Zipkin or Jaeger collector. Default empty, i.e. operations aren't traced.")
+	logFormat          = flag.String("log-format", "text", "The format the provisioner logs provision, delete and update operations in: text, through glog with fields like pv, pvc, namespace, operation and duration appended as key=value, or json, one JSON object per line on stderr with those fields and time, level and msg, so that cluster log pipelines can index them. Other messages are logged through glog as text either way. Default text.")
+	workerThreads      = flag.Int("worker-threads", 4, "The number of provision, delete and update operations the provisioner will run in parallel. Default 4.")
+	configFile         = flag.String("config-file", "", "Path to a YAML file of flag values by flag name, e.g. export-clients: 10.0.0.0/8, for the flags that aren't set on the command line, which takes precedence. The file is read again every config-reload-interval and changes to export-clients, service-cidr, allow-any-client, server-hostname and use-service-dns are applied without restarting, to volumes provisioned from then on; changes to other flags need a restart. Default empty, i.e. only the command line.")
+	configReload       = flag.Duration("config-reload-interval", 30*time.Second, "How often the provisioner reads config-file again for changes. Only applies if config-file is set. If set to 0, it's only read on startup. Default 30s.")
+	benchmarkVolumes   = flag.Int("benchmark-volumes", 100, "The number of volumes the benchmark subcommand provisions and deletes. Only applies to the benchmark subcommand. Default 100.")
+	benchmarkParallel  = flag.Int("benchmark-concurrency", 10, "The number of volumes the benchmark subcommand provisions and deletes at a time. Only applies to the benchmark subcommand. Default 10.")
+	fsckRepair         = flag.Bool("fsck-repair", false, "If the fsck subcommand will repair the discrepancies it finds that it can: re-add exports missing from the config file, export again exports the NFS server doesn't serve and remove exports without PVs. Only applies to the fsck subcommand. Default false, i.e. discrepancies are only reported.")
 )
 
-const ganeshaConfig = "/export/vfs.conf"
-
 func main() {
 	flag.Set("logtostderr", "true")
-	flag.Parse()
+	subcommand, exportsCommand, args := parseSubcommand(os.Args[1:])
+	benchmark := subcommand == subcommandBenchmark
+	fsck := subcommand == subcommandFsck
+	flag.CommandLine.Parse(args)
+
+	if *showVersion {
+		fmt.Println(version.Get())
+		return
+	}
+
+	// Flags set on the command line take precedence over the config file
+	cmdline := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		cmdline[f.Name] = true
+	})
+	base := map[string]string{}
+	for _, name := range reloadableFlags {
+		base[name] = flag.Lookup(name).Value.String()
+	}
+	var configValues map[string]string
+	if *configFile != "" {
+		values, err := readConfigFile(*configFile)
+		if err != nil {
+			glog.Fatalf("Invalid config-file specified: %v", err)
+		}
+		if err := applyConfigFile(values, cmdline); err != nil {
+			glog.Fatalf("Invalid config-file specified: %v", err)
+		}
+		configValues = values
+	}
+	if *configReload < 0 {
+		glog.Fatalf("Invalid config-reload-interval specified: must not be negative")
+	}
+
+	if subcommand == subcommandExports {
+		if err := printExports(os.Stdout, *debugSocket, exportsCommand, flag.Args()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := logging.SetFormat(*logFormat); err != nil {
+		glog.Fatalf("Invalid log-format specified: %v", err)
+	}
+	if err := tracing.SetOutput(*traceFile); err != nil {
+		glog.Fatalf("Invalid trace-file specified: %v", err)
+	}
 
 	if errs := validateProvisioner(*provisioner, field.NewPath("provisioner")); len(errs) != 0 {
 		glog.Errorf("Invalid provisioner specified: %v", errs)
 		os.Exit(1)
 	}
+	glog.Infof("Running %v", version.Get())
 	glog.Infof("Provisioner %s specified", *provisioner)
 
-	if *runServer && !*useGanesha {
-		glog.Errorf("Invalid flags specified: if run-server is true, use-ganesha must also be true.")
+	aliases := []string{}
+	for _, alias := range strings.Split(*provisionerAliases, ",") {
+		if alias = strings.TrimSpace(alias); alias == "" {
+			continue
+		}
+		if errs := validateProvisioner(alias, field.NewPath("provisioner-aliases")); len(errs) != 0 {
+			glog.Errorf("Invalid provisioner alias specified: %v", errs)
+			os.Exit(1)
+		}
+		aliases = append(aliases, alias)
+	}
+	if len(aliases) != 0 {
+		glog.Infof("Provisioner aliases %v specified", aliases)
+	}
+
+	classAnnotations, err := controller.ParseClassAnnotations(*classAnnotation)
+	if err != nil {
+		glog.Errorf("Invalid storage-class-annotation specified: %v", err)
+		os.Exit(1)
+	}
+
+	*annotationDomain = strings.TrimSuffix(*annotationDomain, "/")
+	if *annotationDomain != "" {
+		if msgs := validation.IsDNS1123Subdomain(*annotationDomain); len(msgs) != 0 {
+			glog.Errorf("Invalid annotation-domain specified: %s", strings.Join(msgs, ", "))
+			os.Exit(1)
+		}
+	}
+
+	// Unless service-ports is explicitly set, even to empty, expect the
+	// service to have the ports the NFS server serves on
+	servicePortsSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "service-ports" {
+			servicePortsSet = true
+		}
+	})
+	if !servicePortsSet {
+		*servicePorts = fmt.Sprintf("%d/TCP,%d/TCP,111/UDP,111/TCP", *nfsPort, *mountPort)
+		if !*useGanesha && *kernelNFSv4Root != "" {
+			// NFSv4 needs neither mountd nor rpcbind
+			*servicePorts = fmt.Sprintf("%d/TCP", *nfsPort)
+		}
+	}
+	ports, err := vol.ParseServicePorts(*servicePorts)
+	if err != nil {
+		glog.Errorf("Invalid service-ports specified: %v", err)
+		os.Exit(1)
+	}
+
+	if *resyncPeriod <= 0 {
+		glog.Errorf("Invalid resync-period specified: must be positive")
+		os.Exit(1)
+	}
+	if *fullResyncPeriod < 0 {
+		glog.Errorf("Invalid full-resync-period specified: must not be negative")
+		os.Exit(1)
+	}
+
+	if *workerThreads < 1 {
+		glog.Errorf("Invalid worker-threads specified: must be at least 1")
+		os.Exit(1)
+	}
+
+	versions, err := server.ParseMinorVersions(*minorVersions)
+	if err != nil {
+		glog.Errorf("Invalid nfs-minor-versions specified: %v", err)
+		os.Exit(1)
+	}
+	if *enablePNFS && len(versions) != 0 && !hasPNFSMinorVersion(versions) {
+		glog.Errorf("Invalid flags specified: if enable-pnfs is true, nfs-minor-versions must include 1 or 2, which pNFS requires.")
+		os.Exit(1)
+	}
+
+	if *exportBatchWindow < 0 {
+		glog.Errorf("Invalid export-batch-window specified: must not be negative")
+		os.Exit(1)
+	}
+
+	if *superviseInterval < 0 {
+		glog.Errorf("Invalid supervise-interval specified: must not be negative")
+		os.Exit(1)
+	}
+
+	if *gracePeriod < 0 {
+		glog.Errorf("Invalid grace-period specified: must not be negative")
+		os.Exit(1)
+	}
+
+	var tmpl *template.Template
+	if *exportTemplate != "" {
+		if !*useGanesha && !*additionalExporter {
+			glog.Errorf("Invalid flags specified: export-template only applies if use-ganesha or additional-exporter is true.")
+			os.Exit(1)
+		}
+		tmpl, err = vol.ParseExportTemplate(*exportTemplate)
+		if err != nil {
+			glog.Errorf("Invalid export-template specified: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if *namespaceQuotas != "" {
+		data, err := ioutil.ReadFile(*namespaceQuotas)
+		if err != nil {
+			glog.Errorf("Invalid namespace-quotas specified: %v", err)
+			os.Exit(1)
+		}
+		if _, err := vol.ParseNamespaceQuotas(data); err != nil {
+			glog.Errorf("Invalid namespace-quotas specified: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	var nameTmpl *template.Template
+	if *pvNameTemplate != "" {
+		nameTmpl, err = vol.ParsePVNameTemplate(*pvNameTemplate)
+		if err != nil {
+			glog.Errorf("Invalid pv-name-template specified: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	labelKeys, err := vol.ParseClaimKeys(*claimLabels)
+	if err != nil {
+		glog.Errorf("Invalid claim-labels specified: %v", err)
+		os.Exit(1)
+	}
+	annotationKeys, err := vol.ParseClaimKeys(*claimAnnotations)
+	if err != nil {
+		glog.Errorf("Invalid claim-annotations specified: %v", err)
+		os.Exit(1)
+	}
+
+	fsalBlock, err := vol.ParseFSAL(*fsal)
+	if err != nil {
+		glog.Errorf("Invalid fsal specified: %v", err)
+		os.Exit(1)
+	}
+	if *fsalRoot != "" && !strings.HasPrefix(*fsalRoot, "/") {
+		glog.Errorf("Invalid fsal-root specified: must be an absolute path")
+		os.Exit(1)
+	}
+
+	if *cacheEntriesHWMark < 0 {
+		glog.Errorf("Invalid cache-entries-hwmark specified: must not be negative")
+		os.Exit(1)
+	}
+	if *attrExpiration < 0 {
+		glog.Errorf("Invalid cache-attr-expiration specified: must not be negative")
+		os.Exit(1)
+	}
+
+	logLevel, err := server.ParseLogLevel(*ganeshaLogLevel)
+	if err != nil {
+		glog.Errorf("Invalid ganesha-log-level specified: %v", err)
+		os.Exit(1)
+	}
+	if *ganeshaDBusAddress != "" {
+		if !(*useGanesha || *additionalExporter) || (*useGanesha && *runServer) {
+			glog.Errorf("Invalid ganesha-dbus-address specified: only applies if NFS Ganesha is exported through, i.e. use-ganesha or additional-exporter is true, and run-server doesn't run it")
+			os.Exit(1)
+		}
+		ganesha.SetBusAddress(*ganeshaDBusAddress)
+	}
+
+	clients := vol.SplitClients(*exportClients)
+	if err := vol.ValidateClients(clients); err != nil {
+		glog.Errorf("Invalid export-clients specified: %v", err)
+		os.Exit(1)
+	}
+	if *serviceCIDR != "" {
+		if _, _, err := net.ParseCIDR(*serviceCIDR); err != nil {
+			glog.Errorf("Invalid service-cidr specified: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	dir := strings.TrimSuffix(*exportDir, "/")
+	if !strings.HasPrefix(dir, "/") {
+		glog.Errorf("Invalid export-dir specified: must be an absolute path other than /")
+		os.Exit(1)
+	}
+	// Each provisioner keeps its ganesha config in its own export-dir, so that
+	// provisioners exporting through the same NFS Ganesha don't share one
+	ganeshaConfig := dir + "/vfs.conf"
+	extraDirs := []string{}
+	for _, extra := range strings.Split(*extraExportDirs, ",") {
+		extra = strings.TrimSuffix(strings.TrimSpace(extra), "/")
+		if extra == "" {
+			continue
+		}
+		if !strings.HasPrefix(extra, "/") {
+			glog.Errorf("Invalid additional-export-dirs specified: %q must be an absolute path other than /", extra)
+			os.Exit(1)
+		}
+		for _, other := range append([]string{dir}, extraDirs...) {
+			if extra == other || strings.HasPrefix(extra, other+"/") || strings.HasPrefix(other, extra+"/") {
+				glog.Errorf("Invalid additional-export-dirs specified: %s and %s mustn't be the same or inside one another", extra, other)
+				os.Exit(1)
+			}
+		}
+		extraDirs = append(extraDirs, extra)
+	}
+	if len(extraDirs) != 0 && *fsalRoot != "" {
+		glog.Errorf("Invalid additional-export-dirs specified: can't be set with fsal-root, which is only the path of export-dir")
+		os.Exit(1)
+	}
+	if err := vol.ParsePlacementPolicy(*placementPolicy); err != nil {
+		glog.Errorf("Invalid placement-policy specified: %v", err)
+		os.Exit(1)
+	}
+	if *minExportId < 1 || *maxExportId > 65535 || *minExportId > *maxExportId {
+		glog.Errorf("Invalid min-export-id and max-export-id specified: must be between 1 and 65535, min-export-id no greater than max-export-id")
+		os.Exit(1)
+	}
+	if *directoryPoolSize < 0 {
+		glog.Errorf("Invalid directory-pool-size specified: must not be negative")
+		os.Exit(1)
+	}
+	if err := vol.ParseSnapshotBackend(*snapshotBackend); err != nil {
+		glog.Errorf("Invalid snapshot-backend specified: %v", err)
+		os.Exit(1)
+	}
+
+	if root := strings.TrimSuffix(*kernelNFSv4Root, "/"); *kernelNFSv4Root != "" {
+		for _, d := range append([]string{dir}, extraDirs...) {
+			if !strings.HasPrefix(root, "/") || root == d || strings.HasPrefix(root, d+"/") {
+				glog.Errorf("Invalid kernel-nfsv4-root specified: must be an absolute path other than / and outside export-dir and additional-export-dirs, e.g. %s", d)
+				os.Exit(1)
+			}
+		}
+	}
+
+	for name, port := range map[string]int{"lockd-port": *lockdPort, "statd-port": *statdPort, "statd-outgoing-port": *statdOutgoingPort} {
+		if port < 0 || port > 65535 {
+			glog.Errorf("Invalid %s specified: must be between 0 and 65535", name)
+			os.Exit(1)
+		}
+	}
+
+	if *nfsdThreads < 0 {
+		glog.Errorf("Invalid nfsd-threads specified: must not be negative")
+		os.Exit(1)
+	}
+	kernelVersions, err := server.ParseKernelVersions(*nfsdVersions)
+	if err != nil {
+		glog.Errorf("Invalid nfsd-versions specified: %v", err)
+		os.Exit(1)
+	}
+	if len(kernelVersions) == 0 && *kernelNFSv4Root != "" {
+		kernelVersions = []string{"4", "4.1", "4.2"}
+	}
+
+	if *krb5Keytab != "" && !strings.HasPrefix(*krb5Keytab, "/") {
+		glog.Errorf("Invalid krb5-keytab specified: must be an absolute path")
+		os.Exit(1)
+	}
+
+	if *leaderElect && *leaseDuration <= 0 {
+		glog.Errorf("Invalid leader-elect-lease-duration specified: must be positive")
+		os.Exit(1)
+	}
+
+	if *additionalExporter && *additionalServer == "" {
+		glog.Errorf("Invalid additional-exporter specified: requires additional-exporter-server")
+		os.Exit(1)
+	}
+
+	if *stubExportsFile != "" && *runServer {
+		glog.Errorf("Invalid stub-exports-file specified: requires run-server to be false")
 		os.Exit(1)
 	}
 
-	if *runServer {
+	if *dryRun && (*runServer || benchmark) {
+		glog.Errorf("Invalid dry-run specified: requires run-server to be false and can't be used in benchmark mode")
+		os.Exit(1)
+	}
+
+	if fsck && (*runServer || *leaderElect) {
+		glog.Errorf("Invalid flags specified: fsck requires run-server and leader-elect to be false, it checks the exports of a provisioner that's already running")
+		os.Exit(1)
+	}
+
+	if benchmark {
+		if *benchmarkVolumes < 1 || *benchmarkParallel < 1 {
+			glog.Errorf("Invalid benchmark-volumes and benchmark-concurrency specified: must be at least 1")
+			os.Exit(1)
+		}
+		if *leaderElect || *useExportResource {
+			glog.Errorf("Invalid flags specified: leader-elect and use-export-resource need an API server, which the benchmark doesn't use.")
+			os.Exit(1)
+		}
+		// Without the PVs of the export-dir, the provisioner would remove
+		// their exports as stale
+		if err := checkEmptyDir(dir); err != nil {
+			glog.Errorf("Invalid export-dir specified: the benchmark must be run in an empty directory: %v", err)
+			os.Exit(1)
+		}
+		if *serverHostname == "" {
+			*serverHostname = "localhost"
+		}
+		if len(clients) == 0 && !*allowAnyClient {
+			clients = []string{"127.0.0.1"}
+		}
+	}
+
+	var config *rest.Config
+	var clientset kubernetes.Interface
+	if benchmark {
+		clientset = fake.NewSimpleClientset()
+	} else {
+		if *master != "" || *kubeconfig != "" {
+			config, err = clientcmd.BuildConfigFromFlags(*master, *kubeconfig)
+		} else if config, err = rest.InClusterConfig(); err != nil {
+			// Out of cluster, e.g. on a developer's machine, fall back to
+			// the kubeconfig kubectl would use
+			glog.Infof("Not running in a cluster (%v), using the kubeconfig of the %s env or %s", err, clientcmd.RecommendedConfigPathEnvVar, clientcmd.RecommendedHomeFile)
+			config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{}).ClientConfig()
+		}
+		if err != nil {
+			glog.Fatalf("Failed to create config: %v", err)
+		}
+		clientset, err = kubernetes.NewForConfig(config)
+		if err != nil {
+			glog.Fatalf("Failed to create client: %v", err)
+		}
+	}
+
+	// Stop gracefully on SIGTERM, e.g. when the pod is deleted, or SIGINT
+	stopCh := make(chan struct{})
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigCh
+		glog.Infof("Received signal %v, shutting down", sig)
+		close(stopCh)
+	}()
+
+	// Wait to become the leader before serving NFS, a standby takes over the
+	// exports, which are on the shared storage, and the service's endpoints
+	// once the leader's lease expires
+	var elector *election.Elector
+	if *leaderElect {
+		elector, err = newElector(clientset, *leaseDuration)
+		if err != nil {
+			glog.Fatalf("Error setting up leader election: %v", err)
+		}
+		glog.Infof("Waiting to acquire leader lease")
+		retryPeriod := *leaseDuration / 5
+		if !elector.Acquire(retryPeriod, stopCh) {
+			return
+		}
+		go elector.Renew(retryPeriod, func() {
+			glog.Fatalf("Failed to renew leader lease, exiting so that the new leader can serve")
+		}, stopCh)
+	}
+
+	if *runServer && *useGanesha {
 		// Start the NFS server
 		glog.Infof("Starting NFS server!")
-		err := server.Start(ganeshaConfig)
+		err := server.Start(ganeshaConfig, *nfsPort, *mountPort, versions, *enablePNFS, *gracePeriod, *ganeshaLogFile, logLevel, *cacheEntriesHWMark, *attrExpiration, *krb5Keytab, *unprivileged, *serverAsChildren)
 		if err != nil {
 			glog.Fatalf("Error starting NFS server: %v", err)
 		}
+	} else if *runServer {
+		glog.Infof("Starting kernel NFS server!")
+		err := server.StartKernel(*nfsPort, *mountPort, *lockdPort, *statdPort, *statdOutgoingPort, *statdHostname, *nfsdThreads, kernelVersions, *krb5Keytab)
+		if err != nil {
+			glog.Fatalf("Error starting kernel NFS server: %v", err)
+		}
 	}
 
-	var config *rest.Config
-	var err error
-	if *master != "" || *kubeconfig != "" {
-		config, err = clientcmd.BuildConfigFromFlags(*master, *kubeconfig)
-	} else {
-		config, err = rest.InClusterConfig()
+	if *useGanesha && logLevel != "" {
+		if err := server.SetLogLevel(logLevel); err != nil {
+			glog.Errorf("Error setting NFS Ganesha log level: %v", err)
+		}
+	}
+
+	var exportStore vol.ExportStore
+	if *useExportResource {
+		exportStore, err = vol.NewExportStore(config, clientset)
+		if err != nil {
+			glog.Fatalf("Failed to create export store: %v", err)
+		}
+	}
+
+	additionalDirs := []string{}
+	for _, extra := range extraDirs {
+		additionalDirs = append(additionalDirs, extra+"/")
+	}
+
+	// Fail fast on what would otherwise fail the first claim. A dry run and
+	// stub exports don't need the NFS server, the benchmark no API server
+	var checkClient kubernetes.Interface
+	if !benchmark {
+		checkClient = clientset
+	}
+	exporters := []string{vol.ExporterKernel}
+	if *useGanesha {
+		exporters = []string{vol.ExporterGanesha}
+	}
+	if *additionalExporter && *useGanesha {
+		exporters = append(exporters, vol.ExporterKernel)
+	} else if *additionalExporter {
+		exporters = append(exporters, vol.ExporterGanesha)
+	}
+	if errs := vol.CheckEnvironment(append([]string{dir + "/"}, additionalDirs...), exporters, !*dryRun && *stubExportsFile == "", checkClient); len(errs) != 0 {
+		for _, err := range errs {
+			glog.Errorf("Startup check failed: %v", err)
+		}
+		glog.Fatalf("%d startup checks failed, see above for how to fix them", len(errs))
+	}
+	nfsProvisioner := vol.NewNFSProvisioner(clientset, vol.Options{
+		ExportDir:     dir + "/",
+		UseGanesha:    *useGanesha,
+		GaneshaConfig: ganeshaConfig,
+		ExportStore:   exportStore,
+		Settings: vol.Settings{
+			ExportClients:  clients,
+			ServiceCIDR:    *serviceCIDR,
+			AllowAnyClient: *allowAnyClient,
+			ServerHostname: *serverHostname,
+			UseServiceDNS:  *useServiceDNS,
+		},
+		UseLoadBalancer:      *useLoadBalancer,
+		ServicePorts:         ports,
+		NFSPort:              *nfsPort,
+		MountPort:            *mountPort,
+		UseNodePort:          *useNodePort,
+		ExportTemplate:       tmpl,
+		FSAL:                 fsalBlock,
+		FSALRoot:             *fsalRoot,
+		NFSv4Root:            *kernelNFSv4Root,
+		Unprivileged:         *unprivileged,
+		AuditLog:             *auditLog,
+		MinExportId:          uint16(*minExportId),
+		MaxExportId:          uint16(*maxExportId),
+		ImportExports:        *importExports,
+		ExportBatchWindow:    *exportBatchWindow,
+		DirectoryPoolSize:    *directoryPoolSize,
+		SnapshotBackend:      *snapshotBackend,
+		AdditionalExportDirs: additionalDirs,
+		PlacementPolicy:      *placementPolicy,
+		DryRun:               *dryRun || fsck,
+		StubExportsFile:      *stubExportsFile,
+		AnnotationDomain:     *annotationDomain,
+		AdditionalExporter:   *additionalExporter,
+		AdditionalServer:     *additionalServer,
+		NamespaceDirs:        *namespaceDirs,
+		NamespaceQuotas:      *namespaceQuotas,
+		ClaimLabels:          labelKeys,
+		ClaimAnnotations:     annotationKeys,
+		PVNameTemplate:       nameTmpl,
+	})
+
+	if *runServer && *useGanesha {
+		// The provisioner has re-added any missing exports, restart the grace
+		// period so that clients can reclaim their locks on them too
+		if err := server.StartGrace(); err != nil {
+			glog.Errorf("Error restarting NFSv4 grace period: %v", err)
+		}
+	}
+
+	if benchmark {
+		report := vol.Benchmark(nfsProvisioner, clientset, *benchmarkVolumes, *benchmarkParallel)
+		report.Print(os.Stdout)
+		if *runServer && *useGanesha {
+			if err := server.Stop(); err != nil {
+				glog.Errorf("Error stopping NFS server: %v", err)
+			}
+		}
+		if report.Failed != 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if fsck {
+		// The provisioner was created as a dry run so that it didn't
+		// reconcile on startup, the check does it instead
+		checker, ok := nfsProvisioner.(vol.ConsistencyChecker)
+		if !ok {
+			glog.Fatalf("Provisioner can't check its consistency")
+		}
+		report, err := checker.CheckConsistency(*fsckRepair)
+		if err != nil {
+			glog.Fatalf("Error checking consistency: %v", err)
+		}
+		report.Print(os.Stdout)
+		if report.Unrepaired() != 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Serve metrics and probes on the same mux if they're on the same address
+	muxes := map[string]*http.ServeMux{}
+	getMux := func(address string) *http.ServeMux {
+		if _, ok := muxes[address]; !ok {
+			muxes[address] = http.NewServeMux()
+		}
+		return muxes[address]
+	}
+
+	if *metricsAddress != "" {
+		if collector, ok := nfsProvisioner.(metrics.Collector); ok {
+			metrics.Register(collector)
+		}
+		if updater, ok := nfsProvisioner.(vol.UsageUpdater); ok && *usageInterval > 0 {
+			go wait.Until(func() {
+				if err := updater.UpdateUsage(); err != nil {
+					glog.Errorf("Error measuring usage of PVs: %v", err)
+				}
+			}, *usageInterval, stopCh)
+		}
+		metrics.Register(version.Collector{})
+		mux := getMux(*metricsAddress)
+		mux.Handle("/metrics", metrics.Handler())
+		mux.Handle("/version", version.Handler())
+	}
+
+	if *healthAddress != "" {
+		if checker, ok := nfsProvisioner.(vol.HealthChecker); ok {
+			mux := getMux(*healthAddress)
+			mux.Handle("/healthz", healthHandler(checker.CheckLive))
+			mux.Handle("/readyz", healthHandler(checker.CheckReady))
+			if *healthAddress != *metricsAddress {
+				mux.Handle("/version", version.Handler())
+			}
+		}
+	}
+
+	for address, mux := range muxes {
+		go func(address string, mux *http.ServeMux) {
+			glog.Fatalf("Error serving HTTP on %s: %v", address, http.ListenAndServe(address, mux))
+		}(address, mux)
+	}
+
+	if *driftInterval > 0 {
+		if detector, ok := nfsProvisioner.(vol.DriftDetector); ok {
+			go wait.Until(func() {
+				if err := detector.DetectDrift(); err != nil {
+					glog.Errorf("Error detecting export drift: %v", err)
+				}
+			}, *driftInterval, stopCh)
+		}
+	}
+
+	if *runServer && *useGanesha && *superviseInterval > 0 {
+		// Restart the NFS server if it dies. It re-exports the exports in its
+		// config file by itself, re-add any that went missing
+		go server.Supervise(ganeshaConfig, *ganeshaLogFile, *superviseInterval, func() {
+			if reexporter, ok := nfsProvisioner.(vol.Reexporter); ok {
+				if err := reexporter.ReexportMissing(); err != nil {
+					glog.Errorf("Error re-exporting exports after restarting NFS server: %v", err)
+				}
+			}
+		}, stopCh)
 	}
+
+	// A dry run must leave the exports as they are
+	if *watchConfig && !*dryRun {
+		if watcher, ok := nfsProvisioner.(vol.ConfigWatcher); ok {
+			go func() {
+				if err := watcher.WatchConfig(stopCh); err != nil {
+					glog.Errorf("Error watching config files, edits made outside the provisioner won't be noticed until the exports are verified: %v", err)
+				}
+			}()
+		}
+	}
+
+	if *configFile != "" && *configReload > 0 {
+		if reconfigurer, ok := nfsProvisioner.(vol.Reconfigurer); ok {
+			go reloadConfigFile(*configFile, configValues, base, cmdline, reconfigurer, *configReload, stopCh)
+		}
+	}
+
+	if *verifyInterval > 0 && !*dryRun {
+		if verifier, ok := nfsProvisioner.(vol.ExportVerifier); ok {
+			go wait.Until(func() {
+				if err := verifier.VerifyExports(); err != nil {
+					glog.Errorf("Error verifying exports: %v", err)
+				}
+			}, *verifyInterval, stopCh)
+		}
+	}
+
+	// Start the provision controller which will dynamically provision NFS PVs
+	pc := controller.NewProvisionController(clientset, *resyncPeriod, *fullResyncPeriod, *provisioner, aliases, classAnnotations, nfsProvisioner, *workerThreads)
+	if *debugSocket != "" {
+		if dumper, ok := nfsProvisioner.(vol.StateDumper); ok {
+			go serveDebug(*debugSocket, dumper, pc)
+		}
+	}
+	pc.Run(stopCh)
+
+	if *unexportOnShutdown && !*dryRun {
+		if unexporter, ok := nfsProvisioner.(vol.Unexporter); ok {
+			glog.Infof("Unexporting all exports")
+			if err := unexporter.UnexportAll(); err != nil {
+				glog.Errorf("Error unexporting exports: %v", err)
+			}
+		}
+	}
+
+	if *runServer && *useGanesha {
+		glog.Infof("Stopping NFS server")
+		if err := server.Stop(); err != nil {
+			glog.Errorf("Error stopping NFS server: %v", err)
+		}
+	}
+
+	if elector != nil {
+		glog.Infof("Releasing leader lease")
+		if err := elector.Release(); err != nil {
+			glog.Errorf("Error releasing leader lease: %v", err)
+		}
+	}
+}
+
+// checkEmptyDir creates the given directory if it doesn't exist and returns an
+// error if it has any entries.
+func checkEmptyDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.Open(dir)
 	if err != nil {
-		glog.Fatalf("Failed to create config: %v", err)
+		return err
 	}
-	clientset, err := kubernetes.NewForConfig(config)
+	defer f.Close()
+	if names, _ := f.Readdirnames(1); len(names) != 0 {
+		return fmt.Errorf("%s isn't empty", dir)
+	}
+	return nil
+}
+
+// newElector returns an elector of this pod, by its hostname, for the lease in
+// the endpoints of the service passed in via the SERVICE_NAME env, which it
+// points at the pod IP passed in via the POD_IP env and the service's ports.
+func newElector(client kubernetes.Interface, leaseDuration time.Duration) (*election.Elector, error) {
+	serviceName, namespace, podIP := os.Getenv("SERVICE_NAME"), os.Getenv("POD_NAMESPACE"), os.Getenv("POD_IP")
+	if serviceName == "" || namespace == "" || podIP == "" {
+		return nil, fmt.Errorf("the SERVICE_NAME, POD_NAMESPACE and POD_IP env must be set")
+	}
+	service, err := client.Core().Services(namespace).Get(serviceName)
 	if err != nil {
-		glog.Fatalf("Failed to create client: %v", err)
+		return nil, fmt.Errorf("error getting service %s/%s: %v", namespace, serviceName, err)
+	}
+	if len(service.Spec.Selector) != 0 {
+		return nil, fmt.Errorf("service %s/%s must have no selector, so that only the leader is its endpoint", namespace, serviceName)
 	}
+	identity, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("error getting hostname: %v", err)
+	}
+	return election.NewElector(client, namespace, serviceName, identity, leaseDuration, podIP, election.EndpointPorts(service)), nil
+}
 
-	nfsProvisioner := vol.NewNFSProvisioner("/export/", clientset, *useGanesha, ganeshaConfig)
+// serveDebug serves the provisioner's state and the controller's queued and
+// running operations as JSON at /debug/state on a unix socket at the given
+// path, which only the user the provisioner runs as can connect to.
+func serveDebug(path string, dumper vol.StateDumper, pc *controller.ProvisionController) {
+	os.Remove(path)
+	// Create the socket accessible to only the user from the start
+	umask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		glog.Errorf("Error listening on debug socket %s: %v", path, err)
+		return
+	}
 
-	// Start the provision controller which will dynamically provision NFS PVs
-	pc := controller.NewProvisionController(clientset, 15*time.Second, *provisioner, nfsProvisioner)
-	pc.Run(wait.NeverStop)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/state", func(w http.ResponseWriter, r *http.Request) {
+		state, err := dumper.DumpState()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		queued, running := pc.Operations()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			*vol.State
+			QueuedOperations  []string `json:"queuedOperations"`
+			RunningOperations []string `json:"runningOperations"`
+		}{state, queued, running})
+	})
+	glog.Errorf("Error serving debug socket %s: %v", path, http.Serve(listener, mux))
+}
+
+const (
+	// nfs-provisioner benchmark [flags] provisions and deletes volumes against
+	// the NFS server with an in-memory API server instead, reporting their
+	// throughput and latency
+	subcommandBenchmark = "benchmark"
+	// nfs-provisioner fsck [flags] cross-checks the PVs, directories and
+	// exports of the provisioner deployed with the same flags instead,
+	// reporting and optionally repairing discrepancies
+	subcommandFsck = "fsck"
+	// nfs-provisioner exports list|describe [flags] [pv] prints the exports of
+	// the provisioner serving its state on debug-socket instead
+	subcommandExports = "exports"
+)
+
+// parseSubcommand splits the given arguments, those after the program name,
+// into the subcommand they start with, if any, and the arguments left to parse
+// the flags from. For the exports subcommand, its command, e.g. list, is
+// returned too, empty if it's missing.
+func parseSubcommand(args []string) (subcommand, exportsCommand string, rest []string) {
+	if len(args) == 0 {
+		return "", "", args
+	}
+	switch args[0] {
+	case subcommandBenchmark, subcommandFsck:
+		return args[0], "", args[1:]
+	case subcommandExports:
+		if len(args) == 1 {
+			return args[0], "", args[1:]
+		}
+		return args[0], args[1], args[2:]
+	}
+	return "", "", args
+}
+
+// printExports gets the state of the provisioner serving it on the debug
+// socket at the given path and writes its exports to w: with the list command,
+// a line per export with its PV, path, exportId, gid and usage, and with the
+// describe command, everything about the export of the PV named in args,
+// including its options as in the config file.
+func printExports(w io.Writer, path, command string, args []string) error {
+	if path == "" {
+		return fmt.Errorf("debug-socket must be set to the path of the provisioner's debug socket")
+	}
+	switch {
+	case command == "list" && len(args) == 0:
+	case command == "describe" && len(args) == 1:
+	default:
+		return fmt.Errorf("usage: nfs-provisioner exports list [flags] | nfs-provisioner exports describe [flags] <pv>")
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", path)
+			},
+		},
+		Timeout: 30 * time.Second,
+	}
+	resp, err := client.Get("http://localhost/debug/state")
+	if err != nil {
+		return fmt.Errorf("error getting state from debug socket %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("error getting state from debug socket %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	var state vol.State
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		return fmt.Errorf("error parsing state from debug socket %s: %v", path, err)
+	}
+
+	if command == "list" {
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "PV\tPATH\tEXPORT ID\tGID\tCAPACITY\tUSED")
+		for _, e := range state.Exports {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\n", orNone(e.PV), e.Path, e.ExportId, formatGid(e.Gid), formatBytes(e.Capacity), formatUsedBytes(e.UsedBytes))
+		}
+		return tw.Flush()
+	}
+
+	for _, e := range state.Exports {
+		if e.PV != args[0] {
+			continue
+		}
+		fmt.Fprintf(w, "PV:          %s\n", e.PV)
+		fmt.Fprintf(w, "Path:        %s\n", e.Path)
+		fmt.Fprintf(w, "Export ID:   %d\n", e.ExportId)
+		fmt.Fprintf(w, "Gid:         %s\n", formatGid(e.Gid))
+		fmt.Fprintf(w, "Capacity:    %s\n", formatBytes(e.Capacity))
+		fmt.Fprintf(w, "Used bytes:  %s\n", formatUsedBytes(e.UsedBytes))
+		inodes := "<unknown>"
+		if e.UsedInodes != nil {
+			inodes = strconv.FormatUint(*e.UsedInodes, 10)
+		}
+		fmt.Fprintf(w, "Used inodes: %s\n", inodes)
+		fmt.Fprintf(w, "Options:\n")
+		for _, line := range strings.Split(strings.TrimRight(e.Block, "\n"), "\n") {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+		return nil
+	}
+	return fmt.Errorf("no export of PV %s found", args[0])
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
+
+func formatGid(gid *uint32) string {
+	if gid == nil {
+		return "<none>"
+	}
+	return strconv.FormatUint(uint64(*gid), 10)
+}
+
+func formatBytes(bytes *int64) string {
+	if bytes == nil {
+		return "<unknown>"
+	}
+	return strconv.FormatInt(*bytes, 10)
+}
+
+// formatUsedBytes formats used bytes, unknown until usage is measured, as is
+// capacity, which needs metrics-address and usage-interval set.
+func formatUsedBytes(bytes *uint64) string {
+	if bytes == nil {
+		return "<unknown>"
+	}
+	return strconv.FormatUint(*bytes, 10)
+}
+
+// reloadableFlags are the flags whose changes in the config file are applied
+// without restarting, as they only affect volumes provisioned afterwards.
+var reloadableFlags = []string{"export-clients", "service-cidr", "allow-any-client", "server-hostname", "use-service-dns"}
+
+// readConfigFile reads the given YAML config file of flag values by flag
+// name. A list is joined with commas, e.g. for export-clients.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file %s: %v", path, err)
+	}
+	// An empty file, e.g. of a ConfigMap with no flags yet, sets none
+	if len(bytes.TrimSpace(data)) == 0 {
+		return map[string]string{}, nil
+	}
+	data, err = yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %v", path, err)
+	}
+	raw := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// Keep numbers as written, e.g. 1000000 rather than 1e+06
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error parsing config file %s: must be a map of flag values by flag name: %v", path, err)
+	}
+
+	values := map[string]string{}
+	for name, v := range raw {
+		if flag.Lookup(name) == nil || name == "config-file" {
+			return nil, fmt.Errorf("config file %s has unknown flag %q", path, name)
+		}
+		switch v := v.(type) {
+		case nil:
+			values[name] = ""
+		case []interface{}:
+			items := []string{}
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[name] = strings.Join(items, ",")
+		case map[string]interface{}:
+			return nil, fmt.Errorf("config file %s has a map for flag %q, must be a value or list", path, name)
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
+
+// applyConfigFile sets the flags to the given config file values, except those
+// set on the command line.
+func applyConfigFile(values map[string]string, cmdline map[string]bool) error {
+	for name, value := range values {
+		if cmdline[name] {
+			glog.Infof("Flag %s is set on the command line, ignoring its value in the config file", name)
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q for flag %s: %v", value, name, err)
+		}
+	}
+	return nil
+}
+
+// reloadConfigFile reads the given config file every interval and, when it
+// changes, reconfigures the provisioner with the reloadable flags' new values
+// or, for flags no longer in the file, their values on startup without it.
+// Changes to other flags are only warned about. It blocks until stopCh is
+// closed.
+func reloadConfigFile(path string, last, base map[string]string, cmdline map[string]bool, reconfigurer vol.Reconfigurer, interval time.Duration, stopCh <-chan struct{}) {
+	wait.Until(func() {
+		values, err := readConfigFile(path)
+		if err != nil {
+			glog.Errorf("Error reloading config file, keeping the current settings: %v", err)
+			return
+		}
+		if reflect.DeepEqual(values, last) {
+			return
+		}
+		for _, name := range changedFlags(last, values) {
+			if !containsString(reloadableFlags, name) && !cmdline[name] {
+				glog.Warningf("Flag %s changed in config file %s, restart the provisioner to apply it", name, path)
+			}
+		}
+		last = values
+
+		current := map[string]string{}
+		for _, name := range reloadableFlags {
+			current[name] = base[name]
+			if value, ok := values[name]; ok && !cmdline[name] {
+				current[name] = value
+			}
+		}
+		settings, err := parseSettings(current)
+		if err != nil {
+			glog.Errorf("Invalid settings in config file %s, keeping the current ones: %v", path, err)
+			return
+		}
+		glog.Infof("Config file %s changed, applying it to volumes provisioned from now on", path)
+		reconfigurer.Reconfigure(settings)
+	}, interval, stopCh)
+}
+
+// changedFlags returns the names of the flags whose values differ between the
+// given config file values.
+func changedFlags(old, new map[string]string) []string {
+	changed := []string{}
+	for name, value := range new {
+		if oldValue, ok := old[name]; !ok || oldValue != value {
+			changed = append(changed, name)
+		}
+	}
+	for name := range old {
+		if _, ok := new[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// parseSettings parses and validates the given values of the reloadable flags
+// like main does on startup.
+func parseSettings(values map[string]string) (vol.Settings, error) {
+	clients := vol.SplitClients(values["export-clients"])
+	if err := vol.ValidateClients(clients); err != nil {
+		return vol.Settings{}, fmt.Errorf("invalid export-clients: %v", err)
+	}
+	if cidr := values["service-cidr"]; cidr != "" {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return vol.Settings{}, fmt.Errorf("invalid service-cidr: %v", err)
+		}
+	}
+	allowAnyClient, err := strconv.ParseBool(values["allow-any-client"])
+	if err != nil {
+		return vol.Settings{}, fmt.Errorf("invalid allow-any-client: %v", err)
+	}
+	useServiceDNS, err := strconv.ParseBool(values["use-service-dns"])
+	if err != nil {
+		return vol.Settings{}, fmt.Errorf("invalid use-service-dns: %v", err)
+	}
+	return vol.Settings{
+		ExportClients:  clients,
+		ServiceCIDR:    values["service-cidr"],
+		AllowAnyClient: allowAnyClient,
+		ServerHostname: values["server-hostname"],
+		UseServiceDNS:  useServiceDNS,
+	}, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// healthHandler returns a handler that responds 200 ok if the given check
+// passes and 500 with its error if it doesn't.
+func healthHandler(check func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			glog.Errorf("Health check %s failed: %v", r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+}
+
+// hasPNFSMinorVersion returns whether one of the given NFSv4 minor versions
+// supports pNFS, i.e. is 1 or later.
+func hasPNFSMinorVersion(versions []int) bool {
+	for _, v := range versions {
+		if v >= 1 {
+			return true
+		}
+	}
+	return false
 }
 
 // validateProvisioner tests if provisioner is a valid qualified name.
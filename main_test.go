@@ -0,0 +1,406 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	vol "github.com/wongma7/nfs-provisioner/volume"
+)
+
+func TestReadConfigFile(t *testing.T) {
+	tests := []struct {
+		name           string
+		data           string
+		expectedValues map[string]string
+		expectError    bool
+	}{
+		{
+			name: "values and lists",
+			data: "export-clients:\n- 10.0.0.0/8\n- 192.168.0.1\nallow-any-client: true\nmax-export-id: 1000000\nserver-hostname:\n",
+			expectedValues: map[string]string{
+				"export-clients":   "10.0.0.0/8,192.168.0.1",
+				"allow-any-client": "true",
+				"max-export-id":    "1000000",
+				"server-hostname":  "",
+			},
+		},
+		{
+			name:           "empty",
+			data:           "",
+			expectedValues: map[string]string{},
+		},
+		{
+			name:        "unknown flag",
+			data:        "export-client: 10.0.0.0/8\n",
+			expectError: true,
+		},
+		{
+			name:        "config-file itself",
+			data:        "config-file: /etc/other.yaml\n",
+			expectError: true,
+		},
+		{
+			name:        "map value",
+			data:        "export-clients:\n  a: b\n",
+			expectError: true,
+		},
+		{
+			name:        "not a map",
+			data:        "- export-clients\n",
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		path := writeConfigFile(t, test.data)
+		values, err := readConfigFile(path)
+		os.Remove(path)
+		if test.expectError {
+			if err == nil {
+				t.Errorf("test %s: expected error but got values %v", test.name, values)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(test.expectedValues, values) {
+			t.Errorf("test %s: expected values %v but got %v", test.name, test.expectedValues, values)
+		}
+	}
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	defer restoreFlags("server-hostname", "service-cidr", "allow-any-client")()
+
+	flag.Set("server-hostname", "cmdline.example.com")
+	values := map[string]string{
+		"server-hostname":  "file.example.com",
+		"service-cidr":     "10.96.0.0/12",
+		"allow-any-client": "true",
+	}
+	if err := applyConfigFile(values, map[string]bool{"server-hostname": true}); err != nil {
+		t.Fatalf("unexpected error applying config file: %v", err)
+	}
+	if *serverHostname != "cmdline.example.com" {
+		t.Errorf("expected flag set on the command line to take precedence but got server-hostname %q", *serverHostname)
+	}
+	if *serviceCIDR != "10.96.0.0/12" || !*allowAnyClient {
+		t.Errorf("expected flags not set on the command line from config file but got service-cidr %q, allow-any-client %v", *serviceCIDR, *allowAnyClient)
+	}
+
+	if err := applyConfigFile(map[string]string{"allow-any-client": "maybe"}, map[string]bool{}); err == nil {
+		t.Errorf("expected error applying invalid value but got none")
+	}
+}
+
+func TestChangedFlags(t *testing.T) {
+	old := map[string]string{"export-clients": "10.0.0.0/8", "service-cidr": "10.96.0.0/12", "fsal": "VFS"}
+	new := map[string]string{"export-clients": "10.0.0.0/16", "fsal": "VFS", "use-service-dns": "true"}
+	expected := []string{"export-clients", "service-cidr", "use-service-dns"}
+	if changed := changedFlags(old, new); !reflect.DeepEqual(expected, changed) {
+		t.Errorf("expected changed flags %v but got %v", expected, changed)
+	}
+}
+
+func TestParseSettings(t *testing.T) {
+	values := map[string]string{
+		"export-clients":   "10.0.0.0/8, 192.168.0.1",
+		"service-cidr":     "10.96.0.0/12",
+		"allow-any-client": "false",
+		"server-hostname":  "nfs.example.com",
+		"use-service-dns":  "true",
+	}
+	expected := vol.Settings{
+		ExportClients:  []string{"10.0.0.0/8", "192.168.0.1"},
+		ServiceCIDR:    "10.96.0.0/12",
+		ServerHostname: "nfs.example.com",
+		UseServiceDNS:  true,
+	}
+	settings, err := parseSettings(values)
+	if err != nil {
+		t.Fatalf("unexpected error parsing settings: %v", err)
+	}
+	if !reflect.DeepEqual(expected, settings) {
+		t.Errorf("expected settings %+v but got %+v", expected, settings)
+	}
+
+	for name, value := range map[string]string{
+		"export-clients":   "10.0.0.0/8 {",
+		"service-cidr":     "10.96.0.0",
+		"allow-any-client": "maybe",
+		"use-service-dns":  "",
+	} {
+		invalid := map[string]string{}
+		for k, v := range values {
+			invalid[k] = v
+		}
+		invalid[name] = value
+		if _, err := parseSettings(invalid); err == nil {
+			t.Errorf("expected error parsing invalid %s %q but got none", name, value)
+		}
+	}
+}
+
+func TestReloadConfigFile(t *testing.T) {
+	path := writeConfigFile(t, "export-clients: 10.0.0.0/16\nserver-hostname: file.example.com\nfsal: CEPH\n")
+	defer os.Remove(path)
+
+	base := map[string]string{
+		"export-clients":   "10.0.0.0/8",
+		"service-cidr":     "10.96.0.0/12",
+		"allow-any-client": "false",
+		"server-hostname":  "cmdline.example.com",
+		"use-service-dns":  "false",
+	}
+	last := map[string]string{"export-clients": "10.0.0.0/8", "service-cidr": "10.0.0.0/24"}
+	reconfigurer := &testReconfigurer{settings: make(chan vol.Settings, 1)}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go reloadConfigFile(path, last, base, map[string]bool{"server-hostname": true}, reconfigurer, time.Hour, stopCh)
+
+	// service-cidr is no longer in the file, so it goes back to its value on
+	// startup, and server-hostname is set on the command line
+	expected := vol.Settings{
+		ExportClients:  []string{"10.0.0.0/16"},
+		ServiceCIDR:    "10.96.0.0/12",
+		ServerHostname: "cmdline.example.com",
+	}
+	select {
+	case settings := <-reconfigurer.settings:
+		if !reflect.DeepEqual(expected, settings) {
+			t.Errorf("expected settings %+v but got %+v", expected, settings)
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("expected provisioner to be reconfigured but it wasn't")
+	}
+}
+
+func TestParseSubcommand(t *testing.T) {
+	tests := []struct {
+		name                   string
+		args                   []string
+		expectedSubcommand     string
+		expectedExportsCommand string
+		expectedArgs           []string
+	}{
+		{
+			name:         "no subcommand",
+			args:         []string{"-provisioner=example.com/nfs", "-run-server=false"},
+			expectedArgs: []string{"-provisioner=example.com/nfs", "-run-server=false"},
+		},
+		{
+			name:         "no args",
+			args:         []string{},
+			expectedArgs: []string{},
+		},
+		{
+			name:               "benchmark",
+			args:               []string{"benchmark", "-benchmark-volumes=10"},
+			expectedSubcommand: "benchmark",
+			expectedArgs:       []string{"-benchmark-volumes=10"},
+		},
+		{
+			name:               "fsck",
+			args:               []string{"fsck", "-fsck-repair"},
+			expectedSubcommand: "fsck",
+			expectedArgs:       []string{"-fsck-repair"},
+		},
+		{
+			name:                   "exports describe",
+			args:                   []string{"exports", "describe", "-debug-socket=/tmp/debug.sock", "pvc-1"},
+			expectedSubcommand:     "exports",
+			expectedExportsCommand: "describe",
+			expectedArgs:           []string{"-debug-socket=/tmp/debug.sock", "pvc-1"},
+		},
+		{
+			name:               "exports without command",
+			args:               []string{"exports"},
+			expectedSubcommand: "exports",
+			expectedArgs:       []string{},
+		},
+		{
+			name:         "subcommand not first",
+			args:         []string{"-fsck-repair", "fsck"},
+			expectedArgs: []string{"-fsck-repair", "fsck"},
+		},
+	}
+	for _, test := range tests {
+		subcommand, exportsCommand, args := parseSubcommand(test.args)
+		if subcommand != test.expectedSubcommand || exportsCommand != test.expectedExportsCommand || !reflect.DeepEqual(test.expectedArgs, args) {
+			t.Errorf("test %s: expected subcommand %q, exports command %q and args %v but got %q, %q and %v", test.name, test.expectedSubcommand, test.expectedExportsCommand, test.expectedArgs, subcommand, exportsCommand, args)
+		}
+	}
+}
+
+func TestPrintExports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfs-provisioner-debug")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	gid := uint32(1000)
+	capacity := int64(1048576)
+	usedBytes := uint64(4096)
+	usedInodes := uint64(3)
+	state := vol.State{
+		Exports: []vol.ExportState{
+			{Path: "/export/pvc-1", ExportId: 1, PV: "pvc-1", Gid: &gid, Block: "EXPORT\n{\n\tExport_Id = 1;\n}\n", Capacity: &capacity, UsedBytes: &usedBytes, UsedInodes: &usedInodes},
+			{Path: "/export/orphan", ExportId: 22, Block: "EXPORT\n{\n\tExport_Id = 22;\n}\n"},
+		},
+	}
+	path := filepath.Join(dir, "debug.sock")
+	listener := serveTestState(t, path, state)
+	defer listener.Close()
+
+	tests := []struct {
+		name           string
+		command        string
+		args           []string
+		expectedOutput string
+		expectError    bool
+	}{
+		{
+			name:    "list",
+			command: "list",
+			expectedOutput: "PV      PATH            EXPORT ID  GID     CAPACITY   USED\n" +
+				"pvc-1   /export/pvc-1   1          1000    1048576    4096\n" +
+				"<none>  /export/orphan  22         <none>  <unknown>  <unknown>\n",
+		},
+		{
+			name:    "describe",
+			command: "describe",
+			args:    []string{"pvc-1"},
+			expectedOutput: "PV:          pvc-1\n" +
+				"Path:        /export/pvc-1\n" +
+				"Export ID:   1\n" +
+				"Gid:         1000\n" +
+				"Capacity:    1048576\n" +
+				"Used bytes:  4096\n" +
+				"Used inodes: 3\n" +
+				"Options:\n" +
+				"  EXPORT\n" +
+				"  {\n" +
+				"  \tExport_Id = 1;\n" +
+				"  }\n",
+		},
+		{
+			name:        "describe unknown PV",
+			command:     "describe",
+			args:        []string{"pvc-2"},
+			expectError: true,
+		},
+		{
+			name:        "list with args",
+			command:     "list",
+			args:        []string{"pvc-1"},
+			expectError: true,
+		},
+		{
+			name:        "no command",
+			command:     "",
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		err := printExports(&buf, path, test.command, test.args)
+		if test.expectError {
+			if err == nil {
+				t.Errorf("test %s: expected error but got output %q", test.name, buf.String())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if buf.String() != test.expectedOutput {
+			t.Errorf("test %s: expected output %q but got %q", test.name, test.expectedOutput, buf.String())
+		}
+	}
+
+	if err := printExports(&bytes.Buffer{}, filepath.Join(dir, "missing.sock"), "list", nil); err == nil {
+		t.Errorf("expected error getting state from missing socket but got none")
+	}
+}
+
+// serveTestState serves the given state on a debug socket at the given path,
+// as serveDebug does, until the returned listener is closed.
+func serveTestState(t *testing.T, path string, state vol.State) net.Listener {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("error listening on debug socket: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/state", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+	})
+	go http.Serve(listener, mux)
+	return listener
+}
+
+type testReconfigurer struct {
+	settings chan vol.Settings
+}
+
+var _ vol.Reconfigurer = &testReconfigurer{}
+
+func (r *testReconfigurer) Reconfigure(settings vol.Settings) {
+	r.settings <- settings
+}
+
+// writeConfigFile writes the given data to a new config file and returns its
+// path.
+func writeConfigFile(t *testing.T, data string) string {
+	f, err := ioutil.TempFile("", "nfs-provisioner-config")
+	if err != nil {
+		t.Fatalf("error creating config file: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatalf("error writing config file: %v", err)
+	}
+	return f.Name()
+}
+
+// restoreFlags returns a func that sets the given flags back to their current
+// values.
+func restoreFlags(names ...string) func() {
+	values := map[string]string{}
+	for _, name := range names {
+		values[name] = flag.Lookup(name).Value.String()
+	}
+	return func() {
+		for name, value := range values {
+			flag.Set(name, value)
+		}
+	}
+}
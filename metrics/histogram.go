@@ -0,0 +1,125 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the buckets of
+// histograms of how long operations take.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Histograms is a histogram metric, one histogram per set of labels values
+// are observed with. It's a Collector of its own family.
+type Histograms struct {
+	name    string
+	help    string
+	buckets []float64
+
+	lock   sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	labels Labels
+	// counts[i] is the number of observations in buckets[i] but no lower one
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+var _ Collector = &Histograms{}
+
+// NewHistograms returns a histogram metric of the given name whose buckets
+// have the given upper bounds, which must be sorted.
+func NewHistograms(name, help string, buckets []float64) *Histograms {
+	return &Histograms{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		series:  map[string]*histogram{},
+	}
+}
+
+// Observe adds the given value to the histogram of the given labels.
+func (h *Histograms) Observe(labels Labels, v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	key := labelsKey(labels)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{labels: labels, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+// Collect returns the histograms as a family with, per set of labels, a
+// cumulative _bucket sample per bucket labeled by its upper bound le, and _sum
+// and _count samples.
+func (h *Histograms) Collect() []Family {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	f := Family{Name: h.name, Help: h.help, Type: Histogram}
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			f.Samples = append(f.Samples, Sample{Suffix: "_bucket", Labels: withLabel(s.labels, "le", formatValue(bound)), Value: float64(cumulative)})
+		}
+		f.Samples = append(f.Samples,
+			Sample{Suffix: "_bucket", Labels: withLabel(s.labels, "le", "+Inf"), Value: float64(s.count)},
+			Sample{Suffix: "_sum", Labels: s.labels, Value: s.sum},
+			Sample{Suffix: "_count", Labels: s.labels, Value: float64(s.count)})
+	}
+	return []Family{f}
+}
+
+// labelsKey returns a string identifying the given labels.
+func labelsKey(labels Labels) string {
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, name+"\x00"+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\x00")
+}
+
+// withLabel returns a copy of the given labels with the given label added.
+func withLabel(labels Labels, name, value string) Labels {
+	with := Labels{name: value}
+	for k, v := range labels {
+		with[k] = v
+	}
+	return with
+}
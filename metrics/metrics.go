@@ -0,0 +1,183 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics exposes metrics over HTTP in the Prometheus text format.
+// Metrics are gathered from registered collectors whenever they are scraped.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Type is the type of a metric.
+type Type string
+
+const (
+	Counter   Type = "counter"
+	Gauge     Type = "gauge"
+	Histogram Type = "histogram"
+)
+
+// Labels are the labels of a sample, by name.
+type Labels map[string]string
+
+// Sample is a value of a metric with a set of labels. Its name is the name of
+// its family followed by Suffix, e.g. _bucket for the samples of a histogram.
+type Sample struct {
+	Suffix string
+	Labels Labels
+	Value  float64
+}
+
+// Family is a metric and all of its samples.
+type Family struct {
+	Name    string
+	Help    string
+	Type    Type
+	Samples []Sample
+}
+
+// Collector is implemented by anything that has metrics to expose.
+type Collector interface {
+	// Collect returns the current values of the collector's metrics.
+	Collect() []Family
+}
+
+var (
+	collectorsLock sync.Mutex
+	collectors     []Collector
+)
+
+// Register registers the given collector, so that its metrics are exposed by
+// Handler.
+func Register(c Collector) {
+	collectorsLock.Lock()
+	defer collectorsLock.Unlock()
+	collectors = append(collectors, c)
+}
+
+// Gather collects the metrics of every registered collector, sorted by name.
+// Families with the same name are merged.
+func Gather() []Family {
+	collectorsLock.Lock()
+	cs := make([]Collector, len(collectors))
+	copy(cs, collectors)
+	collectorsLock.Unlock()
+
+	byName := map[string]*Family{}
+	for _, c := range cs {
+		for _, f := range c.Collect() {
+			if existing, ok := byName[f.Name]; ok {
+				existing.Samples = append(existing.Samples, f.Samples...)
+				continue
+			}
+			f := f
+			byName[f.Name] = &f
+		}
+	}
+
+	families := make([]Family, 0, len(byName))
+	for _, f := range byName {
+		families = append(families, *f)
+	}
+	sort.Sort(byFamilyName(families))
+	return families
+}
+
+type byFamilyName []Family
+
+func (f byFamilyName) Len() int           { return len(f) }
+func (f byFamilyName) Less(i, j int) bool { return f[i].Name < f[j].Name }
+func (f byFamilyName) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+// Handler returns an HTTP handler that serves the metrics of every registered
+// collector.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Write(w, Gather())
+	})
+}
+
+// Write writes the given families in the Prometheus text format.
+func Write(w io.Writer, families []Family) error {
+	buf := bufio.NewWriter(w)
+	for _, f := range families {
+		if len(f.Samples) == 0 {
+			continue
+		}
+		fmt.Fprintf(buf, "# HELP %s %s\n", f.Name, escape(f.Help, false))
+		fmt.Fprintf(buf, "# TYPE %s %s\n", f.Name, f.Type)
+		for _, s := range f.Samples {
+			buf.WriteString(f.Name + s.Suffix)
+			writeLabels(buf, s.Labels)
+			buf.WriteByte(' ')
+			buf.WriteString(formatValue(s.Value))
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Flush()
+}
+
+func writeLabels(buf *bufio.Writer, labels Labels) {
+	if len(labels) == 0 {
+		return
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(buf, "%s=\"%s\"", name, escape(labels[name], true))
+	}
+	buf.WriteByte('}')
+}
+
+// escape escapes backslashes and newlines and, in label values, double quotes.
+func escape(s string, quotes bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quotes {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
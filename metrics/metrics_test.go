@@ -0,0 +1,123 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+type testCollector []Family
+
+func (c testCollector) Collect() []Family {
+	return c
+}
+
+func TestWrite(t *testing.T) {
+	families := []Family{
+		{
+			Name: "b_total",
+			Help: "B, with a \\ and a\nnewline.",
+			Type: Counter,
+			Samples: []Sample{
+				{Labels: Labels{"pv": "pvc-1", "op": "read"}, Value: 3},
+				{Labels: Labels{"pv": "say \"hi\""}, Value: 0.5},
+			},
+		},
+		{
+			Name:    "a",
+			Help:    "A.",
+			Type:    Gauge,
+			Samples: []Sample{{Value: 1e12}},
+		},
+		{
+			Name: "empty",
+			Help: "No samples, not written.",
+			Type: Gauge,
+		},
+	}
+	expected := `# HELP b_total B, with a \\ and a\nnewline.
+# TYPE b_total counter
+b_total{op="read",pv="pvc-1"} 3
+b_total{pv="say \"hi\""} 0.5
+# HELP a A.
+# TYPE a gauge
+a 1e+12
+`
+	var buf bytes.Buffer
+	if err := Write(&buf, families); err != nil {
+		t.Fatalf("unexpected error writing metrics: %v", err)
+	}
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\nbut got:\n%s", expected, buf.String())
+	}
+}
+
+func TestGather(t *testing.T) {
+	collectorsLock.Lock()
+	old := collectors
+	collectors = nil
+	collectorsLock.Unlock()
+	defer func() {
+		collectorsLock.Lock()
+		collectors = old
+		collectorsLock.Unlock()
+	}()
+
+	Register(testCollector{{Name: "b", Type: Gauge, Samples: []Sample{{Labels: Labels{"x": "1"}, Value: 1}}}})
+	Register(testCollector{
+		{Name: "a", Type: Gauge, Samples: []Sample{{Value: 2}}},
+		{Name: "b", Type: Gauge, Samples: []Sample{{Labels: Labels{"x": "2"}, Value: 3}}},
+	})
+
+	families := Gather()
+	if len(families) != 2 || families[0].Name != "a" || families[1].Name != "b" {
+		t.Fatalf("expected families a and b but got %v", families)
+	}
+	if len(families[1].Samples) != 2 {
+		t.Errorf("expected the samples of b to be merged but got %v", families[1].Samples)
+	}
+}
+
+func TestHistograms(t *testing.T) {
+	h := NewHistograms("op_duration_seconds", "Duration of ops.", []float64{0.1, 1})
+	h.Observe(Labels{"op": "b"}, 0.1)
+	h.Observe(Labels{"op": "b"}, 0.5)
+	h.Observe(Labels{"op": "b"}, 5)
+	h.Observe(Labels{"op": "a"}, 0.05)
+
+	expected := `# HELP op_duration_seconds Duration of ops.
+# TYPE op_duration_seconds histogram
+op_duration_seconds_bucket{le="0.1",op="a"} 1
+op_duration_seconds_bucket{le="1",op="a"} 1
+op_duration_seconds_bucket{le="+Inf",op="a"} 1
+op_duration_seconds_sum{op="a"} 0.05
+op_duration_seconds_count{op="a"} 1
+op_duration_seconds_bucket{le="0.1",op="b"} 1
+op_duration_seconds_bucket{le="1",op="b"} 2
+op_duration_seconds_bucket{le="+Inf",op="b"} 3
+op_duration_seconds_sum{op="b"} 5.6
+op_duration_seconds_count{op="b"} 3
+`
+	var buf bytes.Buffer
+	if err := Write(&buf, h.Collect()); err != nil {
+		t.Fatalf("unexpected error writing metrics: %v", err)
+	}
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\nbut got:\n%s", expected, buf.String())
+	}
+}
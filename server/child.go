@@ -0,0 +1,168 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// How long to wait for a child process to be ready after starting it and to
+// exit after asking it to.
+const (
+	childStartTimeout = 30 * time.Second
+	childStopTimeout  = 30 * time.Second
+)
+
+// child is a server process running in the foreground as a child of the
+// provisioner.
+type child struct {
+	name string
+	cmd  *exec.Cmd
+	// done is closed once the process has exited and err is set.
+	done chan struct{}
+	err  error
+}
+
+var (
+	// asChildren is whether the server processes are run as children of the
+	// provisioner instead of daemonizing.
+	asChildren bool
+
+	childLock sync.Mutex
+	// helpers are the child processes NFS Ganesha depends on, in the order
+	// they were started.
+	helpers []*child
+	// ganeshaChild is the NFS Ganesha child process.
+	ganeshaChild *child
+)
+
+// startProcess runs the given daemon, which detaches by itself once it's
+// started. If the server processes are run as children, it's instead started
+// in the foreground by appending foregroundFlag to its args and startProcess
+// waits until ready returns true.
+func startProcess(ready func() bool, foregroundFlag string, name string, args ...string) (*child, error) {
+	if !asChildren {
+		cmd := exec.Command(name, args...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("%s failed with error: %v, output: %s", name, err, out)
+		}
+		return nil, nil
+	}
+
+	cmd := exec.Command(name, append(args, foregroundFlag)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting %s: %v", name, err)
+	}
+	c := &child{name: name, cmd: cmd, done: make(chan struct{})}
+	go func() {
+		c.err = cmd.Wait()
+		glog.Infof("%s exited: %v", name, c.err)
+		close(c.done)
+	}()
+
+	timeout := time.After(childStartTimeout)
+	for !ready() {
+		select {
+		case <-c.done:
+			return nil, fmt.Errorf("%s exited before it was ready: %v", name, c.err)
+		case <-timeout:
+			c.stop()
+			return nil, fmt.Errorf("timed out waiting for %s to be ready", name)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	return c, nil
+}
+
+// startHelper starts a process NFS Ganesha depends on with startProcess and,
+// if it's a child, records it so that stopHelpers stops it.
+func startHelper(ready func() bool, foregroundFlag string, name string, args ...string) error {
+	c, err := startProcess(ready, foregroundFlag, name, args...)
+	if err != nil {
+		return err
+	}
+	if c != nil {
+		childLock.Lock()
+		helpers = append(helpers, c)
+		childLock.Unlock()
+	}
+	return nil
+}
+
+// exited returns whether the child process has exited.
+func (c *child) exited() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait waits up to timeout for the child process to exit and returns whether
+// it did.
+func (c *child) wait(timeout time.Duration) bool {
+	select {
+	case <-c.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// stop asks the child process to exit with SIGTERM, killing it if it hasn't
+// after childStopTimeout.
+func (c *child) stop() {
+	if c.exited() {
+		return
+	}
+	c.cmd.Process.Signal(syscall.SIGTERM)
+	if !c.wait(childStopTimeout) {
+		glog.Errorf("%s didn't exit after SIGTERM, killing it", c.name)
+		c.cmd.Process.Kill()
+		<-c.done
+	}
+}
+
+// stopHelpers stops the child processes NFS Ganesha depends on, in the
+// reverse of the order they were started.
+func stopHelpers() {
+	childLock.Lock()
+	defer childLock.Unlock()
+	for i := len(helpers) - 1; i >= 0; i-- {
+		helpers[i].stop()
+	}
+	helpers = nil
+}
+
+// processReady returns a function that returns whether the given command
+// succeeds, for checking if a child process is ready.
+func processReady(name string, args ...string) func() bool {
+	return func() bool {
+		return exec.Command(name, args...).Run() == nil
+	}
+}
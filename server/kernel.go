@@ -0,0 +1,170 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// The sysctls the kernel lock manager, lockd, reads its ports from when it
+// starts.
+const (
+	nlmTCPPortFile = "/proc/sys/fs/nfs/nlm_tcpport"
+	nlmUDPPortFile = "/proc/sys/fs/nfs/nlm_udpport"
+)
+
+// StartKernel starts the kernel NFS server, serving NFS on nfsPort and mountd
+// on mountPort, and the lock management NFSv3 clients need for file locking:
+// rpc.statd and the kernel's lockd, which nfsd starts. If lockdPort isn't zero,
+// lockd listens on it. If statdPort or statdOutgoingPort isn't zero, rpc.statd
+// listens on or sends reboot notifications from it. If statdHostname isn't
+// empty, rpc.statd identifies the server to clients by it, so that clients
+// recognize its reboot notifications after the pod is rescheduled. If threads
+// isn't zero, nfsd runs that many threads. If versions isn't empty, only those
+// NFS versions are served. If krb5Keytab isn't empty, rpc.svcgssd is started
+// with that keytab so that the server accepts Kerberos-secured mounts. If an
+// error is encountered at any point it returns it instantly
+func StartKernel(nfsPort, mountPort, lockdPort, statdPort, statdOutgoingPort int, statdHostname string, threads int, versions []string, krb5Keytab string) error {
+	// Start rpcbind if it is not started yet
+	cmd := exec.Command("/usr/sbin/rpcinfo", "127.0.0.1")
+	if err := cmd.Run(); err != nil {
+		cmd := exec.Command("/usr/sbin/rpcbind", "-w")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("Starting rpcbind failed with error: %v, output: %s", err, out)
+		}
+	}
+
+	// lockd must know its ports before nfsd starts it
+	if lockdPort != 0 {
+		if err := setLockdPort(lockdPort); err != nil {
+			return err
+		}
+	}
+
+	args := []string{}
+	if statdPort != 0 {
+		args = append(args, "-p", strconv.Itoa(statdPort))
+	}
+	if statdOutgoingPort != 0 {
+		args = append(args, "-o", strconv.Itoa(statdOutgoingPort))
+	}
+	if statdHostname != "" {
+		args = append(args, "-n", statdHostname)
+	}
+	cmd = exec.Command("/usr/sbin/rpc.statd", args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("rpc.statd failed with error: %v, output: %s", err, out)
+	}
+
+	// nfsd hands the GSS context of Kerberos-secured requests to rpc.svcgssd
+	if krb5Keytab != "" {
+		cmd = exec.Command("/usr/sbin/rpc.svcgssd")
+		cmd.Env = append(os.Environ(), "KRB5_KTNAME=FILE:"+krb5Keytab)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("rpc.svcgssd failed with error: %v, output: %s", err, out)
+		}
+	}
+
+	// rpc.nfsd and exportfs need the nfsd filesystem
+	if _, err := os.Stat("/proc/fs/nfsd/threads"); os.IsNotExist(err) {
+		cmd = exec.Command("mount", "-t", "nfsd", "nfsd", "/proc/fs/nfsd")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("mounting nfsd filesystem failed with error: %v, output: %s", err, out)
+		}
+	}
+
+	cmd = exec.Command("/usr/sbin/rpc.nfsd", nfsdArgs(nfsPort, threads, versions)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("rpc.nfsd failed with error: %v, output: %s", err, out)
+	}
+
+	cmd = exec.Command("/usr/sbin/rpc.mountd", "-p", strconv.Itoa(mountPort))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("rpc.mountd failed with error: %v, output: %s", err, out)
+	}
+
+	return nil
+}
+
+// kernelVersions are the NFS versions rpc.nfsd can enable and disable. NFSv4.0
+// is served whenever NFSv4 is.
+var kernelVersions = []string{"2", "3", "4", "4.1", "4.2"}
+
+// nfsdArgs returns the args to run rpc.nfsd with to serve on the given port
+// with the given number of threads and only the given versions. Zero threads
+// or empty versions leave rpc.nfsd's choice alone.
+func nfsdArgs(nfsPort, threads int, versions []string) []string {
+	args := []string{"-p", strconv.Itoa(nfsPort)}
+	if len(versions) != 0 {
+		for _, v := range kernelVersions {
+			if containsVersion(versions, v) || (v == "4" && containsVersion(versions, "4.1", "4.2")) {
+				args = append(args, "-V", v)
+			} else {
+				args = append(args, "-N", v)
+			}
+		}
+	}
+	if threads != 0 {
+		args = append(args, strconv.Itoa(threads))
+	}
+	return args
+}
+
+func containsVersion(versions []string, want ...string) bool {
+	for _, v := range versions {
+		for _, w := range want {
+			if v == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ParseKernelVersions parses a comma-separated list of the NFS versions the
+// kernel NFS server serves, e.g. "3,4.1". NFSv4.0 is written as 4.
+func ParseKernelVersions(s string) ([]string, error) {
+	versions := []string{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !containsVersion(kernelVersions, field) {
+			return nil, fmt.Errorf("invalid NFS version %q, must be one of %s", field, strings.Join(kernelVersions, ", "))
+		}
+		if !containsVersion(versions, field) {
+			versions = append(versions, field)
+		}
+	}
+	return versions, nil
+}
+
+// setLockdPort sets the TCP and UDP ports lockd listens on when it starts.
+func setLockdPort(port int) error {
+	for _, file := range []string{nlmTCPPortFile, nlmUDPPortFile} {
+		if err := ioutil.WriteFile(file, []byte(strconv.Itoa(port)), 0644); err != nil {
+			return fmt.Errorf("error setting lockd port in %s: %v", file, err)
+		}
+	}
+	return nil
+}
@@ -20,31 +20,62 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/guelfey/go.dbus"
+	"github.com/wongma7/nfs-provisioner/ganesha"
 )
 
 const defaultGaneshaConfig = "/vfs.conf"
 
-// Start starts the NFS server. If an error is encountered at any point it returns it instantly
-func Start(ganeshaConfig string) error {
+// ganeshaCapabilities are the capabilities, in setpriv's form, NFS Ganesha
+// keeps if it's run with dropped capabilities: those to access files on behalf
+// of any user, take on their credentials, raise its file limit and bind the
+// rquota port.
+var ganeshaCapabilities = []string{"+chown", "+dac_override", "+dac_read_search", "+fowner", "+fsetid", "+setuid", "+setgid", "+sys_resource", "+net_bind_service"}
+
+// dropCaps is whether NFS Ganesha is run with only ganeshaCapabilities.
+var dropCaps bool
+
+// Start starts the NFS server, serving NFS on nfsPort and mountd on mountPort.
+// If minorVersions isn't empty, only those NFSv4 minor versions are served. If
+// pnfs is true, the server acts as a pNFS metadata and data server. If
+// gracePeriod isn't zero, the NFSv4 grace period lasts that long. NFS Ganesha
+// logs to logFile and, if logLevel isn't empty, at that level. If
+// cacheEntriesHWMark isn't zero, NFS Ganesha tries to cache at most that many
+// entries and if attrExpiration isn't zero, it caches their attributes for that
+// long. If krb5Keytab isn't empty, NFS Ganesha accepts Kerberos-secured
+// mounts with the principal in that keytab. If dropCapabilities is true, NFS
+// Ganesha runs with only the capabilities it needs to serve files, dropping
+// the rest of root's. If children is true, the server processes, i.e. rpcbind, rpc.statd,
+// dbus-daemon and NFS Ganesha, are run in the foreground as children of the
+// provisioner, each started once the previous one is ready, instead of
+// daemonizing, and Stop stops them all. If an error is encountered at any
+// point it returns it instantly
+func Start(ganeshaConfig string, nfsPort, mountPort int, minorVersions []int, pnfs bool, gracePeriod time.Duration, logFile, logLevel string, cacheEntriesHWMark int, attrExpiration time.Duration, krb5Keytab string, dropCapabilities bool, children bool) error {
+	asChildren = children
+	dropCaps = dropCapabilities
+
 	// Start rpcbind if it is not started yet
-	cmd := exec.Command("/usr/sbin/rpcinfo", "127.0.0.1")
-	if err := cmd.Run(); err != nil {
-		cmd := exec.Command("/usr/sbin/rpcbind", "-w")
-		if out, err := cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("Starting rpcbind failed with error: %v, output: %s", err, out)
+	rpcbindReady := processReady("/usr/sbin/rpcinfo", "127.0.0.1")
+	if !rpcbindReady() {
+		if err := startHelper(rpcbindReady, "-f", "/usr/sbin/rpcbind", "-w"); err != nil {
+			return err
 		}
 	}
 
-	cmd = exec.Command("/usr/sbin/rpc.statd")
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("rpc.statd failed with error: %v, output: %s", err, out)
+	statdReady := processReady("/usr/sbin/rpcinfo", "-u", "127.0.0.1", "status")
+	if err := startHelper(statdReady, "-F", "/usr/sbin/rpc.statd"); err != nil {
+		return err
 	}
 
 	// Start dbus, needed for ganesha dynamic exports
-	cmd = exec.Command("dbus-daemon", "--system")
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("dbus-daemon failed with error: %v, output: %s", err, out)
+	dbusReady := processReady("dbus-send", "--system", "--print-reply", "--dest=org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus.GetId")
+	if err := startHelper(dbusReady, "--nofork", "dbus-daemon", "--system"); err != nil {
+		return err
 	}
 
 	// Copy the default ganesha config to the export directory if one isn't there
@@ -58,16 +89,292 @@ func Start(ganeshaConfig string) error {
 			return fmt.Errorf("error writing ganesha config: %v", err)
 		}
 	}
-	// Start ganesha.nfsd
-	cmd = exec.Command("ganesha.nfsd", "-L", "/var/log/ganesha.log", "-f", ganeshaConfig)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("ganesha.nfsd failed with error: %v, output: %s", err, out)
+	if err := setPorts(ganeshaConfig, nfsPort, mountPort); err != nil {
+		return fmt.Errorf("error setting ports in ganesha config: %v", err)
+	}
+	if err := setNFSv4(ganeshaConfig, minorVersions, pnfs, gracePeriod); err != nil {
+		return fmt.Errorf("error setting NFSv4 parameters in ganesha config: %v", err)
+	}
+	if err := setLogLevel(ganeshaConfig, logLevel); err != nil {
+		return fmt.Errorf("error setting log level in ganesha config: %v", err)
+	}
+	if err := setCache(ganeshaConfig, cacheEntriesHWMark, attrExpiration); err != nil {
+		return fmt.Errorf("error setting cache parameters in ganesha config: %v", err)
+	}
+	if err := setKerberos(ganeshaConfig, krb5Keytab); err != nil {
+		return fmt.Errorf("error setting Kerberos parameters in ganesha config: %v", err)
+	}
+
+	return startGanesha(ganeshaConfig, logFile)
+}
+
+// startGanesha starts ganesha.nfsd, which exports every EXPORT in the given
+// config file and logs to the given log file. If it's run as a child, any
+// previous child that is somehow still around is stopped first.
+func startGanesha(ganeshaConfig, logFile string) error {
+	childLock.Lock()
+	defer childLock.Unlock()
+	if ganeshaChild != nil {
+		ganeshaChild.stop()
+		ganeshaChild = nil
+	}
+
+	name, args := "ganesha.nfsd", []string{"-L", logFile, "-f", ganeshaConfig}
+	if dropCaps {
+		args = append([]string{"--inh-caps=-all", "--bounding-set=-all," + strings.Join(ganeshaCapabilities, ","), "--", name}, args...)
+		name = "setpriv"
+	}
+	c, err := startProcess(func() bool {
+		running, err := ganesha.IsRunning()
+		return err == nil && running
+	}, "-F", name, args...)
+	if err != nil {
+		return err
+	}
+	ganeshaChild = c
+
+	return nil
+}
+
+// Supervise checks every interval, until stopCh is closed, that NFS Ganesha is
+// running, i.e. owns its D-Bus name, and restarts it if it isn't. NFS Ganesha
+// re-exports the exports in the config file when it restarts; restarted is
+// called after every restart so that the caller can re-add any other exports.
+func Supervise(ganeshaConfig, logFile string, interval time.Duration, restarted func(), stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(interval):
+		}
+
+		running, err := ganesha.IsRunning()
+		if err != nil {
+			glog.Errorf("Error checking if NFS Ganesha is running: %v", err)
+			continue
+		}
+		if running {
+			continue
+		}
+
+		glog.Errorf("NFS Ganesha is not running, restarting it")
+		if err := startGanesha(ganeshaConfig, logFile); err != nil {
+			glog.Errorf("Error restarting NFS Ganesha: %v", err)
+			continue
+		}
+		glog.Infof("Restarted NFS Ganesha")
+		restarted()
+	}
+}
+
+// setPorts sets the NFS and mountd ports in the NFS_Core_Param block of the
+// ganesha config, adding the block if there isn't one.
+func setPorts(ganeshaConfig string, nfsPort, mountPort int) error {
+	config, err := ganesha.ReadFile(ganeshaConfig)
+	if err != nil {
+		return err
+	}
+	param := getOrAddBlock(config, "NFS_Core_Param")
+	param.Set("NFS_Port", strconv.Itoa(nfsPort))
+	param.Set("MNT_Port", strconv.Itoa(mountPort))
+
+	return ioutil.WriteFile(ganeshaConfig, []byte(config.String()), 0600)
+}
+
+// setNFSv4 sets the NFSv4 minor versions and pNFS roles in the NFSv4 block of
+// the ganesha config, adding the block if there isn't one. Empty minorVersions
+// or a zero gracePeriod leaves ganesha's choice alone.
+func setNFSv4(ganeshaConfig string, minorVersions []int, pnfs bool, gracePeriod time.Duration) error {
+	config, err := ganesha.ReadFile(ganeshaConfig)
+	if err != nil {
+		return err
+	}
+	if len(minorVersions) == 0 && !pnfs && gracePeriod == 0 && len(config.Blocks("NFSv4")) == 0 {
+		return nil
+	}
+	nfsv4 := getOrAddBlock(config, "NFSv4")
+	if len(minorVersions) != 0 {
+		versions := make([]string, 0, len(minorVersions))
+		for _, v := range minorVersions {
+			versions = append(versions, strconv.Itoa(v))
+		}
+		nfsv4.Set("Minor_Versions", strings.Join(versions, ", "))
+	}
+	if gracePeriod != 0 {
+		nfsv4.Set("Grace_Period", strconv.Itoa(int(gracePeriod.Seconds())))
+	}
+	if pnfs {
+		nfsv4.Set("PNFS_MDS", "true")
+		nfsv4.Set("PNFS_DS", "true")
+	} else {
+		nfsv4.Unset("PNFS_MDS")
+		nfsv4.Unset("PNFS_DS")
+	}
+
+	return ioutil.WriteFile(ganeshaConfig, []byte(config.String()), 0600)
+}
+
+// setLogLevel sets the default log level in the LOG block of the ganesha
+// config, adding the block if there isn't one. An empty logLevel leaves
+// ganesha's choice alone.
+func setLogLevel(ganeshaConfig, logLevel string) error {
+	if logLevel == "" {
+		return nil
+	}
+	config, err := ganesha.ReadFile(ganeshaConfig)
+	if err != nil {
+		return err
+	}
+	getOrAddBlock(config, "LOG").Set("Default_Log_Level", logLevel)
+
+	return ioutil.WriteFile(ganeshaConfig, []byte(config.String()), 0600)
+}
+
+// setCache sets the high water mark of cached entries in the CACHEINODE block
+// and the attribute expiration time in the EXPORT_DEFAULTS block of the ganesha
+// config, adding the blocks if there aren't any. A zero cacheEntriesHWMark or
+// attrExpiration leaves ganesha's choice alone.
+func setCache(ganeshaConfig string, cacheEntriesHWMark int, attrExpiration time.Duration) error {
+	if cacheEntriesHWMark == 0 && attrExpiration == 0 {
+		return nil
+	}
+	config, err := ganesha.ReadFile(ganeshaConfig)
+	if err != nil {
+		return err
+	}
+	if cacheEntriesHWMark != 0 {
+		getOrAddBlock(config, "CACHEINODE").Set("Entries_HWMark", strconv.Itoa(cacheEntriesHWMark))
+	}
+	if attrExpiration != 0 {
+		getOrAddBlock(config, "EXPORT_DEFAULTS").Set("Attr_Expiration_Time", strconv.Itoa(int(attrExpiration.Seconds())))
+	}
+
+	return ioutil.WriteFile(ganeshaConfig, []byte(config.String()), 0600)
+}
+
+// setKerberos activates Kerberos in the NFS_KRB5 block of the ganesha config
+// with the given keytab, adding the block if there isn't one. An empty
+// krb5Keytab leaves ganesha's choice alone.
+func setKerberos(ganeshaConfig, krb5Keytab string) error {
+	if krb5Keytab == "" {
+		return nil
+	}
+	config, err := ganesha.ReadFile(ganeshaConfig)
+	if err != nil {
+		return err
+	}
+	krb5 := getOrAddBlock(config, "NFS_KRB5")
+	krb5.Set("Active_krb5", "true")
+	krb5.Set("KeytabPath", krb5Keytab)
+
+	return ioutil.WriteFile(ganeshaConfig, []byte(config.String()), 0600)
+}
+
+// getOrAddBlock returns the first top-level block of the config with the given
+// name, adding an empty one if there isn't one.
+func getOrAddBlock(config *ganesha.Block, name string) *ganesha.Block {
+	if blocks := config.Blocks(name); len(blocks) > 0 {
+		return blocks[0]
+	}
+	block := ganesha.NewBlock(name)
+	config.AddBlock(block)
+	return block
+}
+
+// ParseMinorVersions parses a comma-separated list of NFSv4 minor versions,
+// e.g. "0,1". Ganesha serves minor versions 0, 1 and 2.
+func ParseMinorVersions(s string) ([]int, error) {
+	versions := []int{}
+	seen := map[int]bool{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		v, err := strconv.Atoi(field)
+		if err != nil || v < 0 || v > 2 {
+			return nil, fmt.Errorf("invalid NFSv4 minor version %q, must be 0, 1 or 2", field)
+		}
+		if !seen[v] {
+			seen[v] = true
+			versions = append(versions, v)
+		}
+	}
+	return versions, nil
+}
+
+// logLevels are the log levels of NFS Ganesha, from least to most verbose.
+var logLevels = []string{"NULL", "FATAL", "MAJ", "CRIT", "WARN", "EVENT", "INFO", "DEBUG", "MID_DEBUG", "FULL_DEBUG"}
+
+// ParseLogLevel parses an NFS Ganesha log level, e.g. "DEBUG" or "NIV_DEBUG",
+// case-insensitively, and returns it without the NIV_ prefix, as the LOG block
+// of the config takes it. An empty level is returned as is.
+func ParseLogLevel(s string) (string, error) {
+	level := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(s)), "NIV_")
+	if level == "" {
+		return "", nil
+	}
+	for _, l := range logLevels {
+		if level == l {
+			return level, nil
+		}
+	}
+	return "", fmt.Errorf("invalid NFS Ganesha log level %q, must be one of %s", s, strings.Join(logLevels, ", "))
+}
+
+// SetLogLevel sets the log level of every component of the running NFS
+// Ganesha using D-Bus, so that it takes effect without a restart.
+func SetLogLevel(logLevel string) error {
+	call := ganesha.Call(ganesha.AdminPath, "org.freedesktop.DBus.Properties.Set", "org.ganesha.nfsd.log.component", "COMPONENT_ALL", dbus.MakeVariant("NIV_"+logLevel))
+	if call.Err != nil {
+		return fmt.Errorf("error setting property org.ganesha.nfsd.log.component.COMPONENT_ALL: %v", call.Err)
+	}
+
+	return nil
+}
+
+// StartGrace (re)starts the NFSv4 grace period of NFS Ganesha using D-Bus.
+// NFS Ganesha starts in grace, but the provisioner may re-add exports that had
+// gone missing from the config file only after it has started, so by the time
+// they're back a good part of the grace period may have passed. Calling this
+// once all exports are back gives clients the whole grace period to reclaim
+// their locks on any of them. NFS Ganesha lifts grace by itself once the grace
+// period is over or all clients have reclaimed.
+func StartGrace() error {
+	call := ganesha.Call(ganesha.AdminPath, "org.ganesha.nfsd.admin.grace", "0")
+	if call.Err != nil {
+		return fmt.Errorf("error calling org.ganesha.nfsd.admin.grace: %v", call.Err)
 	}
 
 	return nil
 }
 
-// Stop stops the NFS server.
-func Stop() {
-	// /bin/dbus-send --system   --dest=org.ganesha.nfsd --type=method_call /org/ganesha/nfsd/admin org.ganesha.nfsd.admin.shutdown
+// Stop stops the NFS server, letting NFS Ganesha shut down cleanly, e.g. so
+// that it records client state for the grace period on its next start. If the
+// server processes are run as children, it waits for NFS Ganesha to exit and
+// then stops the processes it depends on.
+func Stop() error {
+	call := ganesha.Call(ganesha.AdminPath, "org.ganesha.nfsd.admin.shutdown")
+	if !asChildren {
+		if call.Err != nil {
+			return fmt.Errorf("error calling org.ganesha.nfsd.admin.shutdown: %v", call.Err)
+		}
+		return nil
+	}
+
+	childLock.Lock()
+	if ganeshaChild != nil {
+		if call.Err != nil || !ganeshaChild.wait(childStopTimeout) {
+			glog.Errorf("NFS Ganesha didn't shut down cleanly, stopping it")
+			ganeshaChild.stop()
+		}
+		ganeshaChild = nil
+	}
+	childLock.Unlock()
+	stopHelpers()
+
+	if call.Err != nil {
+		return fmt.Errorf("error calling org.ganesha.nfsd.admin.shutdown: %v", call.Err)
+	}
+	return nil
 }
@@ -0,0 +1,165 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tracing records spans of operations, e.g. provisioning a volume and
+// each of its stages, as Zipkin v2 JSON lines that can be sent to a Zipkin or
+// Jaeger collector, so that operators can see where a claim's latency goes.
+// Tracing is off until SetOutput is called, then Start returns nil spans, on
+// which every method does nothing.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// ServiceName is the local endpoint spans are recorded with.
+const ServiceName = "nfs-provisioner"
+
+var (
+	lock   sync.Mutex
+	output io.Writer
+)
+
+// SetOutput makes spans be appended to the given file. If the path is empty,
+// tracing stays off.
+func SetOutput(path string) error {
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening trace file %s: %v", path, err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	output = f
+	return nil
+}
+
+// Span is an operation within a trace, timed from Start to Finish.
+type Span struct {
+	traceID  string
+	id       string
+	parentID string
+	name     string
+	start    time.Time
+
+	tagsLock sync.Mutex
+	tags     map[string]string
+}
+
+// Start starts a span of the given name, a child of the given parent or, if
+// the parent is nil, the root of a new trace. It returns nil if tracing is
+// off.
+func Start(name string, parent *Span) *Span {
+	lock.Lock()
+	on := output != nil
+	lock.Unlock()
+	if !on {
+		return nil
+	}
+
+	s := &Span{id: newID(8), name: name, start: time.Now(), tags: map[string]string{}}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.id
+	} else {
+		s.traceID = newID(16)
+	}
+	return s
+}
+
+// SetTag tags the span with the given key and value, e.g. the PV it's about.
+func (s *Span) SetTag(key, value string) {
+	if s == nil {
+		return
+	}
+	s.tagsLock.Lock()
+	defer s.tagsLock.Unlock()
+	s.tags[key] = value
+}
+
+// Finish ends the span and records it, tagged with the given error, if any.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	if err != nil {
+		s.SetTag("error", err.Error())
+	}
+	line, encodeErr := s.encode(time.Since(s.start))
+	if encodeErr != nil {
+		return
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if output != nil {
+		output.Write(line)
+	}
+}
+
+// zipkinSpan is a span in the Zipkin v2 JSON format. Times are in
+// microseconds.
+type zipkinSpan struct {
+	TraceID       string            `json:"traceId"`
+	ID            string            `json:"id"`
+	ParentID      string            `json:"parentId,omitempty"`
+	Name          string            `json:"name"`
+	Timestamp     int64             `json:"timestamp"`
+	Duration      int64             `json:"duration"`
+	LocalEndpoint zipkinEndpoint    `json:"localEndpoint"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName"`
+}
+
+// encode returns the span, which took the given duration, as a Zipkin v2 JSON
+// object on its own line.
+func (s *Span) encode(duration time.Duration) ([]byte, error) {
+	s.tagsLock.Lock()
+	defer s.tagsLock.Unlock()
+	line, err := json.Marshal(zipkinSpan{
+		TraceID:       s.traceID,
+		ID:            s.id,
+		ParentID:      s.parentID,
+		Name:          s.name,
+		Timestamp:     s.start.UnixNano() / int64(time.Microsecond),
+		Duration:      int64(duration / time.Microsecond),
+		LocalEndpoint: zipkinEndpoint{ServiceName: ServiceName},
+		Tags:          s.tags,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// newID returns a random hex ID of the given number of bytes.
+func newID(bytes int) string {
+	b := make([]byte, bytes)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
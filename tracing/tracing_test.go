@@ -0,0 +1,78 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpans(t *testing.T) {
+	if s := Start("off", nil); s != nil {
+		t.Errorf("expected nil span while tracing is off, got %v", s)
+	}
+
+	var buf bytes.Buffer
+	lock.Lock()
+	output = &buf
+	lock.Unlock()
+	defer func() {
+		lock.Lock()
+		output = nil
+		lock.Unlock()
+	}()
+
+	root := Start("provision", nil)
+	root.SetTag("pv", "pvc-1")
+	child := Start("directory", root)
+	child.Finish(errors.New("permission denied"))
+	root.Finish(nil)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 spans, got %q", buf.String())
+	}
+	var spans [2]zipkinSpan
+	for i, line := range lines {
+		if err := json.Unmarshal([]byte(line), &spans[i]); err != nil {
+			t.Fatalf("error decoding span %q: %v", line, err)
+		}
+	}
+	c, r := spans[0], spans[1]
+	if c.Name != "directory" || c.TraceID != r.TraceID || c.ParentID != r.ID || c.Tags["error"] != "permission denied" {
+		t.Errorf("expected child span of %+v, got %+v", r, c)
+	}
+	if r.Name != "provision" || r.ParentID != "" || len(r.TraceID) != 32 || len(r.ID) != 16 || r.Tags["pv"] != "pvc-1" || r.LocalEndpoint.ServiceName != ServiceName {
+		t.Errorf("unexpected root span %+v", r)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	s := &Span{traceID: "t", id: "i", parentID: "p", name: "export", start: time.Unix(1, 5000), tags: map[string]string{}}
+	expected := `{"traceId":"t","id":"i","parentId":"p","name":"export","timestamp":1000005,"duration":1500,"localEndpoint":{"serviceName":"nfs-provisioner"}}` + "\n"
+	got, err := s.encode(1500 * time.Microsecond)
+	if err != nil {
+		t.Fatalf("unexpected error encoding span: %v", err)
+	}
+	if string(got) != expected {
+		t.Errorf("expected %q, got %q", expected, string(got))
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package version reports the build of the provisioner: the git commit it was
+// built from, when, with which Go and the features it supports, so that
+// operators can tell what a running instance can do.
+package version
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+
+	"github.com/wongma7/nfs-provisioner/metrics"
+)
+
+// Set at build time with -ldflags "-X", see the Makefile
+var (
+	gitCommit = "unknown"
+	buildDate = "unknown"
+)
+
+// features are the features this build supports that a deployment may depend
+// on, named after the flags, subcommands or parameters that use them.
+var features = []string{
+	"ganesha",
+	"kernel",
+	"additional-exporter",
+	"kernel-nfsv4-root",
+	"pnfs",
+	"kerberos",
+	"snapshots-btrfs",
+	"snapshots-zfs",
+	"clone",
+	"export-resource",
+	"additional-export-dirs",
+	"annotation-domain",
+	"leader-elect",
+	"dry-run",
+	"stub-exports-file",
+	"benchmark",
+	"fsck",
+	"exports",
+}
+
+// Info is the build of the provisioner.
+type Info struct {
+	GitCommit string   `json:"gitCommit"`
+	BuildDate string   `json:"buildDate"`
+	GoVersion string   `json:"goVersion"`
+	Features  []string `json:"features"`
+}
+
+// Get returns the build of the provisioner.
+func Get() Info {
+	return Info{
+		GitCommit: gitCommit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Features:  append([]string{}, features...),
+	}
+}
+
+// String returns the build on a line, e.g. for --version.
+func (i Info) String() string {
+	return fmt.Sprintf("nfs-provisioner commit %s, built %s with %s, features: %s", i.GitCommit, i.BuildDate, i.GoVersion, strings.Join(i.Features, ","))
+}
+
+// Handler serves the build as JSON.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Get())
+	})
+}
+
+// Collector exposes the build as the labels of a metric that is always 1, so
+// that it can be joined with the provisioner's other metrics.
+type Collector struct{}
+
+var _ metrics.Collector = Collector{}
+
+func (Collector) Collect() []metrics.Family {
+	info := Get()
+	return []metrics.Family{{
+		Name: "nfs_provisioner_build_info",
+		Help: "The build of the provisioner: its git commit, build date, Go version and supported features. Always 1.",
+		Type: metrics.Gauge,
+		Samples: []metrics.Sample{{
+			Labels: metrics.Labels{
+				"git_commit": info.GitCommit,
+				"build_date": info.BuildDate,
+				"go_version": info.GoVersion,
+				"features":   strings.Join(info.Features, ","),
+			},
+			Value: 1,
+		}},
+	}}
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package version
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wongma7/nfs-provisioner/metrics"
+)
+
+func TestVersion(t *testing.T) {
+	gitCommit, buildDate = "abc123", "2016-11-01T00:00:00Z"
+	defer func() { gitCommit, buildDate = "unknown", "unknown" }()
+
+	req, err := http.NewRequest("GET", "/version", nil)
+	if err != nil {
+		t.Fatalf("error creating request: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, req)
+	var info Info
+	if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+		t.Fatalf("error decoding /version: %v", err)
+	}
+	if !reflect.DeepEqual(info, Get()) {
+		t.Errorf("expected /version %+v but got %+v", Get(), info)
+	}
+	if info.GitCommit != "abc123" || info.BuildDate != "2016-11-01T00:00:00Z" {
+		t.Errorf("expected commit and build date set at build time but got %+v", info)
+	}
+	if s := info.String(); !strings.Contains(s, "commit abc123") || !strings.Contains(s, "fsck") {
+		t.Errorf("expected version line with commit and features but got %q", s)
+	}
+
+	var buf bytes.Buffer
+	if err := metrics.Write(&buf, Collector{}.Collect()); err != nil {
+		t.Fatalf("error writing metrics: %v", err)
+	}
+	if !strings.Contains(buf.String(), `git_commit="abc123"`) {
+		t.Errorf("expected build info metric labeled with commit but got:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"syscall"
+)
+
+// The extended attributes Linux stores a file's access ACL and a directory's
+// default ACL, which files created in it inherit, in.
+const (
+	aclAccessXattr  = "system.posix_acl_access"
+	aclDefaultXattr = "system.posix_acl_default"
+)
+
+// The tags of POSIX ACL entries, in the order entries must be in, and the
+// version of the extended attributes' format.
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+
+	aclVersion   = 2
+	aclUndefined = 0xffffffff
+)
+
+// aclEntry is an entry of a POSIX ACL granting the permissions perm, e.g. 07
+// for rwx, to the user or group id, if its tag is aclUser or aclGroup.
+type aclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+// setACL sets the access and default ACLs of the given directory to grant
+// the owner, the owning group and others the permissions of the given mode and
+// the given named users and groups rwx, so that files created in it grant them
+// the same. Setting the access ACL makes the mode's group bits the ACL's mask,
+// so it must be set after any chmod.
+func setACL(path string, mode os.FileMode, uids, gids []uint32) error {
+	acl := encodeACL(mode, uids, gids)
+	if err := syscall.Setxattr(path, aclAccessXattr, acl, 0); err != nil {
+		return fmt.Errorf("error setting access ACL of %s: %v", path, err)
+	}
+	if err := syscall.Setxattr(path, aclDefaultXattr, acl, 0); err != nil {
+		return fmt.Errorf("error setting default ACL of %s: %v", path, err)
+	}
+	return nil
+}
+
+// encodeACL encodes the ACL setACL sets into the format of the extended
+// attributes.
+func encodeACL(mode os.FileMode, uids, gids []uint32) []byte {
+	perm := uint16(mode.Perm())
+	entries := []aclEntry{{tag: aclUserObj, perm: perm >> 6 & 07, id: aclUndefined}}
+	for _, uid := range sortedIds(uids) {
+		entries = append(entries, aclEntry{tag: aclUser, perm: 07, id: uid})
+	}
+	entries = append(entries, aclEntry{tag: aclGroupObj, perm: perm >> 3 & 07, id: aclUndefined})
+	for _, gid := range sortedIds(gids) {
+		entries = append(entries, aclEntry{tag: aclGroup, perm: 07, id: gid})
+	}
+	if len(uids) != 0 || len(gids) != 0 {
+		// Named entries need a mask, which mustn't take away their rwx
+		entries = append(entries, aclEntry{tag: aclMask, perm: 07, id: aclUndefined})
+	}
+	entries = append(entries, aclEntry{tag: aclOther, perm: perm & 07, id: aclUndefined})
+
+	buf := make([]byte, 4+8*len(entries))
+	binary.LittleEndian.PutUint32(buf, aclVersion)
+	for i, entry := range entries {
+		b := buf[4+8*i:]
+		binary.LittleEndian.PutUint16(b, entry.tag)
+		binary.LittleEndian.PutUint16(b[2:], entry.perm)
+		binary.LittleEndian.PutUint32(b[4:], entry.id)
+	}
+	return buf
+}
+
+// sortedIds returns the given ids sorted and without duplicates, as the
+// entries of an ACL with the same tag must be.
+func sortedIds(ids []uint32) []uint32 {
+	sorted := []uint32{}
+	seen := map[uint32]bool{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			sorted = append(sorted, id)
+		}
+	}
+	sort.Sort(uint32Slice(sorted))
+	return sorted
+}
+
+type uint32Slice []uint32
+
+func (s uint32Slice) Len() int           { return len(s) }
+func (s uint32Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
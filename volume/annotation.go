@@ -0,0 +1,91 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// exportAnnotations are the PV annotations of the export backing the PV that
+// are namespaced under the annotation domain, if there is one. PVs provisioned
+// before it was set carry them under these legacy keys.
+var exportAnnotations = []string{annBlock, annExportId}
+
+// annotationKey returns the key of the given export annotation, namespaced
+// under the annotation domain if there is one.
+func (p *nfsProvisioner) annotationKey(key string) string {
+	if p.annotationDomain == "" {
+		return key
+	}
+	return p.annotationDomain + "/" + key
+}
+
+// getAnnotation returns the value of the given export annotation of the given
+// PV and whether it has it, under its namespaced key or else its legacy one,
+// in case the PV hasn't been migrated yet.
+func (p *nfsProvisioner) getAnnotation(volume *v1.PersistentVolume, key string) (string, bool) {
+	if value, ok := volume.Annotations[p.annotationKey(key)]; ok {
+		return value, true
+	}
+	value, ok := volume.Annotations[key]
+	return value, ok
+}
+
+// migrateAnnotations moves the export annotations of the PVs this provisioner
+// created from their legacy keys to their namespaced ones. A namespaced
+// annotation the PV already has is kept.
+func (p *nfsProvisioner) migrateAnnotations() error {
+	if p.annotationDomain == "" {
+		return nil
+	}
+	volumes, err := p.client.Core().PersistentVolumes().List(api.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error listing PVs: %v", err)
+	}
+
+	for i := range volumes.Items {
+		volume := &volumes.Items[i]
+		if volume.Annotations[annCreatedBy] != createdBy {
+			continue
+		}
+		migrated := false
+		for _, key := range exportAnnotations {
+			value, ok := volume.Annotations[key]
+			if !ok {
+				continue
+			}
+			if _, ok := volume.Annotations[p.annotationKey(key)]; !ok {
+				volume.Annotations[p.annotationKey(key)] = value
+			}
+			delete(volume.Annotations, key)
+			migrated = true
+		}
+		if !migrated {
+			continue
+		}
+		if _, err := p.client.Core().PersistentVolumes().Update(volume); err != nil {
+			glog.Errorf("error migrating annotations of PV %s to domain %s: %v", volume.Name, p.annotationDomain, err)
+			continue
+		}
+		glog.Infof("migrated annotations of PV %s to domain %s", volume.Name, p.annotationDomain)
+	}
+	return nil
+}
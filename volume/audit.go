@@ -0,0 +1,112 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// The export mutations recorded in the audit log.
+const (
+	auditAdd      = "add"
+	auditUpdate   = "update"
+	auditRemove   = "remove"
+	auditUnexport = "unexport"
+)
+
+// auditEntry is a line of the audit log: an export mutation, what made the
+// provisioner do it and when.
+type auditEntry struct {
+	Time   string `json:"time"`
+	Action string `json:"action"`
+	// The provisioner operation that did the mutation, e.g. provision or
+	// reconcile
+	Operation string `json:"operation"`
+	PV        string `json:"pv,omitempty"`
+	// The claim, namespace/name, the PV was provisioned for, if known
+	Claim string `json:"claim,omitempty"`
+	Path  string `json:"path"`
+	Block string `json:"block"`
+}
+
+// auditLog is an append-only file of JSON lines recording every export the
+// provisioner adds, updates and removes, e.g. to find out who removed an
+// export.
+type auditLog struct {
+	path  string
+	mutex sync.Mutex
+}
+
+// newAuditLog returns an audit log appending to the given file, or nil if the
+// path is empty.
+func newAuditLog(path string) *auditLog {
+	if path == "" {
+		return nil
+	}
+	return &auditLog{path: path}
+}
+
+// record appends the given entry to the audit log, timestamped now. The file
+// is opened for every entry so that it can be rotated by moving it.
+func (a *auditLog) record(entry auditEntry) error {
+	entry.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error encoding audit log entry: %v", err)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening audit log %s: %v", a.path, err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing audit log %s: %v", a.path, err)
+	}
+	return nil
+}
+
+// audit records the given mutation of the export with the given path and
+// block in the audit log, if there is one. The PV and claim may be empty if
+// the export has none.
+func (p *nfsProvisioner) audit(action, operation, pvName, claim, path, block string) {
+	if p.auditLog == nil {
+		return
+	}
+	entry := auditEntry{Action: action, Operation: operation, PV: pvName, Claim: claim, Path: path, Block: block}
+	if err := p.auditLog.record(entry); err != nil {
+		glog.Errorf("error recording %s of export of %s in audit log: %v", action, path, err)
+	}
+}
+
+// volumeClaim returns the namespace/name of the claim the given PV is bound
+// to, or empty if it isn't.
+func volumeClaim(volume *v1.PersistentVolume) string {
+	if ref := volume.Spec.ClaimRef; ref != nil {
+		return ref.Namespace + "/" + ref.Name
+	}
+	return ""
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// exportBatcher coalesces the kernel exports and unexports requested within a
+// window of the first of them into a single `exportfs -r`, which syncs the
+// active exports with /etc/exports and the drop-in files in /etc/exports.d,
+// instead of one `exportfs -o` or `exportfs -u` per client of each, so that
+// throughput holds up when many claims arrive together.
+type exportBatcher struct {
+	window time.Duration
+	// refresh syncs the active exports and returns, for each of the given
+	// paths, an error if it isn't active, if it should be, or is, if it
+	// shouldn't
+	refresh func(map[string]bool) (map[string]error, error)
+
+	mutex sync.Mutex
+	// The batch collecting requests until the window ends, nil if there is none
+	batch *exportBatch
+}
+
+// exportBatch is the requests coalesced into one refresh.
+type exportBatch struct {
+	// Whether each path should be active after the refresh
+	paths map[string]bool
+	// Closed once the refresh is done and errs and err are set
+	done chan struct{}
+	errs map[string]error
+	err  error
+}
+
+func newExportBatcher(window time.Duration) *exportBatcher {
+	return &exportBatcher{window: window, refresh: refreshExports}
+}
+
+// sync waits for the refresh of the batch the request that the given path be
+// active or not is coalesced into and returns whether that failed or left the
+// path otherwise. The block exporting the path must already have been added to
+// or removed from the config.
+func (b *exportBatcher) sync(path string, active bool) error {
+	b.mutex.Lock()
+	batch := b.batch
+	if batch == nil {
+		batch = &exportBatch{paths: map[string]bool{}, done: make(chan struct{})}
+		b.batch = batch
+		time.AfterFunc(b.window, b.flush)
+	}
+	batch.paths[path] = active
+	b.mutex.Unlock()
+
+	<-batch.done
+	if batch.err != nil {
+		return batch.err
+	}
+	return batch.errs[path]
+}
+
+// flush refreshes the current batch, letting requests coalesce into a new one.
+func (b *exportBatcher) flush() {
+	b.mutex.Lock()
+	batch := b.batch
+	b.batch = nil
+	b.mutex.Unlock()
+
+	batch.errs, batch.err = b.refresh(batch.paths)
+	close(batch.done)
+}
+
+// refreshExports runs `exportfs -r` and returns, for each of the given paths,
+// an error if it isn't among the active exports, if it should be, or is, if it
+// shouldn't.
+func refreshExports(paths map[string]bool) (map[string]error, error) {
+	out, err := exec.Command("exportfs", "-r").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("exportfs -r failed with error: %v, output: %s", err, out)
+	}
+
+	exported, err := exportfsList()
+	if err != nil {
+		return nil, err
+	}
+	active := map[string]bool{}
+	for _, entry := range exported {
+		active[entry.path] = true
+	}
+
+	errs := map[string]error{}
+	for path, wanted := range paths {
+		if wanted && !active[path] {
+			errs[path] = fmt.Errorf("exportfs -r succeeded but %s isn't among the active exports", path)
+		} else if !wanted && active[path] {
+			errs[path] = fmt.Errorf("exportfs -r succeeded but %s is still among the active exports", path)
+		}
+	}
+	return errs, nil
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/wongma7/nfs-provisioner/controller"
+	"k8s.io/client-go/1.4/kubernetes"
+	"k8s.io/client-go/1.4/pkg/api/resource"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/util/uuid"
+)
+
+// BenchmarkReport is the result of Benchmark.
+type BenchmarkReport struct {
+	Volumes     int
+	Concurrency int
+	// How many cycles failed to provision or delete their volume, and the
+	// error of the first of them
+	Failed     int
+	FirstError error
+	Duration   time.Duration
+	// The latencies of the successful provisions and deletes
+	Provision []time.Duration
+	Delete    []time.Duration
+}
+
+// Benchmark runs the given number of cycles of provisioning a volume with the
+// given provisioner and deleting it, concurrency of them at a time, the way the
+// controller would, creating and deleting their PVs with the given client,
+// which needn't be a real API server's. It helps admins size a deployment by
+// measuring how many volumes per second the directories and exports of the
+// provisioner's configuration can be created and removed at.
+func Benchmark(provisioner controller.Provisioner, client kubernetes.Interface, volumes, concurrency int) *BenchmarkReport {
+	report := &BenchmarkReport{Volumes: volumes, Concurrency: concurrency}
+	var mutex sync.Mutex
+	fail := func(err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if report.Failed == 0 {
+			report.FirstError = err
+		}
+		report.Failed++
+	}
+
+	cycles := make(chan int, volumes)
+	for i := 0; i < volumes; i++ {
+		cycles <- i
+	}
+	close(cycles)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range cycles {
+				provisioned, deleted, err := benchmarkCycle(provisioner, client, i)
+				mutex.Lock()
+				if provisioned != 0 {
+					report.Provision = append(report.Provision, provisioned)
+				}
+				if deleted != 0 {
+					report.Delete = append(report.Delete, deleted)
+				}
+				mutex.Unlock()
+				if err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	report.Duration = time.Since(start)
+
+	return report
+}
+
+// benchmarkCycle provisions the i-th volume of a benchmark and deletes it,
+// returning how long each took, zero if it failed.
+func benchmarkCycle(provisioner controller.Provisioner, client kubernetes.Interface, i int) (time.Duration, time.Duration, error) {
+	claim := &v1.PersistentVolumeClaim{}
+	claim.Name = fmt.Sprintf("benchmark-%d", i)
+	claim.Namespace = v1.NamespaceDefault
+	options := controller.VolumeOptions{
+		Capacity:                      resource.MustParse("1Mi"),
+		AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+		PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+		PVName:                        "pvc-" + string(uuid.NewUUID()),
+		Parameters:                    map[string]string{},
+		PVC:                           claim,
+	}
+
+	start := time.Now()
+	volume, err := provisioner.Provision(options)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error provisioning volume %s: %v", options.PVName, err)
+	}
+	provisioned := time.Since(start)
+	if volume, err = client.Core().PersistentVolumes().Create(volume); err != nil {
+		return provisioned, 0, fmt.Errorf("error creating PV %s: %v", options.PVName, err)
+	}
+
+	start = time.Now()
+	if err := provisioner.Delete(volume); err != nil {
+		return provisioned, 0, fmt.Errorf("error deleting volume %s: %v", volume.Name, err)
+	}
+	deleted := time.Since(start)
+	if err := client.Core().PersistentVolumes().Delete(volume.Name, nil); err != nil {
+		return provisioned, deleted, fmt.Errorf("error deleting PV %s: %v", volume.Name, err)
+	}
+	return provisioned, deleted, nil
+}
+
+// Print writes the throughput of the benchmark and the percentiles of its
+// latencies to w.
+func (r *BenchmarkReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "%d volumes, %d at a time, in %v: %.1f volumes/s\n", r.Volumes, r.Concurrency, r.Duration, float64(r.Volumes-r.Failed)/r.Duration.Seconds())
+	if r.Failed != 0 {
+		fmt.Fprintf(w, "%d failed, the first with: %v\n", r.Failed, r.FirstError)
+	}
+	for _, operation := range []struct {
+		name      string
+		latencies []time.Duration
+	}{{"provision", r.Provision}, {"delete", r.Delete}} {
+		if len(operation.latencies) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%s latency: p50 %v, p90 %v, p99 %v, max %v\n", operation.name,
+			percentile(operation.latencies, 0.5), percentile(operation.latencies, 0.9), percentile(operation.latencies, 0.99), percentile(operation.latencies, 1))
+	}
+}
+
+// percentile returns the q-th quantile of the given latencies, which mustn't
+// be empty.
+func percentile(latencies []time.Duration, q float64) time.Duration {
+	sorted := append([]time.Duration{}, latencies...)
+	sort.Sort(durationSlice(sorted))
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+type durationSlice []time.Duration
+
+func (s durationSlice) Len() int           { return len(s) }
+func (s durationSlice) Less(i, j int) bool { return s[i] < s[j] }
+func (s durationSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,120 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// reserveCapacity places the directory of the given PV in one of the given
+// export directories, picked by the placement policy among those whose
+// filesystem the PV fits in, and reserves the given capacity of the filesystem
+// for the PV, until releaseCapacity, so that the capacity of every volume
+// counts against the filesystem's size even while its directory is still
+// empty. It returns the export directory. Checking and reserving is atomic, so
+// that claims provisioned concurrently, e.g. two of 500Gi with 600Gi free,
+// can't all pass the check when only some fit. If namespace isn't empty, it's
+// the namespace of the PV's claim, whose quota, if it has one, the capacity
+// reserved for its claims mustn't exceed either.
+func (p *nfsProvisioner) reserveCapacity(pvName, namespace string, dirs []string, capacity int64) (string, error) {
+	quotas, err := p.getNamespaceQuotas()
+	if err != nil {
+		return "", err
+	}
+	sizes, available := map[string]int64{}, map[string]int64{}
+	for _, dir := range dirs {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(dir, &stat); err != nil {
+			return "", fmt.Errorf("error calling statfs on %v: %v", dir, err)
+		}
+		sizes[dir] = int64(stat.Blocks) * stat.Bsize
+		available[dir] = int64(stat.Bavail) * stat.Bsize
+	}
+
+	p.mapMutex.Lock()
+	defer p.mapMutex.Unlock()
+	if quota, ok := quotaOf(quotas, namespace); ok && namespace != "" {
+		if used := p.namespaceReserved(namespace, pvName); used+capacity > quota {
+			return "", &quotaExceededError{namespace: namespace, quota: quota, used: used, capacity: capacity}
+		}
+	}
+	reserved := map[string]int64{}
+	for pv, c := range p.reservations {
+		if pv != pvName {
+			reserved[p.placementOf(pv)] += c
+		}
+	}
+	fits := []string{}
+	free := map[string]int64{}
+	errs := []string{}
+	for _, dir := range dirs {
+		unreserved := sizes[dir] - reserved[dir]
+		if capacity > unreserved {
+			errs = append(errs, fmt.Sprintf("insufficient unreserved space %v bytes in %s to satisfy claim for %v bytes, %v of the filesystem's %v bytes are reserved by other volumes", unreserved, dir, capacity, reserved[dir], sizes[dir]))
+			continue
+		}
+		fits = append(fits, dir)
+		free[dir] = unreserved
+		if available[dir] < unreserved {
+			free[dir] = available[dir]
+		}
+	}
+	if len(fits) == 0 {
+		return "", fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	dir := p.pickExportDir(fits, free)
+	p.reservations[pvName] = capacity
+	p.placements[pvName] = dir
+	if namespace != "" {
+		p.namespaces[pvName] = namespace
+	}
+	return dir, nil
+}
+
+// releaseCapacity releases the capacity reserved for the given PV, if any, and
+// forgets where its directory was placed.
+func (p *nfsProvisioner) releaseCapacity(pvName string) {
+	p.mapMutex.Lock()
+	defer p.mapMutex.Unlock()
+	delete(p.reservations, pvName)
+	delete(p.placements, pvName)
+	delete(p.subdirs, pvName)
+	delete(p.namespaces, pvName)
+}
+
+// reserveExistingCapacity reserves the capacity of the given PV, which already
+// exists, in the export directory its directory is in without checking that it
+// fits, to rebuild the reservations and placements on startup.
+func (p *nfsProvisioner) reserveExistingCapacity(volume *v1.PersistentVolume) {
+	p.mapMutex.Lock()
+	defer p.mapMutex.Unlock()
+	if dir := p.exportDirOf(p.volumePath(volume)); dir != "" {
+		p.placements[volume.Name] = dir
+	}
+	if ref := volume.Spec.ClaimRef; ref != nil && ref.Namespace != "" {
+		p.namespaces[volume.Name] = ref.Namespace
+	}
+	capacity, ok := volume.Spec.Capacity[v1.ResourceStorage]
+	if !ok {
+		return
+	}
+	p.reservations[volume.Name] = capacity.Value()
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/wongma7/nfs-provisioner/controller"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+const (
+	// A claim annotation for the name of a claim in the same namespace, bound
+	// to a PV this provisioner created, whose PV's directory is copied into the
+	// directory of the claim's volume before the volume is exported.
+	annCloneFrom = "nfs-provisioner.kubernetes.io/clone-from"
+
+	// A claim annotation like annCloneFrom but for a snapshot of the other
+	// claim's PV, <claim>/<snapshot>, which is copied instead.
+	annRestoreFrom = "nfs-provisioner.kubernetes.io/restore-from"
+)
+
+// cloneSource is what the directory of a new volume is copied from: the
+// directory of a PV or, if snapshot isn't empty, the PV's snapshot of that
+// name.
+type cloneSource struct {
+	volume   *v1.PersistentVolume
+	snapshot string
+}
+
+// getCloneSource gets the source of the volume of the given options from the
+// annotation annCloneFrom or annRestoreFrom of its claim, or nil if the claim
+// has neither. The source's PV must be one this provisioner created whose
+// directory exists, and no bigger than the claim asks for.
+func (p *nfsProvisioner) getCloneSource(options controller.VolumeOptions) (*cloneSource, error) {
+	if options.PVC == nil {
+		return nil, nil
+	}
+	clone, cloning := options.PVC.Annotations[annCloneFrom]
+	restore, restoring := options.PVC.Annotations[annRestoreFrom]
+	if cloning && restoring {
+		return nil, fmt.Errorf("claim can't have both annotations %s and %s", annCloneFrom, annRestoreFrom)
+	}
+	source := &cloneSource{}
+	name := clone
+	if restoring {
+		parts := strings.SplitN(restore, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid value %q for annotation %s, must be <claim>/<snapshot>", restore, annRestoreFrom)
+		}
+		name, source.snapshot = parts[0], parts[1]
+	} else if !cloning {
+		return nil, nil
+	}
+
+	namespace := options.PVC.Namespace
+	claim, err := p.client.Core().PersistentVolumeClaims(namespace).Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("error getting claim %s/%s to clone: %v", namespace, name, err)
+	}
+	if claim.Spec.VolumeName == "" {
+		return nil, fmt.Errorf("claim %s/%s to clone isn't bound", namespace, name)
+	}
+	volume, err := p.client.Core().PersistentVolumes().Get(claim.Spec.VolumeName)
+	if err != nil {
+		return nil, fmt.Errorf("error getting PV %s of claim %s/%s to clone: %v", claim.Spec.VolumeName, namespace, name, err)
+	}
+	if volume.Annotations[annCreatedBy] != createdBy || volume.Spec.NFS == nil || volume.Spec.NFS.Path != p.exportDirOf(volume.Spec.NFS.Path)+volume.Name {
+		return nil, fmt.Errorf("PV %s of claim %s/%s to clone wasn't created by this provisioner", volume.Name, namespace, name)
+	}
+	if _, err := os.Stat(volume.Spec.NFS.Path); err != nil {
+		return nil, fmt.Errorf("error stating directory of PV %s to clone: %v", volume.Name, err)
+	}
+	if capacity, ok := volume.Spec.Capacity[v1.ResourceStorage]; ok && capacity.Cmp(options.Capacity) > 0 {
+		return nil, fmt.Errorf("claim asks for %s, less than the capacity %s of PV %s to clone", options.Capacity.String(), capacity.String(), volume.Name)
+	}
+	if source.snapshot != "" {
+		exports, err := getSnapshotExports(volume)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := exports[source.snapshot]; !ok {
+			return nil, fmt.Errorf("PV %s of claim %s/%s has no snapshot %q to restore", volume.Name, namespace, name, source.snapshot)
+		}
+	}
+	source.volume = volume
+	return source, nil
+}
+
+// cloneDirectory copies the contents of the given source into the given path.
+// A PV's directory is copied from a snapshot taken for the copy, if snapshots
+// are enabled, so that the copy is of a single point in time even if clients
+// write to the PV meanwhile, and then deleted.
+func (p *nfsProvisioner) cloneDirectory(source *cloneSource, path string) error {
+	p.volumeMutex.Lock(source.volume.Name)
+	defer p.volumeMutex.Unlock(source.volume.Name)
+
+	if source.snapshot != "" {
+		// The snapshot may have been deleted since the source was gotten
+		volume, err := p.client.Core().PersistentVolumes().Get(source.volume.Name)
+		if err != nil {
+			return fmt.Errorf("error getting PV %s: %v", source.volume.Name, err)
+		}
+		exports, err := getSnapshotExports(volume)
+		if err != nil {
+			return err
+		}
+		export, ok := exports[source.snapshot]
+		if !ok {
+			return fmt.Errorf("PV %s has no snapshot %q to restore", volume.Name, source.snapshot)
+		}
+		return copyDirectory(export.Path, path)
+	}
+
+	// Only the directories of PVs in exportDir can be snapshotted
+	if p.snapshotter == nil || p.exportDirOf(source.volume.Spec.NFS.Path) != p.exportDir {
+		return copyDirectory(source.volume.Spec.NFS.Path, path)
+	}
+
+	id := snapshotId(source.volume.Name, "clone-"+filepath.Base(path))
+	snapshot, err := p.snapshotter.snapshot(source.volume.Name, id)
+	if err != nil {
+		return fmt.Errorf("error taking snapshot to clone: %v", err)
+	}
+	defer func() {
+		if err := p.snapshotter.deleteSnapshot(id); err != nil {
+			glog.Errorf("error deleting snapshot %s taken to clone PV %s: %v", id, source.volume.Name, err)
+		}
+	}()
+	return copyDirectory(snapshot, path)
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"syscall"
+)
+
+// StateDumper is implemented by provisioners that can dump their internal
+// state, e.g. for troubleshooting a live instance.
+type StateDumper interface {
+	DumpState() (*State, error)
+}
+
+var _ StateDumper = &nfsProvisioner{}
+
+// State is the internal state of the provisioner.
+type State struct {
+	// The exports in the config file, in its order
+	Exports []ExportState `json:"exports"`
+	// The exportIds in use and the one the next export will get, 0 if all are
+	// in use
+	ExportIds    []uint16 `json:"exportIds"`
+	NextExportId uint16   `json:"nextExportId"`
+}
+
+// ExportState is an export in the config file, the PV it backs if there's a
+// record of it, the group its directory is owned by, i.e. the gid it grants
+// access to, if the directory exists, and its PV's capacity and usage as of
+// the last time usage was measured, if it has been.
+type ExportState struct {
+	Path       string  `json:"path"`
+	ExportId   uint16  `json:"exportId"`
+	PV         string  `json:"pv,omitempty"`
+	Gid        *uint32 `json:"gid,omitempty"`
+	Block      string  `json:"block"`
+	Capacity   *int64  `json:"capacity,omitempty"`
+	UsedBytes  *uint64 `json:"usedBytes,omitempty"`
+	UsedInodes *uint64 `json:"usedInodes,omitempty"`
+}
+
+// DumpState returns the provisioner's exports, as in the config file of its
+// exporter, and exportIds.
+func (p *nfsProvisioner) DumpState() (*State, error) {
+	exports, err := p.exporter.GetConfigExports()
+	if err != nil {
+		return nil, fmt.Errorf("error getting exports in config file %s: %v", p.exporter.GetConfig(), err)
+	}
+	records, err := p.exportStore.List()
+	if err != nil {
+		return nil, fmt.Errorf("error listing export records: %v", err)
+	}
+	pvs := map[string]string{}
+	for _, record := range records {
+		pvs[record.Path] = record.PV
+	}
+	usage := map[string]volumeUsage{}
+	p.usageMutex.Lock()
+	for _, u := range p.usage {
+		usage[u.pv] = u
+	}
+	p.usageMutex.Unlock()
+
+	state := &State{Exports: []ExportState{}, ExportIds: []uint16{}}
+	for _, export := range exports {
+		if !p.inExportDirs(export.path) {
+			continue
+		}
+		e := ExportState{Path: export.path, ExportId: export.exportId, PV: pvs[export.path], Block: export.block}
+		if u, ok := usage[e.PV]; ok && e.PV != "" {
+			e.Capacity, e.UsedBytes, e.UsedInodes = &u.capacity, &u.bytes, &u.inodes
+		}
+		if info, err := os.Stat(export.path); err == nil {
+			if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+				gid := stat.Gid
+				e.Gid = &gid
+			}
+		}
+		state.Exports = append(state.Exports, e)
+	}
+
+	p.mapMutex.Lock()
+	defer p.mapMutex.Unlock()
+	for id := range p.exportIds {
+		state.ExportIds = append(state.ExportIds, id)
+	}
+	sort.Sort(uint16Slice(state.ExportIds))
+	if id, ok := p.nextExportId(); ok {
+		state.NextExportId = id
+	}
+	return state, nil
+}
+
+type uint16Slice []uint16
+
+func (s uint16Slice) Len() int           { return len(s) }
+func (s uint16Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint16Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
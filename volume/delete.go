@@ -22,28 +22,99 @@ import (
 	"os/exec"
 	"strconv"
 
-	"github.com/guelfey/go.dbus"
+	"github.com/golang/glog"
+	"github.com/wongma7/nfs-provisioner/ganesha"
 	"k8s.io/client-go/1.4/pkg/api/v1"
 )
 
 // Delete removes the directory that was created by Provision backing the given
-// PV.
+// PV. A PV stamped with the identity of another provisioner's storage isn't
+// deleted, since this provisioner may not see its directory, e.g. if it runs
+// on another node of a daemon set, and another directory of the same name
+// could be removed. A PV without an identity, e.g. provisioned by an older
+// version, is deleted if its directory exists.
 func (p *nfsProvisioner) Delete(volume *v1.PersistentVolume) error {
-	err := p.deleteDirectory(volume)
-	if err != nil {
-		return fmt.Errorf("error deleting volume's backing path: %v", err)
+	if p.dryRun {
+		return fmt.Errorf("dry run, not deleting volume: would delete directory %s and its export", p.volumePath(volume))
+	}
+
+	p.volumeMutex.Lock(volume.Name)
+	defer p.volumeMutex.Unlock(volume.Name)
+
+	if stamped, ok := volume.Annotations[annIdentity]; ok {
+		identity, err := p.stateStore.loadIdentity(false)
+		if err != nil {
+			return fmt.Errorf("error getting identity to compare volume's with: %v", err)
+		}
+		if stamped != identity {
+			return fmt.Errorf("volume was provisioned in the storage of the provisioner with identity %s, not this one's %q", stamped, identity)
+		}
+	}
+
+	return p.deleteVolume(volume)
+}
+
+// deleteVolume deletes the given PV's snapshots, backing directory and
+// export. The caller must hold the PV's volume lock. A directory already deleted by a
+// previous attempt that failed to delete the export is skipped, so that the
+// controller's retries can finish deleting the volume.
+func (p *nfsProvisioner) deleteVolume(volume *v1.PersistentVolume) error {
+	if err := p.deleteSnapshots(volume); err != nil {
+		return fmt.Errorf("error deleting volume's snapshots: %v", err)
+	}
+
+	if p.directoryDeleted(volume) {
+		glog.Infof("backing directory of volume %s was already deleted, deleting its export", volume.Name)
+	} else {
+		err := p.deleteDirectory(volume)
+		if err != nil {
+			return fmt.Errorf("error deleting volume's backing path: %v", err)
+		}
+		p.recordEvent(volume, v1.EventTypeNormal, "DirectoryDeleted", fmt.Sprintf("Deleted backing directory %s", p.volumePath(volume)))
 	}
 
-	err = p.deleteExport(volume)
+	err := p.deleteExport(volume)
 	if err != nil {
 		return fmt.Errorf("deleted the volume's backing path but error deleting export: %v", err)
 	}
+	p.recordEvent(volume, v1.EventTypeNormal, "ExportRemoved", fmt.Sprintf("Removed export from config file %s and unexported it", p.exporter.GetConfig()))
+
+	// The volume may never have been committed, e.g. if the controller failed
+	// to create its PV
+	p.clearJournal(volume.Name)
+	p.releaseCapacity(volume.Name)
 
 	return nil
 }
 
+// directoryDeleted returns whether the given PV's backing directory doesn't
+// exist but its export does, in the export store, whose record deleteExport
+// deletes last, or in the config file, i.e. a previous attempt to delete the
+// volume deleted the directory and then failed.
+func (p *nfsProvisioner) directoryDeleted(volume *v1.PersistentVolume) bool {
+	path := p.volumePath(volume)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return false
+	}
+	if p.exportStore != nil {
+		if export, err := p.exportStore.Get(volume.Name); err == nil && export != nil {
+			return true
+		}
+	}
+	exports, err := p.exporter.GetConfigExports()
+	if err != nil {
+		return false
+	}
+	for _, export := range exports {
+		if export.path == path {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *nfsProvisioner) deleteDirectory(volume *v1.PersistentVolume) error {
-	path := fmt.Sprintf(p.exportDir+"%s", volume.ObjectMeta.Name)
+	path := p.volumePath(volume)
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return fmt.Errorf("Delete called on a volume that doesn't exist, presumably because this provisioner never created it")
 	}
@@ -55,56 +126,146 @@ func (p *nfsProvisioner) deleteDirectory(volume *v1.PersistentVolume) error {
 }
 
 func (p *nfsProvisioner) deleteExport(volume *v1.PersistentVolume) error {
-	if ann, ok := volume.Annotations[annExportId]; ok {
-		// If PV doesn't have this annotation it's no big deal for knfs
-		exportId, _ := strconv.ParseUint(ann, 10, 16)
-		p.deleteExportId(uint16(exportId))
+	block, exportId, err := p.getExportInfo(volume)
+	if err != nil {
+		return err
 	}
 
-	block, ok := volume.Annotations[annBlock]
-	if !ok {
-		return fmt.Errorf("PV doesn't have an annotation %s, can't remove the export from the config file %s ", p.exporter.GetConfig(), annBlock)
-	}
-	if err := p.removeFromFile(p.exporter.GetConfig(), block); err != nil {
+	if err := p.removeFromConfig(block); err != nil {
 		return fmt.Errorf("error removing the export from the config file %s: %v", p.exporter.GetConfig(), err)
 	}
 
-	err := p.exporter.Unexport(volume)
+	p.audit(auditRemove, "delete", volume.Name, volumeClaim(volume), p.volumePath(volume), block)
+
+	err = p.exporter.Unexport(block)
 	if err != nil {
 		return fmt.Errorf("removed export from the config file %s but error unexporting it: %v", p.exporter.GetConfig(), err)
 	}
 
+	if p.exportStore != nil {
+		if err := p.exportStore.Delete(volume.Name); err != nil {
+			return fmt.Errorf("removed export but error deleting its record: %v", err)
+		}
+	}
+
+	// Only free the exportId once the export and its record are gone, or a
+	// retry of a failed delete could find it given to another export meanwhile
+	// and free it again
+	if exportId != 0 {
+		// If PV doesn't have an exportId it's no big deal for knfs
+		p.deleteExportId(exportId)
+	}
+
 	return nil
 }
 
-func (e *ganeshaExporter) Unexport(volume *v1.PersistentVolume) error {
-	ann, ok := volume.Annotations[annExportId]
+// getExportInfo gets the block and exportId of the export backing the given PV
+// from its record in the export store or, failing that, from its annotations.
+// The returned exportId is zero if it is unknown.
+func (p *nfsProvisioner) getExportInfo(volume *v1.PersistentVolume) (string, uint16, error) {
+	if p.exportStore != nil {
+		export, err := p.exportStore.Get(volume.Name)
+		if err != nil {
+			return "", 0, fmt.Errorf("error getting the export record for PV: %v", err)
+		}
+		if export != nil {
+			return export.Block, export.ExportId, nil
+		}
+	}
+
+	var exportId uint16
+	if ann, ok := p.getAnnotation(volume, annExportId); ok {
+		id, _ := strconv.ParseUint(ann, 10, 16)
+		exportId = uint16(id)
+	}
+
+	block, ok := p.getAnnotation(volume, annBlock)
 	if !ok {
-		return fmt.Errorf("PV doesn't have an annotation %s, can't remove the export from the server", annExportId)
+		return "", 0, fmt.Errorf("PV doesn't have an export record or an annotation %s, can't remove the export from the config file %s", p.annotationKey(annBlock), p.exporter.GetConfig())
 	}
-	exportId, _ := strconv.ParseUint(ann, 10, 16)
 
-	// Call RemoveExport using dbus
-	conn, err := dbus.SystemBus()
+	return block, exportId, nil
+}
+
+// Unexport removes the export with the Export_Id of the given EXPORT block from
+// NFS Ganesha using D-Bus. An export ganesha doesn't serve, e.g. because a
+// retried delete already removed it, is already unexported.
+func (e *ganeshaExporter) Unexport(block string) error {
+	exports, err := parseExportBlock(block)
+	if err != nil {
+		return fmt.Errorf("can't remove the export from the server: %v", err)
+	}
+	exportId, err := exports[0].ExportId()
 	if err != nil {
-		return fmt.Errorf("error getting dbus session bus: %v", err)
+		return fmt.Errorf("can't remove the export from the server: %v", err)
 	}
-	obj := conn.Object("org.ganesha.nfsd", "/org/ganesha/nfsd/ExportMgr")
-	call := obj.Call("org.ganesha.nfsd.exportmgr.RemoveExport", 0, uint16(exportId))
+
+	// Call RemoveExport using dbus
+	call := ganesha.Call(ganesha.ExportMgrPath, "org.ganesha.nfsd.exportmgr.RemoveExport", exportId)
 	if call.Err != nil {
+		if infos, err := ganesha.ShowExports(); err == nil && !ganeshaServes(infos, exportId) {
+			return nil
+		}
 		return fmt.Errorf("error calling org.ganesha.nfsd.exportmgr.RemoveExport: %v", call.Err)
 	}
 
 	return nil
 }
 
-func (e *kernelExporter) Unexport(volume *v1.PersistentVolume) error {
-	// Execute exportfs
-	cmd := exec.Command("exportfs", "-r")
-	out, err := cmd.CombinedOutput()
+// Unexport unexports the directory of the given /etc/exports block from each
+// of its clients with `exportfs -u`, leaving other exports undisturbed. A
+// directory under the NFSv4 pseudo-root is unmounted from there too. If there's
+// a batcher, the block must already be removed from the config and it's
+// unexported by the batch's `exportfs -r` instead. A client the directory
+// isn't exported to, e.g. because a retried delete already unexported it, is
+// skipped.
+func (e *kernelExporter) Unexport(block string) error {
+	path, clients, err := parseKernelBlock(block)
 	if err != nil {
-		return fmt.Errorf("exportfs -r failed with error: %v, output: %s", err, out)
+		return err
+	}
+
+	if e.batcher != nil {
+		if err := e.batcher.sync(path, false); err != nil {
+			return err
+		}
+	} else {
+		for _, client := range clients {
+			cmd := exec.Command("exportfs", "-u", client.host+":"+path)
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				if entries, listErr := exportfsList(); listErr == nil && !exportfsListed(entries, path, client.host) {
+					continue
+				}
+				return fmt.Errorf("exportfs -u %s:%s failed with error: %v, output: %s", client.host, path, err, out)
+			}
+		}
 	}
 
+	if e.nfsv4Root != "" {
+		return e.unbindMount(path)
+	}
 	return nil
 }
+
+// ganeshaServes returns whether the given exports NFS Ganesha serves include
+// the one with the given Export_Id.
+func ganeshaServes(infos []ganesha.ExportInfo, exportId uint16) bool {
+	for _, info := range infos {
+		if info.ExportId == exportId {
+			return true
+		}
+	}
+	return false
+}
+
+// exportfsListed returns whether the given active exports include the export
+// of the given path to the given client.
+func exportfsListed(entries []exportfsEntry, path, host string) bool {
+	for _, entry := range entries {
+		if entry.path == path && entry.host == host {
+			return true
+		}
+	}
+	return false
+}
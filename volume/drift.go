@@ -0,0 +1,173 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/wongma7/nfs-provisioner/ganesha"
+	"github.com/wongma7/nfs-provisioner/metrics"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// DriftDetector is implemented by provisioners that can compare the exports
+// the NFS server actually serves with the ones their PVs imply.
+type DriftDetector interface {
+	DetectDrift() error
+}
+
+var _ DriftDetector = &nfsProvisioner{}
+
+// exportDrift is the PVs whose exports the NFS server doesn't serve and the
+// exports it serves that have no PV, as of the last DetectDrift.
+type exportDrift struct {
+	missing []string
+	stale   []string
+}
+
+// DetectDrift compares the exports NFS Ganesha or the kernel serves, as told
+// by D-Bus or exportfs -v, with the PVs this provisioner created, for
+// collectDrift to collect. A warning event is emitted on every PV whose export
+// has newly gone missing, stale exports are only logged since they have no PV.
+func (p *nfsProvisioner) DetectDrift() error {
+	volumes, err := p.client.Core().PersistentVolumes().List(api.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error listing PVs: %v", err)
+	}
+	active, err := p.activeExports()
+	if err != nil {
+		return err
+	}
+
+	wanted := map[string]*v1.PersistentVolume{}
+	for i := range volumes.Items {
+		volume := &volumes.Items[i]
+		if volume.Annotations[annCreatedBy] != createdBy || volume.Spec.NFS == nil || !p.inExportDirs(volume.Spec.NFS.Path) {
+			continue
+		}
+		wanted[volume.Name] = volume
+	}
+	drift := diffExports(wanted, active)
+
+	p.driftMutex.Lock()
+	previous := p.drift
+	p.drift = drift
+	p.driftMutex.Unlock()
+
+	for _, pv := range drift.missing {
+		if containsString(previous.missing, pv) {
+			continue
+		}
+		p.recordEvent(wanted[pv], v1.EventTypeWarning, "ExportDrift", "The NFS server doesn't serve the export of this PV, it may have been removed outside the provisioner")
+	}
+	if len(drift.stale) != 0 {
+		glog.Warningf("the NFS server serves exports of %s, which have no PVs", strings.Join(drift.stale, ", "))
+	}
+	return nil
+}
+
+// diffExports returns which of the given wanted PVs aren't among the given
+// PVs whose exports are active, and vice versa, sorted.
+func diffExports(wanted map[string]*v1.PersistentVolume, active map[string]bool) exportDrift {
+	drift := exportDrift{missing: []string{}, stale: []string{}}
+	for pv := range wanted {
+		if !active[pv] {
+			drift.missing = append(drift.missing, pv)
+		}
+	}
+	for pv := range active {
+		if _, ok := wanted[pv]; !ok {
+			drift.stale = append(drift.stale, pv)
+		}
+	}
+	sort.Strings(drift.missing)
+	sort.Strings(drift.stale)
+	return drift
+}
+
+// activeExports returns the names of the PVs whose exports in the config file
+// the NFS server serves: with ganesha, those whose Export_Id it shows over
+// D-Bus and with the kernel, those whose path exportfs -v lists. Exporting
+// through both, each export is checked with the server it's exported by.
+func (p *nfsProvisioner) activeExports() (map[string]bool, error) {
+	active := map[string]bool{}
+	for _, e := range p.exporters() {
+		exports, err := e.GetConfigExports()
+		if err != nil {
+			return nil, fmt.Errorf("error getting exports in config file %s: %v", e.GetConfig(), err)
+		}
+		served, err := servedBy(e)
+		if err != nil {
+			return nil, err
+		}
+		for _, export := range exports {
+			if p.inExportDirs(export.path) && served(export) {
+				active[filepath.Base(export.path)] = true
+			}
+		}
+	}
+	return active, nil
+}
+
+// servedBy returns a func that tells whether the NFS server of the given
+// exporter serves an export.
+func servedBy(e exporter) (func(export configExport) bool, error) {
+	if _, ok := e.(*ganeshaExporter); ok {
+		infos, err := ganesha.ShowExports()
+		if err != nil {
+			return nil, err
+		}
+		ids := map[uint16]bool{}
+		for _, info := range infos {
+			ids[info.ExportId] = true
+		}
+		return func(export configExport) bool { return ids[export.exportId] }, nil
+	} else if _, ok := e.(*stubExporter); ok {
+		return func(export configExport) bool { return true }, nil
+	}
+	entries, err := exportfsList()
+	if err != nil {
+		return nil, err
+	}
+	paths := map[string]bool{}
+	for _, entry := range entries {
+		paths[entry.path] = true
+	}
+	return func(export configExport) bool { return paths[export.path] }, nil
+}
+
+// collectDrift returns the number of PVs whose exports were missing and of
+// stale exports as of the last DetectDrift as metrics.
+func (p *nfsProvisioner) collectDrift() []metrics.Family {
+	p.driftMutex.Lock()
+	defer p.driftMutex.Unlock()
+
+	return []metrics.Family{{
+		Name: "nfs_provisioner_export_drift",
+		Help: "PVs whose exports the NFS server doesn't serve (missing) and exports it serves without PVs (stale).",
+		Type: metrics.Gauge,
+		Samples: []metrics.Sample{
+			{Labels: metrics.Labels{"kind": "missing"}, Value: float64(len(p.drift.missing))},
+			{Labels: metrics.Labels{"kind": "stale"}, Value: float64(len(p.drift.stale))},
+		},
+	}}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/wongma7/nfs-provisioner/controller"
+	"github.com/wongma7/nfs-provisioner/logging"
+	"k8s.io/client-go/1.4/pkg/api"
+)
+
+// dryRunVolume validates the given options and discovers the server the way
+// createVolume does, then logs what provisioning the volume would do without
+// creating its directory or export or reserving its capacity or exportId. What
+// it would do is returned as the error, so that the controller reports it in
+// an event on the claim rather than creating a PV.
+func (p *nfsProvisioner) dryRunVolume(options controller.VolumeOptions, params exportParams) error {
+	gid, err := p.validateOptions(options)
+	if err != nil {
+		return fmt.Errorf("error validating options for volume: %v", err)
+	}
+	source, err := p.getCloneSource(options)
+	if err != nil {
+		return fmt.Errorf("error getting volume to clone: %v", err)
+	}
+	if checker, ok := p.exporterFor(params).(readinessChecker); ok {
+		if err := checker.CheckReady(); err != nil {
+			return fmt.Errorf("NFS server isn't ready for volume: %v", err)
+		}
+	}
+	server, err := p.getExportServer(params)
+	if err != nil {
+		return fmt.Errorf("error getting NFS server IP for volume: %v", err)
+	}
+	mountOptions, err := p.getMountOptions(params)
+	if err != nil {
+		return fmt.Errorf("error getting mount options for volume: %v", err)
+	}
+
+	dirs, err := p.getExportDirs(options)
+	if err != nil {
+		return fmt.Errorf("error getting export directories for volume: %v", err)
+	}
+	// The reservation checks the capacity fits and picks the export
+	// directory, it's released right away
+	dir, err := p.reserveCapacity(options.PVName, claimNamespace(options), dirs, options.Capacity.Value())
+	p.releaseCapacity(options.PVName)
+	if err != nil {
+		return fmt.Errorf("error reserving capacity for volume: %v", err)
+	}
+	path := dir + p.namespaceSubdir(options) + options.PVName
+
+	p.mapMutex.Lock()
+	exportId, ok := p.nextExportId()
+	p.mapMutex.Unlock()
+	if !ok {
+		return fmt.Errorf("error generating export id for export: all export ids between %d and %d are in use", p.minExportId, p.maxExportId)
+	}
+	block, err := p.exporter.CreateBlock(strconv.FormatUint(uint64(exportId), 10), path, params)
+	if err != nil {
+		return fmt.Errorf("error creating export block for volume: %v", err)
+	}
+
+	directoryParams := getDirectoryParams(options, gid)
+	fields := logging.Fields{logging.Operation: "provision", logging.PV: options.PVName, "path": path, "server": server, "gid": directoryParams.gid, "export_id": exportId, "block": strings.TrimSpace(block)}
+	if mountOptions != "" {
+		fields["mount_options"] = mountOptions
+	}
+	msg := fmt.Sprintf("dry run, not provisioning volume: would create directory %s", path)
+	if source != nil {
+		fields["source"] = source.volume.Name
+		msg += fmt.Sprintf(" as a copy of PV %s", source.volume.Name)
+	}
+	logging.Info("dry run, not provisioning volume", fields)
+	return fmt.Errorf("%s, export it with block %q and put server %s in the PV", msg, strings.TrimSpace(block), server)
+}
+
+// reserveExistingVolumes reserves the capacity of the PVs whose directories
+// exist in the export directories, as reconciling does on startup, which a dry
+// run doesn't.
+func (p *nfsProvisioner) reserveExistingVolumes() error {
+	volumes, err := p.client.Core().PersistentVolumes().List(api.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error listing PVs: %v", err)
+	}
+	for i := range volumes.Items {
+		volume := &volumes.Items[i]
+		if volume.Annotations[annCreatedBy] != createdBy || volume.Spec.NFS == nil || !p.inExportDirs(volume.Spec.NFS.Path) {
+			continue
+		}
+		if _, err := os.Stat(volume.Spec.NFS.Path); err == nil {
+			p.reserveExistingCapacity(volume)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// recordEvent emits an event on the given PV, so that kubectl describe pv
+// tells what the provisioner did to its export and directory. It does nothing
+// if the provisioner has no event recorder, e.g. in tests.
+func (p *nfsProvisioner) recordEvent(volume *v1.PersistentVolume, eventtype, reason, message string) {
+	if p.eventRecorder == nil {
+		return
+	}
+	p.eventRecorder.Event(volume, eventtype, reason, message)
+}
+
+// recordEventByName emits an event on the PV of the given name, for callers
+// that only know the PV's name.
+func (p *nfsProvisioner) recordEventByName(pvName, eventtype, reason, message string) {
+	if p.eventRecorder == nil {
+		return
+	}
+	volume, err := p.client.Core().PersistentVolumes().Get(pvName)
+	if err != nil {
+		glog.Errorf("error getting PV %s to emit an event on: %v", pvName, err)
+		return
+	}
+	p.eventRecorder.Event(volume, eventtype, reason, message)
+}
+
+// recordClaimEvent emits an event on the given claim, e.g. for why provisioning
+// a volume for it was refused.
+func (p *nfsProvisioner) recordClaimEvent(claim *v1.PersistentVolumeClaim, eventtype, reason, message string) {
+	if p.eventRecorder == nil {
+		return
+	}
+	p.eventRecorder.Event(claim, eventtype, reason, message)
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/golang/glog"
+)
+
+// writeFileAtomic writes data to a temporary file in the same directory as
+// path, fsyncs it, and renames it over path, so that a crash at any point
+// leaves either the old or the new contents in place, never a truncated file.
+// If path already exists its permission bits are kept, otherwise perm is used.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return streamFileAtomic(path, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// errUnchanged is returned by the write function of streamFileAtomic to leave
+// the file as it is, and by streamFileAtomic then.
+var errUnchanged = errors.New("file unchanged")
+
+// streamFileAtomic is writeFileAtomic with the data written by the given
+// function through a buffer instead, so that it needn't all be in memory at
+// once, e.g. because it's copied from the file being replaced.
+func streamFileAtomic(path string, perm os.FileMode, write func(io.Writer) error) error {
+	if fi, err := os.Stat(path); err == nil {
+		perm = fi.Mode().Perm()
+	}
+
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, "."+base+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	// Clean up the temporary file on failure; after a successful rename this
+	// is a no-op error
+	defer os.Remove(tmpPath)
+
+	buf := bufio.NewWriter(tmp)
+	if err := write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		// path can't be renamed over if it's a bind mount, e.g. an /etc/exports
+		// mounted into a container, so fall back to writing it in place
+		if linkErr, ok := err.(*os.LinkError); ok && linkErr.Err == syscall.EBUSY {
+			glog.Warningf("%s is busy, possibly a mount point, writing it in place instead of atomically", path)
+			return copyFile(tmpPath, path, perm)
+		}
+		return err
+	}
+
+	// fsync the directory so the rename itself is durable
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// copyFile copies the contents of the file src over those of dst.
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,280 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// ConsistencyChecker is implemented by provisioners that can cross-check
+// their PVs, directories and exports on demand and repair what's out of sync.
+type ConsistencyChecker interface {
+	CheckConsistency(repair bool) (*ConsistencyReport, error)
+}
+
+var _ ConsistencyChecker = &nfsProvisioner{}
+
+// ConsistencyReport is the result of CheckConsistency.
+type ConsistencyReport struct {
+	// The number of PVs of this provisioner that were checked
+	Volumes       int
+	Discrepancies []Discrepancy
+}
+
+// Discrepancy is something found out of sync and the PV and path it's about.
+type Discrepancy struct {
+	PV      string
+	Path    string
+	Problem string
+	// Whether the discrepancy was repaired and, if it wasn't but could have
+	// been, the error repairing it
+	Repaired bool
+	Err      error
+	// Whether the discrepancy can only be repaired by hand, e.g. because
+	// it'd mean deleting data
+	Manual bool
+}
+
+// Unrepaired returns the number of discrepancies that weren't repaired.
+func (r *ConsistencyReport) Unrepaired() int {
+	unrepaired := 0
+	for _, d := range r.Discrepancies {
+		if !d.Repaired {
+			unrepaired++
+		}
+	}
+	return unrepaired
+}
+
+// Print writes a line per discrepancy and a summary to w.
+func (r *ConsistencyReport) Print(w io.Writer) {
+	for _, d := range r.Discrepancies {
+		pv := d.PV
+		if pv == "" {
+			pv = "<none>"
+		}
+		status := "not repaired"
+		switch {
+		case d.Repaired:
+			status = "repaired"
+		case d.Err != nil:
+			status = fmt.Sprintf("error repairing: %v", d.Err)
+		case d.Manual:
+			status = "must be repaired by hand"
+		}
+		fmt.Fprintf(w, "PV %s, %s: %s (%s)\n", pv, d.Path, d.Problem, status)
+	}
+	fmt.Fprintf(w, "%d PVs checked, %d discrepancies, %d not repaired\n", r.Volumes, len(r.Discrepancies), r.Unrepaired())
+}
+
+// CheckConsistency cross-checks the PVs this provisioner created with their
+// directories and the exports in the config file and served by the NFS
+// server, like reconciling and verifying exports do automatically. It finds
+// PVs stamped with another storage's identity, PVs whose directories are
+// missing, whose exports are missing from the config file or not served, or
+// whose Export_Id annotation doesn't match their export's, exports without
+// PVs and directories without PVs. If repair is true, missing exports are
+// re-added, unserved ones exported again and ones without PVs removed; the
+// rest, which would take deleting data or editing PVs, are left to be repaired
+// by hand. PVs being provisioned, as journaled, are skipped.
+func (p *nfsProvisioner) CheckConsistency(repair bool) (*ConsistencyReport, error) {
+	volumes, err := p.client.Core().PersistentVolumes().List(api.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing PVs: %v", err)
+	}
+	config := p.exporter.GetConfig()
+	exports, err := p.exporter.GetConfigExports()
+	if err != nil {
+		return nil, fmt.Errorf("error getting exports in config file %s: %v", config, err)
+	}
+	inProgress, err := p.journal.load()
+	if err != nil {
+		return nil, fmt.Errorf("error reading journal of provisioning operations: %v", err)
+	}
+	identity, err := p.stateStore.loadIdentity(false)
+	if err != nil {
+		return nil, fmt.Errorf("error getting identity to compare PVs' with: %v", err)
+	}
+	// Whether exports are served can't be checked, e.g. without exportfs,
+	// but the rest still can be
+	active, err := p.activeExports()
+	if err != nil {
+		glog.Errorf("error getting the exports the NFS server serves, not checking them: %v", err)
+		active = nil
+	}
+
+	configured := map[string]configExport{}
+	for _, export := range exports {
+		configured[export.path] = export
+	}
+
+	report := &ConsistencyReport{Discrepancies: []Discrepancy{}}
+	add := func(d Discrepancy, fix func() error) {
+		if fix == nil {
+			d.Manual = true
+		} else if repair {
+			if d.Err = fix(); d.Err == nil {
+				d.Repaired = true
+			}
+		}
+		report.Discrepancies = append(report.Discrepancies, d)
+	}
+
+	wanted := map[string]bool{}
+	for i := range volumes.Items {
+		volume := &volumes.Items[i]
+		if volume.Annotations[annCreatedBy] != createdBy || volume.Spec.NFS == nil {
+			continue
+		}
+		path := volume.Spec.NFS.Path
+		if !p.inExportDirs(path) {
+			continue
+		}
+		wanted[path] = true
+		if snapshots, err := getSnapshotExports(volume); err == nil {
+			for _, export := range snapshots {
+				wanted[export.Path] = true
+			}
+		}
+		if _, ok := inProgress[volume.Name]; ok {
+			continue
+		}
+		report.Volumes++
+
+		if stamped, ok := volume.Annotations[annIdentity]; ok && stamped != identity {
+			add(Discrepancy{PV: volume.Name, Path: path, Problem: fmt.Sprintf("provisioned in storage with identity %s, not this one's %q", stamped, identity)}, nil)
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			add(Discrepancy{PV: volume.Name, Path: path, Problem: fmt.Sprintf("directory is missing: %v", err)}, nil)
+			continue
+		}
+
+		export, ok := configured[path]
+		if !ok {
+			add(Discrepancy{PV: volume.Name, Path: path, Problem: fmt.Sprintf("export is missing from config file %s", config)}, func() error {
+				return p.readdExport(volume)
+			})
+			continue
+		}
+		if ann, ok := p.getAnnotation(volume, annExportId); ok && export.exportId != 0 {
+			if id, err := strconv.ParseUint(ann, 10, 16); err != nil || uint16(id) != export.exportId {
+				add(Discrepancy{PV: volume.Name, Path: path, Problem: fmt.Sprintf("annotation %s is %q but the export in config file %s has Export_Id %d", p.annotationKey(annExportId), ann, config, export.exportId)}, nil)
+			}
+		}
+		if active != nil && !active[filepath.Base(path)] {
+			add(Discrepancy{PV: volume.Name, Path: path, Problem: "export isn't served by the NFS server"}, func() error {
+				if err := p.exporter.Export(export.block); err != nil {
+					return err
+				}
+				p.audit(auditAdd, "fsck", volume.Name, volumeClaim(volume), path, export.block)
+				return nil
+			})
+		}
+	}
+
+	for _, export := range exports {
+		if wanted[export.path] || !p.inExportDirs(export.path) {
+			continue
+		}
+		if _, ok := inProgress[filepath.Base(export.path)]; ok {
+			continue
+		}
+		add(Discrepancy{Path: export.path, Problem: fmt.Sprintf("export in config file %s has no PV", config)}, func() error {
+			return p.removeStaleExport(export, "fsck")
+		})
+	}
+
+	// The directories of namespaces PVs are nested under
+	namespaces := map[string]bool{}
+	for path := range wanted {
+		if parent := filepath.Dir(path) + "/"; parent != p.exportDirOf(path) {
+			namespaces[parent] = true
+		}
+	}
+	for _, dir := range p.exportDirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("error reading export directory %s: %v", dir, err)
+		}
+		for _, entry := range entries {
+			// The state file, journal, directory pool and snapshots are
+			// hidden
+			if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			path := dir + entry.Name()
+			if _, ok := inProgress[entry.Name()]; ok || wanted[path] {
+				continue
+			}
+			if !p.namespaceDirs && !namespaces[path+"/"] {
+				add(Discrepancy{Path: path, Problem: "directory has no PV"}, nil)
+				continue
+			}
+			// A namespace's directory, kept even once it has no PVs
+			nested, err := ioutil.ReadDir(path)
+			if err != nil {
+				return nil, fmt.Errorf("error reading namespace directory %s: %v", path, err)
+			}
+			for _, entry := range nested {
+				nestedPath := path + "/" + entry.Name()
+				if !entry.IsDir() || wanted[nestedPath] {
+					continue
+				}
+				if _, ok := inProgress[entry.Name()]; ok {
+					continue
+				}
+				add(Discrepancy{Path: nestedPath, Problem: "directory has no PV"}, nil)
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// readdExport re-adds the export of the given PV to the config file and
+// exports it.
+func (p *nfsProvisioner) readdExport(volume *v1.PersistentVolume) error {
+	p.volumeMutex.Lock(volume.Name)
+	defer p.volumeMutex.Unlock(volume.Name)
+
+	block, exportId, err := p.getExportInfo(volume)
+	if err != nil {
+		return err
+	}
+	if exportId != 0 {
+		p.reserveExportId(exportId)
+	}
+	if err := p.addToConfig(block); err != nil {
+		return fmt.Errorf("error adding export block to config %s: %v", p.exporter.GetConfig(), err)
+	}
+	p.audit(auditAdd, "fsck", volume.Name, volumeClaim(volume), volume.Spec.NFS.Path, block)
+	if err := p.exporter.Export(block); err != nil {
+		return fmt.Errorf("error exporting: %v", err)
+	}
+	return nil
+}
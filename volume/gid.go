@@ -0,0 +1,152 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/wongma7/nfs-provisioner/controller"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/apis/extensions/v1beta1"
+)
+
+const (
+	// The value of the gid parameter that picks the gid from the ranges pods
+	// in the claim's namespace are allowed
+	gidAuto = "auto"
+
+	// The annotation of an OpenShift project of the ranges of the
+	// supplemental groups and fsGroups its pods are allowed by SCCs with the
+	// MustRunAs strategy, e.g. 1000000000/10000
+	annSupplementalGroups = "openshift.io/sa.scc.supplemental-groups"
+)
+
+// gidRange is an inclusive range of gids.
+type gidRange struct {
+	min, max int64
+}
+
+// parseGidRanges parses the given value of annSupplementalGroups: a
+// comma-separated list of ranges of the form <first>/<size> or <first>-<last>.
+func parseGidRanges(value string) ([]gidRange, error) {
+	ranges := []gidRange{}
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		var r gidRange
+		if parts := strings.SplitN(s, "/", 2); len(parts) == 2 {
+			min, err := strconv.ParseInt(parts[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid range %q: %v", s, err)
+			}
+			size, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil || size < 1 {
+				return nil, fmt.Errorf("invalid range %q: size must be a positive integer", s)
+			}
+			r = gidRange{min, min + size - 1}
+		} else if parts := strings.SplitN(s, "-", 2); len(parts) == 2 {
+			min, err := strconv.ParseInt(parts[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid range %q: %v", s, err)
+			}
+			max, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid range %q: %v", s, err)
+			}
+			r = gidRange{min, max}
+		} else {
+			return nil, fmt.Errorf("invalid range %q: must be of the form <first>/<size> or <first>-<last>", s)
+		}
+		if r.min < 1 || r.max < r.min {
+			return nil, fmt.Errorf("invalid range %q: must be of non-zero gids", s)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// toGidRanges converts the given ranges of a PodSecurityPolicy.
+func toGidRanges(idRanges []v1beta1.IDRange) []gidRange {
+	ranges := []gidRange{}
+	for _, r := range idRanges {
+		if r.Min >= 1 && r.Max >= r.Min {
+			ranges = append(ranges, gidRange{r.Min, r.Max})
+		}
+	}
+	return ranges
+}
+
+// getSupplementalGroupsRanges gets the ranges of the gids pods in the given
+// namespace are allowed, so that a volume can get a gid they can run with: those
+// of the namespace's annSupplementalGroups annotation, which OpenShift SCCs
+// use for both supplemental groups and fsGroups, or else those of the
+// PodSecurityPolicies. If fsGroup is true, or the policies' supplementalGroups
+// strategy is RunAsAny, i.e. they only constrain fsGroups, the policies'
+// fsGroup ranges are preferred.
+func (p *nfsProvisioner) getSupplementalGroupsRanges(namespace string, fsGroup bool) ([]gidRange, error) {
+	ns, err := p.client.Core().Namespaces().Get(namespace)
+	if err != nil {
+		return nil, fmt.Errorf("error getting namespace %s: %v", namespace, err)
+	}
+	if ann, ok := ns.Annotations[annSupplementalGroups]; ok {
+		ranges, err := parseGidRanges(ann)
+		if err != nil {
+			return nil, fmt.Errorf("invalid annotation %s of namespace %s: %v", annSupplementalGroups, namespace, err)
+		}
+		return ranges, nil
+	}
+
+	policies, err := p.client.Extensions().PodSecurityPolicies().List(api.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing PodSecurityPolicies: %v", err)
+	}
+	supplementalRanges, fsGroupRanges := []gidRange{}, []gidRange{}
+	for _, policy := range policies.Items {
+		if policy.Spec.SupplementalGroups.Rule == v1beta1.SupplementalGroupsStrategyMustRunAs {
+			supplementalRanges = append(supplementalRanges, toGidRanges(policy.Spec.SupplementalGroups.Ranges)...)
+		}
+		if policy.Spec.FSGroup.Rule == v1beta1.FSGroupStrategyMustRunAs {
+			fsGroupRanges = append(fsGroupRanges, toGidRanges(policy.Spec.FSGroup.Ranges)...)
+		}
+	}
+	if (fsGroup || len(supplementalRanges) == 0) && len(fsGroupRanges) != 0 {
+		return fsGroupRanges, nil
+	}
+	return supplementalRanges, nil
+}
+
+// getAutoGid gets the gid of a volume whose class's gid parameter is auto for
+// the given options: the first of the ranges pods in the claim's namespace are
+// allowed, which OpenShift and PodSecurityPolicies default pods to.
+func (p *nfsProvisioner) getAutoGid(options controller.VolumeOptions) (string, error) {
+	if options.PVC == nil {
+		return "", fmt.Errorf("gid %s needs the claim's namespace", gidAuto)
+	}
+	fsGroup := getDirectoryParams(options, "").fsGroup
+	ranges, err := p.getSupplementalGroupsRanges(options.PVC.Namespace, fsGroup)
+	if err != nil {
+		return "", fmt.Errorf("error getting gid ranges: %v", err)
+	}
+	if len(ranges) == 0 {
+		return "", fmt.Errorf("namespace %s has no %s annotation and no PodSecurityPolicy constrains gids, gid %s can't pick one", options.PVC.Namespace, annSupplementalGroups, gidAuto)
+	}
+	return strconv.FormatInt(ranges[0].min, 10), nil
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/wongma7/nfs-provisioner/ganesha"
+)
+
+// HealthChecker is implemented by provisioners that can check their own
+// health, so that Kubernetes can restart a provisioner that's broken and
+// withhold traffic from one that can't serve.
+type HealthChecker interface {
+	// CheckLive checks what restarting the pod could fix: the NFS server is
+	// running and the export directories are writable.
+	CheckLive() error
+	// CheckReady checks CheckLive and that the API server is reachable.
+	CheckReady() error
+}
+
+var _ HealthChecker = &nfsProvisioner{}
+
+// CheckLive checks that NFS Ganesha is on D-Bus or the kernel NFS server is
+// running, or both if exporting through both, and that directories can be created in every export directory.
+func (p *nfsProvisioner) CheckLive() error {
+	for _, e := range p.exporters() {
+		if _, ok := e.(*ganeshaExporter); ok {
+			running, err := ganesha.IsRunning()
+			if err != nil {
+				return err
+			}
+			if !running {
+				return fmt.Errorf("NFS Ganesha isn't running: nothing owns D-Bus name %s", ganesha.BusName)
+			}
+		} else if checker, ok := e.(readinessChecker); ok {
+			if err := checker.CheckReady(); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, dir := range p.exportDirs {
+		f, err := ioutil.TempFile(dir, ".healthz")
+		if err != nil {
+			return fmt.Errorf("export directory %s isn't writable: %v", dir, err)
+		}
+		f.Close()
+		if err := os.Remove(f.Name()); err != nil {
+			return fmt.Errorf("error removing %s: %v", f.Name(), err)
+		}
+	}
+	return nil
+}
+
+// CheckReady checks CheckLive, that the export directory is the provisioner's
+// storage and that the API server is reachable. A broken API server isn't
+// checked by CheckLive since restarting can't fix it.
+func (p *nfsProvisioner) CheckReady() error {
+	if err := p.CheckLive(); err != nil {
+		return err
+	}
+	if p.storageErr != nil {
+		return p.storageErr
+	}
+	if _, err := p.client.Discovery().ServerVersion(); err != nil {
+		return fmt.Errorf("error reaching API server: %v", err)
+	}
+	return nil
+}
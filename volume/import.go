@@ -0,0 +1,133 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// importExports adopts the exports in the config file that back existing PVs,
+// e.g. ones created by another instance or an older version of the
+// provisioner, so that this provisioner manages them as its own. For every PV
+// whose path is in exportDir, whose directory exists and which has an export
+// in the config file, it reserves the export's exportId, records the export in
+// the export store if it isn't and normalizes the PV's annotations, including
+// the identity, to the ones Provision sets, so that reconcile doesn't remove
+// the export as stale and Delete can remove it.
+func (p *nfsProvisioner) importExports() error {
+	volumes, err := p.client.Core().PersistentVolumes().List(api.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error listing PVs: %v", err)
+	}
+
+	config := p.exporter.GetConfig()
+	exports, err := p.exporter.GetConfigExports()
+	if err != nil {
+		return fmt.Errorf("error getting exports in config file %s: %v", config, err)
+	}
+	byPath := map[string]configExport{}
+	for _, export := range exports {
+		byPath[export.path] = export
+	}
+
+	for i := range volumes.Items {
+		volume := &volumes.Items[i]
+		if volume.Spec.NFS == nil || !p.inExportDirs(volume.Spec.NFS.Path) {
+			continue
+		}
+		export, ok := byPath[volume.Spec.NFS.Path]
+		if !ok {
+			continue
+		}
+		if _, err := os.Stat(export.path); err != nil {
+			continue
+		}
+		if err := p.importExport(volume, export); err != nil {
+			glog.Errorf("error importing export of %s for PV %s: %v", export.path, volume.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// importExport adopts the given export of the given PV.
+func (p *nfsProvisioner) importExport(volume *v1.PersistentVolume, export configExport) error {
+	p.volumeMutex.Lock(volume.Name)
+	defer p.volumeMutex.Unlock(volume.Name)
+
+	if export.exportId != 0 {
+		p.reserveExportId(export.exportId)
+	}
+
+	record, err := p.exportStore.Get(volume.Name)
+	if err != nil {
+		return fmt.Errorf("error getting the export record for PV: %v", err)
+	}
+	if record == nil {
+		record = &NFSExport{PV: volume.Name, Path: export.path, ExportId: export.exportId, Block: export.block}
+		if gid, err := strconv.ParseUint(volume.Annotations[VolumeGidAnnotationKey], 10, 64); err == nil {
+			record.Gid = gid
+		}
+		if err := p.exportStore.Create(record); err != nil {
+			return fmt.Errorf("error recording export for PV: %v", err)
+		}
+	} else if record.Block != export.block || record.ExportId != export.exportId {
+		// The config file is what the server serves
+		record.Block, record.ExportId = export.block, export.exportId
+		if err := p.exportStore.Update(record); err != nil {
+			return fmt.Errorf("error updating the export record for PV: %v", err)
+		}
+	}
+
+	identity, err := p.stateStore.loadIdentity(true)
+	if err != nil {
+		return fmt.Errorf("error getting identity to stamp PV with: %v", err)
+	}
+	annotations := map[string]string{annCreatedBy: createdBy, p.annotationKey(annBlock): export.block, annIdentity: identity}
+	if export.exportId != 0 {
+		annotations[p.annotationKey(annExportId)] = strconv.FormatUint(uint64(export.exportId), 10)
+	}
+	normalized := true
+	for k, v := range annotations {
+		if volume.Annotations[k] != v {
+			normalized = false
+		}
+	}
+	if normalized {
+		return nil
+	}
+
+	if volume.Annotations == nil {
+		volume.Annotations = map[string]string{}
+	}
+	for k, v := range annotations {
+		volume.Annotations[k] = v
+	}
+	if _, err := p.client.Core().PersistentVolumes().Update(volume); err != nil {
+		return fmt.Errorf("error updating PV annotations: %v", err)
+	}
+	glog.Infof("imported export of %s for PV %s", export.path, volume.Name)
+	p.recordEvent(volume, v1.EventTypeNormal, "ExportImported", fmt.Sprintf("Adopted export of %s in config file %s", export.path, p.exporter.GetConfig()))
+
+	return nil
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/wongma7/nfs-provisioner/ganesha"
+)
+
+// ganeshaIndex is the parsed ganesha config file with its EXPORTs indexed by
+// Export_Id and Pseudo, so that adding, updating or removing an EXPORT doesn't
+// read, parse and validate the whole file again. It's as of the modification
+// time and size the file had when it was last read or written and is rebuilt
+// if they change, e.g. because another provisioner exporting through the same
+// NFS Ganesha wrote it.
+type ganeshaIndex struct {
+	mutex   sync.Mutex
+	config  *ganesha.Block
+	exports map[uint16]*ganesha.Block
+	pseudos map[string]uint16
+	modTime time.Time
+	size    int64
+}
+
+// load makes the index up to date with the given config file.
+func (x *ganeshaIndex) load(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if x.config != nil && info.ModTime().Equal(x.modTime) && info.Size() == x.size {
+		return nil
+	}
+
+	config, err := ganesha.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	x.config = config
+	x.exports = map[uint16]*ganesha.Block{}
+	x.pseudos = map[string]uint16{}
+	for _, export := range config.Exports() {
+		id, err := export.ExportId()
+		if err != nil {
+			continue
+		}
+		x.exports[id] = export
+		if pseudo, ok := export.Get("Pseudo"); ok {
+			x.pseudos[pseudo] = id
+		}
+	}
+	x.modTime = info.ModTime()
+	x.size = info.Size()
+	return nil
+}
+
+// view calls f with the index of the given config file, up to date with it.
+func (x *ganeshaIndex) view(path string, f func(*ganeshaIndex)) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if err := x.load(path); err != nil {
+		return err
+	}
+	f(x)
+	return nil
+}
+
+// modify calls f with the index of the given config file, up to date with it,
+// to change it and writes the changed config back. If f or writing fails, the
+// index is rebuilt from the file next time.
+func (x *ganeshaIndex) modify(path string, f func(*ganeshaIndex) error) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if err := x.load(path); err != nil {
+		return err
+	}
+	if err := f(x); err != nil {
+		x.config = nil
+		return err
+	}
+	if err := writeFileAtomic(path, []byte(x.config.String()), 0600); err != nil {
+		x.config = nil
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		x.config = nil
+		return err
+	}
+	x.modTime = info.ModTime()
+	x.size = info.Size()
+	return nil
+}
+
+// add adds the given EXPORT, which mustn't conflict with the existing ones.
+func (x *ganeshaIndex) add(export *ganesha.Block) error {
+	id, err := x.validate(export)
+	if err != nil {
+		return err
+	}
+	if x.exports[id] != nil {
+		return fmt.Errorf("an EXPORT with Export_Id %d already exists", id)
+	}
+	x.config.AddBlock(export)
+	x.index(id, export)
+	return nil
+}
+
+// replace replaces the existing EXPORT with the same Export_Id as the given
+// one with it, keeping its position.
+func (x *ganeshaIndex) replace(export *ganesha.Block) error {
+	id, err := x.validate(export)
+	if err != nil {
+		return err
+	}
+	existing := x.exports[id]
+	if existing == nil {
+		return fmt.Errorf("no EXPORT with Export_Id %d exists", id)
+	}
+	x.unindex(id)
+	*existing = *export
+	x.index(id, existing)
+	return nil
+}
+
+// remove removes the EXPORTs with the given Export_Id.
+func (x *ganeshaIndex) remove(id uint16) {
+	x.config.RemoveExport(id)
+	x.unindex(id)
+}
+
+// validate checks that the given EXPORT is valid, that its serialization parses
+// back and that its Pseudo isn't another EXPORT's, and returns its Export_Id.
+func (x *ganeshaIndex) validate(export *ganesha.Block) (uint16, error) {
+	if err := ganesha.ValidateExport(export); err != nil {
+		return 0, err
+	}
+	if _, err := ganesha.Parse([]byte(export.String())); err != nil {
+		return 0, fmt.Errorf("EXPORT doesn't parse back: %v", err)
+	}
+	id, err := export.ExportId()
+	if err != nil {
+		return 0, err
+	}
+	if pseudo, ok := export.Get("Pseudo"); ok {
+		if other, ok := x.pseudos[pseudo]; ok && other != id {
+			return 0, fmt.Errorf("EXPORTs %d and %d would have the same Pseudo %s", other, id, pseudo)
+		}
+	}
+	return id, nil
+}
+
+func (x *ganeshaIndex) index(id uint16, export *ganesha.Block) {
+	x.exports[id] = export
+	if pseudo, ok := export.Get("Pseudo"); ok {
+		x.pseudos[pseudo] = id
+	}
+}
+
+func (x *ganeshaIndex) unindex(id uint16) {
+	export := x.exports[id]
+	if export == nil {
+		return
+	}
+	if pseudo, ok := export.Get("Pseudo"); ok && x.pseudos[pseudo] == id {
+		delete(x.pseudos, pseudo)
+	}
+	delete(x.exports, id)
+}
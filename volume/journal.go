@@ -0,0 +1,268 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/wongma7/nfs-provisioner/controller"
+	"github.com/wongma7/nfs-provisioner/logging"
+	"k8s.io/client-go/1.4/pkg/api/errors"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// journalFile is the name of the file in exportDir that provisioning
+// operations in progress are journaled to, so that a volume half-created when
+// the provisioner crashed can be rolled forward or back when it restarts.
+const journalFile = ".journal"
+
+// The stages of provisioning a volume journaled before each is started, so
+// that the last one journaled tells what may need to be rolled back.
+const (
+	// The backing directory is being created
+	journalDirectory = "directory"
+	// The export is being added to the config file and exported
+	journalExport = "export"
+	// The export is done and the PV is being created by the controller
+	journalPV = "pv"
+)
+
+// journalEntry is the intent of a provisioning operation in progress.
+type journalEntry struct {
+	PV       string `json:"pv"`
+	Stage    string `json:"stage"`
+	Path     string `json:"path"`
+	ExportId uint16 `json:"exportId,omitempty"`
+	Block    string `json:"block,omitempty"`
+}
+
+// journal persists the provisioning operations in progress to a small file,
+// rewritten atomically on every change.
+type journal struct {
+	path  string
+	mutex sync.Mutex
+}
+
+func newJournal(exportDir string) *journal {
+	return &journal{path: exportDir + journalFile}
+}
+
+// load reads the journaled operations, by PV. A missing file is not an error,
+// it just means no operations are in progress.
+func (j *journal) load() (map[string]journalEntry, error) {
+	entries := map[string]journalEntry{}
+
+	read, err := ioutil.ReadFile(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return entries, err
+	}
+
+	var list []journalEntry
+	if err := json.Unmarshal(read, &list); err != nil {
+		return entries, fmt.Errorf("error parsing journal file %s: %v", j.path, err)
+	}
+	for _, entry := range list {
+		entries[entry.PV] = entry
+	}
+
+	return entries, nil
+}
+
+// save overwrites the journal with the given operations.
+func (j *journal) save(entries map[string]journalEntry) error {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]journalEntry, 0, len(entries))
+	for _, name := range names {
+		list = append(list, entries[name])
+	}
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(j.path, data, 0600)
+}
+
+// record journals the given operation, replacing the PV's previous stage.
+func (j *journal) record(entry journalEntry) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	entries, err := j.load()
+	if err != nil {
+		return err
+	}
+	entries[entry.PV] = entry
+	return j.save(entries)
+}
+
+// get returns the given PV's operation and whether there is one.
+func (j *journal) get(pvName string) (journalEntry, bool, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	entries, err := j.load()
+	if err != nil {
+		return journalEntry{}, false, err
+	}
+	entry, ok := entries[pvName]
+	return entry, ok, nil
+}
+
+// clear removes the given PV's operation from the journal, if any.
+func (j *journal) clear(pvName string) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	entries, err := j.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := entries[pvName]; !ok {
+		return nil
+	}
+	delete(entries, pvName)
+	return j.save(entries)
+}
+
+// journalStage journals that the given stage of provisioning the given volume
+// is starting.
+func (p *nfsProvisioner) journalStage(entry journalEntry) error {
+	if err := p.journal.record(entry); err != nil {
+		return fmt.Errorf("error journaling stage %s of provisioning: %v", entry.Stage, err)
+	}
+	return nil
+}
+
+// clearJournal removes the given PV's operation from the journal once it's
+// finished, successfully or after cleaning up.
+func (p *nfsProvisioner) clearJournal(pvName string) {
+	if err := p.journal.clear(pvName); err != nil {
+		glog.Errorf("error clearing journal entry of PV %s, it will be recovered on restart: %v", pvName, err)
+	}
+}
+
+var _ controller.Committer = &nfsProvisioner{}
+
+// Commit clears the journal entry of the given PV once the controller has
+// created it, so that the volume isn't rolled back on restart.
+func (p *nfsProvisioner) Commit(volume *v1.PersistentVolume) {
+	p.clearJournal(volume.Name)
+}
+
+// recoverJournal finishes the provisioning operations that were in progress
+// when the provisioner stopped. An operation that fails to be recovered is
+// kept in the journal to be retried on the next restart.
+func (p *nfsProvisioner) recoverJournal() error {
+	entries, err := p.journal.load()
+	if err != nil {
+		return err
+	}
+
+	for name, entry := range entries {
+		if err := p.recoverEntry(entry); err != nil {
+			glog.Errorf("error recovering journaled provisioning of PV %s, keeping it to recover later: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// recoverEntry finishes the given journaled operation and clears it. If its PV
+// exists, it's rolled forward, i.e. just cleared, since reconcile re-adds the
+// PV's export if it's missing. Otherwise it's rolled back.
+func (p *nfsProvisioner) recoverEntry(entry journalEntry) error {
+	_, err := p.client.Core().PersistentVolumes().Get(entry.PV)
+	if err == nil {
+		glog.Infof("PV %s of journaled provisioning at stage %s exists, rolling forward", entry.PV, entry.Stage)
+		p.clearJournal(entry.PV)
+		return nil
+	}
+	if !errors.IsNotFound(err) {
+		return fmt.Errorf("error getting PV: %v", err)
+	}
+
+	glog.Infof("PV %s of journaled provisioning at stage %s doesn't exist, rolling back", entry.PV, entry.Stage)
+	if err := p.rollBack(entry); err != nil {
+		return err
+	}
+	p.clearJournal(entry.PV)
+	return nil
+}
+
+// rollBackJournaled rolls back and clears the journaled operation of the given
+// PV after it failed, keeping it in the journal if it can't be.
+func (p *nfsProvisioner) rollBackJournaled(pvName string) {
+	entry, ok, err := p.journal.get(pvName)
+	if err != nil || !ok {
+		return
+	}
+	if err := p.rollBack(entry); err != nil {
+		logging.Error("error rolling back failed provisioning, the next attempt will retry", logging.Fields{logging.Operation: "provision", logging.PV: pvName, logging.Err: err})
+		return
+	}
+	p.clearJournal(pvName)
+}
+
+// rollBack undoes the stages of the given journaled operation: its export, if
+// it got that far, is removed from the config file and unexported, its
+// exportId freed and its export record deleted, then its directory is deleted.
+// Once the export is undone, the operation is journaled as being at the
+// directory stage, so that the exportId isn't freed twice.
+func (p *nfsProvisioner) rollBack(entry journalEntry) error {
+	if entry.Stage == journalExport || entry.Stage == journalPV {
+		if entry.Block != "" {
+			if err := p.removeFromConfig(entry.Block); err != nil {
+				return fmt.Errorf("error removing export block from config file %s: %v", p.exporter.GetConfig(), err)
+			}
+			p.audit(auditRemove, "recover", entry.PV, "", entry.Path, entry.Block)
+			if err := p.exporter.Unexport(entry.Block); err != nil {
+				// It may never have been exported
+				glog.Warningf("error unexporting %s, it may not have been exported: %v", entry.Path, err)
+			}
+		}
+		if entry.Stage == journalPV {
+			if err := p.exportStore.Delete(entry.PV); err != nil {
+				return fmt.Errorf("error deleting export record: %v", err)
+			}
+		}
+		if entry.ExportId != 0 {
+			p.deleteExportId(entry.ExportId)
+		}
+		if err := p.journalStage(journalEntry{PV: entry.PV, Stage: journalDirectory, Path: entry.Path}); err != nil {
+			return err
+		}
+	}
+
+	if err := os.RemoveAll(entry.Path); err != nil {
+		return fmt.Errorf("error deleting directory %s: %v", entry.Path, err)
+	}
+	return nil
+}
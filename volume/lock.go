@@ -0,0 +1,103 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/golang/glog"
+)
+
+// lockFileSuffix is appended to the path of a config file to get the path of
+// the file that is flock'd while editing it. The config file itself isn't
+// locked because it may be replaced while the lock is held.
+const lockFileSuffix = ".lock"
+
+// lockFile takes an exclusive advisory lock on the lock file of the given path,
+// blocking until any other process holding it releases it, so that multiple
+// provisioner processes (or anyone else honoring the lock) can't interleave
+// edits. Since the lock belongs to the opened file, goroutines of the same
+// process exclude each other too. It returns a func that releases the lock.
+func lockFile(path string) (func(), error) {
+	lockPath := path + lockFileSuffix
+	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening lock file %s: %v", lockPath, err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error locking lock file %s: %v", lockPath, err)
+	}
+
+	return func() {
+		if err := syscall.Flock(int(file.Fd()), syscall.LOCK_UN); err != nil {
+			glog.Errorf("error unlocking lock file %s: %v", lockPath, err)
+		}
+		file.Close()
+	}, nil
+}
+
+// keyMutex is a set of mutexes, one per key, e.g. one per volume so that
+// operations on different volumes can run in parallel but operations on the
+// same volume can't.
+type keyMutex struct {
+	lock  sync.Mutex
+	locks map[string]*keyMutexEntry
+}
+
+type keyMutexEntry struct {
+	sync.Mutex
+	// The number of goroutines holding or waiting for the mutex, so that it can
+	// be forgotten once there are none
+	users int
+}
+
+func newKeyMutex() *keyMutex {
+	return &keyMutex{locks: make(map[string]*keyMutexEntry)}
+}
+
+// Lock locks the mutex of the given key, blocking until it's available.
+func (m *keyMutex) Lock(key string) {
+	m.lock.Lock()
+	entry, ok := m.locks[key]
+	if !ok {
+		entry = &keyMutexEntry{}
+		m.locks[key] = entry
+	}
+	entry.users++
+	m.lock.Unlock()
+
+	entry.Lock()
+}
+
+// Unlock unlocks the mutex of the given key.
+func (m *keyMutex) Unlock(key string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	entry, ok := m.locks[key]
+	if !ok {
+		return
+	}
+	entry.users--
+	if entry.users == 0 {
+		delete(m.locks, key)
+	}
+	entry.Unlock()
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/wongma7/nfs-provisioner/ganesha"
+	"github.com/wongma7/nfs-provisioner/metrics"
+	"github.com/wongma7/nfs-provisioner/tracing"
+)
+
+var _ metrics.Collector = &nfsProvisioner{}
+
+// Collect gets the usage of every PV as of the last UpdateUsage, how long
+// provisioning and its stages have taken, the export drift as of the last
+// DetectDrift, and the per-export I/O statistics
+// and client count from NFS Ganesha.
+func (p *nfsProvisioner) Collect() []metrics.Family {
+	families := p.collectUsage()
+	families = append(families, p.provisionDurations.Collect()...)
+	families = append(families, p.stageDurations.Collect()...)
+	families = append(families, p.collectDrift()...)
+	families = append(families, p.collectQuotas()...)
+	return append(families, p.collectGanesha()...)
+}
+
+// observeProvision observes how long a provision that started at the given
+// time took, labeled by whether it failed.
+func (p *nfsProvisioner) observeProvision(start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	p.provisionDurations.Observe(metrics.Labels{"result": result}, time.Since(start).Seconds())
+}
+
+// timeStage starts timing the given stage of provisioning, in a span under the
+// given one, and returns a func that observes how long it took and finishes
+// the span, to be called once the stage is done: lock,
+// waiting for the PV's volume lock; parameters, getting the claim's export
+// parameters, which may get a Secret and list nodes; validate; ready, checking
+// the NFS server is ready; server, getting the NFS server, which may get the
+// service; directory, creating and chown'ing the directory; clone, copying
+// the directory or snapshot of the PV a claim clones into it; export-id,
+// generating and persisting an exportId; config, adding the export to the
+// config file; export, exporting it over D-Bus or with exportfs; and record,
+// creating the export's record in the export store.
+func (p *nfsProvisioner) timeStage(parent *tracing.Span, stage string) func() {
+	start := time.Now()
+	span := tracing.Start(stage, parent)
+	return func() {
+		p.stageDurations.Observe(metrics.Labels{"stage": stage}, time.Since(start).Seconds())
+		span.Finish(nil)
+	}
+}
+
+// collectGanesha gets the per-export I/O statistics and client count from NFS
+// Ganesha, labeling each export's statistics with the PV it backs. It collects
+// nothing if the provisioner uses the kernel NFS server.
+func (p *nfsProvisioner) collectGanesha() []metrics.Family {
+	var e exporter
+	for _, candidate := range p.exporters() {
+		if _, ok := candidate.(*ganeshaExporter); ok {
+			e = candidate
+		}
+	}
+	if e == nil {
+		return nil
+	}
+
+	exports, err := ganesha.ShowExports()
+	if err != nil {
+		glog.Errorf("error getting exports for metrics: %v", err)
+		return nil
+	}
+	// Get the PVs from the config file rather than the exports' paths, which
+	// may be in another FSAL's filesystem
+	configExports, err := e.GetConfigExports()
+	if err != nil {
+		glog.Errorf("error getting exports in config file %s for metrics: %v", e.GetConfig(), err)
+		return nil
+	}
+	pvs := map[uint16]string{}
+	for _, export := range configExports {
+		if p.inExportDirs(export.path) {
+			pvs[export.exportId] = filepath.Base(export.path)
+		}
+	}
+
+	families := []metrics.Family{
+		{Name: "nfs_provisioner_export_operations_total", Help: "Read or write operations on the export of a PV.", Type: metrics.Counter},
+		{Name: "nfs_provisioner_export_errors_total", Help: "Failed read or write operations on the export of a PV.", Type: metrics.Counter},
+		{Name: "nfs_provisioner_export_requested_bytes_total", Help: "Bytes requested to be read or written on the export of a PV.", Type: metrics.Counter},
+		{Name: "nfs_provisioner_export_transferred_bytes_total", Help: "Bytes actually read or written on the export of a PV.", Type: metrics.Counter},
+		{Name: "nfs_provisioner_export_latency_milliseconds", Help: "Average latency of read or write operations on the export of a PV.", Type: metrics.Gauge},
+	}
+	for _, export := range exports {
+		pv, ok := pvs[export.ExportId]
+		if !ok {
+			continue
+		}
+		for _, protocol := range export.Protocols {
+			read, write, ok, err := ganesha.GetIOStats(export.ExportId, protocol)
+			if err != nil {
+				glog.Errorf("error getting %s statistics of export %d for metrics: %v", protocol, export.ExportId, err)
+				continue
+			}
+			if !ok {
+				continue
+			}
+			for _, io := range []struct {
+				op    string
+				stats ganesha.IOStats
+			}{{"read", read}, {"write", write}} {
+				labels := metrics.Labels{"pv": pv, "export_id": strconv.Itoa(int(export.ExportId)), "protocol": protocol, "op": io.op}
+				for i, v := range []float64{float64(io.stats.Ops), float64(io.stats.Errors), float64(io.stats.Requested), float64(io.stats.Transferred), io.stats.Latency} {
+					families[i].Samples = append(families[i].Samples, metrics.Sample{Labels: labels, Value: v})
+				}
+			}
+		}
+	}
+
+	clients, err := ganesha.CountClients()
+	if err != nil {
+		glog.Errorf("error getting clients for metrics: %v", err)
+	} else {
+		families = append(families, metrics.Family{
+			Name:    "nfs_provisioner_clients",
+			Help:    "Clients known to the NFS server.",
+			Type:    metrics.Gauge,
+			Samples: []metrics.Sample{{Value: float64(clients)}},
+		})
+	}
+
+	return families
+}
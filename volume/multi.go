@@ -0,0 +1,213 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The exporters a StorageClass's exporter parameter can name.
+const (
+	ExporterGanesha = "ganesha"
+	ExporterKernel  = "kernel"
+)
+
+// multiExporter exports through both NFS Ganesha and the kernel NFS server. A
+// new export goes through the one its class's exporter parameter names or else
+// the default one, and an existing export through the one its block is of: an
+// EXPORT block is ganesha's and an /etc/exports line, which starts with the
+// exported path, the kernel's. Config file edits are made by the exporter of
+// the block, so each keeps its own config file and locks.
+type multiExporter struct {
+	ganesha *ganeshaExporter
+	kernel  *kernelExporter
+	// The name of the exporter of exports whose class names none
+	defaultExporter string
+	// The server to put in PVs exported through the other exporter than the
+	// default one, whose NFS server isn't the one discovered for the default
+	otherServer string
+}
+
+var _ exporter = &multiExporter{}
+var _ batchExporter = &multiExporter{}
+var _ entryLister = &multiExporter{}
+
+// named returns the exporter of the given name, or the default one if the name
+// is empty.
+func (e *multiExporter) named(name string) exporter {
+	if name == "" {
+		name = e.defaultExporter
+	}
+	if name == ExporterGanesha {
+		return e.ganesha
+	}
+	return e.kernel
+}
+
+// of returns the exporter of the given block.
+func (e *multiExporter) of(block string) exporter {
+	if strings.HasPrefix(strings.TrimSpace(block), "/") {
+		return e.kernel
+	}
+	return e.ganesha
+}
+
+func (e *multiExporter) GetConfig() string {
+	return e.named("").GetConfig()
+}
+
+func (e *multiExporter) GetConfigExportIds() (map[uint16]bool, error) {
+	exportIds, err := e.ganesha.GetConfigExportIds()
+	if err != nil {
+		return exportIds, err
+	}
+	kernelIds, err := e.kernel.GetConfigExportIds()
+	for id := range kernelIds {
+		exportIds[id] = true
+	}
+	return exportIds, err
+}
+
+func (e *multiExporter) GetConfigExports() ([]configExport, error) {
+	exports, err := e.ganesha.GetConfigExports()
+	if err != nil {
+		return nil, fmt.Errorf("error getting exports in config file %s: %v", e.ganesha.GetConfig(), err)
+	}
+	kernelExports, err := e.kernel.GetConfigExports()
+	if err != nil {
+		return nil, fmt.Errorf("error getting exports in config file %s: %v", e.kernel.GetConfig(), err)
+	}
+	return append(exports, kernelExports...), nil
+}
+
+func (e *multiExporter) CreateBlock(exportId, path string, params exportParams) (string, error) {
+	return e.named(params.exporter).CreateBlock(exportId, path, params)
+}
+
+func (e *multiExporter) AddToConfig(block string) error {
+	return e.of(block).AddToConfig(block)
+}
+
+func (e *multiExporter) RemoveFromConfig(block string) error {
+	return e.of(block).RemoveFromConfig(block)
+}
+
+func (e *multiExporter) Export(block string) error {
+	return e.of(block).Export(block)
+}
+
+func (e *multiExporter) Unexport(block string) error {
+	return e.of(block).Unexport(block)
+}
+
+// ExportBatch exports the given kernel blocks with a single exportfs and the
+// ganesha ones one at a time.
+func (e *multiExporter) ExportBatch(blocks []string) error {
+	kernelBlocks := []string{}
+	for _, block := range blocks {
+		if e.of(block) == exporter(e.kernel) {
+			kernelBlocks = append(kernelBlocks, block)
+			continue
+		}
+		if err := e.ganesha.Export(block); err != nil {
+			return err
+		}
+	}
+	if len(kernelBlocks) == 0 {
+		return nil
+	}
+	return e.kernel.ExportBatch(kernelBlocks)
+}
+
+func (e *multiExporter) listEntries() (map[string][]string, error) {
+	entries, err := e.ganesha.listEntries()
+	if err != nil {
+		return nil, err
+	}
+	kernelEntries, err := e.kernel.listEntries()
+	if err != nil {
+		return nil, err
+	}
+	for path, pathEntries := range kernelEntries {
+		entries[path] = append(entries[path], pathEntries...)
+	}
+	return entries, nil
+}
+
+func (e *multiExporter) normalize(block string) string {
+	return e.of(block).(entryLister).normalize(block)
+}
+
+// exporters returns the exporters the provisioner exports through: both of a
+// multiExporter or else its only one.
+func (p *nfsProvisioner) exporters() []exporter {
+	if multi, ok := p.exporter.(*multiExporter); ok {
+		return []exporter{multi.ganesha, multi.kernel}
+	}
+	return []exporter{p.exporter}
+}
+
+// exporterOf returns the exporter the export of the given block is exported
+// through.
+func (p *nfsProvisioner) exporterOf(block string) exporter {
+	if multi, ok := p.exporter.(*multiExporter); ok {
+		return multi.of(block)
+	}
+	return p.exporter
+}
+
+// exporterFor returns the exporter a new export with the given parameters is
+// exported through.
+func (p *nfsProvisioner) exporterFor(params exportParams) exporter {
+	if multi, ok := p.exporter.(*multiExporter); ok {
+		return multi.named(params.exporter)
+	}
+	return p.exporter
+}
+
+// otherServer returns the server to put in a PV exported through the given
+// exporter, if it isn't the default one's, and whether it is.
+func (p *nfsProvisioner) otherServer(e exporter) (string, bool) {
+	multi, ok := p.exporter.(*multiExporter)
+	if !ok || e == multi.named("") {
+		return "", false
+	}
+	return multi.otherServer, true
+}
+
+// validateExporter checks that the given value of a class's exporter
+// parameter names an exporter the provisioner exports through.
+func (p *nfsProvisioner) validateExporter(name string) error {
+	name = strings.ToLower(name)
+	if name != ExporterGanesha && name != ExporterKernel {
+		return fmt.Errorf("invalid value for parameter exporter: %v. valid values are: 'ganesha' or 'kernel'", name)
+	}
+	switch p.exporter.(type) {
+	case *multiExporter, *stubExporter:
+		return nil
+	case *ganeshaExporter:
+		if name == ExporterGanesha {
+			return nil
+		}
+	case *kernelExporter:
+		if name == ExporterKernel {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid value for parameter exporter: %v. the provisioner doesn't export through it; set additional-exporter to export through both", name)
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/wongma7/nfs-provisioner/controller"
+	"github.com/wongma7/nfs-provisioner/logging"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/types"
+)
+
+// maxPVNameLength is the maximum length of a PV name, that of a DNS subdomain.
+const maxPVNameLength = 253
+
+// invalidPVNameChars matches the runs of characters a PV name can't contain.
+var invalidPVNameChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// pvNameFields are the fields the PV name template is executed with.
+type pvNameFields struct {
+	Namespace string
+	Name      string
+	UID       string
+}
+
+// ParsePVNameTemplate parses the given Go template that the names of PVs, and
+// so of their directories, are generated from. The template is executed with
+// the fields Namespace, Name and UID of the claim, e.g.
+// {{.Namespace}}-{{.Name}}-{{.UID}}.
+func ParsePVNameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("pv-name").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure the template executes, so that VolumeName can't fail later
+	claim := &v1.PersistentVolumeClaim{ObjectMeta: v1.ObjectMeta{Name: "claim", Namespace: "default", UID: types.UID("00000000-0000-0000-0000-000000000000")}}
+	if _, err := executePVNameTemplate(tmpl, claim); err != nil {
+		return nil, err
+	}
+
+	return tmpl, nil
+}
+
+// executePVNameTemplate returns the name the given template generates for the
+// PV of the given claim, sanitized to be a valid PV name. A name that doesn't
+// contain the claim's UID, or is too long, gets the UID as a suffix so that it
+// is unique.
+func executePVNameTemplate(tmpl *template.Template, claim *v1.PersistentVolumeClaim) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, pvNameFields{Namespace: claim.Namespace, Name: claim.Name, UID: string(claim.UID)}); err != nil {
+		return "", fmt.Errorf("error executing PV name template: %v", err)
+	}
+
+	uid := strings.ToLower(string(claim.UID))
+	name := invalidPVNameChars.ReplaceAllString(strings.ToLower(buf.String()), "-")
+	name = strings.Trim(name, "-.")
+	if len(name) <= maxPVNameLength && strings.Contains(name, uid) {
+		return name, nil
+	}
+	if max := maxPVNameLength - len(uid) - 1; len(name) > max {
+		name = strings.TrimRight(name[:max], "-.")
+	}
+	if name == "" {
+		return "pvc-" + uid, nil
+	}
+	return name + "-" + uid, nil
+}
+
+var _ controller.Namer = &nfsProvisioner{}
+
+// VolumeName returns the name of the PV to provision for the given claim,
+// generated from the PV name template, if there is one, or else pvc-<claim
+// UID>. The directory of the PV is named after it.
+func (p *nfsProvisioner) VolumeName(claim *v1.PersistentVolumeClaim) string {
+	if p.pvNameTemplate == nil {
+		return "pvc-" + string(claim.UID)
+	}
+	name, err := executePVNameTemplate(p.pvNameTemplate, claim)
+	if err != nil {
+		logging.Error("error generating PV name, falling back to the default", logging.Fields{logging.Operation: "provision", logging.PVC: claim.Name, logging.Namespace: claim.Namespace, logging.Err: err})
+		return "pvc-" + string(claim.UID)
+	}
+	return name
+}
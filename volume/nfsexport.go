@@ -0,0 +1,210 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"k8s.io/client-go/1.4/dynamic"
+	"k8s.io/client-go/1.4/kubernetes"
+	"k8s.io/client-go/1.4/pkg/api/errors"
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/1.4/pkg/runtime"
+	"k8s.io/client-go/1.4/rest"
+)
+
+const (
+	// The ThirdPartyResource NFSExport objects are stored as. The API server
+	// derives the kind "NfsExport" and the resource "nfsexports" from it.
+	exportResourceName    = "nfs-export." + exportResourceGroup
+	exportResourceGroup   = "wongma7.github.io"
+	exportResourceVersion = "v1"
+	exportResourceKind    = "NfsExport"
+	exportResourcePlural  = "nfsexports"
+)
+
+// NFSExport is the record of an export this provisioner created, named after
+// the PV it backs. It is the source of truth for cleaning up the export on
+// deletion, in place of the PV's annotations.
+type NFSExport struct {
+	// The name of the PV the export backs
+	PV string `json:"pv"`
+	// The exported directory
+	Path string `json:"path"`
+	// The exportId assigned to the export
+	ExportId uint16 `json:"exportId"`
+	// The supplemental group of the volume, zero if none
+	Gid uint64 `json:"gid,omitempty"`
+	// The block added to the ganesha config or /etc/exports
+	Block string `json:"block"`
+}
+
+// ExportStore stores a record of every export the provisioner creates.
+type ExportStore interface {
+	// Get returns the record for the given PV, or nil if there is none.
+	Get(pvName string) (*NFSExport, error)
+	// Create saves the given record.
+	Create(export *NFSExport) error
+	// Update overwrites the existing record for the given record's PV.
+	Update(export *NFSExport) error
+	// Delete removes the record for the given PV.
+	Delete(pvName string) error
+	// List returns all records.
+	List() ([]*NFSExport, error)
+}
+
+// NewExportStore returns an ExportStore that stores records as NfsExport
+// objects in the provisioner pod's namespace, registering the
+// ThirdPartyResource first if it doesn't exist yet.
+func NewExportStore(config *rest.Config, client kubernetes.Interface) (ExportStore, error) {
+	namespace := os.Getenv(namespaceEnv)
+	if namespace == "" {
+		return nil, fmt.Errorf("namespace env %s isn't set; no namespace to store NfsExport objects in", namespaceEnv)
+	}
+
+	tpr := &v1beta1.ThirdPartyResource{
+		ObjectMeta: v1.ObjectMeta{
+			Name: exportResourceName,
+		},
+		Description: "A record of an export created by an nfs-provisioner",
+		Versions:    []v1beta1.APIVersion{{Name: exportResourceVersion}},
+	}
+	if _, err := client.Extensions().ThirdPartyResources().Create(tpr); err != nil && !errors.IsAlreadyExists(err) {
+		return nil, fmt.Errorf("error creating ThirdPartyResource %s: %v", exportResourceName, err)
+	}
+
+	dynamicConfig := *config
+	dynamicConfig.APIPath = "/apis"
+	dynamicConfig.GroupVersion = &unversioned.GroupVersion{Group: exportResourceGroup, Version: exportResourceVersion}
+	dynamicClient, err := dynamic.NewClient(&dynamicConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error creating client for NfsExport objects: %v", err)
+	}
+	resource := &unversioned.APIResource{Name: exportResourcePlural, Namespaced: true, Kind: exportResourceKind}
+
+	return &tprExportStore{client: dynamicClient.Resource(resource, namespace)}, nil
+}
+
+type tprExportStore struct {
+	client *dynamic.ResourceClient
+}
+
+var _ ExportStore = &tprExportStore{}
+
+func (s *tprExportStore) Get(pvName string) (*NFSExport, error) {
+	obj, err := s.client.Get(pvName)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return fromUnstructured(obj)
+}
+
+func (s *tprExportStore) Create(export *NFSExport) error {
+	obj, err := toUnstructured(export)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Create(obj)
+	return err
+}
+
+func (s *tprExportStore) Update(export *NFSExport) error {
+	obj, err := toUnstructured(export)
+	if err != nil {
+		return err
+	}
+	// Update the existing object's spec so its resourceVersion is kept
+	existing, err := s.client.Get(export.PV)
+	if err != nil {
+		return err
+	}
+	existing.Object["spec"] = obj.Object["spec"]
+	_, err = s.client.Update(existing)
+	return err
+}
+
+func (s *tprExportStore) Delete(pvName string) error {
+	err := s.client.Delete(pvName, nil)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *tprExportStore) List() ([]*NFSExport, error) {
+	obj, err := s.client.List(&v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	list, ok := obj.(*runtime.UnstructuredList)
+	if !ok {
+		return nil, fmt.Errorf("expected UnstructuredList but got %T", obj)
+	}
+	exports := []*NFSExport{}
+	for _, item := range list.Items {
+		export, err := fromUnstructured(item)
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, export)
+	}
+	return exports, nil
+}
+
+func toUnstructured(export *NFSExport) (*runtime.Unstructured, error) {
+	data, err := json.Marshal(export)
+	if err != nil {
+		return nil, err
+	}
+	spec := map[string]interface{}{}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+	return &runtime.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": exportResourceGroup + "/" + exportResourceVersion,
+			"kind":       exportResourceKind,
+			"metadata": map[string]interface{}{
+				"name": export.PV,
+			},
+			"spec": spec,
+		},
+	}, nil
+}
+
+func fromUnstructured(obj *runtime.Unstructured) (*NFSExport, error) {
+	spec, ok := obj.Object["spec"]
+	if !ok {
+		return nil, fmt.Errorf("NfsExport %s has no spec", obj.GetName())
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	export := &NFSExport{}
+	if err := json.Unmarshal(data, export); err != nil {
+		return nil, fmt.Errorf("error parsing NfsExport %s: %v", obj.GetName(), err)
+	}
+	return export, nil
+}
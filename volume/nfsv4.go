@@ -0,0 +1,140 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// rootBlock returns the /etc/exports block of the NFSv4 pseudo-root. It's
+// read-only and, unlike the blocks created by CreateBlock, not matched by
+// kernelBlockRe.
+func (e *kernelExporter) rootBlock() string {
+	return "\n" + e.nfsv4Root + " *(ro,insecure,root_squash,no_subtree_check,fsid=0)\n"
+}
+
+// exportNFSv4Root creates and exports the NFSv4 pseudo-root of the given
+// kernel exporter, adding its block to the config if it isn't there.
+func (p *nfsProvisioner) exportNFSv4Root(e *kernelExporter) error {
+	if err := os.MkdirAll(e.nfsv4Root, 0755); err != nil {
+		return fmt.Errorf("error creating NFSv4 pseudo-root %s: %v", e.nfsv4Root, err)
+	}
+
+	block := e.rootBlock()
+	exists, err := e.hasBlock(block)
+	if err != nil {
+		return fmt.Errorf("error reading config files: %v", err)
+	}
+	if !exists {
+		if err := p.addToConfig(block); err != nil {
+			return fmt.Errorf("error adding NFSv4 pseudo-root block %s to config %s: %v", block, e.GetConfig(), err)
+		}
+	}
+
+	cmd := exec.Command("exportfs", "-o", "ro,insecure,root_squash,no_subtree_check,fsid=0", "*:"+e.nfsv4Root)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("exportfs -o of NFSv4 pseudo-root %s failed with error: %v, output: %s", e.nfsv4Root, err, out)
+	}
+
+	return nil
+}
+
+// toRootPath returns the path under the NFSv4 pseudo-root the given directory
+// is bind-mounted and exported at.
+func (e *kernelExporter) toRootPath(path string) string {
+	if e.nfsv4Root == "" {
+		return path
+	}
+	return e.nfsv4Root + path
+}
+
+// fromRootPath returns the directory bind-mounted at the given path under the
+// NFSv4 pseudo-root, which is also the path clients mount it by.
+func (e *kernelExporter) fromRootPath(path string) string {
+	if e.nfsv4Root == "" {
+		return path
+	}
+	return strings.TrimPrefix(path, e.nfsv4Root)
+}
+
+// bindMount bind-mounts the directory exported at the given path under the
+// NFSv4 pseudo-root there, if it isn't already.
+func (e *kernelExporter) bindMount(path string) error {
+	mounted, err := isMounted(path)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return nil
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return fmt.Errorf("error creating bind mount point %s: %v", path, err)
+	}
+	source := e.fromRootPath(path)
+	cmd := exec.Command("mount", "--bind", source, path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("mount --bind %s %s failed with error: %v, output: %s", source, path, err, out)
+	}
+	return nil
+}
+
+// unbindMount unmounts the bind mount at the given path under the NFSv4
+// pseudo-root, if there is one, and removes the mount point.
+func (e *kernelExporter) unbindMount(path string) error {
+	mounted, err := isMounted(path)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		cmd := exec.Command("umount", path)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("umount %s failed with error: %v, output: %s", path, err, out)
+		}
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing bind mount point %s: %v", path, err)
+	}
+	return nil
+}
+
+// isMounted returns whether something is mounted at the given path. Bind
+// mounts of directories on the same filesystem can't be told apart from plain
+// directories by their device, so /proc/self/mountinfo is checked instead.
+func isMounted(path string) (bool, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false, fmt.Errorf("error opening /proc/self/mountinfo: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// The mount point is the fifth field
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 5 && fields[4] == path {
+			return true, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("error reading /proc/self/mountinfo: %v", err)
+	}
+	return false, nil
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wongma7/nfs-provisioner/controller"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// The policies for picking which of several export directories, e.g. on
+// different disks, the directory of a volume is created in.
+const (
+	// The export directory with the most free space, i.e. bytes both
+	// available and not reserved by other volumes
+	PlacementMostFreeSpace = "most-free-space"
+	// Every export directory in turn
+	PlacementRoundRobin = "round-robin"
+	// The export directory the class's exportDir parameter names, or else
+	// the first
+	PlacementClassPinned = "class-pinned"
+)
+
+// ParsePlacementPolicy checks that the given placement policy is valid.
+func ParsePlacementPolicy(policy string) error {
+	switch policy {
+	case PlacementMostFreeSpace, PlacementRoundRobin, PlacementClassPinned:
+		return nil
+	}
+	return fmt.Errorf("invalid placement policy %q, valid policies are: %s, %s, %s", policy, PlacementMostFreeSpace, PlacementRoundRobin, PlacementClassPinned)
+}
+
+// getExportDirs gets the export directories the directory of a volume with the
+// given options can be created in: the one its class's exportDir parameter
+// names, if any, else every export directory or, with the class-pinned
+// policy, the first.
+func (p *nfsProvisioner) getExportDirs(options controller.VolumeOptions) ([]string, error) {
+	for k, v := range options.Parameters {
+		if strings.ToLower(k) != "exportdir" {
+			continue
+		}
+		dir := strings.TrimSuffix(v, "/") + "/"
+		if !containsString(p.exportDirs, dir) {
+			return nil, fmt.Errorf("invalid value for parameter exportDir: %v. valid values are: %s", v, strings.Join(p.exportDirs, ", "))
+		}
+		return []string{dir}, nil
+	}
+	if p.placementPolicy == PlacementClassPinned {
+		return p.exportDirs[:1], nil
+	}
+	return p.exportDirs, nil
+}
+
+// pickExportDir picks, by the placement policy, which of the given export
+// directories the volume fits in to create its directory in, given how many
+// bytes each has free. The caller must hold mapMutex.
+func (p *nfsProvisioner) pickExportDir(dirs []string, free map[string]int64) string {
+	if p.placementPolicy == PlacementRoundRobin {
+		// The first that fits, starting after the last one picked
+		for i := range p.exportDirs {
+			next := (p.nextExportDir + i) % len(p.exportDirs)
+			if containsString(dirs, p.exportDirs[next]) {
+				p.nextExportDir = (next + 1) % len(p.exportDirs)
+				return p.exportDirs[next]
+			}
+		}
+	}
+	picked := dirs[0]
+	for _, dir := range dirs[1:] {
+		if free[dir] > free[picked] {
+			picked = dir
+		}
+	}
+	return picked
+}
+
+// placementOf returns the export directory the directory of the given PV was
+// placed in, exportDir if it wasn't placed. The caller must hold mapMutex.
+func (p *nfsProvisioner) placementOf(pvName string) string {
+	if dir, ok := p.placements[pvName]; ok {
+		return dir
+	}
+	return p.exportDir
+}
+
+// placedPath returns the path of the directory of the given PV in the export
+// directory reserveCapacity placed it in, in the subdirectory placeInSubdir
+// placed it in, if any.
+func (p *nfsProvisioner) placedPath(pvName string) string {
+	p.mapMutex.Lock()
+	defer p.mapMutex.Unlock()
+	return p.placementOf(pvName) + p.subdirs[pvName] + pvName
+}
+
+// namespaceSubdir returns the subdirectory of its export directory the
+// directory of a volume for the given options is created in: its claim's
+// namespace's, e.g. "default/", if directories are nested by namespace, or
+// else none.
+func (p *nfsProvisioner) namespaceSubdir(options controller.VolumeOptions) string {
+	namespace := claimNamespace(options)
+	if !p.namespaceDirs || namespace == "" {
+		return ""
+	}
+	return namespace + "/"
+}
+
+// claimNamespace returns the namespace of the claim of a volume for the given
+// options, or empty if there's no claim.
+func claimNamespace(options controller.VolumeOptions) string {
+	if options.PVC == nil {
+		return ""
+	}
+	return options.PVC.Namespace
+}
+
+// placeInSubdir records that the directory of the given PV, being provisioned,
+// is in the given subdirectory of its export directory, until its capacity is
+// released.
+func (p *nfsProvisioner) placeInSubdir(pvName, subdir string) {
+	if subdir == "" {
+		return
+	}
+	p.mapMutex.Lock()
+	defer p.mapMutex.Unlock()
+	p.subdirs[pvName] = subdir
+}
+
+// exportDirOf returns the export directory the given path is in, or "" if it's
+// in none of them.
+func (p *nfsProvisioner) exportDirOf(path string) string {
+	for _, dir := range p.exportDirs {
+		if strings.HasPrefix(path, dir) {
+			return dir
+		}
+	}
+	return ""
+}
+
+// inExportDirs returns whether the given path is in one of the export
+// directories.
+func (p *nfsProvisioner) inExportDirs(path string) bool {
+	return p.exportDirOf(path) != ""
+}
+
+// volumePath returns the path of the directory backing the given PV: its NFS
+// path, if it's in one of the export directories, or else its path in
+// exportDir.
+func (p *nfsProvisioner) volumePath(volume *v1.PersistentVolume) string {
+	if volume.Spec.NFS != nil && p.inExportDirs(volume.Spec.NFS.Path) {
+		return volume.Spec.NFS.Path
+	}
+	return p.exportDir + volume.Name
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/pkg/util/uuid"
+)
+
+// poolDir is the name of the directory in exportDir the directory pool keeps
+// its directories in, so that taking one is a rename within the filesystem.
+const poolDir = ".pool"
+
+// directoryPool keeps directories set up ahead of claims, already with their
+// permissions, ownership and ACLs, so that creating a volume's directory is
+// just a rename, cutting provisioning latency for bursty workloads. It keeps
+// up to size directories of every set of directory parameters it has been
+// asked for, and of the default ones, refilling in the background as they're
+// taken. The directories survive restarts.
+type directoryPool struct {
+	dir   string
+	size  int
+	setUp func(path string, params directoryParams) error
+
+	mutex sync.Mutex
+	// The ready directories of each set of parameters, by poolKey
+	ready map[string][]string
+	// Whether each set of parameters is being refilled
+	refilling map[string]bool
+}
+
+// newDirectoryPool returns a pool in the given directory, with the directories
+// already there ready to be taken, and starts refilling it.
+func newDirectoryPool(dir string, size int, setUp func(string, directoryParams) error) (*directoryPool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating pool directory %s: %v", dir, err)
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading pool directory %s: %v", dir, err)
+	}
+
+	pool := &directoryPool{dir: dir, size: size, setUp: setUp, ready: map[string][]string{}, refilling: map[string]bool{}}
+	keys := map[string]directoryParams{poolKey(directoryParams{gid: "none", owner: "0"}): {gid: "none", owner: "0"}}
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		key := strings.SplitN(info.Name(), ".", 2)[0]
+		params, ok := parsePoolKey(key)
+		if !info.IsDir() || !ok || !strings.Contains(info.Name(), ".") {
+			glog.Warningf("removing unknown entry %s of the directory pool", path)
+			os.RemoveAll(path)
+			continue
+		}
+		pool.ready[key] = append(pool.ready[key], path)
+		keys[key] = params
+	}
+	for _, params := range keys {
+		go pool.refill(params)
+	}
+	return pool, nil
+}
+
+// take renames a directory set up with the given parameters to the given path
+// and returns whether there was one. It refills the pool either way.
+func (d *directoryPool) take(params directoryParams, path string) bool {
+	key := poolKey(params)
+	defer func() { go d.refill(params) }()
+
+	d.mutex.Lock()
+	ready := d.ready[key]
+	if len(ready) == 0 {
+		d.mutex.Unlock()
+		return false
+	}
+	pooled := ready[len(ready)-1]
+	d.ready[key] = ready[:len(ready)-1]
+	d.mutex.Unlock()
+
+	if err := os.Rename(pooled, path); err != nil {
+		glog.Errorf("error taking pooled directory %s, creating one instead: %v", pooled, err)
+		os.RemoveAll(pooled)
+		return false
+	}
+	return true
+}
+
+// refill sets up directories with the given parameters until there are size
+// of them ready, unless it's already being refilled.
+func (d *directoryPool) refill(params directoryParams) {
+	key := poolKey(params)
+	d.mutex.Lock()
+	if d.refilling[key] {
+		d.mutex.Unlock()
+		return
+	}
+	d.refilling[key] = true
+	d.mutex.Unlock()
+
+	defer func() {
+		d.mutex.Lock()
+		d.refilling[key] = false
+		d.mutex.Unlock()
+	}()
+
+	for {
+		d.mutex.Lock()
+		full := len(d.ready[key]) >= d.size
+		d.mutex.Unlock()
+		if full {
+			return
+		}
+
+		path := filepath.Join(d.dir, key+"."+string(uuid.NewUUID()))
+		if err := d.setUp(path, params); err != nil {
+			glog.Errorf("error setting up pooled directory %s: %v", path, err)
+			os.RemoveAll(path)
+			return
+		}
+		d.mutex.Lock()
+		d.ready[key] = append(d.ready[key], path)
+		d.mutex.Unlock()
+	}
+}
+
+// poolKey returns the key of the given directory parameters, which pooled
+// directories' names start with: the gid, f or s for whether it's for pods'
+// fsGroup or supplementalGroups, the owner and the mode, separated by _, e.g.
+// 1000_f_0_.
+func poolKey(params directoryParams) string {
+	group := "s"
+	if params.fsGroup {
+		group = "f"
+	}
+	return strings.Join([]string{params.gid, group, params.owner, params.mode}, "_")
+}
+
+// parsePoolKey parses the given key of directory parameters.
+func parsePoolKey(key string) (directoryParams, bool) {
+	parts := strings.Split(key, "_")
+	if len(parts) != 4 || (parts[1] != "f" && parts[1] != "s") {
+		return directoryParams{}, false
+	}
+	return directoryParams{gid: parts[0], fsGroup: parts[1] == "f", owner: parts[2], mode: parts[3]}, true
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/wongma7/nfs-provisioner/ganesha"
+	"k8s.io/client-go/1.4/kubernetes"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/errors"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// CheckEnvironment checks that what the provisioner needs is in place before
+// it starts, so that it can fail fast saying what to do about it instead of
+// failing on the first claim: the export directories exist and are writable,
+// if checkServer is true, the dependencies of the NFS server of each of the
+// given exporters are there, i.e. NFS Ganesha is on D-Bus or exportfs is
+// installed and nfsd is running, and, if client isn't nil, it's allowed to list
+// the objects the controller watches. It returns every problem found.
+func CheckEnvironment(exportDirs []string, exporters []string, checkServer bool, client kubernetes.Interface) []error {
+	errs := []error{}
+	for _, dir := range exportDirs {
+		if err := checkExportDir(dir); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if checkServer {
+		for _, exporter := range exporters {
+			if exporter == ExporterGanesha {
+				errs = append(errs, checkGanesha()...)
+			} else {
+				errs = append(errs, checkKernelServer()...)
+			}
+		}
+	}
+	if client != nil {
+		errs = append(errs, checkPermissions(client)...)
+	}
+	return errs
+}
+
+// checkExportDir checks that the given export directory exists and that
+// directories can be created in it.
+func checkExportDir(dir string) error {
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("export directory %s doesn't exist: mount the storage to provision in at it, e.g. with a volume in the pod spec", dir)
+	}
+	if err != nil {
+		return fmt.Errorf("error checking export directory %s: %v", dir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("export directory %s isn't a directory", dir)
+	}
+	f, err := ioutil.TempFile(dir, ".preflight")
+	if err != nil {
+		return fmt.Errorf("export directory %s isn't writable by uid %d: %v; make it writable, e.g. with the pod's fsGroup, or run the provisioner as root", dir, os.Getuid(), err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
+// checkGanesha checks that the bus NFS Ganesha is on is reachable and that
+// it's on it.
+func checkGanesha() []error {
+	running, err := ganesha.IsRunning()
+	if err != nil {
+		return []error{fmt.Errorf("%v; check that dbus-daemon is running, which run-server starts, or that ganesha-dbus-address is the address of the bus NFS Ganesha is on", err)}
+	}
+	if !running {
+		return []error{fmt.Errorf("NFS Ganesha isn't running: nothing owns D-Bus name %s; start it, e.g. with run-server, and check its log if it exits", ganesha.BusName)}
+	}
+	return nil
+}
+
+// checkKernelServer checks that exportfs is installed and the kernel NFS
+// server is running.
+func checkKernelServer() []error {
+	errs := []error{}
+	if _, err := exec.LookPath("exportfs"); err != nil {
+		errs = append(errs, fmt.Errorf("exportfs isn't installed: %v; install nfs-utils in the image", err))
+	}
+	if _, err := os.Stat(nfsdExportsFile); err != nil {
+		errs = append(errs, fmt.Errorf("kernel NFS server isn't running: nfsd filesystem isn't mounted at /proc/fs/nfsd: %v; load the nfsd module on the node and run the provisioner privileged with run-server, or start the NFS server on the node", err))
+	} else if threads, err := ioutil.ReadFile(nfsdThreadsFile); err == nil && strings.TrimSpace(string(threads)) == "0" {
+		errs = append(errs, fmt.Errorf("kernel NFS server isn't running: nfsd has no threads; start it with run-server or rpc.nfsd"))
+	}
+	return errs
+}
+
+// checkPermissions checks that the given client is allowed to list the PVs,
+// claims and classes the controller watches. Creating and updating PVs can't
+// be checked without side effects.
+func checkPermissions(client kubernetes.Interface) []error {
+	errs := []error{}
+	for _, check := range []struct {
+		resource string
+		list     func() error
+	}{
+		{"persistentvolumes", func() error {
+			_, err := client.Core().PersistentVolumes().List(api.ListOptions{})
+			return err
+		}},
+		{"persistentvolumeclaims", func() error {
+			_, err := client.Core().PersistentVolumeClaims(v1.NamespaceAll).List(api.ListOptions{})
+			return err
+		}},
+		{"storageclasses", func() error {
+			_, err := client.Storage().StorageClasses().List(api.ListOptions{})
+			return err
+		}},
+	} {
+		err := check.list()
+		if err == nil {
+			continue
+		}
+		if errors.IsForbidden(err) {
+			errs = append(errs, fmt.Errorf("not allowed to list %s: %v; grant the provisioner's service account the list and watch verbs on %s, e.g. in a ClusterRole bound to it", check.resource, err, check.resource))
+		} else {
+			errs = append(errs, fmt.Errorf("error listing %s: %v; check that the API server is reachable with master or kubeconfig, or in cluster", check.resource, err))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/util/validation"
+)
+
+// ParseClaimKeys parses the given comma-separated list of the keys of the
+// labels or annotations of claims to copy onto their PVs.
+func ParseClaimKeys(s string) ([]string, error) {
+	keys := []string{}
+	for _, key := range strings.Split(s, ",") {
+		if key = strings.TrimSpace(key); key == "" {
+			continue
+		}
+		if msgs := validation.IsQualifiedName(key); len(msgs) != 0 {
+			return nil, fmt.Errorf("invalid key %q: %s", key, strings.Join(msgs, ", "))
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// copyClaimMetadata copies the claim's labels and annotations of the keys the
+// provisioner is configured to copy onto the given PV's, so that PVs can be
+// attributed to and selected by e.g. the team or app of their claims. Labels
+// the claim's selector requires and the provisioner's own annotations are
+// never overwritten, or the PV wouldn't bind or be deletable.
+func (p *nfsProvisioner) copyClaimMetadata(pv *v1.PersistentVolume, claim *v1.PersistentVolumeClaim) {
+	if claim == nil {
+		return
+	}
+	for _, key := range p.claimLabels {
+		v, ok := claim.Labels[key]
+		if !ok {
+			continue
+		}
+		if pv.Labels == nil {
+			pv.Labels = map[string]string{}
+		}
+		if _, ok := pv.Labels[key]; !ok {
+			pv.Labels[key] = v
+		}
+	}
+	for _, key := range p.claimAnnotations {
+		v, ok := claim.Annotations[key]
+		if !ok {
+			continue
+		}
+		if pv.Annotations == nil {
+			pv.Annotations = map[string]string{}
+		}
+		if _, ok := pv.Annotations[key]; !ok {
+			pv.Annotations[key] = v
+		}
+	}
+}
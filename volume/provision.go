@@ -17,23 +17,37 @@ limitations under the License.
 package volume
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
+	"net"
 	"os"
 	"os/exec"
-	"reflect"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"text/template"
+	"time"
 
 	"github.com/golang/glog"
-	"github.com/guelfey/go.dbus"
 	"github.com/wongma7/nfs-provisioner/controller"
+	"github.com/wongma7/nfs-provisioner/ganesha"
+	"github.com/wongma7/nfs-provisioner/logging"
+	"github.com/wongma7/nfs-provisioner/metrics"
+	"github.com/wongma7/nfs-provisioner/tracing"
 	"k8s.io/client-go/1.4/kubernetes"
+	core_v1 "k8s.io/client-go/1.4/kubernetes/typed/core/v1"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
 	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/util/wait"
+	"k8s.io/client-go/1.4/tools/record"
 )
 
 const (
@@ -42,7 +56,8 @@ const (
 	VolumeGidAnnotationKey = "pv.beta.kubernetes.io/gid"
 
 	// A PV annotation for the entire ganesha EXPORT block or /etc/exports
-	// block, needed for deletion.
+	// block, needed for deletion. Like annExportId, it's namespaced under the
+	// annotation domain, if there is one.
 	annBlock = "EXPORT_block"
 
 	// A PV annotation for the exportId of this PV's backing ganesha/kernel export
@@ -50,38 +65,311 @@ const (
 	// map so the id can be reassigned.
 	annExportId = "Export_Id"
 
+	// PV annotations for the access type (RW or RO) and the comma-separated
+	// clients of this PV's backing ganesha export. Editing them updates the
+	// export in place. A claim annotation annClients restricts the export of
+	// the PV provisioned for it to the clients.
+	annAccessType = "Access_Type"
+	annClients    = "Clients"
+
+	// A PV annotation for the options to mount the PV's NFS share with, set
+	// if the server doesn't serve on the standard ports
+	annMountOptions = "volume.beta.kubernetes.io/mount-options"
+
 	// are we allowed to set this? else make up our own
 	annCreatedBy = "kubernetes.io/createdby"
 	createdBy    = "nfs-dynamic-provisioner"
 
+	// A PV annotation for the identity of the provisioner's storage, i.e. of
+	// its exportDir, that the PV was provisioned in. Only a provisioner with
+	// the same identity, which sees the PV's directory, deletes the PV.
+	annIdentity = "nfs-provisioner.kubernetes.io/identity"
+
+	// The standard NFS and mountd ports
+	DefaultNFSPort   = 2049
+	DefaultMountPort = 20048
+
+	// How often and for how long to wait for a LoadBalancer service to be
+	// assigned an ingress point
+	loadBalancerPollInterval = 5 * time.Second
+	loadBalancerTimeout      = 2 * time.Minute
+
+	// The cluster DNS domain services' names are under
+	clusterDomain = "cluster.local"
+
+	// How long the pod CIDRs of the cluster's nodes are cached for rather than
+	// listing the nodes on every provision
+	podCIDRsTTL = time.Minute
+
+	// The directory the kernel exporter puts each export's drop-in file in
+	kernelExportsDir = "/etc/exports.d"
+
 	podIPEnv     = "POD_IP"
 	serviceEnv   = "SERVICE_NAME"
 	namespaceEnv = "POD_NAMESPACE"
 	nodeEnv      = "NODE_NAME"
 )
 
-func NewNFSProvisioner(exportDir string, client kubernetes.Interface, useGanesha bool, ganeshaConfig string) controller.Provisioner {
+// Options are the options of a provisioner created by NewNFSProvisioner.
+type Options struct {
+	// The directory volumes are created in, with a trailing slash
+	ExportDir string
+	// Whether exports are made through NFS Ganesha instead of the kernel NFS
+	// server
+	UseGanesha bool
+	// The ganesha config file exports are added to
+	GaneshaConfig string
+	// Where exports are recorded besides the annotations of the PVs they back.
+	// If nil, they're recorded in the state file in ExportDir.
+	ExportStore ExportStore
+	// The settings that can be changed while the provisioner runs:
+	// ExportClients, if not empty, are the clients exports are restricted to
+	// unless a class or claim specifies others. If there are none, exports are
+	// restricted to the cluster's pod CIDRs and ServiceCIDR, if not empty, or,
+	// if AllowAnyClient is true, not restricted. ServerHostname, if not empty,
+	// is put as the server of every provisioned PV instead of a discovered IP.
+	// If UseServiceDNS is true, a valid service's DNS name is put instead of
+	// its cluster IP.
+	Settings
+	// If true and the service is of type LoadBalancer, its ingress IP or
+	// hostname is put as the server of PVs, so that clients outside the
+	// cluster can mount them
+	UseLoadBalancer bool
+	// The ports the service must have to be considered valid. If empty, any
+	// ports will do.
+	ServicePorts []ServicePort
+	// The ports the NFS server serves on, put in PVs' mount options if not the
+	// standard ones
+	NFSPort   int
+	MountPort int
+	// If true and the service is of type NodePort, the node's IP and the
+	// service's node ports are put in PVs instead
+	UseNodePort bool
+	// If not nil, the template ganesha EXPORT blocks are created from instead
+	// of the default block
+	ExportTemplate *template.Template
+	// If not nil, the FSAL block of ganesha exports instead of the VFS one
+	FSAL *ganesha.Block
+	// If not empty, the path of ExportDir in the FSAL's filesystem
+	FSALRoot string
+	// If not empty, the directory kernel exports are bind-mounted under and
+	// exported from as the NFSv4 pseudo-root, so that PVs are mounted with
+	// NFSv4 only
+	NFSv4Root string
+	// If true, groups are granted access to directories with ACLs instead of
+	// chgrp
+	Unprivileged bool
+	// If not empty, the file every export added, updated, removed or
+	// unexported is logged to
+	AuditLog string
+	// The range exports are assigned exportIds from, so that several
+	// provisioners exporting through the same NFS server, each with its own
+	// ExportDir, don't assign the same ones
+	MinExportId uint16
+	MaxExportId uint16
+	// If true, the exports in the config file that back existing PVs, e.g.
+	// ones created by another instance, are adopted on startup
+	ImportExports bool
+	// If positive, kernel exports and unexports requested within it of each
+	// other are synced with a single `exportfs -r`
+	ExportBatchWindow time.Duration
+	// If positive, how many directories of each set of directory parameters
+	// are set up ahead of claims
+	DirectoryPoolSize int
+	// If btrfs or zfs, PVs' directories can be snapshotted on the filesystem
+	// ExportDir is on
+	SnapshotBackend string
+	// More directories, e.g. on other disks, to create volumes in, picked by
+	// PlacementPolicy
+	AdditionalExportDirs []string
+	PlacementPolicy      string
+	// If true, volumes are only validated and what provisioning them would do
+	// is logged, nothing is created, deleted or exported, and exports aren't
+	// reconciled on startup
+	DryRun bool
+	// If not empty, the file exports are only recorded in, with no NFS server
+	// serving them, e.g. to run the provisioner out of cluster for development
+	StubExportsFile string
+	// If not empty, the domain the export annotations of PVs are namespaced
+	// under. Those of existing PVs are migrated from their legacy keys on
+	// startup.
+	AnnotationDomain string
+	// If true, exports are made through both NFS Ganesha and the kernel NFS
+	// server, the one UseGanesha picks unless a class's exporter parameter
+	// names the other, whose PVs get AdditionalServer as their server
+	AdditionalExporter bool
+	AdditionalServer   string
+	// If true, the directory of each PV is created in a directory of its
+	// claim's namespace, e.g. ExportDir/<namespace>/<pv name>
+	NamespaceDirs bool
+	// If not empty, the file of the quotas of the capacity provisioned for
+	// each namespace's claims, read on every claim
+	NamespaceQuotas string
+	// The keys of the labels and annotations of claims to copy onto their PVs
+	ClaimLabels      []string
+	ClaimAnnotations []string
+	// If not nil, the template PVs, and so their directories, are named from
+	// instead of pvc-<claim UID>
+	PVNameTemplate *template.Template
+}
+
+// NewNFSProvisioner creates a provisioner with the given options that creates
+// volumes in options.ExportDir.
+func NewNFSProvisioner(client kubernetes.Interface, options Options) controller.Provisioner {
+	exportDir := options.ExportDir
+	ganeshaExp := &ganeshaExporter{
+		ganeshaConfig:  options.GaneshaConfig,
+		exportTemplate: options.ExportTemplate,
+		fsal:           options.FSAL,
+		exportDir:      exportDir,
+		fsalRoot:       options.FSALRoot,
+	}
+	kernel := &kernelExporter{nfsv4Root: strings.TrimSuffix(options.NFSv4Root, "/"), exportsDir: kernelExportsDir}
+	if options.ExportBatchWindow > 0 {
+		kernel.batcher = newExportBatcher(options.ExportBatchWindow)
+	}
 	var exporter exporter
-	if useGanesha {
-		exporter = &ganeshaExporter{ganeshaConfig: ganeshaConfig}
+	if options.StubExportsFile != "" {
+		exporter = &stubExporter{config: options.StubExportsFile}
+	} else if options.AdditionalExporter {
+		multi := &multiExporter{ganesha: ganeshaExp, kernel: kernel, defaultExporter: ExporterKernel, otherServer: options.AdditionalServer}
+		if options.UseGanesha {
+			multi.defaultExporter = ExporterGanesha
+		}
+		exporter = multi
+	} else if options.UseGanesha {
+		exporter = ganeshaExp
+	} else {
+		exporter = kernel
+	}
+	provisioner := newNFSProvisionerInternal(exportDir, client, exporter, options.ExportStore)
+	for _, e := range provisioner.exporters() {
+		if checker, ok := e.(readinessChecker); ok {
+			if err := checker.CheckReady(); err != nil {
+				glog.Errorf("NFS server isn't ready, provisioning will fail until it is: %v", err)
+			}
+		}
+	}
+	provisioner.dryRun = options.DryRun
+	for _, e := range provisioner.exporters() {
+		if kernel, ok := e.(*kernelExporter); ok && kernel.nfsv4Root != "" && !options.DryRun {
+			if err := provisioner.exportNFSv4Root(kernel); err != nil {
+				glog.Errorf("error exporting NFSv4 pseudo-root, PVs won't be mountable: %v", err)
+			}
+		}
+	}
+	provisioner.serverHostname = options.ServerHostname
+	provisioner.useServiceDNS = options.UseServiceDNS
+	provisioner.useLoadBalancer = options.UseLoadBalancer
+	provisioner.servicePorts = options.ServicePorts
+	provisioner.nfsPort = options.NFSPort
+	provisioner.mountPort = options.MountPort
+	provisioner.useNodePort = options.UseNodePort
+	provisioner.exportClients = options.ExportClients
+	provisioner.serviceCIDR = options.ServiceCIDR
+	provisioner.allowAnyClient = options.AllowAnyClient
+	provisioner.unprivileged = options.Unprivileged
+	provisioner.auditLog = newAuditLog(options.AuditLog)
+	provisioner.minExportId = options.MinExportId
+	provisioner.maxExportId = options.MaxExportId
+	provisioner.exportDirs = append(provisioner.exportDirs, options.AdditionalExportDirs...)
+	provisioner.placementPolicy = options.PlacementPolicy
+	provisioner.annotationDomain = options.AnnotationDomain
+	provisioner.namespaceDirs = options.NamespaceDirs
+	provisioner.namespaceQuotas = options.NamespaceQuotas
+	provisioner.claimLabels = options.ClaimLabels
+	provisioner.claimAnnotations = options.ClaimAnnotations
+	provisioner.pvNameTemplate = options.PVNameTemplate
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&core_v1.EventSinkImpl{Interface: client.Core().Events(v1.NamespaceAll)})
+	provisioner.eventRecorder = broadcaster.NewRecorder(v1.EventSource{Component: createdBy})
+
+	// Watch the service getServer will use, if any, rather than getting it on
+	// every provision
+	if serviceName, namespace := os.Getenv(serviceEnv), os.Getenv(namespaceEnv); serviceName != "" && namespace != "" {
+		provisioner.serviceCache = newServiceCache(client, namespace, serviceName, wait.NeverStop)
+	}
+
+	// A dry run mustn't record the filesystem, re-add exports or anything
+	// else the rest does to the export directory and config file
+	if options.DryRun {
+		if err := provisioner.reserveExistingVolumes(); err != nil {
+			glog.Errorf("error reserving capacity of existing PVs, dry runs may report claims fit that don't: %v", err)
+		}
+		return provisioner
+	}
+
+	if err := provisioner.verifyStorage(); err != nil {
+		glog.Errorf("error verifying export directory, refusing to provision: %v", err)
+		provisioner.storageErr = err
+	}
+
+	if err := provisioner.recoverJournal(); err != nil {
+		glog.Errorf("error recovering journaled provisioning operations, some volumes may be half-created: %v", err)
+	}
+
+	if options.DirectoryPoolSize > 0 && provisioner.storageErr == nil {
+		pool, err := newDirectoryPool(exportDir+poolDir, options.DirectoryPoolSize, provisioner.setUpDirectory)
+		if err != nil {
+			glog.Errorf("error creating directory pool, directories will be created on demand: %v", err)
+		} else {
+			provisioner.pool = pool
+		}
+	}
+
+	if snapshotter, err := newSnapshotter(options.SnapshotBackend, exportDir); err != nil {
+		glog.Errorf("error setting up snapshots, they will be disabled: %v", err)
 	} else {
-		exporter = &kernelExporter{}
+		provisioner.snapshotter = snapshotter
+	}
+
+	if options.ImportExports {
+		if err := provisioner.importExports(); err != nil {
+			glog.Errorf("error importing exports of existing PVs, reconciling may remove them as stale: %v", err)
+		}
+	}
+
+	if err := provisioner.reconcile(); err != nil {
+		glog.Errorf("error reconciling exports with PVs, some PVs may not be usable or some exports may be stale: %v", err)
+	}
+
+	if err := provisioner.migrateAnnotations(); err != nil {
+		glog.Errorf("error migrating annotations of PVs to domain %s, they'll be read from their legacy keys: %v", options.AnnotationDomain, err)
 	}
-	return newNFSProvisionerInternal(exportDir, client, exporter)
+
+	return provisioner
 }
 
-func newNFSProvisionerInternal(exportDir string, client kubernetes.Interface, exporter exporter) *nfsProvisioner {
+func newNFSProvisionerInternal(exportDir string, client kubernetes.Interface, exporter exporter, exportStore ExportStore) *nfsProvisioner {
 	provisioner := &nfsProvisioner{
 		// TODO exportDir must have trailing slash!
-		exportDir:    exportDir,
-		client:       client,
-		exporter:     exporter,
-		mapMutex:     &sync.Mutex{},
-		fileMutex:    &sync.Mutex{},
-		podIPEnv:     podIPEnv,
-		serviceEnv:   serviceEnv,
-		namespaceEnv: namespaceEnv,
-		nodeEnv:      nodeEnv,
+		exportDir:                exportDir,
+		exportDirs:               []string{exportDir},
+		client:                   client,
+		exporter:                 exporter,
+		exportStore:              exportStore,
+		stateStore:               newStateStore(exportDir),
+		journal:                  newJournal(exportDir),
+		mapMutex:                 &sync.Mutex{},
+		reservations:             map[string]int64{},
+		placements:               map[string]string{},
+		subdirs:                  map[string]string{},
+		namespaces:               map[string]string{},
+		volumeMutex:              newKeyMutex(),
+		loadBalancerPollInterval: loadBalancerPollInterval,
+		loadBalancerTimeout:      loadBalancerTimeout,
+		servicePorts:             DefaultServicePorts,
+		nfsPort:                  DefaultNFSPort,
+		mountPort:                DefaultMountPort,
+		podIPEnv:                 podIPEnv,
+		serviceEnv:               serviceEnv,
+		namespaceEnv:             namespaceEnv,
+		nodeEnv:                  nodeEnv,
+		minExportId:              1,
+		maxExportId:              math.MaxUint16,
+		provisionDurations:       metrics.NewHistograms("nfs_provisioner_provision_duration_seconds", "Duration of provisioning a volume, by result.", metrics.DefaultBuckets),
+		stageDurations:           metrics.NewHistograms("nfs_provisioner_provision_stage_duration_seconds", "Duration of a stage of provisioning a volume, e.g. creating its directory or exporting it.", metrics.DefaultBuckets),
 	}
 
 	var err error
@@ -89,14 +377,41 @@ func newNFSProvisionerInternal(exportDir string, client kubernetes.Interface, ex
 	if err != nil {
 		glog.Errorf("error while populating exportIds map, there may be errors exporting later if exportIds are reused: %v", err)
 	}
+	persisted, err := provisioner.stateStore.loadExportIds()
+	if err != nil {
+		glog.Errorf("error while reading persisted exportIds, there may be errors exporting later if exportIds are reused: %v", err)
+	}
+	for id := range persisted {
+		provisioner.exportIds[id] = true
+	}
+	if provisioner.exportStore == nil {
+		provisioner.exportStore = provisioner.stateStore
+	}
 
 	return provisioner
 }
 
 type nfsProvisioner struct {
-	// The directory to create PV-backing directories in
+	// The directory to create PV-backing directories in, which the state
+	// file, journal, directory pool and snapshots are kept in
 	exportDir string
 
+	// The directories to create PV-backing directories in, exportDir first
+	// and then any others, e.g. on other disks, and the policy by which the
+	// one of each volume is picked
+	exportDirs      []string
+	placementPolicy string
+	// Whether the directory of each PV is nested under a directory of its
+	// claim's namespace in the export directory it's placed in
+	namespaceDirs bool
+
+	// The index in exportDirs the round-robin placement policy picks next
+	nextExportDir int
+
+	// Whether to only log what provisioning volumes would do instead of
+	// provisioning them, and not to delete or update volumes either
+	dryRun bool
+
 	// Client, needed for getting a service cluster IP to put as the NFS server of
 	// provisioned PVs
 	client kubernetes.Interface
@@ -104,16 +419,148 @@ type nfsProvisioner struct {
 	// The exporter to use for exporting NFS shares
 	exporter exporter
 
+	// Store for records of created exports, the source of truth for deleting
+	// them, falling back to PV annotations for exports without records.
+	exportStore ExportStore
+
 	// Map to track used exportIds. Each ganesha export needs a unique Export_Id,
 	// and both ganesha and kernel exports need a unique fsid. So we simply assign
 	// each export an exportId and use it as both Export_id and fsid.
 	exportIds map[uint16]bool
 
-	// Lock for accessing exportIds
+	// The range, inclusive, of exportIds to assign. exportIds outside it may be
+	// in use by other provisioners exporting through the same server.
+	minExportId uint16
+	maxExportId uint16
+
+	// Store of the state file in exportDir, which the exportIds map is
+	// persisted to on every change, so that it can be recovered on restart
+	// without depending on the config file, and the exportStore if none other
+	// is given
+	stateStore *stateStore
+
+	// Why exportDir isn't the storage the provisioner's PVs were provisioned
+	// in, as found on startup, refusing to provision. nil if it is.
+	storageErr error
+
+	// If not nil, the pool of directories set up ahead of claims that volumes'
+	// directories are taken from
+	pool *directoryPool
+
+	// If not nil, takes the snapshots of PVs' directories their annotations
+	// ask for
+	snapshotter snapshotter
+
+	// Journal of provisioning operations in progress, so that volumes
+	// half-created by a crash can be recovered on restart
+	journal *journal
+
+	// Lock for accessing exportIds, reservations, placements, subdirs,
+	// namespaces and nextExportDir
 	mapMutex *sync.Mutex
 
-	// Lock for writing to the ganesha config or /etc/exports file
-	fileMutex *sync.Mutex
+	// The capacity reserved for each PV, of provisioned volumes and ones
+	// being provisioned. Reservations aren't persisted since they're rebuilt
+	// from the PVs on startup, after any half-created volume is rolled back.
+	reservations map[string]int64
+
+	// The export directory the directory of each PV is in, of provisioned
+	// volumes and ones being provisioned, rebuilt along with reservations
+	placements map[string]string
+	// The subdirectory of its export directory the directory of each PV being
+	// provisioned is in, if it's nested under its claim's namespace's
+	subdirs map[string]string
+	// The namespace of the claim of each PV, rebuilt along with reservations,
+	// whose reservations count against the namespace's quota
+	namespaces map[string]string
+	// The file of the quotas of namespaces, e.g. mounted from a ConfigMap. If
+	// empty, namespaces have no quotas.
+	namespaceQuotas string
+	// The keys of the labels and annotations of claims to copy onto their PVs
+	claimLabels      []string
+	claimAnnotations []string
+	// The template PVs are named from. If nil, they're named pvc-<claim UID>.
+	pvNameTemplate *template.Template
+
+	// Locks for operating on volumes, one per PV, so that operations on
+	// different volumes can run in parallel. Edits of the ganesha config or
+	// /etc/exports file are serialized by flock'ing it instead, while a
+	// volume's own drop-in file is only edited under its lock.
+	volumeMutex *keyMutex
+
+	// Guards serverHostname, useServiceDNS, exportClients, serviceCIDR and
+	// allowAnyClient, which Reconfigure can change while the provisioner runs
+	settingsMutex sync.RWMutex
+
+	// The server to put in provisioned PVs, overriding the discovery done by
+	// getServer if not empty
+	serverHostname string
+
+	// Whether to put the service's DNS name rather than its cluster IP as the
+	// server, so that PVs stay mountable if the service is re-created
+	useServiceDNS bool
+
+	// The ports the NFS server serves NFS and mountd on
+	nfsPort   int
+	mountPort int
+
+	// Whether to publish a NodePort service's node IP and node ports
+	useNodePort bool
+
+	// The domain the export annotations of PVs are namespaced under, e.g.
+	// nfs.provisioner.kubernetes.io, empty for their legacy keys
+	annotationDomain string
+
+	// Whether to avoid operations that only root can do, i.e. to grant groups
+	// access to directories with ACLs instead of chgrp'ing them, so that the
+	// provisioner can run without CAP_CHOWN
+	unprivileged bool
+
+	// The clients to restrict exports to if neither the class nor the claim
+	// specifies any. If empty, exports are restricted to the cluster's pod
+	// CIDRs and serviceCIDR or, if allowAnyClient is true, aren't restricted.
+	exportClients  []string
+	serviceCIDR    string
+	allowAnyClient bool
+
+	// The ports the service must have for getServer to use it
+	servicePorts []ServicePort
+
+	// Recorder of events about PVs that happen outside of the controller's
+	// operations. May be nil, then no events are emitted.
+	eventRecorder record.EventRecorder
+
+	// The usage of every PV's directory as of the last UpdateUsage, collected
+	// as metrics
+	usageMutex sync.Mutex
+	usage      []volumeUsage
+
+	// The drift between the exports the NFS server serves and the PVs as of
+	// the last DetectDrift, collected as metrics
+	driftMutex sync.Mutex
+	drift      exportDrift
+
+	// Log every export mutation is recorded in. May be nil, then none are.
+	auditLog *auditLog
+
+	// How long provisioning takes and each of its stages, collected as metrics
+	provisionDurations *metrics.Histograms
+	stageDurations     *metrics.Histograms
+
+	// Cache of the service getServer uses. May be nil, then the service is
+	// gotten from the API server every time.
+	serviceCache *serviceCache
+
+	// Cache of the pod CIDRs of the cluster's nodes and when they were listed
+	podCIDRsMutex  sync.Mutex
+	podCIDRs       []string
+	podCIDRsListed time.Time
+
+	// Whether to put a LoadBalancer service's ingress IP or hostname as the
+	// server, waiting up to loadBalancerTimeout for it to be assigned
+	useLoadBalancer          bool
+	loadBalancerPollInterval time.Duration
+	loadBalancerTimeout      time.Duration
 
 	// Environment variables the provisioner pod needs valid values for in order to
 	// put a service cluster IP as the server of provisioned NFS PVs, passed in
@@ -129,23 +576,102 @@ var _ controller.Provisioner = &nfsProvisioner{}
 // Provision creates a volume i.e. the storage asset and returns a PV object for
 // the volume.
 func (p *nfsProvisioner) Provision(options controller.VolumeOptions) (*v1.PersistentVolume, error) {
-	server, path, supGroup, block, exportId, err := p.createVolume(options)
+	start := time.Now()
+	options.Span = tracing.Start("Provision", options.Span)
+	pv, err := p.provision(options)
+	options.Span.Finish(err)
+	p.observeProvision(start, err)
+	return pv, err
+}
+
+func (p *nfsProvisioner) provision(options controller.VolumeOptions) (*v1.PersistentVolume, error) {
+	done := p.timeStage(options.Span, "lock")
+	p.volumeMutex.Lock(options.PVName)
+	defer p.volumeMutex.Unlock(options.PVName)
+	done()
+
+	if p.storageErr != nil {
+		return nil, fmt.Errorf("refusing to provision, export directory isn't the provisioner's storage: %v", p.storageErr)
+	}
+
+	done = p.timeStage(options.Span, "parameters")
+	options, err := p.resolveSecretParameters(options)
+	if err != nil {
+		done()
+		return nil, fmt.Errorf("error getting parameters from secret for volume: %v", err)
+	}
+
+	// The PV must have labels matching the claim's selector or it won't bind
+	labels, err := selectorToLabels(options.Selector)
+	if err != nil {
+		done()
+		return nil, fmt.Errorf("error getting labels for volume: %v", err)
+	}
+
+	params, err := p.getExportParams(options)
+	done()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.dryRun {
+		return nil, p.dryRunVolume(options, params)
+	}
+
+	// A previous attempt that failed without being rolled back, e.g. because
+	// its directory couldn't be deleted, would leave the directory in the way
+	entry, partial, err := p.journal.get(options.PVName)
+	if err != nil {
+		return nil, fmt.Errorf("error reading journal: %v", err)
+	}
+	if partial {
+		logging.Info("resuming volume left half-created by a previous attempt", logging.Fields{logging.Operation: "provision", logging.PV: options.PVName, "stage": entry.Stage})
+		if err := p.recoverEntry(entry); err != nil {
+			return nil, fmt.Errorf("error recovering previous attempt to provision volume: %v", err)
+		}
+	}
+
+	mountOptions, err := p.getMountOptions(params)
+	if err != nil {
+		return nil, fmt.Errorf("error getting mount options for volume: %v", err)
+	}
+
+	// The identity is generated the first time a volume is provisioned
+	identity, err := p.stateStore.loadIdentity(true)
+	if err != nil {
+		return nil, fmt.Errorf("error getting identity to stamp volume with: %v", err)
+	}
+
+	server, path, supGroup, block, exportId, err := p.createVolume(options, params)
 	if err != nil {
 		return nil, err
 	}
+	claim := ""
+	if options.PVC != nil {
+		claim = options.PVC.Namespace + "/" + options.PVC.Name
+	}
+	p.audit(auditAdd, "provision", options.PVName, claim, path, block)
 
 	annotations := make(map[string]string)
 	annotations[annCreatedBy] = createdBy
-	annotations[annExportId] = strconv.FormatUint(uint64(exportId), 10)
-	annotations[annBlock] = block
+	annotations[p.annotationKey(annExportId)] = strconv.FormatUint(uint64(exportId), 10)
+	annotations[p.annotationKey(annBlock)] = block
+	annotations[annIdentity] = identity
 	if supGroup != 0 {
 		annotations[VolumeGidAnnotationKey] = strconv.FormatUint(supGroup, 10)
 	}
+	if mountOptions != "" {
+		annotations[annMountOptions] = mountOptions
+	}
+	if _, ok := p.exporterFor(params).(updater); ok && len(params.clients) != 0 {
+		// Keep Update from lifting the restriction
+		annotations[annClients] = strings.Join(params.clients, ",")
+	}
 
 	pv := &v1.PersistentVolume{
 		ObjectMeta: v1.ObjectMeta{
 			Name:        options.PVName,
-			Labels:      map[string]string{},
+			Labels:      labels,
 			Annotations: annotations,
 		},
 		Spec: v1.PersistentVolumeSpec{
@@ -163,39 +689,288 @@ func (p *nfsProvisioner) Provision(options controller.VolumeOptions) (*v1.Persis
 			},
 		},
 	}
+	p.copyClaimMetadata(pv, options.PVC)
+
+	if err := p.journalStage(journalEntry{PV: options.PVName, Stage: journalPV, Path: path, ExportId: exportId, Block: block}); err != nil {
+		if deleteErr := p.deleteVolume(pv); deleteErr != nil {
+			logging.Error("error cleaning up volume after failing to journal it", logging.Fields{logging.Operation: "provision", logging.PV: options.PVName, logging.Err: deleteErr})
+		}
+		return nil, err
+	}
+
+	if p.exportStore != nil {
+		export := &NFSExport{
+			PV:       options.PVName,
+			Path:     path,
+			ExportId: exportId,
+			Gid:      supGroup,
+			Block:    block,
+		}
+		done := p.timeStage(options.Span, "record")
+		err := p.exportStore.Create(export)
+		done()
+		if err != nil {
+			if deleteErr := p.deleteVolume(pv); deleteErr != nil {
+				logging.Error("error cleaning up volume after failing to record its export", logging.Fields{logging.Operation: "provision", logging.PV: options.PVName, logging.Err: deleteErr})
+			}
+			return nil, fmt.Errorf("error recording export for volume: %v", err)
+		}
+	}
 
 	return pv, nil
 }
 
+// selectorToLabels returns a set of labels that the given claim selector
+// matches, or an error if there is none, e.g. because a key is required to
+// both have and not have a value.
+func selectorToLabels(selector *unversioned.LabelSelector) (map[string]string, error) {
+	labels := map[string]string{}
+	if selector == nil {
+		return labels, nil
+	}
+
+	for k, v := range selector.MatchLabels {
+		labels[k] = v
+	}
+
+	// Keys that must have one of certain values, the intersection of those of
+	// each In requirement on them, that must not have certain values, that
+	// must exist, or that must not
+	in := map[string][]string{}
+	notIn := map[string][]string{}
+	exists := map[string]bool{}
+	doesNotExist := map[string]bool{}
+	for _, expr := range selector.MatchExpressions {
+		switch expr.Operator {
+		case unversioned.LabelSelectorOpIn:
+			if len(expr.Values) == 0 {
+				return nil, fmt.Errorf("selector requirement for key %q has operator In but no values", expr.Key)
+			}
+			values, ok := in[expr.Key]
+			if !ok {
+				in[expr.Key] = expr.Values
+				continue
+			}
+			both := []string{}
+			for _, v := range values {
+				if containsString(expr.Values, v) {
+					both = append(both, v)
+				}
+			}
+			if len(both) == 0 {
+				return nil, fmt.Errorf("selector requires key %q to be one of %v and one of %v", expr.Key, values, expr.Values)
+			}
+			in[expr.Key] = both
+		case unversioned.LabelSelectorOpNotIn:
+			notIn[expr.Key] = append(notIn[expr.Key], expr.Values...)
+		case unversioned.LabelSelectorOpExists:
+			exists[expr.Key] = true
+		case unversioned.LabelSelectorOpDoesNotExist:
+			doesNotExist[expr.Key] = true
+		default:
+			return nil, fmt.Errorf("selector requirement for key %q has unsupported operator %q", expr.Key, expr.Operator)
+		}
+	}
+
+	for k, values := range in {
+		if v, ok := labels[k]; ok {
+			if !containsString(values, v) {
+				return nil, fmt.Errorf("selector requires key %q to be %q and one of %v", k, v, values)
+			}
+			continue
+		}
+		// Pick the first value that isn't excluded, if any
+		labels[k] = values[0]
+		for _, v := range values {
+			if !containsString(notIn[k], v) {
+				labels[k] = v
+				break
+			}
+		}
+	}
+	for k := range exists {
+		if _, ok := labels[k]; !ok {
+			labels[k] = ""
+		}
+	}
+
+	for k, values := range notIn {
+		if v, ok := labels[k]; ok && containsString(values, v) {
+			return nil, fmt.Errorf("selector requires key %q to be %q and not one of %v", k, v, values)
+		}
+	}
+	for k := range doesNotExist {
+		if _, ok := labels[k]; ok {
+			return nil, fmt.Errorf("selector requires key %q to both exist and not exist", k)
+		}
+	}
+
+	return labels, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// getMountOptions gets the options PVs must be mounted with to reach the NFS
+// server's ports, empty if it serves on the standard ones. If the server is
+// published via a NodePort service, the ports are the service's node ports. If
+// kernel exports are NFSv4 only, PVs must be mounted with NFSv4, which doesn't
+// need mountd. If the export requires the given security flavors, PVs are
+// mounted with the most preferred one. If the export is through the other
+// exporter than the default one, its server is assumed to serve on the standard
+// ports.
+func (p *nfsProvisioner) getMountOptions(params exportParams) (string, error) {
+	nfsPort, mountPort := p.nfsPort, p.mountPort
+	if _, other := p.otherServer(p.exporterFor(params)); other {
+		nfsPort, mountPort = DefaultNFSPort, DefaultMountPort
+	} else if serviceName, namespace := os.Getenv(p.serviceEnv), os.Getenv(p.namespaceEnv); p.useNodePort && serviceName != "" && namespace != "" {
+		service, err := p.getService(namespace, serviceName)
+		if err != nil {
+			return "", err
+		}
+		if service.Spec.Type == v1.ServiceTypeNodePort {
+			nfsPort, mountPort, err = p.getNodePorts(service)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	options := []string{}
+	if kernel, ok := p.exporterFor(params).(*kernelExporter); ok && kernel.nfsv4Root != "" {
+		options = append(options, "nfsvers=4")
+		mountPort = 0
+	}
+	if nfsPort != DefaultNFSPort {
+		options = append(options, fmt.Sprintf("port=%d", nfsPort))
+	}
+	if mountPort != 0 && mountPort != DefaultMountPort {
+		options = append(options, fmt.Sprintf("mountport=%d", mountPort))
+	}
+	if len(params.sec) != 0 {
+		options = append(options, "sec="+params.sec[0])
+	}
+	return strings.Join(options, ","), nil
+}
+
 // createVolume creates a volume i.e. the storage asset. It creates a unique
 // directory under /export and exports it. Returns the server IP, the path, a
 // zero/non-zero supplemental group, the block it added to either the ganesha
-// config or /etc/exports, and the exportId
-func (p *nfsProvisioner) createVolume(options controller.VolumeOptions) (string, string, uint64, string, uint16, error) {
+// config or /etc/exports, and the exportId. The export is created with the
+// given parameters.
+func (p *nfsProvisioner) createVolume(options controller.VolumeOptions, params exportParams) (string, string, uint64, string, uint16, error) {
+	done := p.timeStage(options.Span, "validate")
 	gid, err := p.validateOptions(options)
+	done()
 	if err != nil {
 		return "", "", 0, "", 0, fmt.Errorf("error validating options for volume: %v", err)
 	}
+	// The gid, resolved if it's auto, is recorded and put in the PV's
+	// annotation so that pods get it as a supplemental group
+	var supGroup uint64
+	if gid != "none" {
+		supGroup, err = strconv.ParseUint(gid, 10, 64)
+		if err != nil {
+			return "", "", 0, "", 0, fmt.Errorf("error parsing gid %s of volume: %v", gid, err)
+		}
+	}
+	source, err := p.getCloneSource(options)
+	if err != nil {
+		return "", "", 0, "", 0, fmt.Errorf("error getting volume to clone: %v", err)
+	}
+
+	if checker, ok := p.exporterFor(params).(readinessChecker); ok {
+		done = p.timeStage(options.Span, "ready")
+		err := checker.CheckReady()
+		done()
+		if err != nil {
+			return "", "", 0, "", 0, fmt.Errorf("NFS server isn't ready for volume: %v", err)
+		}
+	}
 
-	server, err := p.getServer()
+	done = p.timeStage(options.Span, "server")
+	server, err := p.getExportServer(params)
+	done()
 	if err != nil {
 		return "", "", 0, "", 0, fmt.Errorf("error getting NFS server IP for volume: %v", err)
 	}
 
-	path := fmt.Sprintf(p.exportDir+"%s", options.PVName)
+	dirs, err := p.getExportDirs(options)
+	if err != nil {
+		return "", "", 0, "", 0, fmt.Errorf("error getting export directories for volume: %v", err)
+	}
+
+	done = p.timeStage(options.Span, "reserve")
+	dir, err := p.reserveCapacity(options.PVName, claimNamespace(options), dirs, options.Capacity.Value())
+	done()
+	if err != nil {
+		if _, ok := err.(*quotaExceededError); ok && options.PVC != nil {
+			p.recordClaimEvent(options.PVC, v1.EventTypeWarning, "NamespaceQuotaExceeded", err.Error())
+		}
+		return "", "", 0, "", 0, fmt.Errorf("error reserving capacity for volume: %v", err)
+	}
+	subdir := p.namespaceSubdir(options)
+	p.placeInSubdir(options.PVName, subdir)
+	path := dir + subdir + options.PVName
 
-	err = p.createDirectory(options.PVName, gid)
+	done = p.timeStage(options.Span, "directory")
+	err = p.createDirectory(options.PVName, getDirectoryParams(options, gid))
+	done()
 	if err != nil {
+		p.releaseCapacity(options.PVName)
 		return "", "", 0, "", 0, fmt.Errorf("error creating directory for volume: %v", err)
 	}
 
-	block, exportId, err := p.createExport(options.PVName)
+	if source != nil {
+		done = p.timeStage(options.Span, "clone")
+		err = p.cloneDirectory(source, path)
+		done()
+		if err != nil {
+			p.rollBackJournaled(options.PVName)
+			p.releaseCapacity(options.PVName)
+			return "", "", 0, "", 0, fmt.Errorf("error cloning PV %s into directory for volume: %v", source.volume.Name, err)
+		}
+	}
+
+	block, exportId, err := p.createExport(options.PVName, params, options.Span)
 	if err != nil {
-		os.RemoveAll(path)
+		p.rollBackJournaled(options.PVName)
+		p.releaseCapacity(options.PVName)
 		return "", "", 0, "", 0, fmt.Errorf("error creating export for volume: %v", err)
 	}
 
-	return server, path, 0, block, exportId, nil
+	return server, path, supGroup, block, exportId, nil
+}
+
+var _ controller.Validator = &nfsProvisioner{}
+
+// Validate checks the options of a volume the way provisioning it would before
+// creating anything: the class's parameters, including those in its Secret,
+// the claim's selector and annotations and the claim it clones, if any.
+func (p *nfsProvisioner) Validate(options controller.VolumeOptions) error {
+	options, err := p.resolveSecretParameters(options)
+	if err != nil {
+		return fmt.Errorf("error getting parameters from secret for volume: %v", err)
+	}
+	if _, err := selectorToLabels(options.Selector); err != nil {
+		return fmt.Errorf("error getting labels for volume: %v", err)
+	}
+	if _, err := p.getExportParams(options); err != nil {
+		return err
+	}
+	if _, err := p.validateOptions(options); err != nil {
+		return fmt.Errorf("error validating options for volume: %v", err)
+	}
+	if _, err := p.getCloneSource(options); err != nil {
+		return fmt.Errorf("error getting volume to clone: %v", err)
+	}
+	return nil
 }
 
 func (p *nfsProvisioner) validateOptions(options controller.VolumeOptions) (string, error) {
@@ -205,29 +980,71 @@ func (p *nfsProvisioner) validateOptions(options controller.VolumeOptions) (stri
 		case "gid":
 			if strings.ToLower(v) == "none" {
 				gid = "none"
+			} else if strings.ToLower(v) == gidAuto {
+				gid = gidAuto
 			} else if i, err := strconv.ParseUint(v, 10, 64); err == nil && i != 0 {
 				gid = v
 			} else {
-				return "", fmt.Errorf("invalid value for parameter gid: %v. valid values are: 'none' or a non-zero integer", v)
+				return "", fmt.Errorf("invalid value for parameter gid: %v. valid values are: 'none', 'auto' or a non-zero integer", v)
+			}
+		case "clients":
+			if err := ValidateClients(SplitClients(v)); err != nil {
+				return "", fmt.Errorf("invalid value for parameter clients: %v", err)
+			}
+		case "sec":
+			if _, err := parseSec(v); err != nil {
+				return "", fmt.Errorf("invalid value for parameter sec: %v", err)
 			}
+		case "squash":
+			if s := strings.ToLower(v); s != "root" && s != "all" {
+				return "", fmt.Errorf("invalid value for parameter squash: %v. valid values are: 'root' or 'all'", v)
+			}
+		case "permissions":
+			if s := strings.ToLower(v); s != "supplementalgroups" && s != "fsgroup" {
+				return "", fmt.Errorf("invalid value for parameter permissions: %v. valid values are: 'supplementalGroups' or 'fsGroup'", v)
+			}
+		case "mode":
+			if _, err := parseMode(v); err != nil {
+				return "", fmt.Errorf("invalid value for parameter mode: %v", err)
+			}
+		case "owner", "anonuid", "anongid":
+			if _, err := strconv.ParseUint(v, 10, 32); err != nil {
+				return "", fmt.Errorf("invalid value for parameter %s: %v. valid values are: a non-negative integer", strings.ToLower(k), v)
+			}
+		case "exporter":
+			if err := p.validateExporter(v); err != nil {
+				return "", err
+			}
+		case "exportdir":
+			// Validated by getExportDirs below
 		default:
 			return "", fmt.Errorf("invalid parameter: %q", k)
 		}
 	}
 
-	// TODO implement options.ProvisionerSelector parsing
-	// pv.Labels MUST be set to match claim.spec.selector
-	// gid selector? with or without pv annotation?
-	if options.Selector != nil {
-		return "", fmt.Errorf("claim.Spec.Selector is not supported")
+	if gid == gidAuto {
+		auto, err := p.getAutoGid(options)
+		if err != nil {
+			return "", fmt.Errorf("invalid value for parameter gid: %v", err)
+		}
+		gid = auto
 	}
 
-	var stat syscall.Statfs_t
-	if err := syscall.Statfs(p.exportDir, &stat); err != nil {
-		return "", fmt.Errorf("error calling statfs on %v: %v", p.exportDir, err)
+	dirs, err := p.getExportDirs(options)
+	if err != nil {
+		return "", err
 	}
 	capacity := options.Capacity.Value()
-	available := int64(stat.Bavail) * stat.Bsize
+	var available int64
+	for _, dir := range dirs {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(dir, &stat); err != nil {
+			return "", fmt.Errorf("error calling statfs on %v: %v", dir, err)
+		}
+		if a := int64(stat.Bavail) * stat.Bsize; a > available {
+			available = a
+		}
+	}
 	if capacity > available {
 		return "", fmt.Errorf("insufficient available space %v bytes to satisfy claim for %v bytes", available, capacity)
 	}
@@ -235,221 +1052,918 @@ func (p *nfsProvisioner) validateOptions(options controller.VolumeOptions) (stri
 	return gid, nil
 }
 
-// getServer gets the server IP to put in a provisioned PV's spec.
-func (p *nfsProvisioner) getServer() (string, error) {
-	// Use either `hostname -i` or podIPEnv as the fallback server
-	var fallbackServer string
-	podIP := os.Getenv(p.podIPEnv)
-	if podIP == "" {
-		out, err := exec.Command("hostname", "-i").Output()
-		if err != nil {
-			return "", fmt.Errorf("hostname -i failed with error: %v, output: %s", err, out)
-		}
-		fallbackServer = string(out)
-	} else {
-		fallbackServer = podIP
-	}
+// directoryParams are the parameters of a volume's directory that its class
+// can set.
+type directoryParams struct {
+	// The group only whose members can write to the directory, or "none" if
+	// anybody can
+	gid string
+	// Whether the directory is set up for pods that have the group as their
+	// fsGroup, as opposed to one of their supplementalGroups: it's owned by
+	// owner and the group, only they can access it and files created in it
+	// inherit the group
+	fsGroup bool
+	owner   string
+	// The octal permission bits of the directory, overriding those of the
+	// scheme above if not empty
+	mode string
+}
 
-	// Try to use the service's cluster IP as the server if serviceEnv is
-	// specified. If not, try to use nodeName if nodeEnv is specified (assume the
-	// pod is using hostPort). If not again, use fallback here.
-	serviceName := os.Getenv(p.serviceEnv)
-	if serviceName == "" {
-		nodeName := os.Getenv(p.nodeEnv)
-		if nodeName == "" {
-			glog.Infof("service env %s isn't set, using `hostname -i`/pod IP %s as server IP", p.serviceEnv, fallbackServer)
-			return fallbackServer, nil
+// getDirectoryParams gets the parameters of the directory of a volume for the
+// given options and the gid validateOptions got.
+func getDirectoryParams(options controller.VolumeOptions, gid string) directoryParams {
+	params := directoryParams{gid: gid, owner: "0"}
+	for k, v := range options.Parameters {
+		switch strings.ToLower(k) {
+		case "permissions":
+			params.fsGroup = strings.ToLower(v) == "fsgroup"
+		case "owner":
+			params.owner = v
+		case "mode":
+			params.mode = v
 		}
-		glog.Infof("service env %s isn't set and node env %s is, using node name %s as server IP", p.serviceEnv, p.nodeEnv, nodeName)
-		return nodeName, nil
 	}
+	return params
+}
 
-	// From this point forward, rather than fallback & provision non-persistent
-	// where persistent is expected, just return an error.
-	namespace := os.Getenv(p.namespaceEnv)
-	if namespace == "" {
-		return "", fmt.Errorf("service env %s is set but namespace env %s isn't; no way to get the service cluster IP", p.serviceEnv, p.namespaceEnv)
+// getExportParams gets the parameters of the export of a volume for the given
+// options: its clients, security flavors, how it squashes users and the
+// exporter it's exported through.
+func (p *nfsProvisioner) getExportParams(options controller.VolumeOptions) (exportParams, error) {
+	clients, err := p.getExportClients(options)
+	if err != nil {
+		return exportParams{}, fmt.Errorf("error getting clients for volume: %v", err)
 	}
-	service, err := p.client.Core().Services(namespace).Get(serviceName)
+	sec, err := getExportSec(options)
 	if err != nil {
-		return "", fmt.Errorf("error getting service %s=%s in namespace %s=%s", p.serviceEnv, serviceName, p.namespaceEnv, namespace)
+		return exportParams{}, fmt.Errorf("error getting security flavors for volume: %v", err)
 	}
 
-	// Do some validation of the service before provisioning useless volumes
-	valid := false
-	type endpointPort struct {
-		port     int32
-		protocol v1.Protocol
-	}
-	expectedPorts := map[endpointPort]bool{
-		endpointPort{2049, v1.ProtocolTCP}:  true,
-		endpointPort{20048, v1.ProtocolTCP}: true,
-		endpointPort{111, v1.ProtocolUDP}:   true,
-		endpointPort{111, v1.ProtocolTCP}:   true,
-	}
-	endpoints, err := p.client.Core().Endpoints(namespace).Get(serviceName)
-	for _, subset := range endpoints.Subsets {
-		if len(subset.Addresses) != 1 {
-			continue
-		}
-		if subset.Addresses[0].IP != fallbackServer {
-			continue
-		}
-		actualPorts := make(map[endpointPort]bool)
-		for _, port := range subset.Ports {
-			actualPorts[endpointPort{port.Port, port.Protocol}] = true
+	params := exportParams{clients: clients, sec: sec}
+	for k, v := range options.Parameters {
+		switch strings.ToLower(k) {
+		case "squash":
+			params.allSquash = strings.ToLower(v) == "all"
+		case "anonuid":
+			params.anonUid = v
+		case "anongid":
+			params.anonGid = v
+		case "exporter":
+			params.exporter = strings.ToLower(v)
 		}
-		if !reflect.DeepEqual(expectedPorts, actualPorts) {
-			continue
+	}
+	return params, nil
+}
+
+// getExportClients gets the clients to restrict the export of a volume for the
+// given options to: those of the claim's annotation annClients or, failing
+// that, of the class's clients parameter or, failing that, exportClients. If
+// there are none, exports are restricted to the pod CIDRs of the cluster's
+// nodes and the service CIDR so that they aren't mountable by anybody who can
+// reach the server, unless any client is allowed.
+func (p *nfsProvisioner) getExportClients(options controller.VolumeOptions) ([]string, error) {
+	if options.PVC != nil {
+		if ann, ok := options.PVC.Annotations[annClients]; ok {
+			clients := SplitClients(ann)
+			if err := ValidateClients(clients); err != nil {
+				return nil, fmt.Errorf("invalid value for claim annotation %s: %v", annClients, err)
+			}
+			if len(clients) != 0 {
+				return clients, nil
+			}
 		}
-		valid = true
-		break
 	}
-	if !valid {
-		return "", fmt.Errorf("service %s=%s is not valid; check that it has for ports %v one endpoint, this pod's IP %v", p.serviceEnv, serviceName, expectedPorts, fallbackServer)
+	for k, v := range options.Parameters {
+		if strings.ToLower(k) == "clients" {
+			if clients := SplitClients(v); len(clients) != 0 {
+				return clients, nil
+			}
+		}
 	}
-	if service.Spec.ClusterIP == v1.ClusterIPNone {
-		return "", fmt.Errorf("service %s=%s is valid but it doesn't have a cluster IP", p.serviceEnv, serviceName)
+	settings := p.settings()
+	if len(settings.ExportClients) != 0 {
+		return settings.ExportClients, nil
 	}
 
-	return service.Spec.ClusterIP, nil
+	if settings.AllowAnyClient {
+		return nil, nil
+	}
+	podCIDRs, err := p.getPodCIDRs()
+	if err != nil {
+		return nil, err
+	}
+	if len(podCIDRs) == 0 {
+		// The network plugin doesn't set nodes' pod CIDRs. Kernel exports
+		// need clients, ganesha exports aren't restricted as they used to be
+		if _, ok := p.exporterFor(exportParams{exporter: classExporter(options)}).(*kernelExporter); ok {
+			return nil, fmt.Errorf("no node has a pod CIDR, the clients to export to must be given or any client allowed")
+		}
+		glog.Warningf("no node has a pod CIDR, not restricting export to any clients; set export-clients to restrict exports")
+		return nil, nil
+	}
+	cidrs := append([]string{}, podCIDRs...)
+	if settings.ServiceCIDR != "" && !containsString(cidrs, settings.ServiceCIDR) {
+		cidrs = append(cidrs, settings.ServiceCIDR)
+	}
+	return cidrs, nil
 }
 
-// createDirectory creates the given directory in exportDir with appropriate
-// permissions and ownership according to the given gid parameter string.
-func (p *nfsProvisioner) createDirectory(directory, gid string) error {
-	// TODO quotas
-	path := fmt.Sprintf(p.exportDir+"%s", directory)
-	if _, err := os.Stat(path); err == nil {
-		return fmt.Errorf("error creating volume, the path already exists")
-	}
+// getPodCIDRs gets the pod CIDRs of the cluster's nodes, listing the nodes at
+// most every podCIDRsTTL.
+func (p *nfsProvisioner) getPodCIDRs() ([]string, error) {
+	p.podCIDRsMutex.Lock()
+	defer p.podCIDRsMutex.Unlock()
 
-	perm := os.FileMode(0777)
-	if gid != "none" {
+	if !p.podCIDRsListed.IsZero() && time.Since(p.podCIDRsListed) < podCIDRsTTL {
+		return p.podCIDRs, nil
+	}
+	nodes, err := p.client.Core().Nodes().List(api.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing nodes to get their pod CIDRs: %v", err)
+	}
+	cidrs := []string{}
+	for _, node := range nodes.Items {
+		if cidr := node.Spec.PodCIDR; cidr != "" && !containsString(cidrs, cidr) {
+			cidrs = append(cidrs, cidr)
+		}
+	}
+	p.podCIDRs = cidrs
+	p.podCIDRsListed = time.Now()
+	return cidrs, nil
+}
+
+// classExporter returns the value of the exporter parameter of the class of
+// the given options, if it has one.
+func classExporter(options controller.VolumeOptions) string {
+	for k, v := range options.Parameters {
+		if strings.ToLower(k) == "exporter" {
+			return strings.ToLower(v)
+		}
+	}
+	return ""
+}
+
+// SplitClients splits the given comma-separated list of clients.
+func SplitClients(s string) []string {
+	clients := []string{}
+	for _, client := range strings.Split(s, ",") {
+		if client = strings.TrimSpace(client); client != "" {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// ValidateClients checks that none of the given clients, i.e. IPs, networks or
+// hostnames, would break the export block it's put in.
+func ValidateClients(clients []string) error {
+	for _, client := range clients {
+		if strings.ContainsAny(client, " \t()\";{}") {
+			return fmt.Errorf("invalid client %q", client)
+		}
+	}
+	return nil
+}
+
+// exportParams are the parameters of a volume's export that its class or claim
+// can set.
+type exportParams struct {
+	// The clients to restrict the export to. If empty, any client can mount it.
+	clients []string
+	// The security flavors clients must mount the export with, most preferred
+	// first. If empty, the exporter's default, sys.
+	sec []string
+	// Whether every user, not just root, is squashed to the anonymous user
+	allSquash bool
+	// The uid and gid of the anonymous user squashed users are mapped to. If
+	// empty, the exporter's default, nobody.
+	anonUid string
+	anonGid string
+	// Whether clients can only read the export, e.g. because it's of a
+	// snapshot
+	readOnly bool
+	// The exporter to export through, ExporterGanesha or ExporterKernel. If
+	// empty, the default one.
+	exporter string
+}
+
+// secFlavors are the security flavors an export can require: AUTH_SYS, or
+// Kerberos authentication only, with integrity checking or with privacy, i.e.
+// encryption, too.
+var secFlavors = []string{"sys", "krb5", "krb5i", "krb5p"}
+
+// getExportSec gets the security flavors the export of a volume for the given
+// options must be mounted with, from the class's sec parameter.
+func getExportSec(options controller.VolumeOptions) ([]string, error) {
+	for k, v := range options.Parameters {
+		if strings.ToLower(k) == "sec" {
+			return parseSec(v)
+		}
+	}
+	return nil, nil
+}
+
+// parseSec parses a comma-separated list of security flavors, most preferred
+// first, e.g. "krb5p,krb5i".
+func parseSec(s string) ([]string, error) {
+	sec := []string{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.ToLower(strings.TrimSpace(field))
+		if field == "" {
+			continue
+		}
+		if !containsString(secFlavors, field) {
+			return nil, fmt.Errorf("invalid security flavor %q, must be one of %s", field, strings.Join(secFlavors, ", "))
+		}
+		if !containsString(sec, field) {
+			sec = append(sec, field)
+		}
+	}
+	return sec, nil
+}
+
+// getExportServer gets the server to put in the spec of a PV whose export has
+// the given parameters: the other server if it's exported through the other
+// exporter than the default one, else the server getServer gets.
+func (p *nfsProvisioner) getExportServer(params exportParams) (string, error) {
+	if server, other := p.otherServer(p.exporterFor(params)); other {
+		return server, nil
+	}
+	return p.getServer()
+}
+
+// getServer gets the server IP to put in a provisioned PV's spec.
+func (p *nfsProvisioner) getServer() (string, error) {
+	settings := p.settings()
+	if settings.ServerHostname != "" {
+		glog.Infof("server hostname is set, using %s as server", settings.ServerHostname)
+		return settings.ServerHostname, nil
+	}
+
+	// Use either `hostname -i` or podIPEnv as the fallback server
+	var fallbackServer string
+	podIP := os.Getenv(p.podIPEnv)
+	if podIP == "" {
+		address, err := hostAddress()
+		if err != nil {
+			return "", err
+		}
+		fallbackServer = address
+	} else {
+		fallbackServer = podIP
+	}
+
+	// Try to use the service's cluster IP as the server if serviceEnv is
+	// specified. If not, try to use nodeName if nodeEnv is specified (assume the
+	// pod is using hostPort). If not again, use fallback here.
+	serviceName := os.Getenv(p.serviceEnv)
+	if serviceName == "" {
+		nodeName := os.Getenv(p.nodeEnv)
+		if nodeName == "" {
+			glog.Infof("service env %s isn't set, using `hostname -i`/pod IP %s as server IP", p.serviceEnv, fallbackServer)
+			return fallbackServer, nil
+		}
+		glog.Infof("service env %s isn't set and node env %s is, using node name %s as server IP", p.serviceEnv, p.nodeEnv, nodeName)
+		return nodeName, nil
+	}
+
+	// From this point forward, rather than fallback & provision non-persistent
+	// where persistent is expected, just return an error.
+	namespace := os.Getenv(p.namespaceEnv)
+	if namespace == "" {
+		return "", fmt.Errorf("service env %s is set but namespace env %s isn't; no way to get the service cluster IP", p.serviceEnv, p.namespaceEnv)
+	}
+	service, err := p.getService(namespace, serviceName)
+	if err != nil {
+		return "", err
+	}
+
+	// Do some validation of the service before provisioning useless volumes
+	valid := false
+	// This pod's address in the service's endpoints
+	var address *v1.EndpointAddress
+	endpoints, err := p.getEndpoints(namespace, serviceName)
+	if err != nil {
+		return "", err
+	}
+	for _, subset := range endpoints.Subsets {
+		var found *v1.EndpointAddress
+		for i := range subset.Addresses {
+			if subset.Addresses[i].IP == fallbackServer {
+				found = &subset.Addresses[i]
+				break
+			}
+		}
+		if found == nil {
+			continue
+		}
+		if !hasServicePorts(subset, p.servicePorts) {
+			continue
+		}
+		if len(subset.Addresses) > 1 && service.Spec.ClusterIP != v1.ClusterIPNone {
+			glog.Warningf("service %s=%s has %d endpoints, if they aren't all this pod, clients of its cluster IP may reach the wrong NFS server", p.serviceEnv, serviceName, len(subset.Addresses))
+		}
+		address = found
+		valid = true
+		break
+	}
+	if !valid {
+		return "", fmt.Errorf("service %s=%s is not valid; check that it has for ports %v an endpoint, this pod's IP %v", p.serviceEnv, serviceName, p.servicePorts, fallbackServer)
+	}
+	if service.Spec.ClusterIP == v1.ClusterIPNone {
+		// A headless service has no stable IP, but if this pod's endpoint has a
+		// hostname, e.g. because the pod is in a StatefulSet, it has a stable
+		// DNS name
+		if address.Hostname == "" {
+			return "", fmt.Errorf("service %s=%s is valid but it doesn't have a cluster IP and this pod's endpoint doesn't have a hostname", p.serviceEnv, serviceName)
+		}
+		return fmt.Sprintf("%s.%s.%s.svc.%s", address.Hostname, serviceName, namespace, clusterDomain), nil
+	}
+
+	if p.useNodePort && service.Spec.Type == v1.ServiceTypeNodePort {
+		if _, _, err := p.getNodePorts(service); err != nil {
+			return "", err
+		}
+		return p.getNodeAddress()
+	}
+
+	if p.useLoadBalancer && service.Spec.Type == v1.ServiceTypeLoadBalancer {
+		return p.getLoadBalancerIngress(namespace, serviceName)
+	}
+
+	if settings.UseServiceDNS {
+		return fmt.Sprintf("%s.%s.svc.%s", serviceName, namespace, clusterDomain), nil
+	}
+
+	return service.Spec.ClusterIP, nil
+}
+
+// hostAddress returns the first address `hostname -i` prints or, if it fails,
+// e.g. on a developer's machine whose hostname doesn't resolve or whose
+// hostname doesn't support -i, the first address of a non-loopback interface.
+func hostAddress() (string, error) {
+	out, err := exec.Command("hostname", "-i").Output()
+	if fields := strings.Fields(string(out)); err == nil && len(fields) != 0 {
+		return fields[0], nil
+	}
+	glog.Warningf("hostname -i failed with error: %v, output: %s, using the address of an interface instead", err, out)
+	addrs, ifErr := net.InterfaceAddrs()
+	if ifErr != nil {
+		return "", fmt.Errorf("hostname -i failed with error: %v, output: %s, and error getting interface addresses: %v", err, out, ifErr)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+			return ipNet.IP.String(), nil
+		}
+	}
+	return "", fmt.Errorf("hostname -i failed with error: %v, output: %s, and there's no non-loopback interface address", err, out)
+}
+
+// ServicePort is a port the service fronting the provisioner must have.
+type ServicePort struct {
+	Port     int32
+	Protocol v1.Protocol
+}
+
+func (p ServicePort) String() string {
+	return fmt.Sprintf("%d/%s", p.Port, p.Protocol)
+}
+
+// DefaultServicePorts are the ports NFS Ganesha and the kernel NFS server
+// serve NFSv3 and NFSv4 on: nfs, mountd and rpcbind.
+var DefaultServicePorts = []ServicePort{
+	{DefaultNFSPort, v1.ProtocolTCP},
+	{DefaultMountPort, v1.ProtocolTCP},
+	{111, v1.ProtocolUDP},
+	{111, v1.ProtocolTCP},
+}
+
+// ParseServicePorts parses a comma-separated list of ports like 2049/TCP. An
+// empty list means the service's ports aren't validated at all.
+func ParseServicePorts(ports string) ([]ServicePort, error) {
+	servicePorts := []ServicePort{}
+	for _, port := range strings.Split(ports, ",") {
+		port = strings.TrimSpace(port)
+		if port == "" {
+			continue
+		}
+		parts := strings.Split(port, "/")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid port %q, must be of the form <port>/<protocol>", port)
+		}
+		number, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil || number == 0 {
+			return nil, fmt.Errorf("invalid port number in %q", port)
+		}
+		protocol := v1.Protocol(strings.ToUpper(parts[1]))
+		if protocol != v1.ProtocolTCP && protocol != v1.ProtocolUDP {
+			return nil, fmt.Errorf("invalid protocol in %q, must be TCP or UDP", port)
+		}
+		servicePorts = append(servicePorts, ServicePort{int32(number), protocol})
+	}
+	return servicePorts, nil
+}
+
+// hasServicePorts returns whether the given endpoint subset has all of the
+// given ports.
+func hasServicePorts(subset v1.EndpointSubset, ports []ServicePort) bool {
+	actualPorts := make(map[ServicePort]bool)
+	for _, port := range subset.Ports {
+		actualPorts[ServicePort{port.Port, port.Protocol}] = true
+	}
+	for _, port := range ports {
+		if !actualPorts[port] {
+			return false
+		}
+	}
+	return true
+}
+
+// getNodePorts gets the node ports the given NodePort service maps the NFS and
+// mountd ports to. The mountd node port is zero if the service doesn't map
+// mountd, which only NFSv4 clients can do without.
+func (p *nfsProvisioner) getNodePorts(service *v1.Service) (int, int, error) {
+	nfsPort, mountPort := 0, 0
+	for _, port := range service.Spec.Ports {
+		if port.Protocol != v1.ProtocolTCP {
+			continue
+		}
+		switch int(port.Port) {
+		case p.nfsPort:
+			nfsPort = int(port.NodePort)
+		case p.mountPort:
+			mountPort = int(port.NodePort)
+		}
+	}
+	if nfsPort == 0 {
+		return 0, 0, fmt.Errorf("NodePort service %s=%s doesn't map NFS port %d/TCP to a node port", p.serviceEnv, service.Name, p.nfsPort)
+	}
+	return nfsPort, mountPort, nil
+}
+
+// getNodeAddress gets the external or, failing that, internal IP of the node
+// the provisioner is running on, for clients of a NodePort service to use.
+func (p *nfsProvisioner) getNodeAddress() (string, error) {
+	nodeName := os.Getenv(p.nodeEnv)
+	if nodeName == "" {
+		return "", fmt.Errorf("service %s is of type NodePort but node env %s isn't set; no way to get the node's IP", p.serviceEnv, p.nodeEnv)
+	}
+	node, err := p.client.Core().Nodes().Get(nodeName)
+	if err != nil {
+		return "", fmt.Errorf("error getting node %s=%s: %v", p.nodeEnv, nodeName, err)
+	}
+	for _, addressType := range []v1.NodeAddressType{v1.NodeExternalIP, v1.NodeInternalIP} {
+		for _, address := range node.Status.Addresses {
+			if address.Type == addressType {
+				return address.Address, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("node %s=%s has no external or internal IP", p.nodeEnv, nodeName)
+}
+
+// getLoadBalancerIngress waits for the given LoadBalancer service to be
+// assigned an ingress point and returns its IP or, failing that, hostname.
+func (p *nfsProvisioner) getLoadBalancerIngress(namespace, serviceName string) (string, error) {
+	var ingress string
+	err := wait.PollImmediate(p.loadBalancerPollInterval, p.loadBalancerTimeout, func() (bool, error) {
+		service, err := p.getService(namespace, serviceName)
+		if err != nil {
+			return false, err
+		}
+		for _, i := range service.Status.LoadBalancer.Ingress {
+			if i.IP != "" {
+				ingress = i.IP
+				return true, nil
+			}
+			if i.Hostname != "" {
+				ingress = i.Hostname
+				return true, nil
+			}
+		}
+		glog.Infof("waiting for LoadBalancer service %s=%s to be assigned an ingress point", p.serviceEnv, serviceName)
+		return false, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return "", fmt.Errorf("LoadBalancer service %s=%s wasn't assigned an ingress point within %v", p.serviceEnv, serviceName, p.loadBalancerTimeout)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return ingress, nil
+}
+
+// createDirectory creates the given directory in the export directory it was
+// placed in with appropriate permissions and ownership according to the given
+// parameters.
+func (p *nfsProvisioner) createDirectory(directory string, params directoryParams) error {
+	// TODO quotas
+	path := p.placedPath(directory)
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("error creating volume, the path already exists")
+	}
+	if err := p.journalStage(journalEntry{PV: directory, Stage: journalDirectory, Path: path}); err != nil {
+		return err
+	}
+	// The namespace's directory is kept once created, e.g. for the quota an
+	// admin applies to it
+	if parent := filepath.Dir(path) + "/"; parent != p.exportDirOf(path) {
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return fmt.Errorf("error creating namespace dir %s for volume: %v", parent, err)
+		}
+	}
+
+	// The pool is in exportDir and directories can't be renamed to another
+	// filesystem
+	if p.pool != nil && p.exportDirOf(path) == p.exportDir && p.pool.take(params, path) {
+		return nil
+	}
+	return p.setUpDirectory(path, params)
+}
+
+// setUpDirectory creates the given directory with permissions and ownership
+// according to the given parameters.
+func (p *nfsProvisioner) setUpDirectory(path string, params directoryParams) error {
+	gid := -1
+	if params.gid != "none" {
+		id, err := strconv.ParseUint(params.gid, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid gid %q: %v", params.gid, err)
+		}
+		gid = int(id)
+	}
+	uid := -1
+	if gid != -1 && params.fsGroup {
+		id, err := strconv.ParseUint(params.owner, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid owner %q: %v", params.owner, err)
+		}
+		uid = int(id)
+	}
+
+	perm := os.FileMode(0777)
+	if gid != -1 && p.unprivileged {
+		// The group can't be chown'd to without CAP_CHOWN, an ACL grants it
+		// access instead. The provisioner's own group gets none.
+		perm = os.FileMode(0701)
+	} else if gid != -1 && params.fsGroup {
+		perm = os.FileMode(0770) | os.ModeSetgid
+	} else if gid != -1 {
 		// Execute permission is required for stat, which kubelet uses during unmount.
 		perm = os.FileMode(0071)
 	}
-	if err := os.MkdirAll(path, perm); err != nil {
+	if params.mode != "" {
+		perm, _ = parseMode(params.mode)
+	}
+	if err := os.MkdirAll(path, perm.Perm()); err != nil {
 		return fmt.Errorf("error creating dir for volume: %v", err)
 	}
-	// Due to umask, need to chmod
-	cmd := exec.Command("chmod", strconv.FormatInt(int64(perm), 8), path)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
+
+	if gid != -1 && !p.unprivileged {
+		if err := os.Chown(path, uid, gid); err != nil {
+			os.RemoveAll(path)
+			return fmt.Errorf("error changing ownership of dir for volume: %v", err)
+		}
+	}
+
+	// Due to umask, need to chmod. chown may clear the setgid bit, so chmod
+	// comes after it
+	if err := os.Chmod(path, perm); err != nil {
 		os.RemoveAll(path)
-		return fmt.Errorf("chmod failed with error: %v, output: %s", err, out)
+		return fmt.Errorf("error changing permissions of dir for volume: %v", err)
 	}
 
-	if gid != "none" {
-		groupId, _ := strconv.ParseUint(gid, 10, 64)
-		cmd = exec.Command("chgrp", strconv.FormatUint(groupId, 10), path)
-		out, err = cmd.CombinedOutput()
-		if err != nil {
+	if gid != -1 && p.unprivileged {
+		uids := []uint32{}
+		if uid > 0 {
+			uids = append(uids, uint32(uid))
+		}
+		if err := setACL(path, perm, uids, []uint32{uint32(gid)}); err != nil {
 			os.RemoveAll(path)
-			return fmt.Errorf("chgrp failed with error: %v, output: %s", err, out)
+			return err
 		}
 	}
 
 	return nil
 }
 
-// createExport creates the export by adding a block to the appropriate config
-// file and exporting it, using the appropriate method.
-func (p *nfsProvisioner) createExport(directory string) (string, uint16, error) {
-	path := fmt.Sprintf(p.exportDir+"%s", directory)
+// parseMode parses the given octal permission bits, e.g. 0770 or 2770 for
+// setgid, of a directory.
+func parseMode(s string) (os.FileMode, error) {
+	bits, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || bits > 07777 {
+		return 0, fmt.Errorf("invalid mode %q, must be octal permission bits like 0770", s)
+	}
+	mode := os.FileMode(bits).Perm()
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode, nil
+}
+
+// createExport creates the export with the given parameters by adding a block to
+// the appropriate config file and exporting it, using the appropriate method.
+func (p *nfsProvisioner) createExport(directory string, params exportParams, span *tracing.Span) (string, uint16, error) {
+	path := p.placedPath(directory)
 
-	exportId := p.generateExportId()
+	done := p.timeStage(span, "export-id")
+	exportId, err := p.generateExportId()
+	done()
+	if err != nil {
+		return "", 0, fmt.Errorf("error generating export id for export: %v", err)
+	}
 	exportIdStr := strconv.FormatUint(uint64(exportId), 10)
 
-	config := p.exporter.GetConfig()
-	block := p.exporter.CreateBlock(exportIdStr, path)
+	config := p.exporterFor(params).GetConfig()
+	block, err := p.exporter.CreateBlock(exportIdStr, path, params)
+	if err != nil {
+		// Exporting a block without the class's clients, sec or squash would
+		// make the export more accessible than the class allows
+		p.deleteExportId(exportId)
+		return "", 0, fmt.Errorf("error creating export block for config %s: %v", config, err)
+	}
 
-	// Add the export block to the config file
-	if err := p.addToFile(config, block); err != nil {
+	if err := p.journalStage(journalEntry{PV: directory, Stage: journalExport, Path: path, ExportId: exportId, Block: block}); err != nil {
 		p.deleteExportId(exportId)
+		return "", 0, err
+	}
+
+	// Add the export block to the config file
+	// If adding or exporting the block fails, the caller rolls the journaled
+	// export back
+	done = p.timeStage(span, "config")
+	err = p.addToConfig(block)
+	done()
+	if err != nil {
 		return "", 0, fmt.Errorf("error adding export block %s to config %s: %v", block, config, err)
 	}
 
-	err := p.exporter.Export(path)
+	done = p.timeStage(span, "export")
+	err = p.exporter.Export(block)
+	done()
 	if err != nil {
-		p.deleteExportId(exportId)
-		p.removeFromFile(config, block)
 		return "", 0, fmt.Errorf("error exporting export block %s in config %s: %v", block, config, err)
 	}
 
 	return block, exportId, nil
 }
 
-// generateExportId generates a unique exportId to assign an export
-func (p *nfsProvisioner) generateExportId() uint16 {
+// generateExportId generates a unique exportId to assign an export and
+// persists it so it won't be reassigned after a restart.
+func (p *nfsProvisioner) generateExportId() (uint16, error) {
 	p.mapMutex.Lock()
-	id := uint16(1)
-	for ; id <= math.MaxUint16; id++ {
-		if _, ok := p.exportIds[id]; !ok {
-			break
-		}
+	defer p.mapMutex.Unlock()
+	id, ok := p.nextExportId()
+	if !ok {
+		return 0, fmt.Errorf("all export ids between %d and %d are in use", p.minExportId, p.maxExportId)
 	}
 	p.exportIds[id] = true
-	p.mapMutex.Unlock()
-	return id
+	if err := p.stateStore.saveExportIds(p.exportIds); err != nil {
+		delete(p.exportIds, id)
+		return 0, fmt.Errorf("error persisting export id %d: %v", id, err)
+	}
+	return id, nil
+}
+
+// nextExportId returns the lowest unused exportId in the provisioner's range
+// and whether there is one. The caller must hold mapMutex.
+func (p *nfsProvisioner) nextExportId() (uint16, bool) {
+	for id := int(p.minExportId); id <= int(p.maxExportId); id++ {
+		if !p.exportIds[uint16(id)] {
+			return uint16(id), true
+		}
+	}
+	return 0, false
 }
 
 func (p *nfsProvisioner) deleteExportId(exportId uint16) {
 	p.mapMutex.Lock()
 	delete(p.exportIds, exportId)
+	if err := p.stateStore.saveExportIds(p.exportIds); err != nil {
+		glog.Errorf("error persisting removal of export id %d: %v", exportId, err)
+	}
 	p.mapMutex.Unlock()
 }
 
-func (p *nfsProvisioner) addToFile(path string, toAdd string) error {
-	p.fileMutex.Lock()
-
-	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+// addToConfig adds the given block to the exporter's config file.
+func (p *nfsProvisioner) addToConfig(block string) error {
+	unlock, err := p.lockConfig(block)
 	if err != nil {
-		p.fileMutex.Unlock()
 		return err
 	}
-	defer file.Close()
+	defer unlock()
+	return p.exporter.AddToConfig(block)
+}
 
-	if _, err = file.WriteString(toAdd); err != nil {
-		p.fileMutex.Unlock()
+// removeFromConfig removes the given block from the exporter's config file.
+func (p *nfsProvisioner) removeFromConfig(block string) error {
+	unlock, err := p.lockConfig(block)
+	if err != nil {
 		return err
 	}
-	file.Sync()
+	defer unlock()
+	return p.exporter.RemoveFromConfig(block)
+}
 
-	p.fileMutex.Unlock()
-	return nil
+// configFiler is implemented by exporters that don't keep every block in the
+// one config file, e.g. give each its own drop-in file.
+type configFiler interface {
+	// configFile returns the file the given block is in or, if it's in none,
+	// would be added to.
+	configFile(block string) (string, error)
+}
+
+// lockConfig takes the lock of the file the given block is in or would be
+// added to, so that only edits of the same file exclude each other. A block in
+// a file of its own, i.e. other than the config file, isn't locked since the
+// caller holds the lock of its volume. It returns a func that releases the
+// lock.
+func (p *nfsProvisioner) lockConfig(block string) (func(), error) {
+	e := p.exporterOf(block)
+	config := e.GetConfig()
+	if filer, ok := e.(configFiler); ok {
+		file, err := filer.configFile(block)
+		if err != nil {
+			return nil, err
+		}
+		if file != config {
+			return func() {}, nil
+		}
+	}
+	return lockFile(config)
 }
 
-func (p *nfsProvisioner) removeFromFile(path string, toRemove string) error {
-	p.fileMutex.Lock()
+// addToFile appends toAdd to the given file, copying it rather than reading
+// it into memory so that it can hold tens of thousands of exports.
+func addToFile(path string, toAdd string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
+	return streamFileAtomic(path, 0600, func(w io.Writer) error {
+		if _, err := io.Copy(w, f); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, toAdd)
+		return err
+	})
+}
+
+func removeFromFile(path string, toRemove string) error {
 	read, err := ioutil.ReadFile(path)
 	if err != nil {
-		p.fileMutex.Unlock()
 		return err
 	}
 
 	removed := strings.Replace(string(read), toRemove, "", -1)
-	err = ioutil.WriteFile(path, []byte(removed), 0)
+	return writeFileAtomic(path, []byte(removed), 0600)
+}
+
+// removeKernelEntry removes the entry of the given block from the given
+// /etc/exports-format file, streaming it line by line so that it can hold tens
+// of thousands of exports. See copyWithoutKernelEntry.
+func removeKernelEntry(config, block string) error {
+	path, _, err := parseKernelBlock(block)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(config)
 	if err != nil {
-		p.fileMutex.Unlock()
 		return err
 	}
+	defer f.Close()
 
-	p.fileMutex.Unlock()
-	return nil
+	err = streamFileAtomic(config, 0600, func(w io.Writer) error {
+		found, err := copyWithoutKernelEntry(f, w, path)
+		if err == nil && !found {
+			return errUnchanged
+		}
+		return err
+	})
+	if err == errUnchanged {
+		return nil
+	}
+	return err
+}
+
+// withoutKernelEntry returns the given /etc/exports-format contents without
+// the entries exporting the given path and whether there were any. See
+// copyWithoutKernelEntry.
+func withoutKernelEntry(contents, path string) (string, bool) {
+	var buf bytes.Buffer
+	found, _ := copyWithoutKernelEntry(strings.NewReader(contents), &buf, path)
+	return buf.String(), found
 }
 
+// copyWithoutKernelEntry copies the /etc/exports-format contents of r to w
+// except for the entries exporting the given path, returning whether there
+// were any. Entries are found by the path they export, which is a PV's own
+// directory, the first field of their line, rather than by the whole block
+// CreateBlock created, so that an entry whose whitespace or clients were
+// rearranged since, e.g. by an admin, is still removed. Lines continued with a
+// backslash are part of the same entry. The blank line CreateBlock adds before
+// an entry is removed with it.
+func copyWithoutKernelEntry(r io.Reader, w io.Writer, path string) (bool, error) {
+	reader := bufio.NewReader(r)
+	found := false
+	// A blank line is held back until it's known whether an entry to remove
+	// follows it
+	blank := ""
+	for {
+		entry, readErr := readKernelEntry(reader)
+		if readErr != nil && readErr != io.EOF {
+			return found, readErr
+		}
+		fields := strings.Fields(strings.Replace(entry, "\\\n", " ", -1))
+		switch {
+		case entry == "":
+		case len(fields) == 0:
+			if _, err := io.WriteString(w, blank); err != nil {
+				return found, err
+			}
+			blank = entry
+		case strings.Trim(fields[0], "\"") == path:
+			found = true
+			blank = ""
+		default:
+			if _, err := io.WriteString(w, blank+entry); err != nil {
+				return found, err
+			}
+			blank = ""
+		}
+		if readErr == io.EOF {
+			_, err := io.WriteString(w, blank)
+			return found, err
+		}
+	}
+}
+
+// readKernelEntry reads a line and the lines it's continued on with a
+// backslash.
+func readKernelEntry(reader *bufio.Reader) (string, error) {
+	entry := ""
+	for {
+		line, err := reader.ReadString('\n')
+		entry += line
+		if err != nil || !strings.HasSuffix(strings.TrimRight(line, "\n"), "\\") {
+			return entry, err
+		}
+	}
+}
+
+// exporter is implemented by the NFS servers the provisioner can export PVs'
+// directories through, NFS Ganesha and the kernel NFS server, one of which is
+// chosen on startup. An export is a block of text in the server's config file,
+// which the provisioner records so that it can remove the export later.
+// Exporters can also implement the optional updater, batchExporter,
+// readinessChecker, configFiler and entryLister interfaces.
 type exporter interface {
+	// GetConfig returns the path of the config file exports are added to.
 	GetConfig() string
+	// GetConfigExportIds returns the exportIds of the exports in the config
+	// file, including ones the provisioner didn't add.
 	GetConfigExportIds() (map[uint16]bool, error)
-	CreateBlock(string, string) string
+	// GetConfigExports returns the exports in the config file that look like
+	// ones CreateBlock creates.
+	GetConfigExports() ([]configExport, error)
+	// CreateBlock creates the block of the export of the given path with the
+	// given exportId and parameters. It fails rather than create a block that
+	// doesn't apply every parameter.
+	CreateBlock(string, string, exportParams) (string, error)
+	// AddToConfig adds the given block to the config file.
+	AddToConfig(string) error
+	// RemoveFromConfig removes the given block from the config file.
+	RemoveFromConfig(string) error
+	// Export makes the server serve the export of the given block, which must
+	// be in the config file already.
 	Export(string) error
-	Unexport(*v1.PersistentVolume) error
+	// Unexport makes the server stop serving the export of the given block.
+	Unexport(string) error
 }
 
 type ganeshaExporter struct {
 	ganeshaConfig string
+	// If not nil, the template EXPORT blocks are created from
+	exportTemplate *template.Template
+	// If not nil, the FSAL block of EXPORT blocks instead of the VFS one
+	fsal *ganesha.Block
+	// If fsalRoot is not empty, the Path of an EXPORT block is its directory's
+	// path with the exportDir prefix replaced by fsalRoot, i.e. the path of the
+	// directory in the FSAL's filesystem. Its Pseudo stays the directory's path.
+	exportDir string
+	fsalRoot  string
+	// The config file's EXPORTs, kept up to date as they're added, updated
+	// and removed
+	index ganeshaIndex
 }
 
 var _ exporter = &ganeshaExporter{}
@@ -459,32 +1973,264 @@ func (e *ganeshaExporter) GetConfig() string {
 }
 
 func (e *ganeshaExporter) GetConfigExportIds() (map[uint16]bool, error) {
-	return getConfigExportIds(e.GetConfig(), regexp.MustCompile("Export_Id = ([0-9]+);"))
+	exportIds := map[uint16]bool{}
+	err := e.index.view(e.GetConfig(), func(x *ganeshaIndex) {
+		for id := range x.exports {
+			exportIds[id] = true
+		}
+	})
+	return exportIds, err
 }
 
-// CreateBlock creates the text block to add to the ganesha config file.
-func (e *ganeshaExporter) CreateBlock(exportId, path string) string {
-	return "\nEXPORT\n{\n" +
-		"\tExport_Id = " + exportId + ";\n" +
-		"\tPath = " + path + ";\n" +
-		"\tPseudo = " + path + ";\n" +
-		"\tAccess_Type = RW;\n" +
-		"\tSquash = root_id_squash;\n" +
-		"\tSecType = sys;\n" +
-		"\tFilesystem_id = " + exportId + "." + exportId + ";\n" +
-		"\tFSAL {\n\t\tName = VFS;\n\t}\n}\n"
+// GetConfigExports gets the EXPORT blocks in the ganesha config file.
+func (e *ganeshaExporter) GetConfigExports() ([]configExport, error) {
+	exports := []configExport{}
+	err := e.index.view(e.GetConfig(), func(x *ganeshaIndex) {
+		for _, export := range x.config.Exports() {
+			id, err := export.ExportId()
+			if err != nil {
+				continue
+			}
+			// Pseudo is the directory's path even if Path is in another
+			// FSAL's filesystem
+			path, ok := export.Get("Pseudo")
+			if !ok {
+				path, _ = export.Get("Path")
+			}
+			exports = append(exports, configExport{block: "\n" + export.String(), path: path, exportId: id})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return exports, nil
 }
 
-// Export exports the given directory using NFS Ganesha, assuming it is running
-// and can be connected to using D-Bus.
-func (e *ganeshaExporter) Export(path string) error {
-	// Call AddExport using dbus
-	conn, err := dbus.SystemBus()
+// CreateBlock creates the text block to add to the ganesha config file. If
+// there are security flavors, they replace the block's SecType, and if every
+// user is squashed or there's an anonymous uid or gid, they replace its Squash
+// or set its Anonymous_uid or Anonymous_gid. If there are clients, only they
+// get access to the export, read-only if the export is.
+func (e *ganeshaExporter) CreateBlock(exportId, path string, params exportParams) (string, error) {
+	block, err := e.createBlock(exportId, path)
 	if err != nil {
-		return fmt.Errorf("error getting dbus session bus: %v", err)
+		return "", err
+	}
+	if len(params.sec) != 0 || params.allSquash || params.anonUid != "" || params.anonGid != "" {
+		exports, err := parseExportBlock(block)
+		if err != nil {
+			return "", fmt.Errorf("error setting parameters of export block: %v", err)
+		}
+		export := exports[0]
+		if len(params.sec) != 0 {
+			export.Set("SecType", strings.Join(params.sec, ", "))
+		}
+		if params.allSquash {
+			export.Set("Squash", "all_squash")
+		}
+		if params.anonUid != "" {
+			export.Set("Anonymous_uid", params.anonUid)
+		}
+		if params.anonGid != "" {
+			export.Set("Anonymous_gid", params.anonGid)
+		}
+		block = "\n" + export.String()
+	}
+	if len(params.clients) == 0 && !params.readOnly {
+		return block, nil
+	}
+	accessType := "RW"
+	if params.readOnly {
+		accessType = "RO"
 	}
-	obj := conn.Object("org.ganesha.nfsd", "/org/ganesha/nfsd/ExportMgr")
-	call := obj.Call("org.ganesha.nfsd.exportmgr.AddExport", 0, e.ganeshaConfig, fmt.Sprintf("export(path = %s)", path))
+	restricted, err := e.UpdateBlock(block, accessType, params.clients)
+	if err != nil {
+		return "", fmt.Errorf("error restricting export block to clients: %v", err)
+	}
+	return restricted, nil
+}
+
+func (e *ganeshaExporter) createBlock(exportId, path string) (string, error) {
+	fsalPath := path
+	if e.fsalRoot != "" {
+		fsalPath = strings.TrimSuffix(e.fsalRoot, "/") + "/" + strings.TrimPrefix(path, e.exportDir)
+	}
+
+	if e.exportTemplate != nil {
+		return executeExportTemplate(e.exportTemplate, exportId, fsalPath, path)
+	}
+
+	export := ganesha.NewBlock("EXPORT",
+		"Export_Id", exportId,
+		"Path", fsalPath,
+		"Pseudo", path,
+		"Access_Type", "RW",
+		"Squash", "root_id_squash",
+		"SecType", "sys",
+		"Filesystem_id", exportId+"."+exportId)
+	if e.fsal != nil {
+		export.AddBlock(e.fsal)
+	} else {
+		export.AddBlock(ganesha.NewBlock("FSAL", "Name", "VFS"))
+	}
+	return "\n" + export.String(), nil
+}
+
+// exportTemplateData is what EXPORT block templates are executed with. The
+// fields' values are those of the default block.
+type exportTemplateData struct {
+	ExportId     string
+	Path         string
+	Pseudo       string
+	Squash       string
+	FilesystemId string
+}
+
+// ParseFSAL parses an FSAL of the form <name>[,<key>=<value>...], e.g.
+// GLUSTER,Hostname=gluster.example.com,Volume=vol0, into the FSAL block of
+// EXPORT blocks.
+func ParseFSAL(s string) (*ganesha.Block, error) {
+	fields := strings.Split(s, ",")
+	name := strings.TrimSpace(fields[0])
+	if name == "" {
+		return nil, fmt.Errorf("FSAL %q has no name", s)
+	}
+	fsal := ganesha.NewBlock("FSAL", "Name", name)
+	for _, field := range fields[1:] {
+		parts := strings.SplitN(field, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("FSAL %q has invalid parameter %q, must be <key>=<value>", s, field)
+		}
+		if strings.EqualFold(key, "Name") {
+			return nil, fmt.Errorf("FSAL %q sets Name as a parameter", s)
+		}
+		fsal.Set(key, strings.TrimSpace(parts[1]))
+	}
+	return fsal, nil
+}
+
+// ParseExportTemplate parses the Go template in the given file that ganesha
+// EXPORT blocks are to be created from. The template is executed with the
+// fields ExportId, Path, Pseudo, Squash and FilesystemId, e.g.
+// Export_Id = {{.ExportId}}; and must produce exactly one valid EXPORT block.
+func ParseExportTemplate(file string) (*template.Template, error) {
+	tmpl, err := template.ParseFiles(file)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.Option("missingkey=error")
+
+	// Make sure the template produces valid blocks, so that CreateBlock can't
+	// fail later
+	block, err := executeExportTemplate(tmpl, "1", "/export/pvc-1", "/export/pvc-1")
+	if err != nil {
+		return nil, err
+	}
+	exports, err := parseExportBlock(block)
+	if err != nil {
+		return nil, fmt.Errorf("template doesn't produce an EXPORT block: %v", err)
+	}
+	if len(exports) != 1 {
+		return nil, fmt.Errorf("template must produce exactly one EXPORT block, produces %d", len(exports))
+	}
+	if err := ganesha.ValidateExport(exports[0]); err != nil {
+		return nil, fmt.Errorf("template produces an invalid EXPORT block: %v", err)
+	}
+	id, _ := exports[0].ExportId()
+	if path, _ := exports[0].Get("Path"); id != 1 || path != "/export/pvc-1" {
+		return nil, fmt.Errorf("template must set Export_Id to {{.ExportId}} and Path to {{.Path}}")
+	}
+
+	return tmpl, nil
+}
+
+func executeExportTemplate(tmpl *template.Template, exportId, path, pseudo string) (string, error) {
+	data := exportTemplateData{
+		ExportId:     exportId,
+		Path:         path,
+		Pseudo:       pseudo,
+		Squash:       "root_id_squash",
+		FilesystemId: exportId + "." + exportId,
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("error executing export template: %v", err)
+	}
+	return "\n" + strings.TrimSpace(buf.String()) + "\n", nil
+}
+
+// AddToConfig parses the given EXPORT block and adds it to the ganesha config
+// file, refusing to if the block is invalid or the resulting config would be,
+// e.g. because an EXPORT with the same Export_Id already exists.
+func (e *ganeshaExporter) AddToConfig(block string) error {
+	exports, err := parseExportBlock(block)
+	if err != nil {
+		return err
+	}
+
+	return e.index.modify(e.GetConfig(), func(x *ganeshaIndex) error {
+		for _, export := range exports {
+			if err := x.add(export); err != nil {
+				return fmt.Errorf("error adding export block %s: %v", block, err)
+			}
+		}
+		return nil
+	})
+}
+
+// RemoveFromConfig removes the EXPORT in the ganesha config file with the same
+// Export_Id as the given EXPORT block, regardless of how the two are
+// formatted.
+func (e *ganeshaExporter) RemoveFromConfig(block string) error {
+	exports, err := parseExportBlock(block)
+	if err != nil {
+		return err
+	}
+
+	return e.index.modify(e.GetConfig(), func(x *ganeshaIndex) error {
+		for _, export := range exports {
+			id, _ := export.ExportId()
+			x.remove(id)
+		}
+		return nil
+	})
+}
+
+// parseExportBlock parses the given block and returns its EXPORT blocks, which
+// must have valid Export_Ids.
+func parseExportBlock(block string) ([]*ganesha.Block, error) {
+	parsed, err := ganesha.Parse([]byte(block))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing export block %s: %v", block, err)
+	}
+	exports := parsed.Exports()
+	if len(exports) == 0 {
+		return nil, fmt.Errorf("export block %s has no EXPORT", block)
+	}
+	for _, export := range exports {
+		if _, err := export.ExportId(); err != nil {
+			return nil, fmt.Errorf("error parsing export block %s: %v", block, err)
+		}
+	}
+	return exports, nil
+}
+
+// Export exports the directory of the given EXPORT block, which must be in the
+// config file already, using NFS Ganesha, assuming it is running and can be
+// connected to using D-Bus.
+func (e *ganeshaExporter) Export(block string) error {
+	exports, err := parseExportBlock(block)
+	if err != nil {
+		return err
+	}
+	path, ok := exports[0].Get("Path")
+	if !ok {
+		return fmt.Errorf("export block %s has no Path", block)
+	}
+
+	// Call AddExport using dbus
+	call := ganesha.Call(ganesha.ExportMgrPath, "org.ganesha.nfsd.exportmgr.AddExport", e.ganeshaConfig, fmt.Sprintf("export(path = %s)", path))
 	if call.Err != nil {
 		return fmt.Errorf("error calling org.ganesha.nfsd.exportmgr.AddExport: %v", call.Err)
 	}
@@ -493,6 +2239,19 @@ func (e *ganeshaExporter) Export(path string) error {
 }
 
 type kernelExporter struct {
+	// If not empty, the directory exported as the NFSv4 pseudo-root with
+	// fsid=0. Each export's directory is bind-mounted at its own path under it
+	// and the bind mount is exported instead, so that clients mount it by its
+	// own path over NFSv4.
+	nfsv4Root string
+	// If not empty, the directory each export gets its own drop-in file in,
+	// named after its directory, instead of being appended to /etc/exports, so
+	// that adding and removing an export is creating and deleting a file. The
+	// exports already in /etc/exports are still read and removed from there.
+	exportsDir string
+	// If not nil, exports and unexports are coalesced into batches, each
+	// synced with `exportfs -r`
+	batcher *exportBatcher
 }
 
 var _ exporter = &kernelExporter{}
@@ -501,27 +2260,314 @@ func (e *kernelExporter) GetConfig() string {
 	return "/etc/exports"
 }
 
+// configFiles returns /etc/exports and the drop-in files in exportsDir.
+func (e *kernelExporter) configFiles() ([]string, error) {
+	files := []string{e.GetConfig()}
+	if e.exportsDir == "" {
+		return files, nil
+	}
+	dropIns, err := filepath.Glob(filepath.Join(e.exportsDir, "*.exports"))
+	if err != nil {
+		return nil, fmt.Errorf("error listing drop-in files in %s: %v", e.exportsDir, err)
+	}
+	return append(files, dropIns...), nil
+}
+
+// dropInFile returns the drop-in file of the given block, named after the
+// directory it exports.
+func (e *kernelExporter) dropInFile(block string) (string, error) {
+	path, _, err := parseKernelBlock(block)
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Base(e.fromRootPath(path))
+	if path == e.nfsv4Root {
+		name = "nfsv4-root"
+	}
+	return filepath.Join(e.exportsDir, name+".exports"), nil
+}
+
+var _ configFiler = &kernelExporter{}
+
+// configFile returns the file the given block is in or, if it's in none, would
+// be added to: its drop-in file, unless there's no exportsDir or the block is
+// only in /etc/exports. A drop-in file is named after the directory of the PV
+// whose block it holds, so each has a single volume's block.
+func (e *kernelExporter) configFile(block string) (string, error) {
+	if e.exportsDir == "" {
+		return e.GetConfig(), nil
+	}
+	file, err := e.dropInFile(block)
+	if err != nil {
+		return "", err
+	}
+	if read, err := ioutil.ReadFile(file); err == nil && string(read) == block {
+		return file, nil
+	}
+	read, err := ioutil.ReadFile(e.GetConfig())
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if strings.Contains(string(read), block) {
+		return e.GetConfig(), nil
+	}
+	return file, nil
+}
+
 func (e *kernelExporter) GetConfigExportIds() (map[uint16]bool, error) {
-	return getConfigExportIds(e.GetConfig(), regexp.MustCompile("fsid=([0-9]+)"))
+	files, err := e.configFiles()
+	if err != nil {
+		return map[uint16]bool{}, err
+	}
+	exportIds := map[uint16]bool{}
+	for _, file := range files {
+		ids, err := getConfigExportIds(file, regexp.MustCompile("fsid=([0-9]+)"))
+		if err != nil && !(os.IsNotExist(err) && e.exportsDir != "") {
+			return exportIds, err
+		}
+		for id := range ids {
+			exportIds[id] = true
+		}
+	}
+	return exportIds, nil
+}
+
+// GetConfigExports gets the exports in /etc/exports and the drop-in files that
+// were created by CreateBlock. The path of an export under the NFSv4
+// pseudo-root is that of the directory bind-mounted there.
+func (e *kernelExporter) GetConfigExports() ([]configExport, error) {
+	files, err := e.configFiles()
+	if err != nil {
+		return nil, err
+	}
+	exports := []configExport{}
+	for _, file := range files {
+		fileExports, err := getConfigExports(file, kernelBlockRe)
+		if err != nil {
+			if os.IsNotExist(err) && e.exportsDir != "" {
+				// With drop-in files there may be no /etc/exports
+				continue
+			}
+			return nil, err
+		}
+		exports = append(exports, fileExports...)
+	}
+	for i := range exports {
+		exports[i].path = e.fromRootPath(exports[i].path)
+	}
+	return exports, nil
 }
 
-// CreateBlock creates the text block to add to the /etc/exports file.
-func (e *kernelExporter) CreateBlock(exportId, path string) string {
-	return "\n" + path + " *(rw,insecure,root_squash,fsid=" + exportId + ")\n"
+// hasBlock returns whether /etc/exports or a drop-in file contains the given
+// block.
+func (e *kernelExporter) hasBlock(block string) (bool, error) {
+	files, err := e.configFiles()
+	if err != nil {
+		return false, err
+	}
+	for _, file := range files {
+		read, err := ioutil.ReadFile(file)
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		if strings.Contains(string(read), block) {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
-// Export exports all directories listed in /etc/exports
-func (e *kernelExporter) Export(_ string) error {
-	// Execute exportfs
-	cmd := exec.Command("exportfs", "-r")
-	out, err := cmd.CombinedOutput()
+// CreateBlock creates the text block to add to the /etc/exports file. If there
+// are no clients, any client can mount the export. If every user is squashed
+// or there's an anonymous uid or gid, all_squash, anonuid or anongid follow the
+// fsid, which kernelBlockRe relies on. If there are security flavors, clients
+// must use one of them. A read-only export is ro instead of rw.
+func (e *kernelExporter) CreateBlock(exportId, path string, params exportParams) (string, error) {
+	clients := params.clients
+	if len(clients) == 0 {
+		clients = []string{"*"}
+	}
+	options := "rw,insecure,root_squash,fsid=" + exportId
+	if params.readOnly {
+		options = "ro" + strings.TrimPrefix(options, "rw")
+	}
+	if params.allSquash {
+		options += ",all_squash"
+	}
+	if params.anonUid != "" {
+		options += ",anonuid=" + params.anonUid
+	}
+	if params.anonGid != "" {
+		options += ",anongid=" + params.anonGid
+	}
+	if len(params.sec) != 0 {
+		options += ",sec=" + strings.Join(params.sec, ":")
+	}
+	block := "\n" + e.toRootPath(path)
+	for _, client := range clients {
+		block += " " + client + "(" + options + ")"
+	}
+	return block + "\n", nil
+}
+
+// AddToConfig writes the given block to its drop-in file or, if there is no
+// exportsDir, appends it to /etc/exports.
+func (e *kernelExporter) AddToConfig(block string) error {
+	if e.exportsDir == "" {
+		return addToFile(e.GetConfig(), block)
+	}
+	file, err := e.dropInFile(block)
 	if err != nil {
-		return fmt.Errorf("exportfs -r failed with error: %v, output: %s", err, out)
+		return err
 	}
+	if err := os.MkdirAll(e.exportsDir, 0755); err != nil {
+		return fmt.Errorf("error creating drop-in directory %s: %v", e.exportsDir, err)
+	}
+	return writeFileAtomic(file, []byte(block), 0644)
+}
 
+// RemoveFromConfig removes the entry of the given block from its drop-in file,
+// deleting the file if nothing else is left in it, or else from /etc/exports.
+func (e *kernelExporter) RemoveFromConfig(block string) error {
+	if e.exportsDir != "" {
+		path, _, err := parseKernelBlock(block)
+		if err != nil {
+			return err
+		}
+		file, err := e.dropInFile(block)
+		if err != nil {
+			return err
+		}
+		read, err := ioutil.ReadFile(file)
+		if err == nil {
+			if removed, found := withoutKernelEntry(string(read), path); found {
+				if strings.TrimSpace(removed) == "" {
+					return os.Remove(file)
+				}
+				return writeFileAtomic(file, []byte(removed), 0644)
+			}
+		}
+		if _, err := os.Stat(e.GetConfig()); os.IsNotExist(err) {
+			return nil
+		}
+	}
+	return removeKernelEntry(e.GetConfig(), block)
+}
+
+// Export exports the directory of the given /etc/exports block to each of its
+// clients with `exportfs -o`, leaving other exports undisturbed, and verifies
+// that it's active. A directory under the NFSv4 pseudo-root is bind-mounted
+// there first. If there's a batcher, the block must already be in the config
+// and it's exported by the batch's `exportfs -r` instead.
+func (e *kernelExporter) Export(block string) error {
+	path, clients, err := parseKernelBlock(block)
+	if err != nil {
+		return err
+	}
+	if e.nfsv4Root != "" {
+		if err := e.bindMount(path); err != nil {
+			return err
+		}
+	}
+
+	if e.batcher != nil {
+		if err := e.batcher.sync(path, true); err != nil {
+			if e.nfsv4Root != "" {
+				e.unbindMount(path)
+			}
+			return err
+		}
+		return nil
+	}
+
+	for i, client := range clients {
+		cmd := exec.Command("exportfs", "-o", client.options, client.host+":"+path)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			// Don't leave the directory exported to only some of its clients
+			for _, exported := range clients[:i] {
+				exec.Command("exportfs", "-u", exported.host+":"+path).Run()
+			}
+			if e.nfsv4Root != "" {
+				e.unbindMount(path)
+			}
+			return fmt.Errorf("exportfs -o %s %s:%s failed with error: %v, output: %s", client.options, client.host, path, err, out)
+		}
+	}
+
+	return verifyExported(path)
+}
+
+var _ batchExporter = &kernelExporter{}
+
+// ExportBatch exports the directories of the given /etc/exports blocks, which
+// must already be in the config, with a single `exportfs -r`, which syncs the
+// active exports with /etc/exports and the drop-in files in /etc/exports.d,
+// instead of one `exportfs -o` per client of each block, and verifies that
+// they're all active. Directories under the NFSv4 pseudo-root are bind-mounted
+// there first.
+func (e *kernelExporter) ExportBatch(blocks []string) error {
+	paths := map[string]bool{}
+	for _, block := range blocks {
+		path, _, err := parseKernelBlock(block)
+		if err != nil {
+			return err
+		}
+		if e.nfsv4Root != "" {
+			if err := e.bindMount(path); err != nil {
+				return err
+			}
+		}
+		paths[path] = true
+	}
+
+	errs, err := refreshExports(paths)
+	if err != nil {
+		return err
+	}
+	for _, err := range errs {
+		return err
+	}
 	return nil
 }
 
+// kernelClient is a client and its options in an /etc/exports line, e.g.
+// *(rw,fsid=1)
+type kernelClient struct {
+	host    string
+	options string
+}
+
+// parseKernelBlock parses the given /etc/exports block, which must be a single
+// line, into its path and clients.
+func parseKernelBlock(block string) (string, []kernelClient, error) {
+	fields := strings.Fields(block)
+	if len(fields) < 2 {
+		return "", nil, fmt.Errorf("export block %q has no clients", block)
+	}
+
+	clients := []kernelClient{}
+	for _, field := range fields[1:] {
+		open := strings.Index(field, "(")
+		if open == -1 {
+			clients = append(clients, kernelClient{host: field})
+			continue
+		}
+		if !strings.HasSuffix(field, ")") {
+			return "", nil, fmt.Errorf("export block %q has malformed client %q", block, field)
+		}
+		host := field[:open]
+		if host == "" {
+			// exportfs requires a host, an empty one means any like in
+			// /etc/exports
+			host = "*"
+		}
+		clients = append(clients, kernelClient{host: host, options: field[open+1 : len(field)-1]})
+	}
+
+	return fields[0], clients, nil
+}
+
 // getConfigExportIds populates the exportIds map with pre-existing exportIds
 // found in the given config file. Takes as argument the regex it should use to
 // find each exportId in the file i.e. Export_Id or fsid.
@@ -548,3 +2594,43 @@ func getConfigExportIds(config string, re *regexp.Regexp) (map[uint16]bool, erro
 
 	return exportIds, nil
 }
+
+// kernelBlockRe matches blocks created by the kernelExporter's CreateBlock,
+// with submatches named id and path for the exportId and path.
+var kernelBlockRe = regexp.MustCompile("\n(?P<path>\\S+)(?: [^\\s(]+\\(r[wo],insecure,root_squash,fsid=(?P<id>[0-9]+)(?:,[^\\s,)]+)*\\))+\n")
+
+// configExport is an export block found in a config file.
+type configExport struct {
+	block    string
+	path     string
+	exportId uint16
+}
+
+// getConfigExports finds the export blocks in the given config file that match
+// the given regex, which must have submatches named id and path.
+func getConfigExports(config string, re *regexp.Regexp) ([]configExport, error) {
+	read, err := ioutil.ReadFile(config)
+	if err != nil {
+		return nil, err
+	}
+
+	exports := []configExport{}
+	for _, match := range re.FindAllStringSubmatch(string(read), -1) {
+		export := configExport{block: match[0]}
+		for i, name := range re.SubexpNames() {
+			switch name {
+			case "id":
+				id, err := strconv.ParseUint(match[i], 10, 16)
+				if err != nil {
+					return nil, fmt.Errorf("error parsing export id in block %s: %v", match[0], err)
+				}
+				export.exportId = uint16(id)
+			case "path":
+				export.path = match[i]
+			}
+		}
+		exports = append(exports, export)
+	}
+
+	return exports, nil
+}
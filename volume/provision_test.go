@@ -17,23 +17,38 @@ limitations under the License.
 package volume
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
+	"text/template"
+	"time"
 
 	"github.com/wongma7/nfs-provisioner/controller"
+	"github.com/wongma7/nfs-provisioner/ganesha"
+	"github.com/wongma7/nfs-provisioner/metrics"
 	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api"
 	"k8s.io/client-go/1.4/pkg/api/resource"
 	"k8s.io/client-go/1.4/pkg/api/unversioned"
 	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/apis/extensions/v1beta1"
 	"k8s.io/client-go/1.4/pkg/runtime"
+	"k8s.io/client-go/1.4/pkg/types"
 	utiltesting "k8s.io/client-go/1.4/pkg/util/testing"
+	"k8s.io/client-go/1.4/tools/cache"
+	"k8s.io/client-go/1.4/tools/record"
 )
 
 func TestCreateVolume(t *testing.T) {
@@ -64,7 +79,7 @@ func TestCreateVolume(t *testing.T) {
 			expectedServer:   "1.1.1.1",
 			expectedPath:     tmpDir + "/pvc-1",
 			expectedGroup:    0,
-			expectedBlock:    "\nExport_Id = 1;\n",
+			expectedBlock:    "\nExport_Id = 1;\nPath = " + tmpDir + "/pvc-1;\n",
 			expectedExportId: 1,
 			expectError:      false,
 		},
@@ -81,7 +96,7 @@ func TestCreateVolume(t *testing.T) {
 			expectedServer:   "1.1.1.1",
 			expectedPath:     tmpDir + "/pvc-2",
 			expectedGroup:    0,
-			expectedBlock:    "\nExport_Id = 2;\n",
+			expectedBlock:    "\nExport_Id = 2;\nPath = " + tmpDir + "/pvc-2;\n",
 			expectedExportId: 2,
 			expectError:      false,
 		},
@@ -161,12 +176,12 @@ func TestCreateVolume(t *testing.T) {
 	if err != nil {
 		t.Errorf("Error creating file %s: %v", conf, err)
 	}
-	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{config: conf})
+	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{config: conf}, nil)
 
 	for _, test := range tests {
 		os.Setenv(test.envKey, "1.1.1.1")
 
-		server, path, supGroup, block, exportId, err := p.createVolume(test.options)
+		server, path, supGroup, block, exportId, err := p.createVolume(test.options, exportParams{})
 
 		evaluate(t, test.name, test.expectError, err, test.expectedServer, server, "server")
 		evaluate(t, test.name, test.expectError, err, test.expectedPath, path, "path")
@@ -178,6 +193,46 @@ func TestCreateVolume(t *testing.T) {
 	}
 }
 
+func TestEncodeACL(t *testing.T) {
+	expected := []byte{
+		2, 0, 0, 0,
+		aclUserObj, 0, 07, 0, 0xff, 0xff, 0xff, 0xff,
+		aclUser, 0, 07, 0, 0xe8, 0x03, 0, 0,
+		aclGroupObj, 0, 0, 0, 0xff, 0xff, 0xff, 0xff,
+		aclGroup, 0, 07, 0, 0xe9, 0x03, 0, 0,
+		aclGroup, 0, 07, 0, 0xea, 0x03, 0, 0,
+		aclMask, 0, 07, 0, 0xff, 0xff, 0xff, 0xff,
+		aclOther, 0, 01, 0, 0xff, 0xff, 0xff, 0xff,
+	}
+	evaluate(t, "named entries", false, nil, expected, encodeACL(0701, []uint32{1000}, []uint32{1002, 1001, 1002}), "ACL")
+
+	expected = []byte{
+		2, 0, 0, 0,
+		aclUserObj, 0, 07, 0, 0xff, 0xff, 0xff, 0xff,
+		aclGroupObj, 0, 05, 0, 0xff, 0xff, 0xff, 0xff,
+		aclOther, 0, 0, 0, 0xff, 0xff, 0xff, 0xff,
+	}
+	evaluate(t, "no named entries", false, nil, expected, encodeACL(0750, nil, nil), "ACL")
+}
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		mode         string
+		expectedMode os.FileMode
+		expectError  bool
+	}{
+		{mode: "0770", expectedMode: 0770},
+		{mode: "2770", expectedMode: 0770 | os.ModeSetgid},
+		{mode: "1777", expectedMode: 0777 | os.ModeSticky},
+		{mode: "0778", expectError: true},
+		{mode: "10000", expectError: true},
+	}
+	for _, test := range tests {
+		mode, err := parseMode(test.mode)
+		evaluate(t, test.mode, test.expectError, err, test.expectedMode, mode, "mode")
+	}
+}
+
 func TestValidateOptions(t *testing.T) {
 	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
 	defer os.RemoveAll(tmpDir)
@@ -230,13 +285,60 @@ func TestValidateOptions(t *testing.T) {
 			expectedGid: "",
 			expectError: true,
 		},
-		// TODO implement options.ProvisionerSelector parsing
 		{
-			name:        "non-nil selector",
-			options:     controller.VolumeOptions{Selector: &unversioned.LabelSelector{MatchLabels: nil}},
+			name:        "gid parameter value 'auto'",
+			options:     controller.VolumeOptions{PVC: &v1.PersistentVolumeClaim{ObjectMeta: v1.ObjectMeta{Name: "claim", Namespace: "auto"}}, Parameters: map[string]string{"gid": "auto"}, Capacity: resource.MustParse("1Ki")},
+			expectedGid: "1000000000",
+			expectError: false,
+		},
+		{
+			name:        "clients parameter",
+			options:     controller.VolumeOptions{Parameters: map[string]string{"clients": "10.0.0.0/8, example.com"}, Capacity: resource.MustParse("1Ki")},
+			expectedGid: "none",
+			expectError: false,
+		},
+		{
+			name:        "bad clients parameter value",
+			options:     controller.VolumeOptions{Parameters: map[string]string{"clients": "10.0.0.0/8(rw)"}},
+			expectedGid: "",
+			expectError: true,
+		},
+		{
+			name:        "sec parameter",
+			options:     controller.VolumeOptions{Parameters: map[string]string{"sec": "krb5p, krb5i"}, Capacity: resource.MustParse("1Ki")},
+			expectedGid: "none",
+			expectError: false,
+		},
+		{
+			name:        "bad sec parameter value",
+			options:     controller.VolumeOptions{Parameters: map[string]string{"sec": "krb4"}},
+			expectedGid: "",
+			expectError: true,
+		},
+		{
+			name:        "squash parameters",
+			options:     controller.VolumeOptions{Parameters: map[string]string{"squash": "All", "anonuid": "1000", "anongid": "0"}, Capacity: resource.MustParse("1Ki")},
+			expectedGid: "none",
+			expectError: false,
+		},
+		{
+			name:        "bad squash parameter value",
+			options:     controller.VolumeOptions{Parameters: map[string]string{"squash": "none"}},
+			expectedGid: "",
+			expectError: true,
+		},
+		{
+			name:        "bad anonuid parameter value",
+			options:     controller.VolumeOptions{Parameters: map[string]string{"anonuid": "-1"}},
 			expectedGid: "",
 			expectError: true,
 		},
+		{
+			name:        "non-nil selector",
+			options:     controller.VolumeOptions{Selector: &unversioned.LabelSelector{MatchLabels: nil}},
+			expectedGid: "none",
+			expectError: false,
+		},
 		{
 			name:        "bad capacity",
 			options:     controller.VolumeOptions{Capacity: resource.MustParse("1Ei")},
@@ -245,8 +347,8 @@ func TestValidateOptions(t *testing.T) {
 		},
 	}
 
-	client := fake.NewSimpleClientset()
-	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{})
+	client := fake.NewSimpleClientset(&v1.Namespace{ObjectMeta: v1.ObjectMeta{Name: "auto", Annotations: map[string]string{annSupplementalGroups: "1000000000/10000"}}})
+	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{}, nil)
 
 	for _, test := range tests {
 		gid, err := p.validateOptions(test.options)
@@ -255,6 +357,435 @@ func TestValidateOptions(t *testing.T) {
 	}
 }
 
+func TestGetAutoGid(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	claim := &v1.PersistentVolumeClaim{ObjectMeta: v1.ObjectMeta{Name: "claim", Namespace: "default"}}
+	namespace := func(annotations map[string]string) *v1.Namespace {
+		return &v1.Namespace{ObjectMeta: v1.ObjectMeta{Name: "default", Annotations: annotations}}
+	}
+	policy := func(name string, supplementalGroups v1beta1.SupplementalGroupsStrategyOptions, fsGroup v1beta1.FSGroupStrategyOptions) *v1beta1.PodSecurityPolicy {
+		return &v1beta1.PodSecurityPolicy{ObjectMeta: v1.ObjectMeta{Name: name}, Spec: v1beta1.PodSecurityPolicySpec{SupplementalGroups: supplementalGroups, FSGroup: fsGroup}}
+	}
+	runAsAny := v1beta1.SupplementalGroupsStrategyOptions{Rule: v1beta1.SupplementalGroupsStrategyRunAsAny}
+	mustRunAs := v1beta1.SupplementalGroupsStrategyOptions{Rule: v1beta1.SupplementalGroupsStrategyMustRunAs, Ranges: []v1beta1.IDRange{{Min: 2000, Max: 2999}}}
+	fsGroup := v1beta1.FSGroupStrategyOptions{Rule: v1beta1.FSGroupStrategyMustRunAs, Ranges: []v1beta1.IDRange{{Min: 3000, Max: 3999}}}
+
+	tests := []struct {
+		name        string
+		options     controller.VolumeOptions
+		objs        []runtime.Object
+		expectedGid string
+		expectError bool
+	}{
+		{
+			name:        "namespace annotation",
+			options:     controller.VolumeOptions{PVC: claim, Parameters: map[string]string{"gid": "auto"}},
+			objs:        []runtime.Object{namespace(map[string]string{annSupplementalGroups: "1000000000/10000"}), policy("psp", mustRunAs, fsGroup)},
+			expectedGid: "1000000000",
+		},
+		{
+			name:        "namespace annotation range",
+			options:     controller.VolumeOptions{PVC: claim, Parameters: map[string]string{"gid": "auto"}},
+			objs:        []runtime.Object{namespace(map[string]string{annSupplementalGroups: "5000-5999,1000000000/10000"})},
+			expectedGid: "5000",
+		},
+		{
+			name:        "bad namespace annotation",
+			options:     controller.VolumeOptions{PVC: claim, Parameters: map[string]string{"gid": "auto"}},
+			objs:        []runtime.Object{namespace(map[string]string{annSupplementalGroups: "1000000000"})},
+			expectError: true,
+		},
+		{
+			name:        "policy supplemental groups",
+			options:     controller.VolumeOptions{PVC: claim, Parameters: map[string]string{"gid": "auto"}},
+			objs:        []runtime.Object{namespace(nil), policy("psp", mustRunAs, fsGroup)},
+			expectedGid: "2000",
+		},
+		{
+			name:        "policy fsGroup with permissions fsGroup",
+			options:     controller.VolumeOptions{PVC: claim, Parameters: map[string]string{"gid": "auto", "permissions": "fsGroup"}},
+			objs:        []runtime.Object{namespace(nil), policy("psp", mustRunAs, fsGroup)},
+			expectedGid: "3000",
+		},
+		{
+			name:        "policy fsGroup with supplemental groups RunAsAny",
+			options:     controller.VolumeOptions{PVC: claim, Parameters: map[string]string{"gid": "auto"}},
+			objs:        []runtime.Object{namespace(nil), policy("psp", runAsAny, fsGroup)},
+			expectedGid: "3000",
+		},
+		{
+			name:        "no ranges",
+			options:     controller.VolumeOptions{PVC: claim, Parameters: map[string]string{"gid": "auto"}},
+			objs:        []runtime.Object{namespace(nil), policy("psp", runAsAny, v1beta1.FSGroupStrategyOptions{Rule: v1beta1.FSGroupStrategyRunAsAny})},
+			expectError: true,
+		},
+		{
+			name:        "no claim",
+			options:     controller.VolumeOptions{Parameters: map[string]string{"gid": "auto"}},
+			objs:        []runtime.Object{namespace(map[string]string{annSupplementalGroups: "1000000000/10000"})},
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		p := newNFSProvisionerInternal(tmpDir+"/", fake.NewSimpleClientset(test.objs...), &testExporter{}, nil)
+		gid, err := p.getAutoGid(test.options)
+
+		evaluate(t, test.name, test.expectError, err, test.expectedGid, gid, "gid")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		name        string
+		options     controller.VolumeOptions
+		expectError bool
+	}{
+		{
+			name:        "valid",
+			options:     controller.VolumeOptions{Parameters: map[string]string{"gid": "1000", "sec": "krb5"}, Capacity: resource.MustParse("1Ki")},
+			expectError: false,
+		},
+		{
+			name:        "bad gid parameter value",
+			options:     controller.VolumeOptions{Parameters: map[string]string{"gid": "foo"}},
+			expectError: true,
+		},
+		{
+			name:        "bad sec parameter value",
+			options:     controller.VolumeOptions{Parameters: map[string]string{"sec": "foo"}},
+			expectError: true,
+		},
+		{
+			name:        "missing secret",
+			options:     controller.VolumeOptions{Parameters: map[string]string{"secretName": "foo", "secretNamespace": "default"}},
+			expectError: true,
+		},
+		{
+			name:        "bad selector",
+			options:     controller.VolumeOptions{Selector: &unversioned.LabelSelector{MatchLabels: map[string]string{"tier": "gold"}, MatchExpressions: []unversioned.LabelSelectorRequirement{{Key: "tier", Operator: unversioned.LabelSelectorOpIn, Values: []string{"silver"}}}}},
+			expectError: true,
+		},
+		{
+			name:        "missing claim to clone",
+			options:     controller.VolumeOptions{PVC: &v1.PersistentVolumeClaim{ObjectMeta: v1.ObjectMeta{Namespace: "default", Annotations: map[string]string{annCloneFrom: "foo"}}}},
+			expectError: true,
+		},
+	}
+
+	p := newNFSProvisionerInternal(tmpDir+"/", fake.NewSimpleClientset(), &testExporter{}, nil)
+	p.allowAnyClient = true
+
+	for _, test := range tests {
+		test.options.PVName = "pvc-1"
+		err := p.Validate(test.options)
+		_, statErr := os.Stat(tmpDir + "/pvc-1")
+		evaluate(t, test.name, test.expectError, err, true, os.IsNotExist(statErr), "no directory")
+	}
+}
+
+func TestResolveSecretParameters(t *testing.T) {
+	secret := func(namespace, name string, data map[string]string) runtime.Object {
+		s := &v1.Secret{ObjectMeta: v1.ObjectMeta{Namespace: namespace, Name: name}, Data: map[string][]byte{}}
+		for k, v := range data {
+			s.Data[k] = []byte(v)
+		}
+		return s
+	}
+	client := fake.NewSimpleClientset(
+		secret("default", "profile", map[string]string{"clients": "10.0.0.0/8", "Squash": "all"}),
+		secret("other", "profile", map[string]string{"sec": "krb5p"}),
+		secret("default", "bad", map[string]string{"gid": "1001"}),
+	)
+	os.Setenv(namespaceEnv, "default")
+	defer os.Unsetenv(namespaceEnv)
+
+	tests := []struct {
+		name               string
+		parameters         map[string]string
+		expectedParameters map[string]string
+		expectError        bool
+	}{
+		{
+			name:               "no secret",
+			parameters:         map[string]string{"gid": "1001"},
+			expectedParameters: map[string]string{"gid": "1001"},
+		},
+		{
+			name:               "secret in provisioner namespace",
+			parameters:         map[string]string{"gid": "1001", "secretName": "profile"},
+			expectedParameters: map[string]string{"gid": "1001", "clients": "10.0.0.0/8", "squash": "all"},
+		},
+		{
+			name:               "secret in other namespace",
+			parameters:         map[string]string{"secretName": "profile", "secretNamespace": "other"},
+			expectedParameters: map[string]string{"sec": "krb5p"},
+		},
+		{
+			name:        "missing secret",
+			parameters:  map[string]string{"secretName": "missing"},
+			expectError: true,
+		},
+		{
+			name:        "invalid key",
+			parameters:  map[string]string{"secretName": "bad"},
+			expectError: true,
+		},
+		{
+			name:        "parameter in class and secret",
+			parameters:  map[string]string{"Clients": "10.0.0.1", "secretName": "profile"},
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		p := &nfsProvisioner{client: client, namespaceEnv: namespaceEnv}
+		options, err := p.resolveSecretParameters(controller.VolumeOptions{Parameters: test.parameters})
+		evaluate(t, test.name, test.expectError, err, test.expectedParameters, options.Parameters, "parameters")
+	}
+}
+
+func TestGetExportClients(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	claim := func(clients string) *v1.PersistentVolumeClaim {
+		return &v1.PersistentVolumeClaim{ObjectMeta: v1.ObjectMeta{Annotations: map[string]string{annClients: clients}}}
+	}
+	node := func(name, cidr string) *v1.Node {
+		return &v1.Node{ObjectMeta: v1.ObjectMeta{Name: name}, Spec: v1.NodeSpec{PodCIDR: cidr}}
+	}
+
+	tests := []struct {
+		name            string
+		options         controller.VolumeOptions
+		exportClients   []string
+		serviceCIDR     string
+		allowAnyClient  bool
+		kernel          bool
+		nodes           []runtime.Object
+		expectedClients []string
+		expectError     bool
+	}{
+		{
+			name:            "claim annotation",
+			options:         controller.VolumeOptions{PVC: claim("10.0.0.1, 10.0.0.2"), Parameters: map[string]string{"clients": "10.0.0.3"}},
+			exportClients:   []string{"10.0.0.4"},
+			expectedClients: []string{"10.0.0.1", "10.0.0.2"},
+		},
+		{
+			name:        "bad claim annotation",
+			options:     controller.VolumeOptions{PVC: claim("10.0.0.1;")},
+			expectError: true,
+		},
+		{
+			name:            "class parameter",
+			options:         controller.VolumeOptions{PVC: &v1.PersistentVolumeClaim{}, Parameters: map[string]string{"Clients": "10.0.0.3"}},
+			exportClients:   []string{"10.0.0.4"},
+			expectedClients: []string{"10.0.0.3"},
+		},
+		{
+			name:            "export clients",
+			options:         controller.VolumeOptions{Parameters: map[string]string{}},
+			exportClients:   []string{"10.0.0.4"},
+			kernel:          true,
+			expectedClients: []string{"10.0.0.4"},
+		},
+		{
+			name:            "any client allowed",
+			options:         controller.VolumeOptions{Parameters: map[string]string{}},
+			allowAnyClient:  true,
+			nodes:           []runtime.Object{node("node-1", "10.244.0.0/24")},
+			expectedClients: nil,
+		},
+		{
+			name:            "ganesha pod and service CIDRs",
+			options:         controller.VolumeOptions{Parameters: map[string]string{}},
+			serviceCIDR:     "10.96.0.0/12",
+			nodes:           []runtime.Object{node("node-1", "10.244.0.0/24")},
+			expectedClients: []string{"10.244.0.0/24", "10.96.0.0/12"},
+		},
+		{
+			name:            "kernel pod CIDRs",
+			options:         controller.VolumeOptions{Parameters: map[string]string{}},
+			kernel:          true,
+			nodes:           []runtime.Object{node("node-1", "10.244.0.0/24"), node("node-2", ""), node("node-3", "10.244.1.0/24")},
+			expectedClients: []string{"10.244.0.0/24", "10.244.1.0/24"},
+		},
+		{
+			name:        "kernel no pod CIDRs",
+			options:     controller.VolumeOptions{Parameters: map[string]string{}},
+			kernel:      true,
+			nodes:       []runtime.Object{node("node-1", "")},
+			expectError: true,
+		},
+		{
+			name:            "ganesha no pod CIDRs",
+			options:         controller.VolumeOptions{Parameters: map[string]string{}},
+			serviceCIDR:     "10.96.0.0/12",
+			nodes:           []runtime.Object{node("node-1", "")},
+			expectedClients: nil,
+		},
+	}
+	for _, test := range tests {
+		client := fake.NewSimpleClientset(test.nodes...)
+		var exporter exporter = &testExporter{}
+		if test.kernel {
+			exporter = &kernelExporter{}
+		}
+		p := newNFSProvisionerInternal(tmpDir+"/", client, exporter, nil)
+		p.exportClients = test.exportClients
+		p.serviceCIDR = test.serviceCIDR
+		p.allowAnyClient = test.allowAnyClient
+
+		clients, err := p.getExportClients(test.options)
+		evaluate(t, test.name, test.expectError, err, test.expectedClients, clients, "clients")
+	}
+
+	// The nodes are listed once, not on every provision
+	client := fake.NewSimpleClientset(node("node-1", "10.244.0.0/24"))
+	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{}, nil)
+	options := controller.VolumeOptions{Parameters: map[string]string{}}
+	p.getExportClients(options)
+	client.Core().Nodes().Create(node("node-2", "10.244.1.0/24"))
+	clients, err := p.getExportClients(options)
+	evaluate(t, "cached pod CIDRs", false, err, []string{"10.244.0.0/24"}, clients, "clients")
+	p.podCIDRsListed = time.Now().Add(-podCIDRsTTL)
+	clients, err = p.getExportClients(options)
+	evaluate(t, "expired pod CIDRs", false, err, []string{"10.244.0.0/24", "10.244.1.0/24"}, clients, "clients")
+}
+
+func TestReconfigure(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	p := newNFSProvisionerInternal(tmpDir+"/", fake.NewSimpleClientset(), &testExporter{}, nil)
+	p.exportClients = []string{"10.0.0.0/8"}
+	options := controller.VolumeOptions{Parameters: map[string]string{}}
+
+	clients, err := p.getExportClients(options)
+	evaluate(t, "before reconfigure", false, err, []string{"10.0.0.0/8"}, clients, "clients")
+
+	p.Reconfigure(Settings{ExportClients: []string{"192.168.1.0/24", "10.1.0.0/16"}})
+	clients, err = p.getExportClients(options)
+	evaluate(t, "after reconfigure", false, err, []string{"192.168.1.0/24", "10.1.0.0/16"}, clients, "clients")
+
+	p.Reconfigure(Settings{AllowAnyClient: true})
+	clients, err = p.getExportClients(options)
+	evaluate(t, "reconfigure allow any client", false, err, []string(nil), clients, "clients")
+}
+
+func TestSelectorToLabels(t *testing.T) {
+	tests := []struct {
+		name           string
+		selector       *unversioned.LabelSelector
+		expectedLabels map[string]string
+		expectError    bool
+	}{
+		{
+			name:           "nil selector",
+			selector:       nil,
+			expectedLabels: map[string]string{},
+		},
+		{
+			name: "match labels and expressions",
+			selector: &unversioned.LabelSelector{
+				MatchLabels: map[string]string{"tier": "gold"},
+				MatchExpressions: []unversioned.LabelSelectorRequirement{
+					{Key: "zone", Operator: unversioned.LabelSelectorOpIn, Values: []string{"a", "b"}},
+					{Key: "tier", Operator: unversioned.LabelSelectorOpIn, Values: []string{"silver", "gold"}},
+					{Key: "ssd", Operator: unversioned.LabelSelectorOpExists},
+					{Key: "zone", Operator: unversioned.LabelSelectorOpNotIn, Values: []string{"c"}},
+					{Key: "deprecated", Operator: unversioned.LabelSelectorOpDoesNotExist},
+				},
+			},
+			expectedLabels: map[string]string{"tier": "gold", "zone": "a", "ssd": ""},
+		},
+		{
+			name: "conflicting In",
+			selector: &unversioned.LabelSelector{
+				MatchLabels: map[string]string{"tier": "gold"},
+				MatchExpressions: []unversioned.LabelSelectorRequirement{
+					{Key: "tier", Operator: unversioned.LabelSelectorOpIn, Values: []string{"silver"}},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "overlapping In",
+			selector: &unversioned.LabelSelector{
+				MatchExpressions: []unversioned.LabelSelectorRequirement{
+					{Key: "zone", Operator: unversioned.LabelSelectorOpIn, Values: []string{"a", "b"}},
+					{Key: "zone", Operator: unversioned.LabelSelectorOpIn, Values: []string{"b", "c"}},
+				},
+			},
+			expectedLabels: map[string]string{"zone": "b"},
+		},
+		{
+			name: "disjoint In",
+			selector: &unversioned.LabelSelector{
+				MatchExpressions: []unversioned.LabelSelectorRequirement{
+					{Key: "zone", Operator: unversioned.LabelSelectorOpIn, Values: []string{"a", "b"}},
+					{Key: "zone", Operator: unversioned.LabelSelectorOpIn, Values: []string{"c"}},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "In and NotIn",
+			selector: &unversioned.LabelSelector{
+				MatchExpressions: []unversioned.LabelSelectorRequirement{
+					{Key: "zone", Operator: unversioned.LabelSelectorOpIn, Values: []string{"a", "b"}},
+					{Key: "zone", Operator: unversioned.LabelSelectorOpNotIn, Values: []string{"a"}},
+				},
+			},
+			expectedLabels: map[string]string{"zone": "b"},
+		},
+		{
+			name: "Exists and In",
+			selector: &unversioned.LabelSelector{
+				MatchExpressions: []unversioned.LabelSelectorRequirement{
+					{Key: "zone", Operator: unversioned.LabelSelectorOpExists},
+					{Key: "zone", Operator: unversioned.LabelSelectorOpIn, Values: []string{"a"}},
+				},
+			},
+			expectedLabels: map[string]string{"zone": "a"},
+		},
+		{
+			name: "conflicting NotIn",
+			selector: &unversioned.LabelSelector{
+				MatchLabels: map[string]string{"tier": "gold"},
+				MatchExpressions: []unversioned.LabelSelectorRequirement{
+					{Key: "tier", Operator: unversioned.LabelSelectorOpNotIn, Values: []string{"gold"}},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "conflicting DoesNotExist",
+			selector: &unversioned.LabelSelector{
+				MatchExpressions: []unversioned.LabelSelectorRequirement{
+					{Key: "ssd", Operator: unversioned.LabelSelectorOpExists},
+					{Key: "ssd", Operator: unversioned.LabelSelectorOpDoesNotExist},
+				},
+			},
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		labels, err := selectorToLabels(test.selector)
+		if test.expectError {
+			evaluate(t, test.name, true, err, nil, nil, "labels")
+			continue
+		}
+		evaluate(t, test.name, false, err, test.expectedLabels, labels, "labels")
+	}
+}
+
 func TestCreateDirectory(t *testing.T) {
 	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
 	defer os.RemoveAll(tmpDir)
@@ -266,6 +797,7 @@ func TestCreateDirectory(t *testing.T) {
 		name         string
 		directory    string
 		gid          string
+		mode         string
 		expectedGid  uint32
 		expectedPerm os.FileMode
 		expectError  bool
@@ -286,6 +818,15 @@ func TestCreateDirectory(t *testing.T) {
 		// 	expectedPerm: os.FileMode(0071),
 		// 	expectError:  false,
 		// },
+		{
+			name:         "mode",
+			directory:    "qux",
+			gid:          "none",
+			mode:         "0750",
+			expectedGid:  defaultGid,
+			expectedPerm: os.FileMode(0750),
+			expectError:  false,
+		},
 		{
 			name:         "path already exists",
 			directory:    "foo",
@@ -305,13 +846,13 @@ func TestCreateDirectory(t *testing.T) {
 	}
 
 	client := fake.NewSimpleClientset()
-	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{})
+	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{}, nil)
 
 	for _, test := range tests {
 		path := p.exportDir + test.directory
 		defer os.RemoveAll(path)
 
-		err := p.createDirectory(test.directory, test.gid)
+		err := p.createDirectory(test.directory, directoryParams{gid: test.gid, owner: "0", mode: test.mode})
 
 		var gid uint32
 		var perm os.FileMode
@@ -331,20 +872,56 @@ func TestCreateDirectory(t *testing.T) {
 	}
 }
 
+func TestDirectoryPool(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	p := newNFSProvisionerInternal(tmpDir+"/", fake.NewSimpleClientset(), &testExporter{}, nil)
+	params := directoryParams{gid: "1000", fsGroup: true, owner: "0"}
+	pool := &directoryPool{dir: tmpDir + "/" + poolDir, size: 2, setUp: p.setUpDirectory, ready: map[string][]string{}, refilling: map[string]bool{}}
+	os.Mkdir(pool.dir, 0700)
+
+	pool.refill(params)
+	infos, _ := ioutil.ReadDir(pool.dir)
+	evaluate(t, "refilled pool", false, nil, 2, len(infos), "pooled directories")
+
+	p.pool = pool
+	err := p.createDirectory("pvc-1", params)
+	fi, statErr := os.Stat(tmpDir + "/pvc-1")
+	if statErr != nil {
+		t.Fatalf("Error stating taken directory: %v", statErr)
+	}
+	evaluate(t, "taken directory", false, err, os.FileMode(0770)|os.ModeSetgid|os.ModeDir, fi.Mode(), "mode")
+
+	// A restarted provisioner takes the directories left in the pool
+	pool, err = newDirectoryPool(tmpDir+"/"+poolDir, 2, p.setUpDirectory)
+	if err != nil {
+		t.Fatalf("Error creating pool: %v", err)
+	}
+	key := poolKey(params)
+	pool.mutex.Lock()
+	ready := len(pool.ready[key])
+	pool.mutex.Unlock()
+	if ready < 1 {
+		t.Errorf("expected the directory left in the pool to be ready but got %d", ready)
+	}
+	evaluate(t, "take other parameters", false, nil, false, pool.take(directoryParams{gid: "none", owner: "0", mode: "0700"}, tmpDir+"/pvc-2"), "taken")
+	parsed, ok := parsePoolKey(key)
+	evaluate(t, "parse pool key", false, nil, true, ok && reflect.DeepEqual(parsed, params), "parsed")
+}
+
 func TestAddToRemoveFromFile(t *testing.T) {
 	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
 	defer os.RemoveAll(tmpDir)
 
-	client := fake.NewSimpleClientset()
 	conf := tmpDir + "/test"
 	_, err := os.Create(conf)
 	if err != nil {
 		t.Errorf("Error creating file %s: %v", conf, err)
 	}
-	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{})
 
 	toAdd := "abc\nxyz\n"
-	p.addToFile(conf, toAdd)
+	addToFile(conf, toAdd)
 
 	read, _ := ioutil.ReadFile(conf)
 	if toAdd != string(read) {
@@ -353,23 +930,452 @@ func TestAddToRemoveFromFile(t *testing.T) {
 
 	toRemove := toAdd
 
-	p.removeFromFile(conf, toRemove)
+	removeFromFile(conf, toRemove)
 	read, _ = ioutil.ReadFile(conf)
 	if "" != string(read) {
 		t.Errorf("Expected %s but got %s", "", string(read))
 	}
 }
 
-func TestGetConfigExportIds(t *testing.T) {
+func TestGaneshaAddToRemoveFromConfig(t *testing.T) {
 	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
 	defer os.RemoveAll(tmpDir)
 
-	tests := []struct {
-		name              string
-		useGanesha        bool
-		configContents    string
-		re                *regexp.Regexp
-		expectedExportIds map[uint16]bool
+	conf := tmpDir + "/vfs.conf"
+	err := ioutil.WriteFile(conf, []byte("NFS_Core_Param\n{\n\tMNT_Port = 20048;\n}\n"), 0600)
+	if err != nil {
+		t.Errorf("Error writing file %s: %v", conf, err)
+	}
+	e := &ganeshaExporter{ganeshaConfig: conf}
+
+	block := createBlock(t, e, "1", "/export/foo", exportParams{})
+	evaluate(t, "add export", false, e.AddToConfig(block), nil, nil, "")
+	evaluate(t, "add duplicate export", true, e.AddToConfig(createBlock(t, e, "1", "/export/bar", exportParams{})), nil, nil, "")
+	exportIds, err := e.GetConfigExportIds()
+	evaluate(t, "get export ids", false, err, map[uint16]bool{1: true}, exportIds, "export ids")
+
+	// A block formatted differently from the one in the config should still be
+	// removed, since removal is by Export_Id
+	reformatted := "EXPORT { Export_Id = 1; Path = /export/foo; }"
+	evaluate(t, "remove export", false, e.RemoveFromConfig(reformatted), nil, nil, "")
+	exportIds, err = e.GetConfigExportIds()
+	evaluate(t, "get export ids after remove", false, err, map[uint16]bool{}, exportIds, "export ids")
+
+	evaluate(t, "add malformed export", true, e.AddToConfig("EXPORT { Export_Id = 2; Path = /export/foo"), nil, nil, "")
+	evaluate(t, "add invalid export", true, e.AddToConfig("EXPORT { Export_Id = 2; Path = /export/foo; }"), nil, nil, "")
+}
+
+func TestGaneshaIndex(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	conf := tmpDir + "/vfs.conf"
+	err := ioutil.WriteFile(conf, []byte(""), 0600)
+	if err != nil {
+		t.Errorf("Error writing file %s: %v", conf, err)
+	}
+	e := &ganeshaExporter{ganeshaConfig: conf}
+
+	evaluate(t, "index add export", false, e.AddToConfig(createBlock(t, e, "1", "/export/foo", exportParams{})), nil, nil, "")
+	err = e.AddToConfig(createBlock(t, e, "2", "/export/foo", exportParams{}))
+	evaluate(t, "index add same pseudo", true, err, nil, nil, "")
+
+	// Another writer of the config file must be noticed
+	read, _ := ioutil.ReadFile(conf)
+	other := createBlock(t, &ganeshaExporter{}, "3", "/export/other/bar", exportParams{})
+	err = ioutil.WriteFile(conf, append(read, other...), 0600)
+	if err != nil {
+		t.Errorf("Error writing file %s: %v", conf, err)
+	}
+	exportIds, err := e.GetConfigExportIds()
+	evaluate(t, "index after other writer", false, err, map[uint16]bool{1: true, 3: true}, exportIds, "export ids")
+
+	evaluate(t, "index remove export", false, e.RemoveFromConfig(createBlock(t, e, "1", "/export/foo", exportParams{})), nil, nil, "")
+	evaluate(t, "index add removed pseudo", false, e.AddToConfig(createBlock(t, e, "2", "/export/foo", exportParams{})), nil, nil, "")
+	exports, err := e.GetConfigExports()
+	paths := []string{}
+	for _, export := range exports {
+		paths = append(paths, export.path)
+	}
+	evaluate(t, "index exports", false, err, []string{"/export/other/bar", "/export/foo"}, paths, "paths")
+
+	// The file must be what the index says
+	read, _ = ioutil.ReadFile(conf)
+	reread, _ := ganesha.Parse(read)
+	evaluate(t, "index file", false, nil, 2, len(reread.Exports()), "exports in file")
+}
+
+func TestGaneshaUpdateConfig(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	conf := tmpDir + "/vfs.conf"
+	err := ioutil.WriteFile(conf, []byte(""), 0600)
+	if err != nil {
+		t.Errorf("Error writing file %s: %v", conf, err)
+	}
+	e := &ganeshaExporter{ganeshaConfig: conf}
+
+	block := createBlock(t, e, "1", "/export/foo", exportParams{})
+	evaluate(t, "add export", false, e.AddToConfig(block), nil, nil, "")
+	evaluate(t, "add other export", false, e.AddToConfig(createBlock(t, e, "2", "/export/bar", exportParams{})), nil, nil, "")
+
+	newBlock, err := e.UpdateBlock(block, "RO", []string{"10.0.0.1", "10.0.0.2"})
+	evaluate(t, "update block", false, err, nil, nil, "")
+	err = e.UpdateConfig(newBlock)
+	evaluate(t, "update config", false, err, nil, nil, "")
+
+	config, err := ganesha.ReadFile(conf)
+	if err != nil {
+		t.Fatalf("Error reading file %s: %v", conf, err)
+	}
+	export := config.Export(1)
+	accessType, _ := export.Get("Access_Type")
+	evaluate(t, "export access type", false, nil, "None", accessType, "access type")
+	clients := export.Blocks("CLIENT")
+	evaluate(t, "client blocks", false, nil, 1, len(clients), "number of CLIENT blocks")
+	clientList, _ := clients[0].Get("Clients")
+	evaluate(t, "clients", false, nil, "10.0.0.1, 10.0.0.2", clientList, "clients")
+	accessType, _ = clients[0].Get("Access_Type")
+	evaluate(t, "client access type", false, nil, "RO", accessType, "access type")
+	evaluate(t, "other export untouched", false, nil, "\n"+config.Export(2).String(), createBlock(t, e, "2", "/export/bar", exportParams{}), "block")
+
+	// Removing the clients should revert to the original block
+	reverted, err := e.UpdateBlock(newBlock, "RW", []string{})
+	evaluate(t, "revert block", false, err, block, reverted, "block")
+
+	evaluate(t, "update missing export", true, e.UpdateConfig(createBlock(t, e, "3", "/export/baz", exportParams{})), nil, nil, "")
+}
+
+func TestParseFSAL(t *testing.T) {
+	tests := []struct {
+		name          string
+		fsal          string
+		expectedBlock string
+		expectError   bool
+	}{
+		{
+			name:          "name only",
+			fsal:          "CEPH",
+			expectedBlock: "FSAL\n{\n\tName = CEPH;\n}\n",
+		},
+		{
+			name:          "parameters",
+			fsal:          "GLUSTER, Hostname=gluster.example.com,Volume=vol0",
+			expectedBlock: "FSAL\n{\n\tName = GLUSTER;\n\tHostname = gluster.example.com;\n\tVolume = vol0;\n}\n",
+		},
+		{
+			name:        "no name",
+			fsal:        ",Volume=vol0",
+			expectError: true,
+		},
+		{
+			name:        "no value",
+			fsal:        "GLUSTER,Volume",
+			expectError: true,
+		},
+		{
+			name:        "name parameter",
+			fsal:        "GLUSTER,Name=CEPH",
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		fsal, err := ParseFSAL(test.fsal)
+		if test.expectError {
+			evaluate(t, test.name, true, err, nil, nil, "FSAL")
+			continue
+		}
+		var block string
+		if err == nil {
+			block = fsal.String()
+		}
+		evaluate(t, test.name, false, err, test.expectedBlock, block, "FSAL")
+	}
+}
+
+func TestGaneshaCreateBlockParams(t *testing.T) {
+	tests := []struct {
+		name     string
+		params   exportParams
+		expected map[string]string
+	}{
+		{
+			name:     "defaults",
+			params:   exportParams{},
+			expected: map[string]string{"SecType": "sys", "Squash": "root_id_squash", "Anonymous_uid": "", "Anonymous_gid": ""},
+		},
+		{
+			name:     "sec",
+			params:   exportParams{sec: []string{"krb5p", "krb5i"}},
+			expected: map[string]string{"SecType": "krb5p, krb5i", "Squash": "root_id_squash"},
+		},
+		{
+			name:     "all squash",
+			params:   exportParams{allSquash: true, anonUid: "1000", anonGid: "2000"},
+			expected: map[string]string{"SecType": "sys", "Squash": "all_squash", "Anonymous_uid": "1000", "Anonymous_gid": "2000"},
+		},
+	}
+	e := &ganeshaExporter{}
+	for _, test := range tests {
+		block := createBlock(t, e, "1", "/export/pvc-1", test.params)
+		exports, err := parseExportBlock(block)
+		if err != nil {
+			t.Fatalf("unexpected error parsing block %s: %v", block, err)
+		}
+		for k, expected := range test.expected {
+			v, _ := exports[0].Get(k)
+			evaluate(t, test.name, false, nil, expected, v, k)
+		}
+	}
+}
+
+func TestGaneshaCreateBlockFSAL(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	conf := tmpDir + "/vfs.conf"
+	err := ioutil.WriteFile(conf, []byte(""), 0600)
+	if err != nil {
+		t.Errorf("Error writing file %s: %v", conf, err)
+	}
+	fsal, _ := ParseFSAL("GLUSTER,Hostname=gluster.example.com,Volume=vol0")
+	e := &ganeshaExporter{ganeshaConfig: conf, fsal: fsal, exportDir: "/export/", fsalRoot: "/"}
+
+	block := createBlock(t, e, "1", "/export/pvc-1", exportParams{})
+	exports, err := parseExportBlock(block)
+	if err != nil {
+		t.Fatalf("unexpected error parsing block %s: %v", block, err)
+	}
+	path, _ := exports[0].Get("Path")
+	pseudo, _ := exports[0].Get("Pseudo")
+	evaluate(t, "path in FSAL", false, nil, "/pvc-1", path, "Path")
+	evaluate(t, "pseudo", false, nil, "/export/pvc-1", pseudo, "Pseudo")
+	evaluate(t, "FSAL", false, nil, fsal.String(), exports[0].Blocks("FSAL")[0].String(), "FSAL")
+
+	// The export should be found by its directory's path
+	evaluate(t, "add export", false, e.AddToConfig(block), nil, nil, "")
+	configExports, err := e.GetConfigExports()
+	evaluate(t, "config exports", false, err, []configExport{{block: block, path: "/export/pvc-1", exportId: 1}}, configExports, "config exports")
+}
+
+func TestGaneshaCreateBlockUnparseableTemplate(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	// A template ParseExportTemplate would refuse, e.g. one that only produces
+	// a valid block for the exportId it is checked with
+	tmpl := template.Must(template.New("export").Parse("EXPORT { Export_Id = {{.ExportId}}; Path = {{.Path}};"))
+	e := &ganeshaExporter{ganeshaConfig: tmpDir + "/vfs.conf", exportTemplate: tmpl}
+	for name, params := range map[string]exportParams{
+		"sec":     {sec: []string{"krb5p"}},
+		"squash":  {allSquash: true, anonUid: "1000"},
+		"clients": {clients: []string{"10.0.0.0/8"}},
+	} {
+		block, err := e.CreateBlock("2", "/export/pvc-2", params)
+		evaluate(t, name, true, err, "", block, "block")
+	}
+
+	conf := tmpDir + "/vfs.conf"
+	if err := ioutil.WriteFile(conf, []byte(""), 0600); err != nil {
+		t.Fatalf("Error writing file %s: %v", conf, err)
+	}
+	p := newNFSProvisionerInternal(tmpDir+"/", fake.NewSimpleClientset(), e, nil)
+	p.serverHostname = "localhost"
+	options := controller.VolumeOptions{
+		Capacity:                      resource.MustParse("1Ki"),
+		AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+		PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+		PVName:     "pvc-1",
+		Parameters: map[string]string{"clients": "10.0.0.0/8"},
+	}
+	pv, err := p.Provision(options)
+	evaluate(t, "provision refused", true, err, (*v1.PersistentVolume)(nil), pv, "PV")
+	if err != nil && !strings.Contains(err.Error(), "error creating export block") {
+		t.Errorf("expected provisioning to fail creating the export block but got: %v", err)
+	}
+	config, _ := ioutil.ReadFile(conf)
+	evaluate(t, "nothing exported", false, nil, "", string(config), "config")
+	evaluate(t, "export id freed", false, nil, map[uint16]bool{}, p.exportIds, "export ids")
+	_, partial, err := p.journal.get("pvc-1")
+	evaluate(t, "journal cleared", false, err, false, partial, "partial")
+	if _, err := os.Stat(tmpDir + "/pvc-1"); !os.IsNotExist(err) {
+		t.Errorf("expected directory to be deleted but stat got: %v", err)
+	}
+}
+
+func TestGetExportOptions(t *testing.T) {
+	tests := []struct {
+		name               string
+		annotations        map[string]string
+		expectedAccessType string
+		expectedClients    []string
+		expectError        bool
+	}{
+		{
+			name:               "defaults",
+			annotations:        map[string]string{},
+			expectedAccessType: "RW",
+			expectedClients:    []string{},
+		},
+		{
+			name:               "read only for some clients",
+			annotations:        map[string]string{annAccessType: "ro", annClients: "10.0.0.1, example.com,"},
+			expectedAccessType: "RO",
+			expectedClients:    []string{"10.0.0.1", "example.com"},
+		},
+		{
+			name:        "invalid access type",
+			annotations: map[string]string{annAccessType: "MDONLY"},
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		volume := newProvisionedVolume("pv-1", "/export/pv-1", "1", "")
+		for k, v := range test.annotations {
+			volume.Annotations[k] = v
+		}
+		accessType, clients, err := getExportOptions(volume)
+		if test.expectError {
+			evaluate(t, test.name, true, err, nil, nil, "access type")
+			continue
+		}
+		evaluate(t, test.name, false, err, test.expectedAccessType, accessType, "access type")
+		evaluate(t, test.name, false, err, test.expectedClients, clients, "clients")
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	conf := tmpDir + "/test"
+	if err := writeFileAtomic(conf, []byte("foo"), 0640); err != nil {
+		t.Fatalf("unexpected error writing %s: %v", conf, err)
+	}
+	os.Chmod(conf, 0600)
+	if err := writeFileAtomic(conf, []byte("bar"), 0640); err != nil {
+		t.Fatalf("unexpected error writing %s: %v", conf, err)
+	}
+
+	read, _ := ioutil.ReadFile(conf)
+	evaluate(t, "contents replaced", false, nil, "bar", string(read), "contents")
+	fi, _ := os.Stat(conf)
+	evaluate(t, "permission bits kept", false, nil, os.FileMode(0600), fi.Mode().Perm(), "permission bits")
+	files, _ := ioutil.ReadDir(tmpDir)
+	evaluate(t, "no temporary files left", false, nil, 1, len(files), "number of files")
+}
+
+func TestLockFile(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	conf := tmpDir + "/test"
+	unlock, err := lockFile(conf)
+	if err != nil {
+		t.Fatalf("unexpected error locking %s: %v", conf, err)
+	}
+
+	// Another open file description, as another process would have, must not be
+	// able to take the lock while it's held
+	file, err := os.Open(conf + lockFileSuffix)
+	if err != nil {
+		t.Fatalf("unexpected error opening lock file: %v", err)
+	}
+	defer file.Close()
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == nil {
+		t.Errorf("expected lock to be held but it could be taken")
+	}
+
+	unlock()
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Errorf("expected lock to be released but it couldn't be taken: %v", err)
+	}
+}
+
+func TestKeyMutex(t *testing.T) {
+	m := newKeyMutex()
+	m.Lock("pv-1")
+
+	// A different key must not block
+	done := make(chan struct{})
+	go func() {
+		m.Lock("pv-2")
+		m.Unlock("pv-2")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("locking a different key blocked")
+	}
+
+	// The same key must block until unlocked
+	locked := make(chan struct{})
+	unlocked := make(chan struct{})
+	go func() {
+		m.Lock("pv-1")
+		close(locked)
+		m.Unlock("pv-1")
+		close(unlocked)
+	}()
+	select {
+	case <-locked:
+		t.Errorf("locking the same key didn't block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	m.Unlock("pv-1")
+	<-unlocked
+
+	if len(m.locks) != 0 {
+		t.Errorf("expected unused locks to be forgotten but %d remain", len(m.locks))
+	}
+}
+
+func TestExportBatcher(t *testing.T) {
+	b := newExportBatcher(50 * time.Millisecond)
+	refreshed := []map[string]bool{}
+	b.refresh = func(paths map[string]bool) (map[string]error, error) {
+		refreshed = append(refreshed, paths)
+		return map[string]error{"/export/pvc-2": errors.New("fake error")}, nil
+	}
+
+	// Requests within the window are coalesced into one refresh
+	paths := map[string]bool{"/export/pvc-1": true, "/export/pvc-2": true, "/export/pvc-3": false}
+	var mutex sync.Mutex
+	failed := map[string]bool{}
+	var wg sync.WaitGroup
+	for path, active := range paths {
+		wg.Add(1)
+		go func(path string, active bool) {
+			defer wg.Done()
+			err := b.sync(path, active)
+			mutex.Lock()
+			defer mutex.Unlock()
+			failed[path] = err != nil
+		}(path, active)
+	}
+	wg.Wait()
+
+	evaluate(t, "batch refreshes", false, nil, []map[string]bool{paths}, refreshed, "refreshes")
+	expected := map[string]bool{"/export/pvc-1": false, "/export/pvc-2": true, "/export/pvc-3": false}
+	evaluate(t, "batch errors", false, nil, expected, failed, "failed paths")
+
+	// A later request gets its own refresh
+	b.sync("/export/pvc-4", true)
+	evaluate(t, "batch after refresh", false, nil, 2, len(refreshed), "refreshes")
+}
+
+func TestGetConfigExportIds(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		name              string
+		useGanesha        bool
+		configContents    string
+		re                *regexp.Regexp
+		expectedExportIds map[uint16]bool
 		expectError       bool
 	}{
 		{
@@ -395,62 +1401,2065 @@ func TestGetConfigExportIds(t *testing.T) {
 			expectError:       false,
 		},
 		{
-			name: "bad regex",
-			configContents: "\nEXPORT\n{\n" +
-				"\tExport_Id = 1;\n" +
-				"\tFilesystem_id = 1.1;\n" +
-				"\tFSAL {\n\t\tName = VFS;\n\t}\n}\n",
-			re:                regexp.MustCompile("Export_Id = [0-9]+;"),
-			expectedExportIds: map[uint16]bool{},
-			expectError:       true,
+			name: "bad regex",
+			configContents: "\nEXPORT\n{\n" +
+				"\tExport_Id = 1;\n" +
+				"\tFilesystem_id = 1.1;\n" +
+				"\tFSAL {\n\t\tName = VFS;\n\t}\n}\n",
+			re:                regexp.MustCompile("Export_Id = [0-9]+;"),
+			expectedExportIds: map[uint16]bool{},
+			expectError:       true,
+		},
+	}
+	for i, test := range tests {
+		conf := tmpDir + "/test" + "-" + strconv.Itoa(i)
+		err := ioutil.WriteFile(conf, []byte(test.configContents), 0755)
+		if err != nil {
+			t.Errorf("Error writing file %s: %v", conf, err)
+		}
+
+		exportIds, err := getConfigExportIds(conf, test.re)
+
+		evaluate(t, test.name, test.expectError, err, test.expectedExportIds, exportIds, "export ids")
+	}
+}
+
+func TestExportIdsPersisted(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	client := fake.NewSimpleClientset()
+	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{}, nil)
+
+	for i := 0; i < 3; i++ {
+		if _, err := p.generateExportId(); err != nil {
+			t.Errorf("unexpected error generating export id: %v", err)
+		}
+	}
+	p.deleteExportId(2)
+
+	// A new provisioner, as after a restart, should recover the ids even though
+	// the exporter's config doesn't contain any
+	p = newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{}, nil)
+	expectedExportIds := map[uint16]bool{1: true, 3: true}
+	if !reflect.DeepEqual(expectedExportIds, p.exportIds) {
+		t.Errorf("expected export ids %v but got %v", expectedExportIds, p.exportIds)
+	}
+
+	exportId, err := p.generateExportId()
+	evaluate(t, "reuse freed export id", false, err, uint16(2), exportId, "export id")
+}
+
+func TestStateStore(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	// The exportIds of a legacy exportIds file are read if there's no state file
+	ioutil.WriteFile(tmpDir+"/"+legacyExportIdsFile, []byte("[1,3]"), 0600)
+	s := newStateStore(tmpDir + "/")
+	exportIds, err := s.loadExportIds()
+	evaluate(t, "legacy export ids", false, err, map[uint16]bool{1: true, 3: true}, exportIds, "export ids")
+
+	export := &NFSExport{PV: "pvc-1", Path: tmpDir + "/pvc-1", ExportId: 1, Gid: 1000, Block: "block"}
+	err = s.Create(export)
+	evaluate(t, "create record", false, err, nil, nil, "")
+	err = s.Create(export)
+	evaluate(t, "create existing record", true, err, nil, nil, "")
+
+	// A new store, as after the pod is replaced, should recover everything
+	s = newStateStore(tmpDir + "/")
+	got, err := s.Get("pvc-1")
+	evaluate(t, "get record", false, err, export, got, "record")
+	exportIds, err = s.loadExportIds()
+	evaluate(t, "migrated export ids", false, err, map[uint16]bool{1: true, 3: true}, exportIds, "export ids")
+
+	updated := &NFSExport{PV: "pvc-1", Path: tmpDir + "/pvc-1", ExportId: 1, Gid: 1000, Block: "updated"}
+	err = s.Update(updated)
+	got, _ = s.Get("pvc-1")
+	evaluate(t, "update record", false, err, updated, got, "record")
+	err = s.Update(&NFSExport{PV: "pvc-2"})
+	evaluate(t, "update missing record", true, err, nil, nil, "")
+
+	err = s.Delete("pvc-1")
+	list, _ := s.List()
+	evaluate(t, "delete record", false, err, []*NFSExport{}, list, "records")
+
+	ioutil.WriteFile(tmpDir+"/"+stateFile, []byte(`{"version":2}`), 0600)
+	exportIds, err = s.loadExportIds()
+	evaluate(t, "newer version", true, err, map[uint16]bool{}, exportIds, "export ids")
+}
+
+func TestStateStoreRecordsGid(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	conf := tmpDir + "/test"
+	if _, err := os.Create(conf); err != nil {
+		t.Errorf("Error creating file %s: %v", conf, err)
+	}
+	p := newNFSProvisionerInternal(tmpDir+"/", fake.NewSimpleClientset(), &testExporter{config: conf}, nil)
+	p.allowAnyClient = true
+	p.serverHostname = "localhost"
+
+	options := controller.VolumeOptions{
+		Capacity:                      resource.MustParse("1Ki"),
+		AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+		PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+		PVName:     "pvc-1",
+		Parameters: map[string]string{"gid": "1001"},
+	}
+	if _, err := p.Provision(options); err != nil {
+		t.Fatalf("unexpected error provisioning: %v", err)
+	}
+
+	// The gid should survive the pod being replaced
+	expected := &NFSExport{PV: "pvc-1", Path: tmpDir + "/pvc-1", ExportId: 1, Gid: 1001, Block: "\nExport_Id = 1;\nPath = " + tmpDir + "/pvc-1;\n"}
+	export, err := newStateStore(tmpDir + "/").Get("pvc-1")
+	evaluate(t, "recorded gid", false, err, expected, export, "record")
+}
+
+func TestReserveCapacity(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	p := newNFSProvisionerInternal(tmpDir+"/", fake.NewSimpleClientset(), &testExporter{}, nil)
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(tmpDir, &stat); err != nil {
+		t.Fatalf("Error calling statfs on %s: %v", tmpDir, err)
+	}
+	size := int64(stat.Blocks) * stat.Bsize
+
+	// Two claims of more than half the filesystem can't both fit
+	errs := make(chan error, 2)
+	for _, pv := range []string{"pvc-1", "pvc-2"} {
+		go func(pv string) {
+			_, err := p.reserveCapacity(pv, "", p.exportDirs, size/2+1)
+			errs <- err
+		}(pv)
+	}
+	failed := 0
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			failed++
+		}
+	}
+	evaluate(t, "concurrent reservations", false, nil, 1, failed, "failed reservations")
+
+	p.releaseCapacity("pvc-1")
+	p.releaseCapacity("pvc-2")
+	_, err := p.reserveCapacity("pvc-3", "", p.exportDirs, size/2+1)
+	evaluate(t, "reservation after release", false, err, map[string]int64{"pvc-3": size/2 + 1}, p.reservations, "reservations")
+	_, err = p.reserveCapacity("pvc-3", "", p.exportDirs, size/2+1)
+	evaluate(t, "reservation of same volume", false, err, map[string]int64{"pvc-3": size/2 + 1}, p.reservations, "reservations")
+}
+
+func TestPlaceVolume(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	dir1, dir2 := tmpDir+"/export1/", tmpDir+"/export2/"
+	for _, dir := range []string{dir1, dir2} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("Error creating %s: %v", dir, err)
+		}
+	}
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(tmpDir, &stat); err != nil {
+		t.Fatalf("Error calling statfs on %s: %v", tmpDir, err)
+	}
+	size := int64(stat.Blocks) * stat.Bsize
+
+	newProvisioner := func(policy string) *nfsProvisioner {
+		p := newNFSProvisionerInternal(dir1, fake.NewSimpleClientset(), &testExporter{}, nil)
+		p.exportDirs = []string{dir1, dir2}
+		p.placementPolicy = policy
+		return p
+	}
+	class := func(parameters map[string]string) controller.VolumeOptions {
+		return controller.VolumeOptions{Parameters: parameters}
+	}
+
+	p := newProvisioner(PlacementRoundRobin)
+	placed := []string{}
+	for _, pv := range []string{"pvc-1", "pvc-2", "pvc-3"} {
+		dir, err := p.reserveCapacity(pv, "", p.exportDirs, 1)
+		if err != nil {
+			t.Fatalf("Error reserving capacity for %s: %v", pv, err)
+		}
+		placed = append(placed, dir)
+	}
+	evaluate(t, "round-robin", false, nil, []string{dir1, dir2, dir1}, placed, "export dirs")
+	evaluate(t, "round-robin placed path", false, nil, dir2+"pvc-2", p.placedPath("pvc-2"), "path")
+	p.releaseCapacity("pvc-2")
+	evaluate(t, "released placed path", false, nil, dir1+"pvc-2", p.placedPath("pvc-2"), "path")
+
+	p = newProvisioner(PlacementMostFreeSpace)
+	_, err := p.reserveCapacity("pvc-1", "", []string{dir1}, size*3/4)
+	evaluate(t, "reserve most of first", false, err, nil, nil, "")
+	dir, err := p.reserveCapacity("pvc-2", "", p.exportDirs, 1)
+	evaluate(t, "most-free-space", false, err, dir2, dir, "export dir")
+	dir, err = p.reserveCapacity("pvc-3", "", p.exportDirs, size/2)
+	evaluate(t, "most-free-space only one fits", false, err, dir2, dir, "export dir")
+	_, err = p.reserveCapacity("pvc-4", "", p.exportDirs, size/2)
+	evaluate(t, "most-free-space none fits", true, err, nil, nil, "")
+
+	p = newProvisioner(PlacementClassPinned)
+	dirs, err := p.getExportDirs(class(map[string]string{}))
+	evaluate(t, "class-pinned default", false, err, []string{dir1}, dirs, "export dirs")
+	dirs, err = p.getExportDirs(class(map[string]string{"exportDir": strings.TrimSuffix(dir2, "/")}))
+	evaluate(t, "class-pinned parameter", false, err, []string{dir2}, dirs, "export dirs")
+	_, err = p.getExportDirs(class(map[string]string{"exportDir": tmpDir + "/export3"}))
+	evaluate(t, "class-pinned invalid parameter", true, err, nil, nil, "")
+
+	p = newProvisioner(PlacementMostFreeSpace)
+	dirs, err = p.getExportDirs(class(map[string]string{}))
+	evaluate(t, "most-free-space default", false, err, []string{dir1, dir2}, dirs, "export dirs")
+}
+
+func TestNamespaceDirs(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	os.Setenv(podIPEnv, "1.1.1.1")
+	defer os.Unsetenv(podIPEnv)
+
+	conf := tmpDir + "/test"
+	if _, err := os.Create(conf); err != nil {
+		t.Errorf("Error creating file %s: %v", conf, err)
+	}
+	p := newNFSProvisionerInternal(tmpDir+"/", fake.NewSimpleClientset(), &testExporter{config: conf}, nil)
+	p.namespaceDirs = true
+
+	options := controller.VolumeOptions{
+		Capacity:   resource.MustParse("1Ki"),
+		PVName:     "pvc-1",
+		PVC:        &v1.PersistentVolumeClaim{ObjectMeta: v1.ObjectMeta{Name: "claim", Namespace: "team-a"}},
+		Parameters: map[string]string{},
+	}
+	_, path, _, _, _, err := p.createVolume(options, exportParams{})
+	evaluate(t, "nested under namespace", false, err, tmpDir+"/team-a/pvc-1", path, "path")
+	if info, err := os.Stat(tmpDir + "/team-a"); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("expected namespace dir with mode 0755 but got %v, %v", info, err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected volume dir %s but got error %v", path, err)
+	}
+
+	options.PVName = "pvc-2"
+	options.PVC = nil
+	_, path, _, _, _, err = p.createVolume(options, exportParams{})
+	evaluate(t, "no claim, not nested", false, err, tmpDir+"/pvc-2", path, "path")
+}
+
+func TestNamespaceQuotas(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	quotas := tmpDir + "/quotas.yaml"
+	if err := ioutil.WriteFile(quotas, []byte("team-a: 2Ki\n\"*\": 1024\n"), 0600); err != nil {
+		t.Errorf("Error writing file %s: %v", quotas, err)
+	}
+	p := newNFSProvisionerInternal(tmpDir+"/", fake.NewSimpleClientset(), &testExporter{}, nil)
+	p.namespaceQuotas = quotas
+
+	tests := []struct {
+		pv          string
+		namespace   string
+		capacity    int64
+		expectError bool
+	}{
+		{"pvc-1", "team-a", 1024, false},
+		{"pvc-2", "team-a", 1024, false},
+		{"pvc-3", "team-a", 1, true},
+		{"pvc-4", "team-b", 1025, true},
+		{"pvc-5", "team-b", 1024, false},
+		{"pvc-6", "", 4096, false},
+	}
+	for _, test := range tests {
+		_, err := p.reserveCapacity(test.pv, test.namespace, p.exportDirs, test.capacity)
+		evaluate(t, test.pv+" in "+test.namespace, test.expectError, err, nil, nil, "reservation")
+		if _, ok := err.(*quotaExceededError); test.expectError && !ok {
+			t.Errorf("expected quota exceeded error reserving %s but got %v", test.pv, err)
+		}
+	}
+
+	p.releaseCapacity("pvc-1")
+	_, err := p.reserveCapacity("pvc-3", "team-a", p.exportDirs, 1)
+	evaluate(t, "after release", false, err, nil, nil, "reservation")
+
+	families := p.collectQuotas()
+	evaluate(t, "provisioned metric", false, nil, []metrics.Sample{
+		{Labels: metrics.Labels{"namespace": "team-a"}, Value: 1025},
+		{Labels: metrics.Labels{"namespace": "team-b"}, Value: 1024},
+	}, families[0].Samples, "samples")
+	evaluate(t, "quota metric", false, nil, []metrics.Sample{
+		{Labels: metrics.Labels{"namespace": "team-a"}, Value: 2048},
+		{Labels: metrics.Labels{"namespace": "team-b"}, Value: 1024},
+	}, families[1].Samples, "samples")
+
+	_, err = ParseNamespaceQuotas([]byte("team-a: lots\n"))
+	evaluate(t, "invalid quota", true, err, nil, nil, "quotas")
+	_, err = ParseNamespaceQuotas([]byte("team-a: [1Gi]\n"))
+	evaluate(t, "list quota", true, err, nil, nil, "quotas")
+}
+
+func TestCopyClaimMetadata(t *testing.T) {
+	keys, err := ParseClaimKeys(" team, cost-center,,example.com/app ")
+	evaluate(t, "parse keys", false, err, []string{"team", "cost-center", "example.com/app"}, keys, "keys")
+	_, err = ParseClaimKeys("team,bad key")
+	evaluate(t, "parse invalid key", true, err, nil, nil, "keys")
+
+	p := newNFSProvisionerInternal("/export/", fake.NewSimpleClientset(), &testExporter{}, nil)
+	p.claimLabels = []string{"team", "app", "missing"}
+	p.claimAnnotations = []string{"cost-center", annCreatedBy}
+
+	claim := &v1.PersistentVolumeClaim{
+		ObjectMeta: v1.ObjectMeta{
+			Labels:      map[string]string{"team": "a", "app": "db", "other": "x"},
+			Annotations: map[string]string{"cost-center": "42", annCreatedBy: "someone", "other": "x"},
+		},
+	}
+	pv := &v1.PersistentVolume{
+		ObjectMeta: v1.ObjectMeta{
+			Labels:      map[string]string{"app": "selected"},
+			Annotations: map[string]string{annCreatedBy: createdBy},
+		},
+	}
+	p.copyClaimMetadata(pv, claim)
+	evaluate(t, "labels", false, nil, map[string]string{"team": "a", "app": "selected"}, pv.Labels, "labels")
+	evaluate(t, "annotations", false, nil, map[string]string{"cost-center": "42", annCreatedBy: createdBy}, pv.Annotations, "annotations")
+
+	pv = &v1.PersistentVolume{}
+	p.copyClaimMetadata(pv, nil)
+	evaluate(t, "no claim", false, nil, map[string]string(nil), pv.Labels, "labels")
+}
+
+func TestVolumeName(t *testing.T) {
+	claim := &v1.PersistentVolumeClaim{ObjectMeta: v1.ObjectMeta{Name: "My_Claim", Namespace: "team-a", UID: types.UID("1234-abcd")}}
+	long := strings.Repeat("x", 300)
+
+	tests := []struct {
+		name          string
+		template      string
+		expectedName  string
+		expectedError bool
+	}{
+		{"default", "", "pvc-1234-abcd", false},
+		{"namespace, name and uid", "{{.Namespace}}-{{.Name}}-{{.UID}}", "team-a-my-claim-1234-abcd", false},
+		{"no uid gets suffix", "{{.Namespace}}/{{.Name}}", "team-a-my-claim-1234-abcd", false},
+		{"trimmed", ".{{.Name}}-", "my-claim-1234-abcd", false},
+		{"empty", "{{if false}}x{{end}}", "pvc-1234-abcd", false},
+		{"too long", long + "-{{.UID}}", strings.Repeat("x", 253-len("-1234-abcd")) + "-1234-abcd", false},
+		{"unparseable", "{{.Name", "", true},
+		{"unknown field", "{{.Foo}}", "", true},
+	}
+	for _, test := range tests {
+		p := newNFSProvisionerInternal("/export/", fake.NewSimpleClientset(), &testExporter{}, nil)
+		if test.template != "" {
+			tmpl, err := ParsePVNameTemplate(test.template)
+			if test.expectedError {
+				evaluate(t, test.name, true, err, nil, nil, "template")
+				continue
+			}
+			if err != nil {
+				t.Errorf("test %s failed: unexpected error parsing template: %v", test.name, err)
+				continue
+			}
+			p.pvNameTemplate = tmpl
+		}
+		evaluate(t, test.name, false, nil, test.expectedName, p.VolumeName(claim), "name")
+	}
+}
+
+func TestExportIdRange(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	p := newNFSProvisionerInternal(tmpDir+"/", fake.NewSimpleClientset(), &testExporter{}, nil)
+	p.minExportId, p.maxExportId = 65534, 65535
+	// An id in the range in use by another provisioner of the same server
+	p.exportIds[65534] = true
+
+	exportId, err := p.generateExportId()
+	evaluate(t, "last export id in range", false, err, uint16(65535), exportId, "export id")
+	exportId, err = p.generateExportId()
+	evaluate(t, "range exhausted", true, err, uint16(0), exportId, "export id")
+}
+
+func TestExportStore(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	client := fake.NewSimpleClientset()
+	conf := tmpDir + "/test"
+	_, err := os.Create(conf)
+	if err != nil {
+		t.Errorf("Error creating file %s: %v", conf, err)
+	}
+	store := newTestExportStore()
+	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{config: conf}, store)
+	p.allowAnyClient = true
+
+	os.Setenv(podIPEnv, "1.1.1.1")
+	defer os.Unsetenv(podIPEnv)
+
+	options := controller.VolumeOptions{
+		Capacity:                      resource.MustParse("1Ki"),
+		AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+		PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+		PVName:     "pvc-1",
+		Parameters: map[string]string{},
+	}
+	pv, err := p.Provision(options)
+	if err != nil {
+		t.Fatalf("unexpected error provisioning: %v", err)
+	}
+
+	expected := &NFSExport{PV: "pvc-1", Path: tmpDir + "/pvc-1", ExportId: 1, Block: "\nExport_Id = 1;\nPath = " + tmpDir + "/pvc-1;\n"}
+	export, _ := store.Get("pvc-1")
+	evaluate(t, "record created", false, nil, expected, export, "export record")
+
+	// The record, not the annotations, should be used for deletion
+	delete(pv.Annotations, annBlock)
+	delete(pv.Annotations, annExportId)
+	recorder := record.NewFakeRecorder(10)
+	p.eventRecorder = recorder
+	err = p.Delete(pv)
+	export, _ = store.Get("pvc-1")
+	evaluate(t, "record deleted", false, err, (*NFSExport)(nil), export, "export record")
+	evaluate(t, "delete events", false, nil, []string{"Normal DirectoryDeleted", "Normal ExportRemoved"}, eventReasons(recorder), "events")
+}
+
+func TestProvisionGid(t *testing.T) {
+	tests := []struct {
+		name            string
+		gid             string
+		expectedGid     uint64
+		expectedGidAnno string
+	}{
+		{"none", "none", 0, ""},
+		{"id", "1", 1, "1"},
+		{"auto", "auto", 1000000000, "1000000000"},
+	}
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	conf := tmpDir + "/test"
+	if _, err := os.Create(conf); err != nil {
+		t.Errorf("Error creating file %s: %v", conf, err)
+	}
+	for _, test := range tests {
+		client := fake.NewSimpleClientset(&v1.Namespace{ObjectMeta: v1.ObjectMeta{Name: "default", Annotations: map[string]string{annSupplementalGroups: "1000000000/10000"}}})
+		store := newTestExportStore()
+		p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{config: conf}, store)
+		p.allowAnyClient = true
+		p.serverHostname = "localhost"
+
+		options := controller.VolumeOptions{
+			Capacity:                      resource.MustParse("1Ki"),
+			AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+			PVName:     "pvc-" + test.name,
+			PVC:        &v1.PersistentVolumeClaim{ObjectMeta: v1.ObjectMeta{Name: "claim", Namespace: "default"}},
+			Parameters: map[string]string{"gid": test.gid},
+		}
+		pv, err := p.Provision(options)
+		if err != nil {
+			t.Errorf("test %s failed: unexpected error provisioning: %v", test.name, err)
+			continue
+		}
+		export, _ := store.Get("pvc-" + test.name)
+		evaluate(t, test.name, false, nil, test.expectedGid, export.Gid, "recorded gid")
+		evaluate(t, test.name, false, nil, test.expectedGidAnno, pv.Annotations[VolumeGidAnnotationKey], "gid annotation")
+	}
+}
+
+func TestDeleteRetry(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	conf := tmpDir + "/test"
+	_, err := os.Create(conf)
+	if err != nil {
+		t.Errorf("Error creating file %s: %v", conf, err)
+	}
+	p := newNFSProvisionerInternal(tmpDir+"/", fake.NewSimpleClientset(), &testExporter{config: conf}, nil)
+	p.allowAnyClient = true
+	p.serverHostname = "localhost"
+
+	options := controller.VolumeOptions{
+		Capacity:                      resource.MustParse("1Ki"),
+		AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+		PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+		PVName:     "pvc-1",
+		Parameters: map[string]string{},
+	}
+	pv, err := p.Provision(options)
+	if err != nil {
+		t.Fatalf("unexpected error provisioning: %v", err)
+	}
+
+	// A previous attempt deleted the directory but failed to delete the export
+	os.RemoveAll(tmpDir + "/pvc-1")
+	err = p.Delete(pv)
+	read, _ := ioutil.ReadFile(conf)
+	evaluate(t, "retry delete", false, err, "", string(read), "config")
+
+	// Neither the directory nor the export exist any more
+	evaluate(t, "delete again", true, p.Delete(pv), nil, nil, "")
+}
+
+func TestDeleteKeepsExportIdUntilUnexported(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	conf := tmpDir + "/test"
+	_, err := os.Create(conf)
+	if err != nil {
+		t.Errorf("Error creating file %s: %v", conf, err)
+	}
+	exporter := &failingUnexportExporter{testExporter: testExporter{config: conf}, fail: true}
+	p := newNFSProvisionerInternal(tmpDir+"/", fake.NewSimpleClientset(), exporter, nil)
+	p.allowAnyClient = true
+	p.serverHostname = "localhost"
+
+	options := controller.VolumeOptions{
+		Capacity:                      resource.MustParse("1Ki"),
+		AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+		PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+		PVName:     "pvc-1",
+		Parameters: map[string]string{},
+	}
+	pv, err := p.Provision(options)
+	if err != nil {
+		t.Fatalf("unexpected error provisioning: %v", err)
+	}
+
+	err = p.Delete(pv)
+	evaluate(t, "unexport fails", true, err, map[uint16]bool{1: true}, p.exportIds, "export ids")
+
+	exporter.fail = false
+	err = p.Delete(pv)
+	evaluate(t, "retry unexport", false, err, map[uint16]bool{}, p.exportIds, "export ids")
+}
+
+func TestDeleteRetryAfterRecordDeleteFails(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	conf := tmpDir + "/test"
+	_, err := os.Create(conf)
+	if err != nil {
+		t.Errorf("Error creating file %s: %v", conf, err)
+	}
+	store := &failingDeleteExportStore{testExportStore: *newTestExportStore(), fail: true}
+	p := newNFSProvisionerInternal(tmpDir+"/", fake.NewSimpleClientset(), &testExporter{config: conf}, store)
+	p.allowAnyClient = true
+	p.serverHostname = "localhost"
+
+	options := controller.VolumeOptions{
+		Capacity:                      resource.MustParse("1Ki"),
+		AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+		PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+		PVName:     "pvc-1",
+		Parameters: map[string]string{},
+	}
+	pv, err := p.Provision(options)
+	if err != nil {
+		t.Fatalf("unexpected error provisioning: %v", err)
+	}
+
+	// The export is removed and unexported but its record isn't deleted, so
+	// its exportId must not be freed yet
+	err = p.Delete(pv)
+	evaluate(t, "record delete fails", true, err, map[uint16]bool{1: true}, p.exportIds, "export ids")
+
+	// The retry removes and unexports the export again, which must not fail
+	store.fail = false
+	err = p.Delete(pv)
+	evaluate(t, "retry delete", false, err, map[uint16]bool{}, p.exportIds, "export ids")
+	export, _ := store.Get("pvc-1")
+	evaluate(t, "record deleted", false, nil, (*NFSExport)(nil), export, "export record")
+}
+
+func TestAlreadyUnexported(t *testing.T) {
+	entries := parseExportfsList("/export/foo    \t10.0.0.0/8\n/export/bar    \t<world>\n")
+	evaluate(t, "exported to client", false, nil, true, exportfsListed(entries, "/export/foo", "10.0.0.0/8"), "listed")
+	evaluate(t, "exported to any client", false, nil, true, exportfsListed(entries, "/export/bar", "*"), "listed")
+	evaluate(t, "not exported to client", false, nil, false, exportfsListed(entries, "/export/foo", "example.com"), "listed")
+	evaluate(t, "not exported", false, nil, false, exportfsListed(entries, "/export/baz", "*"), "listed")
+
+	infos := []ganesha.ExportInfo{{ExportId: 0, Path: "/"}, {ExportId: 1, Path: "/export/foo"}}
+	evaluate(t, "ganesha serves export", false, nil, true, ganeshaServes(infos, 1), "served")
+	evaluate(t, "ganesha removed export", false, nil, false, ganeshaServes(infos, 2), "served")
+}
+
+func TestDryRun(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	client := fake.NewSimpleClientset()
+	conf := tmpDir + "/test"
+	_, err := os.Create(conf)
+	if err != nil {
+		t.Errorf("Error creating file %s: %v", conf, err)
+	}
+	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{config: conf}, nil)
+	p.allowAnyClient = true
+	p.serverHostname = "localhost"
+	p.dryRun = true
+
+	options := controller.VolumeOptions{
+		Capacity:                      resource.MustParse("1Ki"),
+		AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+		PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+		PVName:     "pvc-1",
+		Parameters: map[string]string{"gid": "1001"},
+	}
+	pv, err := p.Provision(options)
+	evaluate(t, "dry run", true, err, (*v1.PersistentVolume)(nil), pv, "PV")
+	if err != nil && !strings.Contains(err.Error(), "would create directory "+tmpDir+"/pvc-1") {
+		t.Errorf("expected dry run error to say what it would do but got: %v", err)
+	}
+	if _, err := os.Stat(tmpDir + "/pvc-1"); !os.IsNotExist(err) {
+		t.Errorf("expected dry run not to create directory but stat got: %v", err)
+	}
+	config, _ := ioutil.ReadFile(conf)
+	evaluate(t, "dry run config", false, nil, "", string(config), "config")
+	evaluate(t, "dry run reservations", false, nil, map[string]int64{}, p.reservations, "reservations")
+	evaluate(t, "dry run export ids", false, nil, map[uint16]bool{}, p.exportIds, "export ids")
+
+	options.Parameters = map[string]string{"gid": "none", "foo": "bar"}
+	_, err = p.Provision(options)
+	if err == nil || strings.Contains(err.Error(), "would create") {
+		t.Errorf("expected dry run of invalid class to fail validation but got: %v", err)
+	}
+
+	volume := &v1.PersistentVolume{
+		ObjectMeta: v1.ObjectMeta{Name: "pvc-2"},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				NFS: &v1.NFSVolumeSource{Path: tmpDir + "/pvc-2"},
+			},
+		},
+	}
+	os.Mkdir(tmpDir+"/pvc-2", 0755)
+	evaluate(t, "dry run delete", true, p.Delete(volume), nil, nil, "")
+	if _, err := os.Stat(tmpDir + "/pvc-2"); err != nil {
+		t.Errorf("expected dry run not to delete directory but stat got: %v", err)
+	}
+}
+
+func TestStubExporter(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	client := fake.NewSimpleClientset()
+	p := newNFSProvisionerInternal(tmpDir+"/", client, &stubExporter{config: tmpDir + "/exports"}, nil)
+	p.allowAnyClient = true
+	p.serverHostname = "localhost"
+
+	options := controller.VolumeOptions{
+		Capacity:                      resource.MustParse("1Ki"),
+		AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+		PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+		PVName:     "pvc-1",
+		Parameters: map[string]string{},
+	}
+	pv, err := p.Provision(options)
+	if err != nil {
+		t.Fatalf("unexpected error provisioning: %v", err)
+	}
+	block := "\n" + tmpDir + "/pvc-1 *(rw,insecure,root_squash,fsid=1)\n"
+	evaluate(t, "stub block", false, nil, block, pv.Annotations[annBlock], "block")
+	exports, err := p.exporter.GetConfigExports()
+	evaluate(t, "stub config exports", false, err, []configExport{{path: tmpDir + "/pvc-1", exportId: 1, block: block}}, exports, "exports")
+
+	err = p.Delete(pv)
+	evaluate(t, "stub delete", false, err, nil, nil, "")
+	exports, err = p.exporter.GetConfigExports()
+	evaluate(t, "stub config exports after delete", false, err, []configExport{}, exports, "exports")
+}
+
+func TestSnapshots(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	client := fake.NewSimpleClientset()
+	conf := tmpDir + "/test"
+	_, err := os.Create(conf)
+	if err != nil {
+		t.Errorf("Error creating file %s: %v", conf, err)
+	}
+	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{config: conf}, nil)
+	p.allowAnyClient = true
+	p.serverHostname = "localhost"
+
+	options := controller.VolumeOptions{
+		Capacity:                      resource.MustParse("1Ki"),
+		AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+		PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+		PVName:     "pvc-1",
+		Parameters: map[string]string{},
+	}
+	pv, err := p.Provision(options)
+	if err != nil {
+		t.Fatalf("unexpected error provisioning: %v", err)
+	}
+	pv, _ = client.Core().PersistentVolumes().Create(pv)
+	data := tmpDir + "/pvc-1/data"
+	ioutil.WriteFile(data, []byte("foo"), 0644)
+
+	pv.Annotations[annSnapshots] = "a"
+	evaluate(t, "snapshots disabled", true, p.Update(pv), nil, nil, "")
+
+	p.snapshotter = &testSnapshotter{dir: tmpDir + "/snapshots"}
+	pv.Annotations[annSnapshots] = "Not_A_Label"
+	evaluate(t, "invalid name", true, p.Update(pv), nil, nil, "")
+
+	pv.Annotations[annSnapshots] = "a"
+	err = p.Update(pv)
+	pv, _ = client.Core().PersistentVolumes().Get("pvc-1")
+	exports, _ := getSnapshotExports(pv)
+	snapshot := tmpDir + "/snapshots/pvc-1.a/pvc-1"
+	evaluate(t, "create", false, err, snapshotExport{Path: snapshot, ExportId: 2, Block: "\nExport_Id = 2;\nPath = " + snapshot + ";\n"}, exports["a"], "snapshot export")
+	read, _ := ioutil.ReadFile(conf)
+	evaluate(t, "create exports snapshot", false, nil, true, strings.Contains(string(read), "Path = "+snapshot+";"), "snapshot in config")
+
+	ioutil.WriteFile(data, []byte("bar"), 0644)
+	ioutil.WriteFile(tmpDir+"/pvc-1/new", []byte("bar"), 0644)
+	pv.Annotations[annRestoreSnapshot] = "a"
+	err = p.Update(pv)
+	contents, _ := ioutil.ReadFile(data)
+	_, statErr := os.Stat(tmpDir + "/pvc-1/new")
+	evaluate(t, "restore", false, err, []interface{}{"foo", true}, []interface{}{string(contents), os.IsNotExist(statErr)}, "restored data, new file removed")
+	pv, _ = client.Core().PersistentVolumes().Get("pvc-1")
+	_, ok := pv.Annotations[annRestoreSnapshot]
+	evaluate(t, "restore annotation removed", false, nil, false, ok, "restore annotation")
+
+	pv.Annotations[annRestoreSnapshot] = "b"
+	evaluate(t, "restore missing", true, p.Update(pv), nil, nil, "")
+	delete(pv.Annotations, annRestoreSnapshot)
+
+	pv.Annotations[annSnapshots] = ""
+	err = p.Update(pv)
+	pv, _ = client.Core().PersistentVolumes().Get("pvc-1")
+	_, ok = pv.Annotations[annSnapshotExports]
+	_, statErr = os.Stat(snapshot)
+	evaluate(t, "delete", false, err, []interface{}{false, true}, []interface{}{ok, os.IsNotExist(statErr)}, "snapshot exports annotation, snapshot deleted")
+	read, _ = ioutil.ReadFile(conf)
+	evaluate(t, "delete unexports snapshot", false, nil, false, strings.Contains(string(read), snapshot), "snapshot in config")
+
+	pv.Annotations[annSnapshots] = "c"
+	p.Update(pv)
+	pv, _ = client.Core().PersistentVolumes().Get("pvc-1")
+	err = p.Delete(pv)
+	read, _ = ioutil.ReadFile(conf)
+	_, statErr = os.Stat(tmpDir + "/snapshots/pvc-1.c")
+	evaluate(t, "delete volume deletes snapshots", false, err, []interface{}{"", true}, []interface{}{string(read), os.IsNotExist(statErr)}, "config, snapshot deleted")
+
+	block := createBlock(t, &kernelExporter{}, "3", "/export/.snapshots/pvc-1.a/pvc-1", exportParams{clients: []string{"10.0.0.1"}, readOnly: true})
+	evaluate(t, "kernel read-only block", false, nil, "\n/export/.snapshots/pvc-1.a/pvc-1 10.0.0.1(ro,insecure,root_squash,fsid=3)\n", block, "block")
+	evaluate(t, "kernel read-only block matches", false, nil, true, kernelBlockRe.MatchString(block), "match")
+}
+
+func TestCloneVolume(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	client := fake.NewSimpleClientset()
+	conf := tmpDir + "/test"
+	_, err := os.Create(conf)
+	if err != nil {
+		t.Errorf("Error creating file %s: %v", conf, err)
+	}
+	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{config: conf}, nil)
+	p.allowAnyClient = true
+	p.serverHostname = "localhost"
+
+	options := controller.VolumeOptions{
+		Capacity:                      resource.MustParse("1Ki"),
+		AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+		PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+		PVName:     "pvc-1",
+		Parameters: map[string]string{},
+	}
+	pv, err := p.Provision(options)
+	if err != nil {
+		t.Fatalf("unexpected error provisioning: %v", err)
+	}
+	pv.Spec.Capacity = v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Ki")}
+	client.Core().PersistentVolumes().Create(pv)
+	os.MkdirAll(tmpDir+"/pvc-1/dir", 0755)
+	ioutil.WriteFile(tmpDir+"/pvc-1/dir/data", []byte("foo"), 0644)
+	client.Core().PersistentVolumeClaims("default").Create(&v1.PersistentVolumeClaim{ObjectMeta: v1.ObjectMeta{Name: "unbound", Namespace: "default"}})
+	client.Core().PersistentVolumeClaims("default").Create(&v1.PersistentVolumeClaim{ObjectMeta: v1.ObjectMeta{Name: "source", Namespace: "default"}, Spec: v1.PersistentVolumeClaimSpec{VolumeName: "pvc-1"}})
+
+	clone := func(pvName, source, capacity string) controller.VolumeOptions {
+		options.PVName = pvName
+		options.Capacity = resource.MustParse(capacity)
+		options.PVC = &v1.PersistentVolumeClaim{ObjectMeta: v1.ObjectMeta{Name: pvName, Namespace: "default", Annotations: map[string]string{annCloneFrom: source}}}
+		return options
+	}
+
+	_, err = p.Provision(clone("pvc-2", "source", "1Ki"))
+	data, _ := ioutil.ReadFile(tmpDir + "/pvc-2/dir/data")
+	evaluate(t, "clone", false, err, "foo", string(data), "cloned data")
+
+	p.snapshotter = &testSnapshotter{dir: tmpDir + "/snapshots"}
+	_, err = p.Provision(clone("pvc-3", "source", "2Ki"))
+	data, _ = ioutil.ReadFile(tmpDir + "/pvc-3/dir/data")
+	snapshots, _ := ioutil.ReadDir(tmpDir + "/snapshots")
+	evaluate(t, "clone from snapshot", false, err, []interface{}{"foo", 0}, []interface{}{string(data), len(snapshots)}, "cloned data, snapshots left")
+
+	pv, _ = client.Core().PersistentVolumes().Get("pvc-1")
+	pv.Annotations[annSnapshots] = "a"
+	if err := p.Update(pv); err != nil {
+		t.Fatalf("unexpected error taking snapshot: %v", err)
+	}
+	ioutil.WriteFile(tmpDir+"/pvc-1/dir/data", []byte("bar"), 0644)
+	restore := func(pvName, source string) controller.VolumeOptions {
+		options := clone(pvName, "", "1Ki")
+		options.PVC.Annotations = map[string]string{annRestoreFrom: source}
+		return options
+	}
+	_, err = p.Provision(restore("pvc-7", "source/a"))
+	data, _ = ioutil.ReadFile(tmpDir + "/pvc-7/dir/data")
+	evaluate(t, "restore snapshot", false, err, "foo", string(data), "restored data")
+	_, err = p.Provision(restore("pvc-8", "source/b"))
+	evaluate(t, "restore missing snapshot", true, err, nil, nil, "")
+	_, err = p.Provision(restore("pvc-9", "source"))
+	evaluate(t, "restore invalid", true, err, nil, nil, "")
+	options = clone("pvc-10", "source", "1Ki")
+	options.PVC.Annotations[annRestoreFrom] = "source/a"
+	_, err = p.Provision(options)
+	evaluate(t, "clone and restore", true, err, nil, nil, "")
+
+	_, err = p.Provision(clone("pvc-4", "unbound", "1Ki"))
+	evaluate(t, "source unbound", true, err, nil, nil, "")
+	_, err = p.Provision(clone("pvc-5", "missing", "1Ki"))
+	evaluate(t, "source missing", true, err, nil, nil, "")
+	_, err = p.Provision(clone("pvc-6", "source", "512"))
+	_, statErr := os.Stat(tmpDir + "/pvc-6")
+	evaluate(t, "source bigger", true, err, true, os.IsNotExist(statErr), "directory not created")
+}
+
+func TestBenchmark(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	client := fake.NewSimpleClientset()
+	conf := tmpDir + "/test"
+	_, err := os.Create(conf)
+	if err != nil {
+		t.Errorf("Error creating file %s: %v", conf, err)
+	}
+	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{config: conf}, nil)
+	p.allowAnyClient = true
+	p.serverHostname = "localhost"
+
+	report := Benchmark(p, client, 20, 4)
+	evaluate(t, "benchmark", false, report.FirstError, []int{0, 20, 20}, []int{report.Failed, len(report.Provision), len(report.Delete)}, "failed, provisioned and deleted")
+	volumes, _ := client.Core().PersistentVolumes().List(api.ListOptions{})
+	evaluate(t, "PVs deleted", false, nil, 0, len(volumes.Items), "PVs")
+	read, _ := ioutil.ReadFile(conf)
+	evaluate(t, "exports removed", false, nil, "", string(read), "config")
+
+	failing := &BenchmarkReport{Volumes: 1, Duration: time.Second, Failed: 1, FirstError: errors.New("foo")}
+	var out bytes.Buffer
+	failing.Print(&out)
+	evaluate(t, "print", false, nil, "1 volumes, 0 at a time, in 1s: 0.0 volumes/s\n1 failed, the first with: foo\n", out.String(), "output")
+	evaluate(t, "percentile", false, nil, 90*time.Millisecond, percentile([]time.Duration{100 * time.Millisecond, 10 * time.Millisecond, 90 * time.Millisecond}, 0.5), "p50")
+}
+
+func TestIdentity(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	conf := tmpDir + "/test"
+	_, err := os.Create(conf)
+	if err != nil {
+		t.Errorf("Error creating file %s: %v", conf, err)
+	}
+	p := newNFSProvisionerInternal(tmpDir+"/", fake.NewSimpleClientset(), &testExporter{config: conf}, nil)
+	p.allowAnyClient = true
+
+	os.Setenv(podIPEnv, "1.1.1.1")
+	defer os.Unsetenv(podIPEnv)
+
+	options := controller.VolumeOptions{
+		Capacity:                      resource.MustParse("1Ki"),
+		AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+		PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+		PVName:     "pvc-1",
+		Parameters: map[string]string{},
+	}
+	pv, err := p.Provision(options)
+	if err != nil {
+		t.Fatalf("unexpected error provisioning: %v", err)
+	}
+	identity, err := p.stateStore.loadIdentity(false)
+	evaluate(t, "stamp identity", false, err, identity, pv.Annotations[annIdentity], "identity")
+
+	// A new provisioner of the same storage, as after the pod is replaced,
+	// should have the same identity
+	p = newNFSProvisionerInternal(tmpDir+"/", fake.NewSimpleClientset(), &testExporter{config: conf}, nil)
+	persisted, err := p.stateStore.loadIdentity(true)
+	evaluate(t, "persisted identity", false, err, identity, persisted, "identity")
+
+	// A provisioner of other storage mustn't delete the volume
+	otherDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(otherDir)
+	other := newNFSProvisionerInternal(otherDir+"/", fake.NewSimpleClientset(), &testExporter{config: conf}, nil)
+	other.stateStore.loadIdentity(true)
+	err = other.Delete(pv)
+	_, statErr := os.Stat(tmpDir + "/pvc-1")
+	evaluate(t, "delete by other identity", true, err, nil, statErr, "stat error")
+
+	err = p.Delete(pv)
+	_, statErr = os.Stat(tmpDir + "/pvc-1")
+	evaluate(t, "delete by same identity", false, err, true, os.IsNotExist(statErr), "directory deleted")
+}
+
+func TestVerifyStorage(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	conf := tmpDir + "/test"
+	_, err := os.Create(conf)
+	if err != nil {
+		t.Errorf("Error creating file %s: %v", conf, err)
+	}
+	client := fake.NewSimpleClientset()
+	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{config: conf}, nil)
+	p.allowAnyClient = true
+
+	os.Setenv(podIPEnv, "1.1.1.1")
+	defer os.Unsetenv(podIPEnv)
+
+	options := controller.VolumeOptions{
+		Capacity:                      resource.MustParse("1Ki"),
+		AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+		PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+		PVName:     "pvc-1",
+		Parameters: map[string]string{},
+	}
+	pv, err := p.Provision(options)
+	if err != nil {
+		t.Fatalf("unexpected error provisioning: %v", err)
+	}
+	client.Core().PersistentVolumes().Create(pv)
+
+	err = p.verifyStorage()
+	evaluate(t, "same storage", false, err, nil, nil, "")
+
+	// The same exportDir on a different, empty volume has no state file
+	emptyDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(emptyDir)
+	pv.Spec.NFS.Path = emptyDir + "/pvc-1"
+	client.Core().PersistentVolumes().Update(pv)
+	other := newNFSProvisionerInternal(emptyDir+"/", client, &testExporter{config: conf}, nil)
+	err = other.verifyStorage()
+	evaluate(t, "empty storage", true, err, nil, nil, "")
+
+	other.storageErr = err
+	options.PVName = "pvc-2"
+	_, err = other.Provision(options)
+	_, statErr := os.Stat(emptyDir + "/pvc-2")
+	evaluate(t, "provision on empty storage", true, err, true, os.IsNotExist(statErr), "directory not created")
+
+	// The state file copied to a different filesystem
+	st, _ := p.stateStore.read()
+	st.Filesystem = "bogus"
+	p.stateStore.write(st)
+	err = p.verifyStorage()
+	evaluate(t, "different filesystem", true, err, nil, nil, "")
+}
+
+func TestProvisionResumesPartial(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	exporter := &testExporter{config: tmpDir + "/test"}
+	partial := createBlock(t, exporter, "1", tmpDir+"/pvc-1", exportParams{})
+	err := ioutil.WriteFile(exporter.config, []byte(partial), 0600)
+	if err != nil {
+		t.Errorf("Error writing file %s: %v", exporter.config, err)
+	}
+	p := newNFSProvisionerInternal(tmpDir+"/", fake.NewSimpleClientset(), exporter, nil)
+	p.allowAnyClient = true
+
+	os.Setenv(podIPEnv, "1.1.1.1")
+	defer os.Unsetenv(podIPEnv)
+
+	// A previous attempt left the directory and export behind, as if deleting
+	// the directory had failed
+	os.Mkdir(tmpDir+"/pvc-1", 0777)
+	ioutil.WriteFile(tmpDir+"/pvc-1/leftover", []byte{}, 0600)
+	p.exportIds[1] = true
+	p.journal.record(journalEntry{PV: "pvc-1", Stage: journalExport, Path: tmpDir + "/pvc-1", ExportId: 1, Block: partial})
+
+	options := controller.VolumeOptions{
+		Capacity:                      resource.MustParse("1Ki"),
+		AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+		PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+		PVName:     "pvc-1",
+		Parameters: map[string]string{},
+	}
+	_, err = p.Provision(options)
+
+	read, _ := ioutil.ReadFile(exporter.config)
+	evaluate(t, "resume config", false, err, partial, string(read), "config")
+	evaluate(t, "resume export ids", false, err, map[uint16]bool{1: true}, p.exportIds, "export ids")
+	_, statErr := os.Stat(tmpDir + "/pvc-1/leftover")
+	evaluate(t, "resume directory", false, err, true, os.IsNotExist(statErr), "leftover deleted")
+
+	// A directory without a journal entry may be another volume's
+	os.Mkdir(tmpDir+"/pvc-2", 0777)
+	options.PVName = "pvc-2"
+	_, err = p.Provision(options)
+	evaluate(t, "existing directory", true, err, nil, nil, "")
+}
+
+func TestParseExportTemplate(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	valid := `EXPORT
+{
+	Export_Id = {{.ExportId}};
+	Path = {{.Path}};
+	Pseudo = {{.Pseudo}};
+	Access_Type = RW;
+	Squash = {{.Squash}};
+	Anonymous_Uid = 1000;
+	FSAL {
+		Name = VFS;
+	}
+}`
+	tests := []struct {
+		name          string
+		template      string
+		expectedBlock string
+		expectError   bool
+	}{
+		{
+			name:          "valid",
+			template:      valid,
+			expectedBlock: "\nEXPORT\n{\n\tExport_Id = 2;\n\tPath = /export/pvc-2;\n\tPseudo = /export/pvc-2;\n\tAccess_Type = RW;\n\tSquash = root_id_squash;\n\tAnonymous_Uid = 1000;\n\tFSAL {\n\t\tName = VFS;\n\t}\n}\n",
+		},
+		{
+			name:        "unknown field",
+			template:    strings.Replace(valid, "{{.Squash}}", "{{.Squish}}", 1),
+			expectError: true,
+		},
+		{
+			name:        "hardcoded export id",
+			template:    strings.Replace(valid, "{{.ExportId}}", "7", 1),
+			expectError: true,
+		},
+		{
+			name:        "invalid export",
+			template:    strings.Replace(valid, "Name = VFS;", "", 1),
+			expectError: true,
+		},
+		{
+			name:        "two exports",
+			template:    valid + "\n" + valid,
+			expectError: true,
+		},
+		{
+			name:        "bad template",
+			template:    "{{.ExportId",
+			expectError: true,
+		},
+	}
+	for i, test := range tests {
+		file := fmt.Sprintf("%s/template-%d", tmpDir, i)
+		if err := ioutil.WriteFile(file, []byte(test.template), 0600); err != nil {
+			t.Fatalf("Error writing file %s: %v", file, err)
+		}
+		tmpl, err := ParseExportTemplate(file)
+		if test.expectError {
+			evaluate(t, test.name, true, err, nil, nil, "template")
+			continue
+		}
+		e := &ganeshaExporter{exportTemplate: tmpl}
+		var block string
+		if err == nil {
+			block = createBlock(t, e, "2", "/export/pvc-2", exportParams{})
+		}
+		evaluate(t, test.name, false, err, test.expectedBlock, block, "block")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	exporter := &testExporter{config: tmpDir + "/test"}
+	kept := createBlock(t, exporter, "1", tmpDir+"/pvc-1", exportParams{})
+	missing := createBlock(t, exporter, "2", tmpDir+"/pvc-2", exportParams{})
+	stale := createBlock(t, exporter, "3", tmpDir+"/pvc-3", exportParams{})
+	foreign := createBlock(t, exporter, "4", "/elsewhere/pvc-4", exportParams{})
+	err := ioutil.WriteFile(exporter.config, []byte(kept+stale+foreign), 0600)
+	if err != nil {
+		t.Errorf("Error writing file %s: %v", exporter.config, err)
+	}
+	for _, dir := range []string{"pvc-1", "pvc-2", "pvc-3"} {
+		os.Mkdir(tmpDir+"/"+dir, 0777)
+	}
+
+	client := fake.NewSimpleClientset(
+		newProvisionedVolume("pvc-1", tmpDir+"/pvc-1", "1", kept),
+		newProvisionedVolume("pvc-2", tmpDir+"/pvc-2", "2", missing),
+		newProvisionedVolume("pvc-5", "/elsewhere/pvc-5", "5", createBlock(t, exporter, "5", "/elsewhere/pvc-5", exportParams{})),
+	)
+	// The stale export's PV was deleted without its record being deleted
+	store := newTestExportStore()
+	store.Create(&NFSExport{PV: "pvc-1", Path: tmpDir + "/pvc-1", ExportId: 1, Block: kept})
+	store.Create(&NFSExport{PV: "pvc-3", Path: tmpDir + "/pvc-3", ExportId: 3, Block: stale})
+	p := newNFSProvisionerInternal(tmpDir+"/", client, exporter, store)
+	recorder := record.NewFakeRecorder(10)
+	p.eventRecorder = recorder
+	p.auditLog = newAuditLog(tmpDir + "/audit.log")
+
+	err = p.reconcile()
+
+	read, _ := ioutil.ReadFile(exporter.config)
+	evaluate(t, "reconcile config", false, err, kept+foreign+missing, string(read), "config")
+	evaluate(t, "reconcile export ids", false, err, map[uint16]bool{1: true, 2: true}, p.exportIds, "export ids")
+	evaluate(t, "reconcile events", false, nil, []string{"Warning ExportMissing"}, eventReasons(recorder), "events")
+	records, _ := store.List()
+	evaluate(t, "reconcile records", false, nil, []*NFSExport{{PV: "pvc-1", Path: tmpDir + "/pvc-1", ExportId: 1, Block: kept}}, records, "records")
+
+	audited := []string{}
+	read, _ = ioutil.ReadFile(tmpDir + "/audit.log")
+	for _, line := range strings.Split(strings.TrimSpace(string(read)), "\n") {
+		var entry auditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Errorf("Error decoding audit log line %q: %v", line, err)
+		}
+		audited = append(audited, entry.Action+" "+entry.Operation+" "+entry.PV+" "+entry.Path)
+	}
+	expected := []string{"add reconcile pvc-2 " + tmpDir + "/pvc-2", "remove reconcile  " + tmpDir + "/pvc-3"}
+	evaluate(t, "reconcile audit log", false, nil, expected, audited, "audit log")
+}
+
+func TestCheckConsistency(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	exporter := &testExporter{config: tmpDir + "/test"}
+	kept := createBlock(t, exporter, "1", tmpDir+"/pvc-1", exportParams{})
+	missing := createBlock(t, exporter, "2", tmpDir+"/pvc-2", exportParams{})
+	stale := createBlock(t, exporter, "3", tmpDir+"/pvc-3", exportParams{})
+	err := ioutil.WriteFile(exporter.config, []byte(kept+stale), 0600)
+	if err != nil {
+		t.Errorf("Error writing file %s: %v", exporter.config, err)
+	}
+	for _, dir := range []string{"pvc-1", "pvc-2", "pvc-3", "orphan"} {
+		os.Mkdir(tmpDir+"/"+dir, 0777)
+	}
+
+	client := fake.NewSimpleClientset(
+		newProvisionedVolume("pvc-1", tmpDir+"/pvc-1", "1", kept),
+		newProvisionedVolume("pvc-2", tmpDir+"/pvc-2", "2", missing),
+		newProvisionedVolume("pvc-4", tmpDir+"/pvc-4", "4", createBlock(t, exporter, "4", tmpDir+"/pvc-4", exportParams{})),
+	)
+	p := newNFSProvisionerInternal(tmpDir+"/", client, exporter, nil)
+
+	for _, repair := range []bool{false, true} {
+		report, err := p.CheckConsistency(repair)
+		if err != nil {
+			t.Errorf("Error checking consistency: %v", err)
+			continue
+		}
+		problems := []string{}
+		for _, d := range report.Discrepancies {
+			problems = append(problems, fmt.Sprintf("%s %s %v", d.PV, strings.TrimPrefix(d.Path, tmpDir+"/"), d.Repaired))
+		}
+		expected := []string{"pvc-2 pvc-2 " + fmt.Sprint(repair), "pvc-4 pvc-4 false", " pvc-3 " + fmt.Sprint(repair), " orphan false", " pvc-3 false"}
+		evaluate(t, fmt.Sprintf("check consistency, repair %v", repair), false, nil, expected, problems, "discrepancies")
+	}
+
+	read, _ := ioutil.ReadFile(exporter.config)
+	evaluate(t, "check consistency config", false, nil, kept+missing, string(read), "config")
+}
+
+func TestReconcileBatch(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	exporter := &testBatchExporter{testExporter: testExporter{config: tmpDir + "/test"}}
+	first := createBlock(t, exporter, "1", tmpDir+"/pvc-1", exportParams{})
+	second := createBlock(t, exporter, "2", tmpDir+"/pvc-2", exportParams{})
+	_, err := os.Create(exporter.config)
+	if err != nil {
+		t.Errorf("Error creating file %s: %v", exporter.config, err)
+	}
+	for _, dir := range []string{"pvc-1", "pvc-2"} {
+		os.Mkdir(tmpDir+"/"+dir, 0777)
+	}
+
+	// As after a reboot emptied the config file
+	client := fake.NewSimpleClientset(
+		newProvisionedVolume("pvc-1", tmpDir+"/pvc-1", "1", first),
+		newProvisionedVolume("pvc-2", tmpDir+"/pvc-2", "2", second),
+	)
+	p := newNFSProvisionerInternal(tmpDir+"/", client, exporter, nil)
+	recorder := record.NewFakeRecorder(10)
+	p.eventRecorder = recorder
+
+	err = p.reconcile()
+
+	read, _ := ioutil.ReadFile(exporter.config)
+	evaluate(t, "reconcile batch config", false, err, first+second, string(read), "config")
+	evaluate(t, "reconcile batch batches", false, err, [][]string{{first, second}}, exporter.batches, "batches")
+	evaluate(t, "reconcile batch events", false, nil, []string{"Warning ExportMissing", "Warning ExportMissing"}, eventReasons(recorder), "events")
+}
+
+func TestCheckEnvironment(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	ioutil.WriteFile(tmpDir+"/file", []byte{}, 0600)
+	errs := CheckEnvironment([]string{tmpDir + "/", tmpDir + "/missing/", tmpDir + "/file/"}, []string{ExporterKernel}, false, fake.NewSimpleClientset())
+	if len(errs) != 2 {
+		t.Errorf("Expected 2 errors, for the missing export directory and the file, but got %v", errs)
+	}
+}
+
+func TestMigrateAnnotations(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	exporter := &testExporter{config: tmpDir + "/test"}
+	legacy := createBlock(t, exporter, "1", tmpDir+"/pvc-1", exportParams{})
+	client := fake.NewSimpleClientset(newProvisionedVolume("pvc-1", tmpDir+"/pvc-1", "1", legacy))
+	p := newNFSProvisionerInternal(tmpDir+"/", client, exporter, nil)
+	p.annotationDomain = "nfs.provisioner.kubernetes.io"
+
+	// The legacy keys are read until the PV is migrated
+	volume, _ := client.Core().PersistentVolumes().Get("pvc-1")
+	block, exportId, err := p.getExportInfo(volume)
+	evaluate(t, "legacy export info", false, err, []interface{}{legacy, uint16(1)}, []interface{}{block, exportId}, "export info")
+
+	err = p.migrateAnnotations()
+	volume, _ = client.Core().PersistentVolumes().Get("pvc-1")
+	expected := map[string]string{
+		annCreatedBy: createdBy,
+		"nfs.provisioner.kubernetes.io/Export_Id":    "1",
+		"nfs.provisioner.kubernetes.io/EXPORT_block": legacy,
+	}
+	evaluate(t, "migrate annotations", false, err, expected, volume.Annotations, "annotations")
+
+	block, exportId, err = p.getExportInfo(volume)
+	evaluate(t, "migrated export info", false, err, []interface{}{legacy, uint16(1)}, []interface{}{block, exportId}, "export info")
+}
+
+func TestImportExports(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	exporter := &testExporter{config: tmpDir + "/test"}
+	adopted := createBlock(t, exporter, "7", tmpDir+"/pvc-1", exportParams{})
+	err := ioutil.WriteFile(exporter.config, []byte(adopted), 0600)
+	if err != nil {
+		t.Errorf("Error writing file %s: %v", exporter.config, err)
+	}
+	os.Mkdir(tmpDir+"/pvc-1", 0777)
+
+	// A PV of another instance with none of the provisioner's annotations and
+	// one without an export
+	foreign := newProvisionedVolume("pvc-1", tmpDir+"/pvc-1", "", "")
+	foreign.Annotations = map[string]string{VolumeGidAnnotationKey: "1000"}
+	unexported := newProvisionedVolume("pvc-2", tmpDir+"/pvc-2", "", "")
+	unexported.Annotations = nil
+	client := fake.NewSimpleClientset(foreign, unexported)
+	p := newNFSProvisionerInternal(tmpDir+"/", client, exporter, nil)
+	recorder := record.NewFakeRecorder(10)
+	p.eventRecorder = recorder
+
+	err = p.importExports()
+
+	evaluate(t, "import export ids", false, err, map[uint16]bool{7: true}, p.exportIds, "export ids")
+	imported, _ := p.exportStore.Get("pvc-1")
+	evaluate(t, "import record", false, err, &NFSExport{PV: "pvc-1", Path: tmpDir + "/pvc-1", ExportId: 7, Gid: 1000, Block: adopted}, imported, "record")
+	volume, _ := client.Core().PersistentVolumes().Get("pvc-1")
+	identity, _ := p.stateStore.loadIdentity(false)
+	expectedAnnotations := map[string]string{VolumeGidAnnotationKey: "1000", annCreatedBy: createdBy, annExportId: "7", annBlock: adopted, annIdentity: identity}
+	evaluate(t, "import annotations", false, err, expectedAnnotations, volume.Annotations, "annotations")
+	volume, _ = client.Core().PersistentVolumes().Get("pvc-2")
+	evaluate(t, "import unexported", false, err, map[string]string(nil), volume.Annotations, "annotations")
+	evaluate(t, "import events", false, nil, []string{"Normal ExportImported"}, eventReasons(recorder), "events")
+}
+
+func TestRecoverJournal(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	exporter := &testExporter{config: tmpDir + "/test"}
+	committed := createBlock(t, exporter, "1", tmpDir+"/pvc-1", exportParams{})
+	pending := createBlock(t, exporter, "2", tmpDir+"/pvc-2", exportParams{})
+	err := ioutil.WriteFile(exporter.config, []byte(committed+pending), 0600)
+	if err != nil {
+		t.Errorf("Error writing file %s: %v", exporter.config, err)
+	}
+	for _, dir := range []string{"pvc-1", "pvc-2", "pvc-3"} {
+		os.Mkdir(tmpDir+"/"+dir, 0777)
+	}
+
+	client := fake.NewSimpleClientset(newProvisionedVolume("pvc-1", tmpDir+"/pvc-1", "1", committed))
+	p := newNFSProvisionerInternal(tmpDir+"/", client, exporter, nil)
+	p.exportIds = map[uint16]bool{1: true, 2: true}
+	entries := []journalEntry{
+		// The PV was created but the provisioner crashed before it was committed
+		{PV: "pvc-1", Stage: journalPV, Path: tmpDir + "/pvc-1", ExportId: 1, Block: committed},
+		// The PV wasn't created
+		{PV: "pvc-2", Stage: journalPV, Path: tmpDir + "/pvc-2", ExportId: 2, Block: pending},
+		// The provisioner crashed while creating the directory
+		{PV: "pvc-3", Stage: journalDirectory, Path: tmpDir + "/pvc-3"},
+	}
+	for _, entry := range entries {
+		if err := p.journal.record(entry); err != nil {
+			t.Errorf("Error journaling %v: %v", entry, err)
+		}
+	}
+
+	err = p.recoverJournal()
+
+	read, _ := ioutil.ReadFile(exporter.config)
+	evaluate(t, "recover journal config", false, err, committed, string(read), "config")
+	evaluate(t, "recover journal export ids", false, err, map[uint16]bool{1: true}, p.exportIds, "export ids")
+	dirs := []string{}
+	for _, dir := range []string{"pvc-1", "pvc-2", "pvc-3"} {
+		if _, err := os.Stat(tmpDir + "/" + dir); err == nil {
+			dirs = append(dirs, dir)
+		}
+	}
+	evaluate(t, "recover journal directories", false, nil, []string{"pvc-1"}, dirs, "directories")
+	left, err := p.journal.load()
+	evaluate(t, "recover journal entries", false, err, map[string]journalEntry{}, left, "journal entries")
+}
+
+func TestDumpState(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	exporter := &testExporter{config: tmpDir + "/test"}
+	first := createBlock(t, exporter, "1", tmpDir+"/pvc-1", exportParams{})
+	third := createBlock(t, exporter, "3", tmpDir+"/pvc-3", exportParams{})
+	if err := ioutil.WriteFile(exporter.config, []byte(first+third), 0600); err != nil {
+		t.Errorf("Error writing file %s: %v", exporter.config, err)
+	}
+	os.Mkdir(tmpDir+"/pvc-1", 0777)
+	p := newNFSProvisionerInternal(tmpDir+"/", fake.NewSimpleClientset(), exporter, nil)
+	p.exportIds = map[uint16]bool{1: true, 3: true}
+	p.exportStore.Create(&NFSExport{PV: "pvc-1", Path: tmpDir + "/pvc-1", ExportId: 1, Block: first})
+	p.usage = []volumeUsage{{pv: "pvc-1", capacity: 1024, bytes: 512, inodes: 2}}
+
+	state, err := p.DumpState()
+	gid := uint32(os.Getgid())
+	capacity, bytes, inodes := int64(1024), uint64(512), uint64(2)
+	expected := &State{
+		Exports: []ExportState{
+			{Path: tmpDir + "/pvc-1", ExportId: 1, PV: "pvc-1", Gid: &gid, Block: first, Capacity: &capacity, UsedBytes: &bytes, UsedInodes: &inodes},
+			{Path: tmpDir + "/pvc-3", ExportId: 3, Block: third},
+		},
+		ExportIds:    []uint16{1, 3},
+		NextExportId: 2,
+	}
+	evaluate(t, "dump state", false, err, expected, state, "state")
+}
+
+func TestReexportMissing(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	exporter := &testExporter{config: tmpDir + "/test"}
+	kept := createBlock(t, exporter, "1", tmpDir+"/pvc-1", exportParams{})
+	missing := createBlock(t, exporter, "2", tmpDir+"/pvc-2", exportParams{})
+	unclaimed := createBlock(t, exporter, "3", tmpDir+"/pvc-3", exportParams{})
+	err := ioutil.WriteFile(exporter.config, []byte(kept+unclaimed), 0600)
+	if err != nil {
+		t.Errorf("Error writing file %s: %v", exporter.config, err)
+	}
+	for _, dir := range []string{"pvc-1", "pvc-2", "pvc-3"} {
+		os.Mkdir(tmpDir+"/"+dir, 0777)
+	}
+
+	client := fake.NewSimpleClientset(
+		newProvisionedVolume("pvc-1", tmpDir+"/pvc-1", "1", kept),
+		newProvisionedVolume("pvc-2", tmpDir+"/pvc-2", "2", missing),
+	)
+	p := newNFSProvisionerInternal(tmpDir+"/", client, exporter, nil)
+
+	// Unlike reconcile, the export without a PV, e.g. one being provisioned,
+	// should be kept
+	err = p.ReexportMissing()
+
+	read, _ := ioutil.ReadFile(exporter.config)
+	evaluate(t, "reexport config", false, err, kept+unclaimed+missing, string(read), "config")
+}
+
+func TestDiffExports(t *testing.T) {
+	wanted := map[string]*v1.PersistentVolume{"pvc-1": nil, "pvc-2": nil, "pvc-3": nil}
+	active := map[string]bool{"pvc-1": true, "pvc-4": true}
+
+	expected := exportDrift{missing: []string{"pvc-2", "pvc-3"}, stale: []string{"pvc-4"}}
+	evaluate(t, "diff exports", false, nil, expected, diffExports(wanted, active), "drift")
+}
+
+func TestGetConfigExports(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	kernel := &kernelExporter{}
+
+	tests := []struct {
+		name            string
+		re              *regexp.Regexp
+		blocks          []string
+		expectedExports []configExport
+	}{
+		{
+			name:   "kernel exports 1, 3",
+			re:     kernelBlockRe,
+			blocks: []string{createBlock(t, kernel, "1", "/export/foo", exportParams{}), "/export/baz 1.1.1.1(ro)\n", createBlock(t, kernel, "3", "/export/bar", exportParams{})},
+			expectedExports: []configExport{
+				{block: createBlock(t, kernel, "1", "/export/foo", exportParams{}), path: "/export/foo", exportId: 1},
+				{block: createBlock(t, kernel, "3", "/export/bar", exportParams{}), path: "/export/bar", exportId: 3},
+			},
+		},
+		{
+			name:   "kernel exports with clients",
+			re:     kernelBlockRe,
+			blocks: []string{createBlock(t, kernel, "1", "/export/foo", exportParams{clients: []string{"10.244.0.0/24", "10.244.1.0/24"}}), createBlock(t, kernel, "2", "/export/bar", exportParams{clients: []string{"example.com"}})},
+			expectedExports: []configExport{
+				{block: createBlock(t, kernel, "1", "/export/foo", exportParams{clients: []string{"10.244.0.0/24", "10.244.1.0/24"}}), path: "/export/foo", exportId: 1},
+				{block: createBlock(t, kernel, "2", "/export/bar", exportParams{clients: []string{"example.com"}}), path: "/export/bar", exportId: 2},
+			},
+		},
+		{
+			name:   "kernel exports with security flavors and squash options",
+			re:     kernelBlockRe,
+			blocks: []string{createBlock(t, kernel, "1", "/export/foo", exportParams{sec: []string{"krb5p"}}), createBlock(t, kernel, "2", "/export/bar", exportParams{allSquash: true, anonUid: "1000", sec: []string{"krb5"}})},
+			expectedExports: []configExport{
+				{block: createBlock(t, kernel, "1", "/export/foo", exportParams{sec: []string{"krb5p"}}), path: "/export/foo", exportId: 1},
+				{block: createBlock(t, kernel, "2", "/export/bar", exportParams{allSquash: true, anonUid: "1000", sec: []string{"krb5"}}), path: "/export/bar", exportId: 2},
+			},
+		},
+	}
+	for i, test := range tests {
+		conf := tmpDir + "/test" + "-" + strconv.Itoa(i)
+		err := ioutil.WriteFile(conf, []byte(strings.Join(test.blocks, "")), 0755)
+		if err != nil {
+			t.Errorf("Error writing file %s: %v", conf, err)
+		}
+
+		exports, err := getConfigExports(conf, test.re)
+
+		evaluate(t, test.name, false, err, test.expectedExports, exports, "exports")
+	}
+}
+
+func TestMultiExporter(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	conf := tmpDir + "/vfs.conf"
+	if err := ioutil.WriteFile(conf, []byte{}, 0600); err != nil {
+		t.Errorf("Error writing file %s: %v", conf, err)
+	}
+	os.MkdirAll(tmpDir+"/exports.d", 0755)
+	e := &multiExporter{
+		ganesha:         &ganeshaExporter{ganeshaConfig: conf},
+		kernel:          &kernelExporter{exportsDir: tmpDir + "/exports.d"},
+		defaultExporter: ExporterGanesha,
+		otherServer:     "1.2.3.4",
+	}
+
+	ganeshaBlock := createBlock(t, e, "1", "/export/foo", exportParams{})
+	kernelBlock := createBlock(t, e, "2", "/export/bar", exportParams{exporter: ExporterKernel})
+	evaluate(t, "default exporter block", false, nil, true, e.of(ganeshaBlock) == exporter(e.ganesha), "exporter of block")
+	evaluate(t, "kernel exporter block", false, nil, true, e.of(kernelBlock) == exporter(e.kernel), "exporter of block")
+
+	evaluate(t, "add ganesha export", false, e.AddToConfig(ganeshaBlock), nil, nil, "")
+	evaluate(t, "add kernel export", false, e.AddToConfig(kernelBlock), nil, nil, "")
+	exportIds, err := e.GetConfigExportIds()
+	evaluate(t, "get export ids", false, err, map[uint16]bool{1: true, 2: true}, exportIds, "export ids")
+	exports, err := e.GetConfigExports()
+	paths := []string{}
+	for _, export := range exports {
+		paths = append(paths, export.path)
+	}
+	evaluate(t, "get exports", false, err, []string{"/export/foo", "/export/bar"}, paths, "export paths")
+
+	evaluate(t, "remove kernel export", false, e.RemoveFromConfig(kernelBlock), nil, nil, "")
+	exportIds, err = e.GetConfigExportIds()
+	evaluate(t, "get export ids after remove", false, err, map[uint16]bool{1: true}, exportIds, "export ids")
+
+	p := &nfsProvisioner{exporter: e, nfsPort: 32049, mountPort: DefaultMountPort}
+	server, err := p.getExportServer(exportParams{exporter: ExporterKernel})
+	evaluate(t, "other exporter server", false, err, "1.2.3.4", server, "server")
+	options, err := p.getMountOptions(exportParams{exporter: ExporterKernel})
+	evaluate(t, "other exporter mount options", false, err, "", options, "mount options")
+	options, err = p.getMountOptions(exportParams{})
+	evaluate(t, "default exporter mount options", false, err, "port=32049", options, "mount options")
+	evaluate(t, "validate kernel with both", false, p.validateExporter("kernel"), nil, nil, "")
+
+	p = &nfsProvisioner{exporter: &kernelExporter{}}
+	evaluate(t, "validate kernel with kernel", false, p.validateExporter("Kernel"), nil, nil, "")
+	evaluate(t, "validate ganesha with kernel", true, p.validateExporter("ganesha"), nil, nil, "")
+	evaluate(t, "validate unknown exporter", true, p.validateExporter("nfs"), nil, nil, "")
+}
+
+func TestKernelNFSv4Root(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	e := &kernelExporter{nfsv4Root: "/nfs4root"}
+	block := createBlock(t, e, "1", "/export/pvc-1", exportParams{})
+	evaluate(t, "block under root", false, nil, "\n/nfs4root/export/pvc-1 *(rw,insecure,root_squash,fsid=1)\n", block, "block")
+
+	// The root's block isn't one of the provisioner's exports
+	conf := tmpDir + "/exports"
+	err := ioutil.WriteFile(conf, []byte(e.rootBlock()+block), 0600)
+	if err != nil {
+		t.Errorf("Error writing file %s: %v", conf, err)
+	}
+	exports, err := getConfigExports(conf, kernelBlockRe)
+	evaluate(t, "root not an export", false, err, []configExport{{block: block, path: "/nfs4root/export/pvc-1", exportId: 1}}, exports, "exports")
+	evaluate(t, "path from root", false, nil, "/export/pvc-1", e.fromRootPath(exports[0].path), "path")
+}
+
+func TestKernelDropInFiles(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	e := &kernelExporter{exportsDir: tmpDir + "/exports.d"}
+	foo := createBlock(t, e, "1", "/export/pvc-1", exportParams{})
+	bar := createBlock(t, e, "2", "/export/pvc-2", exportParams{clients: []string{"10.0.0.0/8"}})
+	evaluate(t, "add foo", false, e.AddToConfig(foo), nil, nil, "")
+	evaluate(t, "add bar", false, e.AddToConfig(bar), nil, nil, "")
+
+	read, err := ioutil.ReadFile(tmpDir + "/exports.d/pvc-1.exports")
+	evaluate(t, "drop-in file", false, err, foo, string(read), "drop-in file")
+
+	files, err := e.configFiles()
+	evaluate(t, "config files", false, err, []string{"/etc/exports", tmpDir + "/exports.d/pvc-1.exports", tmpDir + "/exports.d/pvc-2.exports"}, files, "config files")
+
+	evaluate(t, "remove foo", false, e.RemoveFromConfig(foo), nil, nil, "")
+	_, err = os.Stat(tmpDir + "/exports.d/pvc-1.exports")
+	evaluate(t, "drop-in file deleted", false, nil, true, os.IsNotExist(err), "deleted")
+	_, err = os.Stat(tmpDir + "/exports.d/pvc-2.exports")
+	evaluate(t, "other drop-in file kept", false, err, nil, nil, "")
+
+	// Editing a drop-in file only needs the lock of its volume
+	file, err := e.configFile(bar)
+	evaluate(t, "config file of bar", false, err, tmpDir+"/exports.d/pvc-2.exports", file, "config file")
+	file, err = e.configFile(foo)
+	evaluate(t, "config file of new foo", false, err, tmpDir+"/exports.d/pvc-1.exports", file, "config file")
+	file, err = (&kernelExporter{}).configFile(foo)
+	evaluate(t, "config file without drop-ins", false, err, "/etc/exports", file, "config file")
+}
+
+func TestWithoutKernelEntry(t *testing.T) {
+	e := &kernelExporter{}
+	block := createBlock(t, e, "1", "/export/pvc-1", exportParams{clients: []string{"10.0.0.1", "10.0.0.2"}})
+	other := "/export/pvc-2 *(rw,insecure,root_squash,fsid=2)\n"
+	tests := []struct {
+		name     string
+		contents string
+		expected string
+		found    bool
+	}{
+		{
+			name:     "as added",
+			contents: other + block,
+			expected: other,
+			found:    true,
+		},
+		{
+			name:     "whitespace changed",
+			contents: other + "\n/export/pvc-1\t10.0.0.1(rw,insecure,root_squash,fsid=1)   10.0.0.2(rw,insecure,root_squash,fsid=1)\n",
+			expected: other,
+			found:    true,
+		},
+		{
+			name:     "clients reordered and moved before another export",
+			contents: "/export/pvc-1 10.0.0.2(rw,insecure,root_squash,fsid=1) 10.0.0.1(rw,insecure,root_squash,fsid=1)\n" + other,
+			expected: other,
+			found:    true,
+		},
+		{
+			name:     "continued line",
+			contents: "/export/pvc-1 \\\n  10.0.0.1(rw,insecure,root_squash,fsid=1)\n" + other,
+			expected: other,
+			found:    true,
+		},
+		{
+			name:     "subdirectory",
+			contents: "/export/pvc-1/sub *(rw)\n" + other,
+			expected: "/export/pvc-1/sub *(rw)\n" + other,
+			found:    false,
+		},
+	}
+	for _, test := range tests {
+		removed, found := withoutKernelEntry(test.contents, "/export/pvc-1")
+		evaluate(t, test.name, false, nil, test.expected, removed, "contents")
+		evaluate(t, test.name, false, nil, test.found, found, "found")
+	}
+
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	e = &kernelExporter{exportsDir: tmpDir + "/exports.d"}
+	os.Mkdir(e.exportsDir, 0755)
+	ioutil.WriteFile(tmpDir+"/exports.d/pvc-1.exports", []byte("/export/pvc-1  *(rw,insecure,root_squash,fsid=1)\n"), 0644)
+	evaluate(t, "remove edited drop-in", false, e.RemoveFromConfig(createBlock(t, e, "1", "/export/pvc-1", exportParams{})), nil, nil, "")
+	_, err := os.Stat(tmpDir + "/exports.d/pvc-1.exports")
+	evaluate(t, "edited drop-in file deleted", false, nil, true, os.IsNotExist(err), "deleted")
+}
+
+func TestRemoveKernelEntry(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	e := &kernelExporter{}
+	conf := tmpDir + "/exports"
+	var contents, expected bytes.Buffer
+	for i := 0; i < 20000; i++ {
+		block := createBlock(t, e, strconv.Itoa(i), fmt.Sprintf("/export/pvc-%d", i), exportParams{})
+		contents.WriteString(block)
+		if i != 10000 {
+			expected.WriteString(block)
+		}
+	}
+	ioutil.WriteFile(conf, contents.Bytes(), 0600)
+	added := createBlock(t, e, "20000", "/export/pvc-20000", exportParams{})
+	expected.WriteString(added)
+
+	err := addToFile(conf, added)
+	evaluate(t, "add entry", false, err, nil, nil, "")
+	err = removeKernelEntry(conf, createBlock(t, e, "10000", "/export/pvc-10000", exportParams{}))
+	read, _ := ioutil.ReadFile(conf)
+	evaluate(t, "remove entry", false, err, expected.String(), string(read), "contents")
+
+	before, _ := os.Stat(conf)
+	err = removeKernelEntry(conf, createBlock(t, e, "10000", "/export/pvc-10000", exportParams{}))
+	after, _ := os.Stat(conf)
+	evaluate(t, "remove missing entry", false, err, true, os.SameFile(before, after), "file left as it is")
+}
+
+func TestReapplyConfig(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	e := &kernelExporter{exportsDir: tmpDir + "/exports.d"}
+	kept := createBlock(t, e, "1", tmpDir+"/pvc-1", exportParams{})
+	edited := createBlock(t, e, "2", tmpDir+"/pvc-2", exportParams{})
+	evaluate(t, "add kept", false, e.AddToConfig(kept), nil, nil, "")
+	evaluate(t, "add edited", false, e.AddToConfig(strings.Replace(edited, "rw,", "rw,sync,", 1)), nil, nil, "")
+	foreign := createBlock(t, e, "3", tmpDir+"/other", exportParams{})
+	evaluate(t, "add foreign", false, e.AddToConfig(foreign), nil, nil, "")
+	for _, dir := range []string{"pvc-1", "pvc-2", "other"} {
+		os.Mkdir(tmpDir+"/"+dir, 0777)
+	}
+
+	client := fake.NewSimpleClientset(
+		newProvisionedVolume("pvc-1", tmpDir+"/pvc-1", "1", kept),
+		newProvisionedVolume("pvc-2", tmpDir+"/pvc-2", "2", edited),
+	)
+	p := newNFSProvisionerInternal(tmpDir+"/", client, e, nil)
+	recorder := record.NewFakeRecorder(10)
+	p.eventRecorder = recorder
+
+	conflicts, err := p.reapplyConfig(map[string]string{})
+	paths := []string{}
+	for path := range conflicts {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	evaluate(t, "conflicts", false, err, []string{tmpDir + "/other", tmpDir + "/pvc-2"}, paths, "conflicting paths")
+	evaluate(t, "conflict events", false, nil, []string{"Warning ExportConflict"}, eventReasons(recorder), "events")
+
+	// Conflicts are only warned about once
+	_, err = p.reapplyConfig(conflicts)
+	evaluate(t, "repeated conflict events", false, err, []string{}, eventReasons(recorder), "events")
+}
+
+func TestParseExportfsList(t *testing.T) {
+	out := "/export/foo    \t10.0.0.0/8\n" +
+		"/export/foo    \texample.com\n" +
+		"/export/a-very-long-directory-name\n" +
+		"\t\t<world>\n"
+	expected := []exportfsEntry{
+		{path: "/export/foo", host: "10.0.0.0/8", options: []string{}},
+		{path: "/export/foo", host: "example.com", options: []string{}},
+		{path: "/export/a-very-long-directory-name", host: "*", options: []string{}},
+	}
+	evaluate(t, "exportfs list", false, nil, expected, parseExportfsList(out), "entries")
+	evaluate(t, "no exports", false, nil, []exportfsEntry{}, parseExportfsList(""), "entries")
+
+	out = "/export/foo    \t<world>(rw,wdelay,insecure,root_squash,no_subtree_check,fsid=1,sec=sys)\n" +
+		"/export/a-very-long-directory-name\n" +
+		"\t\t10.0.0.0/8(ro,fsid=2)\n"
+	expected = []exportfsEntry{
+		{path: "/export/foo", host: "*", options: []string{"rw", "wdelay", "insecure", "root_squash", "no_subtree_check", "fsid=1", "sec=sys"}},
+		{path: "/export/a-very-long-directory-name", host: "10.0.0.0/8", options: []string{"ro", "fsid=2"}},
+	}
+	evaluate(t, "exportfs -v list", false, nil, expected, parseExportfsList(out), "entries")
+}
+
+func TestMissingKernelClients(t *testing.T) {
+	block := createBlock(t, &kernelExporter{}, "1", "/export/foo", exportParams{clients: []string{"10.0.0.0/8", "example.com"}})
+	tests := []struct {
+		name     string
+		active   []exportfsEntry
+		expected []string
+	}{
+		{
+			name: "all active",
+			active: []exportfsEntry{
+				{path: "/export/foo", host: "10.0.0.0/8", options: []string{"rw", "wdelay", "insecure", "root_squash", "fsid=1"}},
+				{path: "/export/foo", host: "example.com", options: []string{"rw", "insecure", "root_squash", "fsid=1", "sec=sys"}},
+			},
+			expected: []string{},
+		},
+		{
+			name: "one client missing",
+			active: []exportfsEntry{
+				{path: "/export/foo", host: "10.0.0.0/8", options: []string{"rw", "insecure", "root_squash", "fsid=1"}},
+				{path: "/export/bar", host: "example.com", options: []string{"rw", "insecure", "root_squash", "fsid=1"}},
+			},
+			expected: []string{"example.com"},
+		},
+		{
+			name: "options changed",
+			active: []exportfsEntry{
+				{path: "/export/foo", host: "10.0.0.0/8", options: []string{"ro", "insecure", "root_squash", "fsid=1"}},
+				{path: "/export/foo", host: "example.com", options: []string{"rw", "insecure", "root_squash", "fsid=1"}},
+			},
+			expected: []string{"10.0.0.0/8"},
+		},
+		{
+			name:     "none active",
+			active:   []exportfsEntry{},
+			expected: []string{"10.0.0.0/8", "example.com"},
+		},
+	}
+	for _, test := range tests {
+		missing, err := missingKernelClients(block, test.active)
+		evaluate(t, test.name, false, err, test.expected, missing, "missing clients")
+	}
+}
+
+func TestParseKernelBlock(t *testing.T) {
+	tests := []struct {
+		name            string
+		block           string
+		expectedPath    string
+		expectedClients []kernelClient
+		expectError     bool
+	}{
+		{
+			name:            "created block",
+			block:           createBlock(t, &kernelExporter{}, "1", "/export/foo", exportParams{}),
+			expectedPath:    "/export/foo",
+			expectedClients: []kernelClient{{host: "*", options: "rw,insecure,root_squash,fsid=1"}},
+		},
+		{
+			name:         "created block with clients",
+			block:        createBlock(t, &kernelExporter{}, "1", "/export/foo", exportParams{clients: []string{"10.0.0.0/8", "example.com"}}),
+			expectedPath: "/export/foo",
+			expectedClients: []kernelClient{
+				{host: "10.0.0.0/8", options: "rw,insecure,root_squash,fsid=1"},
+				{host: "example.com", options: "rw,insecure,root_squash,fsid=1"},
+			},
+		},
+		{
+			name:         "created block with security flavors",
+			block:        createBlock(t, &kernelExporter{}, "1", "/export/foo", exportParams{sec: []string{"krb5p", "krb5i"}}),
+			expectedPath: "/export/foo",
+			expectedClients: []kernelClient{
+				{host: "*", options: "rw,insecure,root_squash,fsid=1,sec=krb5p:krb5i"},
+			},
+		},
+		{
+			name:         "created block with all squash",
+			block:        createBlock(t, &kernelExporter{}, "1", "/export/foo", exportParams{allSquash: true, anonUid: "1000", anonGid: "2000"}),
+			expectedPath: "/export/foo",
+			expectedClients: []kernelClient{
+				{host: "*", options: "rw,insecure,root_squash,fsid=1,all_squash,anonuid=1000,anongid=2000"},
+			},
+		},
+		{
+			name:         "multiple clients",
+			block:        "/export/foo 10.0.0.0/8(rw) (ro) example.com\n",
+			expectedPath: "/export/foo",
+			expectedClients: []kernelClient{
+				{host: "10.0.0.0/8", options: "rw"},
+				{host: "*", options: "ro"},
+				{host: "example.com", options: ""},
+			},
+		},
+		{
+			name:        "no clients",
+			block:       "/export/foo\n",
+			expectError: true,
+		},
+		{
+			name:        "malformed client",
+			block:       "/export/foo *(rw\n",
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		path, clients, err := parseKernelBlock(test.block)
+		if test.expectError {
+			evaluate(t, test.name, true, err, nil, nil, "clients")
+			continue
+		}
+		evaluate(t, test.name, false, err, test.expectedPath, path, "path")
+		evaluate(t, test.name, false, err, test.expectedClients, clients, "clients")
+	}
+}
+
+func TestGetServer(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	// service > node > podIP
+	tests := []struct {
+		name           string
+		objs           []runtime.Object
+		podIP          string
+		service        string
+		namespace      string
+		node           string
+		serverHostname string
+		useServiceDNS  bool
+		useLB          bool
+		servicePorts   []ServicePort
+		useNodePort    bool
+		expectedServer string
+		expectError    bool
+	}{
+		{
+			name: "server hostname overrides invalid service",
+			objs: []runtime.Object{
+				newService("foo", "1.1.1.1"),
+				newEndpoints("foo", []string{"3.3.3.3"}, []ServicePort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}}),
+			},
+			podIP:          "2.2.2.2",
+			service:        "foo",
+			namespace:      "default",
+			node:           "",
+			serverHostname: "nfs.example.com",
+			expectedServer: "nfs.example.com",
+			expectError:    false,
+		},
+		{
+			name: "valid service",
+			objs: []runtime.Object{
+				newService("foo", "1.1.1.1"),
+				newEndpoints("foo", []string{"2.2.2.2"}, []ServicePort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}}),
+			},
+			podIP:          "2.2.2.2",
+			service:        "foo",
+			namespace:      "default",
+			node:           "",
+			expectedServer: "1.1.1.1",
+			expectError:    false,
+		},
+		{
+			name: "valid service, use DNS name",
+			objs: []runtime.Object{
+				newService("foo", "1.1.1.1"),
+				newEndpoints("foo", []string{"2.2.2.2"}, []ServicePort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}}),
+			},
+			podIP:          "2.2.2.2",
+			service:        "foo",
+			namespace:      "default",
+			node:           "",
+			useServiceDNS:  true,
+			expectedServer: "foo.default.svc.cluster.local",
+			expectError:    false,
+		},
+		{
+			name: "valid LoadBalancer service, use ingress",
+			objs: []runtime.Object{
+				newLoadBalancerService("foo", "1.1.1.1", "4.4.4.4"),
+				newEndpoints("foo", []string{"2.2.2.2"}, []ServicePort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}}),
+			},
+			podIP:          "2.2.2.2",
+			service:        "foo",
+			namespace:      "default",
+			node:           "",
+			useLB:          true,
+			expectedServer: "4.4.4.4",
+			expectError:    false,
+		},
+		{
+			name: "valid LoadBalancer service, ingress never assigned",
+			objs: []runtime.Object{
+				newLoadBalancerService("foo", "1.1.1.1", ""),
+				newEndpoints("foo", []string{"2.2.2.2"}, []ServicePort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}}),
+			},
+			podIP:          "2.2.2.2",
+			service:        "foo",
+			namespace:      "default",
+			node:           "",
+			useLB:          true,
+			expectedServer: "",
+			expectError:    true,
+		},
+		{
+			name: "valid LoadBalancer service, don't use ingress",
+			objs: []runtime.Object{
+				newLoadBalancerService("foo", "1.1.1.1", "4.4.4.4"),
+				newEndpoints("foo", []string{"2.2.2.2"}, []ServicePort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}}),
+			},
+			podIP:          "2.2.2.2",
+			service:        "foo",
+			namespace:      "default",
+			node:           "",
+			useLB:          false,
+			expectedServer: "1.1.1.1",
+			expectError:    false,
+		},
+		{
+			name: "valid service, multiple endpoints",
+			objs: []runtime.Object{
+				newService("foo", "1.1.1.1"),
+				newEndpoints("foo", []string{"3.3.3.3", "2.2.2.2"}, []ServicePort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}}),
+			},
+			podIP:          "2.2.2.2",
+			service:        "foo",
+			namespace:      "default",
+			node:           "",
+			expectedServer: "1.1.1.1",
+			expectError:    false,
+		},
+		{
+			name: "valid headless service, endpoint has hostname",
+			objs: []runtime.Object{
+				newService("foo", v1.ClusterIPNone),
+				newHostnameEndpoints("foo", "2.2.2.2", "nfs-0", []ServicePort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}}),
+			},
+			podIP:          "2.2.2.2",
+			service:        "foo",
+			namespace:      "default",
+			node:           "",
+			expectedServer: "nfs-0.foo.default.svc.cluster.local",
+			expectError:    false,
+		},
+		{
+			name: "invalid headless service, endpoint has no hostname",
+			objs: []runtime.Object{
+				newService("foo", v1.ClusterIPNone),
+				newEndpoints("foo", []string{"2.2.2.2"}, []ServicePort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}}),
+			},
+			podIP:          "2.2.2.2",
+			service:        "foo",
+			namespace:      "default",
+			node:           "",
+			expectedServer: "",
+			expectError:    true,
+		},
+		{
+			name: "valid service, custom ports",
+			objs: []runtime.Object{
+				newService("foo", "1.1.1.1"),
+				newEndpoints("foo", []string{"2.2.2.2"}, []ServicePort{{2049, v1.ProtocolTCP}}),
+			},
+			podIP:          "2.2.2.2",
+			service:        "foo",
+			namespace:      "default",
+			node:           "",
+			servicePorts:   []ServicePort{{2049, v1.ProtocolTCP}},
+			expectedServer: "1.1.1.1",
+			expectError:    false,
 		},
-	}
-	for i, test := range tests {
-		conf := tmpDir + "/test" + "-" + strconv.Itoa(i)
-		err := ioutil.WriteFile(conf, []byte(test.configContents), 0755)
-		if err != nil {
-			t.Errorf("Error writing file %s: %v", conf, err)
-		}
-
-		exportIds, err := getConfigExportIds(conf, test.re)
-
-		evaluate(t, test.name, test.expectError, err, test.expectedExportIds, exportIds, "export ids")
-	}
-}
-
-func TestGetServer(t *testing.T) {
-	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
-	defer os.RemoveAll(tmpDir)
-
-	// service > node > podIP
-	tests := []struct {
-		name           string
-		objs           []runtime.Object
-		podIP          string
-		service        string
-		namespace      string
-		node           string
-		expectedServer string
-		expectError    bool
-	}{
 		{
-			name: "valid service",
+			name: "valid service, ports not validated",
 			objs: []runtime.Object{
 				newService("foo", "1.1.1.1"),
-				newEndpoints("foo", []string{"2.2.2.2"}, []endpointPort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}}),
+				newEndpoints("foo", []string{"2.2.2.2"}, []ServicePort{{12345, v1.ProtocolTCP}}),
 			},
 			podIP:          "2.2.2.2",
 			service:        "foo",
 			namespace:      "default",
 			node:           "",
+			servicePorts:   []ServicePort{},
 			expectedServer: "1.1.1.1",
 			expectError:    false,
 		},
+		{
+			name: "invalid service, missing custom port",
+			objs: []runtime.Object{
+				newService("foo", "1.1.1.1"),
+				newEndpoints("foo", []string{"2.2.2.2"}, []ServicePort{{2049, v1.ProtocolTCP}}),
+			},
+			podIP:          "2.2.2.2",
+			service:        "foo",
+			namespace:      "default",
+			node:           "",
+			servicePorts:   []ServicePort{{2049, v1.ProtocolTCP}, {875, v1.ProtocolTCP}},
+			expectedServer: "",
+			expectError:    true,
+		},
+		{
+			name: "valid NodePort service, use node IP",
+			objs: []runtime.Object{
+				newNodePortService("foo", "1.1.1.1", 32049),
+				newEndpoints("foo", []string{"2.2.2.2"}, []ServicePort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}}),
+				newNode("bar", "5.5.5.5"),
+			},
+			podIP:          "2.2.2.2",
+			service:        "foo",
+			namespace:      "default",
+			node:           "bar",
+			useNodePort:    true,
+			expectedServer: "5.5.5.5",
+			expectError:    false,
+		},
+		{
+			name: "invalid NodePort service, no node",
+			objs: []runtime.Object{
+				newNodePortService("foo", "1.1.1.1", 32049),
+				newEndpoints("foo", []string{"2.2.2.2"}, []ServicePort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}}),
+			},
+			podIP:          "2.2.2.2",
+			service:        "foo",
+			namespace:      "default",
+			node:           "",
+			useNodePort:    true,
+			expectedServer: "",
+			expectError:    true,
+		},
+		{
+			name: "invalid NodePort service, NFS port not mapped",
+			objs: []runtime.Object{
+				newNodePortService("foo", "1.1.1.1", 0),
+				newEndpoints("foo", []string{"2.2.2.2"}, []ServicePort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}}),
+				newNode("bar", "5.5.5.5"),
+			},
+			podIP:          "2.2.2.2",
+			service:        "foo",
+			namespace:      "default",
+			node:           "bar",
+			useNodePort:    true,
+			expectedServer: "",
+			expectError:    true,
+		},
 		{
 			name: "invalid service, ports don't match exactly",
 			objs: []runtime.Object{
 				newService("foo", "1.1.1.1"),
-				newEndpoints("foo", []string{"2.2.2.2"}, []endpointPort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {999999, v1.ProtocolTCP}}),
+				newEndpoints("foo", []string{"2.2.2.2"}, []ServicePort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {999999, v1.ProtocolTCP}}),
 			},
 			podIP:          "2.2.2.2",
 			service:        "foo",
@@ -463,7 +3472,7 @@ func TestGetServer(t *testing.T) {
 			name: "invalid service, points to different pod IP",
 			objs: []runtime.Object{
 				newService("foo", "1.1.1.1"),
-				newEndpoints("foo", []string{"3.3.3.3"}, []endpointPort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}}),
+				newEndpoints("foo", []string{"3.3.3.3"}, []ServicePort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}}),
 			},
 			podIP:          "2.2.2.2",
 			service:        "foo",
@@ -476,7 +3485,7 @@ func TestGetServer(t *testing.T) {
 			name: "invalid service, should error even though valid node",
 			objs: []runtime.Object{
 				newService("foo", "1.1.1.1"),
-				newEndpoints("foo", []string{"3.3.3.3"}, []endpointPort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}}),
+				newEndpoints("foo", []string{"3.3.3.3"}, []ServicePort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}}),
 			},
 			podIP:          "2.2.2.2",
 			service:        "foo",
@@ -489,7 +3498,7 @@ func TestGetServer(t *testing.T) {
 			name: "valid service but no namespace",
 			objs: []runtime.Object{
 				newService("foo", "1.1.1.1"),
-				newEndpoints("foo", []string{"2.2.2.2"}, []endpointPort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}}),
+				newEndpoints("foo", []string{"2.2.2.2"}, []ServicePort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}}),
 			},
 			podIP:          "2.2.2.2",
 			service:        "foo",
@@ -502,7 +3511,7 @@ func TestGetServer(t *testing.T) {
 			name: "valid service, valid node, should use service",
 			objs: []runtime.Object{
 				newService("foo", "1.1.1.1"),
-				newEndpoints("foo", []string{"2.2.2.2"}, []endpointPort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}}),
+				newEndpoints("foo", []string{"2.2.2.2"}, []ServicePort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}}),
 			},
 			podIP:          "2.2.2.2",
 			service:        "foo",
@@ -547,7 +3556,16 @@ func TestGetServer(t *testing.T) {
 		}
 
 		client := fake.NewSimpleClientset(test.objs...)
-		p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{})
+		p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{}, nil)
+		p.serverHostname = test.serverHostname
+		p.useServiceDNS = test.useServiceDNS
+		p.useLoadBalancer = test.useLB
+		p.useNodePort = test.useNodePort
+		if test.servicePorts != nil {
+			p.servicePorts = test.servicePorts
+		}
+		p.loadBalancerPollInterval = 10 * time.Millisecond
+		p.loadBalancerTimeout = 50 * time.Millisecond
 
 		server, err := p.getServer()
 
@@ -560,6 +3578,250 @@ func TestGetServer(t *testing.T) {
 	}
 }
 
+func TestParseServicePorts(t *testing.T) {
+	tests := []struct {
+		name          string
+		ports         string
+		expectedPorts []ServicePort
+		expectError   bool
+	}{
+		{
+			name:          "default",
+			ports:         "2049/TCP,20048/TCP,111/UDP,111/TCP",
+			expectedPorts: DefaultServicePorts,
+		},
+		{
+			name:          "lower case and spaces",
+			ports:         " 2049/tcp, ",
+			expectedPorts: []ServicePort{{2049, v1.ProtocolTCP}},
+		},
+		{
+			name:          "empty",
+			ports:         "",
+			expectedPorts: []ServicePort{},
+		},
+		{
+			name:        "no protocol",
+			ports:       "2049",
+			expectError: true,
+		},
+		{
+			name:        "bad port",
+			ports:       "99999/TCP",
+			expectError: true,
+		},
+		{
+			name:        "bad protocol",
+			ports:       "2049/SCTP",
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		ports, err := ParseServicePorts(test.ports)
+		if test.expectError {
+			evaluate(t, test.name, true, err, nil, nil, "ports")
+			continue
+		}
+		evaluate(t, test.name, false, err, test.expectedPorts, ports, "ports")
+	}
+}
+
+func TestGetMountOptions(t *testing.T) {
+	tests := []struct {
+		name            string
+		nfsPort         int
+		mountPort       int
+		nfsv4Root       string
+		sec             []string
+		expectedOptions string
+	}{
+		{
+			name:            "standard ports",
+			nfsPort:         2049,
+			mountPort:       20048,
+			expectedOptions: "",
+		},
+		{
+			name:            "custom nfs port",
+			nfsPort:         12049,
+			mountPort:       20048,
+			expectedOptions: "port=12049",
+		},
+		{
+			name:            "custom ports",
+			nfsPort:         12049,
+			mountPort:       30048,
+			expectedOptions: "port=12049,mountport=30048",
+		},
+		{
+			name:            "kernel NFSv4 only",
+			nfsPort:         12049,
+			mountPort:       30048,
+			nfsv4Root:       "/nfs4root",
+			expectedOptions: "nfsvers=4,port=12049",
+		},
+		{
+			name:            "kerberos",
+			nfsPort:         2049,
+			mountPort:       20048,
+			sec:             []string{"krb5p", "krb5i"},
+			expectedOptions: "sec=krb5p",
+		},
+	}
+	for _, test := range tests {
+		p := &nfsProvisioner{nfsPort: test.nfsPort, mountPort: test.mountPort}
+		if test.nfsv4Root != "" {
+			p.exporter = &kernelExporter{nfsv4Root: test.nfsv4Root}
+		}
+		options, err := p.getMountOptions(exportParams{sec: test.sec})
+		evaluate(t, test.name, false, err, test.expectedOptions, options, "mount options")
+	}
+}
+
+func TestGetNodePortMountOptions(t *testing.T) {
+	os.Setenv(serviceEnv, "foo")
+	os.Setenv(namespaceEnv, "default")
+	defer os.Unsetenv(serviceEnv)
+	defer os.Unsetenv(namespaceEnv)
+
+	client := fake.NewSimpleClientset(newNodePortService("foo", "1.1.1.1", 32049))
+	p := &nfsProvisioner{
+		client:       client,
+		nfsPort:      DefaultNFSPort,
+		mountPort:    DefaultMountPort,
+		useNodePort:  true,
+		serviceEnv:   serviceEnv,
+		namespaceEnv: namespaceEnv,
+	}
+	options, err := p.getMountOptions(exportParams{})
+	evaluate(t, "NodePort service", false, err, "port=32049,mountport=30048", options, "mount options")
+}
+
+func TestGetServerFromCache(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	os.Setenv(podIPEnv, "2.2.2.2")
+	os.Setenv(serviceEnv, "foo")
+	os.Setenv(namespaceEnv, "default")
+	defer os.Unsetenv(podIPEnv)
+	defer os.Unsetenv(serviceEnv)
+	defer os.Unsetenv(namespaceEnv)
+
+	// The client has no service, so the server can only come from the cache
+	client := fake.NewSimpleClientset()
+	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{}, nil)
+	p.serviceCache = &serviceCache{
+		services:  cache.NewStore(cache.MetaNamespaceKeyFunc),
+		endpoints: cache.NewStore(cache.MetaNamespaceKeyFunc),
+	}
+	p.serviceCache.services.Add(newService("foo", "1.1.1.1"))
+	p.serviceCache.endpoints.Add(newEndpoints("foo", []string{"2.2.2.2"}, []ServicePort{{2049, v1.ProtocolTCP}, {20048, v1.ProtocolTCP}, {111, v1.ProtocolUDP}, {111, v1.ProtocolTCP}}))
+
+	server, err := p.getServer()
+	evaluate(t, "service in cache", false, err, "1.1.1.1", server, "server")
+
+	// Falls back to the client if the cache doesn't have the service
+	p.serviceCache.services.Delete(newService("foo", "1.1.1.1"))
+	server, err = p.getServer()
+	evaluate(t, "service not in cache", true, err, "", server, "server")
+}
+
+func TestUpdateUsage(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	for _, dir := range []string{"/pvc-1/sub", "/pvc-2"} {
+		if err := os.MkdirAll(tmpDir+dir, 0777); err != nil {
+			t.Fatalf("Error creating dir %s: %v", dir, err)
+		}
+	}
+	for _, file := range []string{"/pvc-1/a", "/pvc-1/sub/b"} {
+		if err := ioutil.WriteFile(tmpDir+file, []byte("foo"), 0644); err != nil {
+			t.Fatalf("Error writing file %s: %v", file, err)
+		}
+	}
+	if err := os.Link(tmpDir+"/pvc-1/a", tmpDir+"/pvc-1/c"); err != nil {
+		t.Fatalf("Error linking file: %v", err)
+	}
+
+	bound := newProvisionedVolume("pvc-1", tmpDir+"/pvc-1", "1", "")
+	bound.Spec.Capacity = v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Ki")}
+	bound.Spec.ClaimRef = &v1.ObjectReference{Name: "claim-1", Namespace: "default"}
+	client := fake.NewSimpleClientset(
+		bound,
+		newProvisionedVolume("pvc-2", tmpDir+"/pvc-2", "2", ""),
+		newProvisionedVolume("pvc-3", "/elsewhere/pvc-3", "3", ""),
+	)
+	p := newNFSProvisionerInternal(tmpDir+"/", client, &testExporter{}, nil)
+
+	evaluate(t, "update usage", false, p.UpdateUsage(), nil, nil, "")
+	inodes := map[string]float64{}
+	capacities := map[string]float64{}
+	for _, f := range p.collectUsage() {
+		for _, s := range f.Samples {
+			switch f.Name {
+			case "nfs_provisioner_volume_used_inodes":
+				inodes[s.Labels["pv"]+"/"+s.Labels["namespace"]+"/"+s.Labels["pvc"]] = s.Value
+			case "nfs_provisioner_volume_capacity_bytes":
+				capacities[s.Labels["pv"]] = s.Value
+			}
+		}
+	}
+	// The directories, a, its hard link c once, and sub/b
+	evaluate(t, "inodes", false, nil, map[string]float64{"pvc-1/default/claim-1": 4, "pvc-2//": 1}, inodes, "inodes")
+	evaluate(t, "capacities", false, nil, map[string]float64{"pvc-1": 1024, "pvc-2": 0}, capacities, "capacities")
+}
+
+func TestCheckLive(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		name        string
+		exportDir   string
+		expectError bool
+	}{
+		{
+			name:        "writable export dir",
+			exportDir:   tmpDir + "/",
+			expectError: false,
+		},
+		{
+			name:        "missing export dir",
+			exportDir:   tmpDir + "/missing/",
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		p := newNFSProvisionerInternal(test.exportDir, fake.NewSimpleClientset(), &testExporter{}, nil)
+		err := p.CheckLive()
+		files, _ := ioutil.ReadDir(tmpDir)
+		evaluate(t, test.name, test.expectError, err, 0, len(files), "leftover files")
+	}
+}
+
+func newProvisionedVolume(name, path, exportId, block string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: v1.ObjectMeta{
+			Name: name,
+			Annotations: map[string]string{
+				annCreatedBy: createdBy,
+				annExportId:  exportId,
+				annBlock:     block,
+			},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				NFS: &v1.NFSVolumeSource{
+					Server: "1.1.1.1",
+					Path:   path,
+				},
+			},
+		},
+	}
+}
+
 func newService(name, clusterIP string) *v1.Service {
 	return &v1.Service{
 		ObjectMeta: v1.ObjectMeta{
@@ -572,19 +3834,50 @@ func newService(name, clusterIP string) *v1.Service {
 	}
 }
 
-type endpointPort struct {
-	port     int32
-	protocol v1.Protocol
+func newNodePortService(name, clusterIP string, nfsNodePort int32) *v1.Service {
+	service := newService(name, clusterIP)
+	service.Spec.Type = v1.ServiceTypeNodePort
+	service.Spec.Ports = []v1.ServicePort{
+		{Name: "nfs", Port: 2049, Protocol: v1.ProtocolTCP, NodePort: nfsNodePort},
+		{Name: "mountd", Port: 20048, Protocol: v1.ProtocolTCP, NodePort: 30048},
+	}
+	return service
+}
+
+func newNode(name, internalIP string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: v1.ObjectMeta{
+			Name: name,
+		},
+		Status: v1.NodeStatus{
+			Addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: internalIP}},
+		},
+	}
+}
+
+func newHostnameEndpoints(name, ip, hostname string, ports []ServicePort) *v1.Endpoints {
+	endpoints := newEndpoints(name, []string{ip}, ports)
+	endpoints.Subsets[0].Addresses[0].Hostname = hostname
+	return endpoints
 }
 
-func newEndpoints(name string, ips []string, ports []endpointPort) *v1.Endpoints {
+func newLoadBalancerService(name, clusterIP, ingressIP string) *v1.Service {
+	service := newService(name, clusterIP)
+	service.Spec.Type = v1.ServiceTypeLoadBalancer
+	if ingressIP != "" {
+		service.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: ingressIP}}
+	}
+	return service
+}
+
+func newEndpoints(name string, ips []string, ports []ServicePort) *v1.Endpoints {
 	epAddresses := []v1.EndpointAddress{}
 	for _, ip := range ips {
 		epAddresses = append(epAddresses, v1.EndpointAddress{IP: ip, Hostname: "", NodeName: nil, TargetRef: nil})
 	}
 	epPorts := []v1.EndpointPort{}
 	for i, port := range ports {
-		epPorts = append(epPorts, v1.EndpointPort{Name: strconv.Itoa(i), Port: port.port, Protocol: port.protocol})
+		epPorts = append(epPorts, v1.EndpointPort{Name: strconv.Itoa(i), Port: port.Port, Protocol: port.Protocol})
 	}
 	return &v1.Endpoints{
 		ObjectMeta: v1.ObjectMeta{
@@ -611,25 +3904,164 @@ func (e *testExporter) GetConfig() string {
 	return e.config
 }
 
+// createBlock creates a block with the given exporter, failing the test if it
+// can't.
+func createBlock(t *testing.T, e exporter, exportId, path string, params exportParams) string {
+	block, err := e.CreateBlock(exportId, path, params)
+	if err != nil {
+		t.Fatalf("error creating block: %v", err)
+	}
+	return block
+}
+
 func (e *testExporter) GetConfigExportIds() (map[uint16]bool, error) {
 	return map[uint16]bool{}, nil
 }
 
-func (e *testExporter) CreateBlock(exportId, path string) string {
-	return "\nExport_Id = " + exportId + ";\n"
+func (e *testExporter) GetConfigExports() ([]configExport, error) {
+	return getConfigExports(e.GetConfig(), regexp.MustCompile("\nExport_Id = (?P<id>[0-9]+);\nPath = (?P<path>[^;]+);\n"))
+}
+
+func (e *testExporter) CreateBlock(exportId, path string, params exportParams) (string, error) {
+	return "\nExport_Id = " + exportId + ";\nPath = " + path + ";\n", nil
+}
+
+func (e *testExporter) AddToConfig(block string) error {
+	return addToFile(e.GetConfig(), block)
+}
+
+func (e *testExporter) RemoveFromConfig(block string) error {
+	return removeFromFile(e.GetConfig(), block)
+}
+
+func (e *testExporter) Export(block string) error {
+	if strings.Contains(block, "FAIL_TO_EXPORT_ME") {
+		return errors.New("fake error")
+	}
+	return nil
+}
+
+func (e *testExporter) Unexport(block string) error {
+	return nil
+}
+
+// failingUnexportExporter is a testExporter that fails to unexport while fail
+// is true.
+type failingUnexportExporter struct {
+	testExporter
+	fail bool
 }
 
-func (e *testExporter) Export(path string) error {
-	if strings.Contains(path, "FAIL_TO_EXPORT_ME") {
+func (e *failingUnexportExporter) Unexport(block string) error {
+	if e.fail {
 		return errors.New("fake error")
 	}
 	return nil
 }
 
-func (e *testExporter) Unexport(volume *v1.PersistentVolume) error {
+// testSnapshotter takes snapshots by copying exported directories into dir.
+type testSnapshotter struct {
+	dir string
+}
+
+var _ snapshotter = &testSnapshotter{}
+
+func (s *testSnapshotter) snapshot(pvName, id string) (string, error) {
+	path := s.dir + "/" + id
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return "", err
+	}
+	src := strings.TrimSuffix(s.dir, "/snapshots") + "/" + pvName
+	if out, err := exec.Command("cp", "-a", src, path).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("%v: %s", err, out)
+	}
+	return path + "/" + pvName, nil
+}
+
+func (s *testSnapshotter) deleteSnapshot(id string) error {
+	return os.RemoveAll(s.dir + "/" + id)
+}
+
+// testBatchExporter is a testExporter that records the blocks it's asked to
+// export at once.
+type testBatchExporter struct {
+	testExporter
+	batches [][]string
+}
+
+var _ batchExporter = &testBatchExporter{}
+
+func (e *testBatchExporter) ExportBatch(blocks []string) error {
+	e.batches = append(e.batches, blocks)
+	return nil
+}
+
+type testExportStore struct {
+	exports map[string]*NFSExport
+}
+
+var _ ExportStore = &testExportStore{}
+
+func newTestExportStore() *testExportStore {
+	return &testExportStore{exports: map[string]*NFSExport{}}
+}
+
+func (s *testExportStore) Get(pvName string) (*NFSExport, error) {
+	return s.exports[pvName], nil
+}
+
+func (s *testExportStore) Create(export *NFSExport) error {
+	s.exports[export.PV] = export
+	return nil
+}
+
+func (s *testExportStore) Update(export *NFSExport) error {
+	s.exports[export.PV] = export
 	return nil
 }
 
+func (s *testExportStore) Delete(pvName string) error {
+	delete(s.exports, pvName)
+	return nil
+}
+
+func (s *testExportStore) List() ([]*NFSExport, error) {
+	exports := []*NFSExport{}
+	for _, export := range s.exports {
+		exports = append(exports, export)
+	}
+	return exports, nil
+}
+
+// failingDeleteExportStore is a testExportStore that fails to delete records
+// while fail is true.
+type failingDeleteExportStore struct {
+	testExportStore
+	fail bool
+}
+
+func (s *failingDeleteExportStore) Delete(pvName string) error {
+	if s.fail {
+		return errors.New("fake error")
+	}
+	return s.testExportStore.Delete(pvName)
+}
+
+// eventReasons returns the types and reasons of the events the given recorder
+// has recorded so far.
+func eventReasons(recorder *record.FakeRecorder) []string {
+	reasons := []string{}
+	for {
+		select {
+		case event := <-recorder.Events:
+			fields := strings.SplitN(event, " ", 3)
+			reasons = append(reasons, fields[0]+" "+fields[1])
+		default:
+			return reasons
+		}
+	}
+}
+
 func evaluate(t *testing.T, name string, expectError bool, err error, expected interface{}, got interface{}, output string) {
 	if !expectError && err != nil {
 		t.Logf("test case: %s", name)
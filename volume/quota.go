@@ -0,0 +1,161 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+
+	"github.com/ghodss/yaml"
+	"github.com/wongma7/nfs-provisioner/metrics"
+	"k8s.io/client-go/1.4/pkg/api/resource"
+)
+
+// defaultQuota is the key in the namespace quotas file of the quota of every
+// namespace not listed.
+const defaultQuota = "*"
+
+// quotaExceededError is the error of reserving capacity that would push the
+// namespace of the claim over its quota.
+type quotaExceededError struct {
+	namespace string
+	quota     int64
+	used      int64
+	capacity  int64
+}
+
+func (e *quotaExceededError) Error() string {
+	return fmt.Sprintf("namespace quota exceeded: namespace %s has %v bytes provisioned of its quota of %v bytes, %v more bytes would exceed it", e.namespace, e.used, e.quota, e.capacity)
+}
+
+// ParseNamespaceQuotas parses the given namespace quotas file: a YAML map of
+// namespaces to the total capacity of the PVs provisioned for their claims,
+// e.g. "team-a: 100Gi", and "*" to that of every namespace not listed.
+func ParseNamespaceQuotas(data []byte) (map[string]int64, error) {
+	raw := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("must be a map of quantities by namespace: %v", err)
+	}
+	quotas := map[string]int64{}
+	for namespace, v := range raw {
+		var value string
+		switch v := v.(type) {
+		case string:
+			value = v
+		case float64:
+			value = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return nil, fmt.Errorf("invalid quota %v of namespace %s: must be a quantity like 100Gi", v, namespace)
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quota %q of namespace %s: %v", value, namespace, err)
+		}
+		if quantity.Value() < 0 {
+			return nil, fmt.Errorf("invalid quota %q of namespace %s: must not be negative", value, namespace)
+		}
+		quotas[namespace] = quantity.Value()
+	}
+	return quotas, nil
+}
+
+// getNamespaceQuotas reads the namespace quotas file, if there is one. It's
+// read on every claim, so that edits of the ConfigMap it's mounted from apply
+// without restarting.
+func (p *nfsProvisioner) getNamespaceQuotas() (map[string]int64, error) {
+	if p.namespaceQuotas == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(p.namespaceQuotas)
+	if err != nil {
+		return nil, fmt.Errorf("error reading namespace quotas: %v", err)
+	}
+	quotas, err := ParseNamespaceQuotas(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing namespace quotas %s: %v", p.namespaceQuotas, err)
+	}
+	return quotas, nil
+}
+
+// quotaOf returns the quota of the given namespace among the given quotas and
+// whether it has one.
+func quotaOf(quotas map[string]int64, namespace string) (int64, bool) {
+	if quota, ok := quotas[namespace]; ok {
+		return quota, true
+	}
+	quota, ok := quotas[defaultQuota]
+	return quota, ok
+}
+
+// namespaceReserved returns the capacity reserved for the PVs of the given
+// namespace's claims other than the given PV. The caller must hold mapMutex.
+func (p *nfsProvisioner) namespaceReserved(namespace, except string) int64 {
+	var reserved int64
+	for pv, c := range p.reservations {
+		if pv != except && p.namespaces[pv] == namespace {
+			reserved += c
+		}
+	}
+	return reserved
+}
+
+// collectQuotas returns the capacity provisioned for each namespace's claims
+// and, if namespace quotas are set, each namespace's quota as metrics.
+func (p *nfsProvisioner) collectQuotas() []metrics.Family {
+	// A broken quotas file fails claims, which say why, the metrics just
+	// lack quotas
+	quotas, _ := p.getNamespaceQuotas()
+
+	p.mapMutex.Lock()
+	provisioned := map[string]int64{}
+	for pv, c := range p.reservations {
+		if namespace, ok := p.namespaces[pv]; ok {
+			provisioned[namespace] += c
+		}
+	}
+	p.mapMutex.Unlock()
+
+	namespaces := []string{}
+	for namespace := range provisioned {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	provisionedSamples, quotaSamples := []metrics.Sample{}, []metrics.Sample{}
+	for _, namespace := range namespaces {
+		labels := metrics.Labels{"namespace": namespace}
+		provisionedSamples = append(provisionedSamples, metrics.Sample{Labels: labels, Value: float64(provisioned[namespace])})
+		if quota, ok := quotaOf(quotas, namespace); ok {
+			quotaSamples = append(quotaSamples, metrics.Sample{Labels: labels, Value: float64(quota)})
+		}
+	}
+	return []metrics.Family{
+		{
+			Name:    "nfs_provisioner_namespace_provisioned_bytes",
+			Help:    "Capacity of the PVs provisioned for a namespace's claims.",
+			Type:    metrics.Gauge,
+			Samples: provisionedSamples,
+		},
+		{
+			Name:    "nfs_provisioner_namespace_quota_bytes",
+			Help:    "Quota of the capacity of the PVs provisioned for a namespace's claims.",
+			Type:    metrics.Gauge,
+			Samples: quotaSamples,
+		},
+	}
+}
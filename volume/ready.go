@@ -0,0 +1,128 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// readinessChecker is implemented by exporters that can check that the NFS
+// server is up to serve new exports, so that a provision fails instead of
+// handing out a PV nobody can mount.
+type readinessChecker interface {
+	CheckReady() error
+}
+
+// The nfsd filesystem files that exist and say how many threads nfsd runs
+// once the kernel NFS server is up.
+const (
+	nfsdExportsFile = "/proc/fs/nfsd/exports"
+	nfsdThreadsFile = "/proc/fs/nfsd/threads"
+)
+
+var _ readinessChecker = &kernelExporter{}
+
+// CheckReady checks that the kernel NFS server is running, i.e. the nfsd
+// filesystem is mounted and nfsd has threads, and that exportfs works.
+func (e *kernelExporter) CheckReady() error {
+	if _, err := os.Stat(nfsdExportsFile); err != nil {
+		return fmt.Errorf("kernel NFS server isn't running: nfsd filesystem isn't mounted at /proc/fs/nfsd: %v", err)
+	}
+	threads, err := ioutil.ReadFile(nfsdThreadsFile)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", nfsdThreadsFile, err)
+	}
+	if strings.TrimSpace(string(threads)) == "0" {
+		return fmt.Errorf("kernel NFS server isn't running: nfsd has no threads")
+	}
+	if _, err := exportfsList(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// verifyExported checks that exportfs lists the given path as exported.
+func verifyExported(path string) error {
+	exported, err := exportfsList()
+	if err != nil {
+		return err
+	}
+	for _, entry := range exported {
+		if entry.path == path {
+			return nil
+		}
+	}
+	return fmt.Errorf("exportfs succeeded but %s isn't among the active exports", path)
+}
+
+// exportfsEntry is an active export of a path to a client, as listed by
+// exportfs.
+type exportfsEntry struct {
+	path string
+	host string
+	// The export's options, only listed by exportfs -v
+	options []string
+}
+
+// exportfsList returns the active exports with their options, as listed by
+// exportfs -v.
+func exportfsList() ([]exportfsEntry, error) {
+	out, err := exec.Command("exportfs", "-v").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("exportfs -v failed with error: %v, output: %s", err, out)
+	}
+	return parseExportfsList(string(out)), nil
+}
+
+// parseExportfsList parses the output of exportfs or exportfs -v into the
+// active exports. exportfs puts each export's path at the start of a line,
+// followed by the client on the same line or, if the path is long, on the
+// next line indented. Any client, *, is listed as <world>.
+func parseExportfsList(out string) []exportfsEntry {
+	entries := []exportfsEntry{}
+	path := ""
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			path = fields[0]
+			fields = fields[1:]
+			if len(fields) == 0 {
+				continue
+			}
+		}
+		if path == "" {
+			continue
+		}
+		entry := exportfsEntry{path: path, host: fields[0], options: []string{}}
+		if open := strings.Index(fields[0], "("); open != -1 && strings.HasSuffix(fields[0], ")") {
+			entry.host = fields[0][:open]
+			entry.options = strings.Split(fields[0][open+1:len(fields[0])-1], ",")
+		}
+		if entry.host == "<world>" {
+			entry.host = "*"
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
@@ -0,0 +1,250 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// reconcile makes the exports match the PVs this provisioner created, which
+// may have gotten out of sync while the provisioner was down. It re-adds the
+// exports of PVs whose paths are missing from the config file and removes the
+// blocks of exports whose PVs no longer exist. A PV is considered this
+// provisioner's if its backing directory exists in exportDir. If the exporter
+// can, the re-added exports are exported all at once, e.g. after a reboot
+// emptied /etc/exports.
+func (p *nfsProvisioner) reconcile() error {
+	volumes, err := p.client.Core().PersistentVolumes().List(api.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error listing PVs: %v", err)
+	}
+
+	config := p.exporter.GetConfig()
+	exports, err := p.exporter.GetConfigExports()
+	if err != nil {
+		return fmt.Errorf("error getting exports in config file %s: %v", config, err)
+	}
+	exported := map[string]bool{}
+	for _, export := range exports {
+		exported[export.path] = true
+	}
+
+	wanted := p.readdMissingExports(volumes.Items, exported, true)
+
+	for _, export := range exports {
+		if wanted[export.path] || !p.inExportDirs(export.path) {
+			continue
+		}
+		glog.Infof("export of %s in config file %s has no PV, removing it", export.path, config)
+		if err := p.removeStaleExport(export, "reconcile"); err != nil {
+			glog.Errorf("%v", err)
+		}
+	}
+
+	return nil
+}
+
+// removeStaleExport removes the given export, which has no PV, from the config
+// file, unexports it, deletes its record, found by its path, and frees its
+// exportId. The given operation is recorded in the audit log.
+func (p *nfsProvisioner) removeStaleExport(export configExport, operation string) error {
+	config := p.exporter.GetConfig()
+	if err := p.removeFromConfig(export.block); err != nil {
+		return fmt.Errorf("error removing export block of %s from config %s: %v", export.path, config, err)
+	}
+	p.audit(auditRemove, operation, "", "", export.path, export.block)
+	if err := p.exporter.Unexport(export.block); err != nil {
+		return fmt.Errorf("error unexporting %s: %v", export.path, err)
+	}
+	if p.exportStore != nil {
+		records, err := p.exportStore.List()
+		if err != nil {
+			return fmt.Errorf("error listing export records to delete that of %s: %v", export.path, err)
+		}
+		for _, record := range records {
+			if record.Path != export.path {
+				continue
+			}
+			if err := p.exportStore.Delete(record.PV); err != nil {
+				return fmt.Errorf("error deleting export record of %s: %v", export.path, err)
+			}
+		}
+	}
+	// Like deleteExport, only free the exportId once nothing refers to it
+	if export.exportId != 0 {
+		p.deleteExportId(export.exportId)
+	}
+	return nil
+}
+
+// Reexporter is implemented by provisioners that can re-export the exports of
+// their PVs, e.g. after the NFS server has restarted.
+type Reexporter interface {
+	ReexportMissing() error
+}
+
+var _ Reexporter = &nfsProvisioner{}
+
+// ReexportMissing re-adds the exports of PVs this provisioner created whose
+// paths are missing from the config file. Unlike reconcile, it doesn't remove
+// exports without PVs, whose PVs may be in the middle of being provisioned, so
+// it's safe to call while the provisioner is running. NFS Ganesha itself
+// re-exports the exports in its config file when it starts.
+func (p *nfsProvisioner) ReexportMissing() error {
+	volumes, err := p.client.Core().PersistentVolumes().List(api.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error listing PVs: %v", err)
+	}
+
+	config := p.exporter.GetConfig()
+	exports, err := p.exporter.GetConfigExports()
+	if err != nil {
+		return fmt.Errorf("error getting exports in config file %s: %v", config, err)
+	}
+	exported := map[string]bool{}
+	for _, export := range exports {
+		exported[export.path] = true
+	}
+
+	p.readdMissingExports(volumes.Items, exported, false)
+	return nil
+}
+
+// batchExporter is implemented by exporters that can export many blocks already
+// in the config at once more cheaply than one at a time.
+type batchExporter interface {
+	ExportBatch([]string) error
+}
+
+// readdMissingExports re-adds to the config file and re-exports the exports of
+// the given PVs that this provisioner created and whose paths aren't in
+// exported. If batch is true and the exporter is a batchExporter, they're
+// exported all at once after they're all re-added. The exports of the PVs'
+// snapshots are re-added too, one at a time. It returns the paths of all the
+// exports this provisioner's PVs and their snapshots should have.
+func (p *nfsProvisioner) readdMissingExports(volumes []v1.PersistentVolume, exported map[string]bool, batch bool) map[string]bool {
+	batcher, ok := p.exporter.(batchExporter)
+	if !ok {
+		batch = false
+	}
+
+	wanted := map[string]bool{}
+	readded := []*v1.PersistentVolume{}
+	blocks := []string{}
+	for i := range volumes {
+		volume := &volumes[i]
+		if volume.Annotations[annCreatedBy] != createdBy || volume.Spec.NFS == nil {
+			continue
+		}
+		path := volume.Spec.NFS.Path
+		if !p.inExportDirs(path) {
+			continue
+		}
+		want, block := p.readdMissingExport(volume, exported[path], batch)
+		if want {
+			wanted[path] = true
+		}
+		p.readdSnapshotExports(volume, exported, wanted)
+		if block != "" {
+			readded = append(readded, volume)
+			blocks = append(blocks, block)
+		}
+	}
+	if len(blocks) == 0 {
+		return wanted
+	}
+
+	config := p.exporter.GetConfig()
+	glog.Infof("exporting the %d exports re-added to config file %s at once", len(blocks), config)
+	if err := batcher.ExportBatch(blocks); err != nil {
+		glog.Errorf("error re-exporting %d PVs: %v", len(blocks), err)
+		for _, volume := range readded {
+			p.recordEvent(volume, v1.EventTypeWarning, "ExportFailed", fmt.Sprintf("Export was missing from config file %s, re-added it but error exporting it: %v", config, err))
+		}
+		return wanted
+	}
+	for _, volume := range readded {
+		p.recordEvent(volume, v1.EventTypeWarning, "ExportMissing", fmt.Sprintf("Export was missing from config file %s, re-added and exported it", config))
+	}
+
+	return wanted
+}
+
+// readdMissingExport re-adds the export of the given PV if it isn't exported.
+// It returns whether the PV should have an export, i.e. its backing directory
+// exists, in which case its capacity is reserved, and its export block is
+// known. If batch is true, the export is only re-added to the config file and,
+// if it was, its block is returned for the caller to export.
+func (p *nfsProvisioner) readdMissingExport(volume *v1.PersistentVolume, exported, batch bool) (bool, string) {
+	p.volumeMutex.Lock(volume.Name)
+	defer p.volumeMutex.Unlock(volume.Name)
+
+	if _, err := os.Stat(volume.Spec.NFS.Path); err != nil {
+		return false, ""
+	}
+	p.reserveExistingCapacity(volume)
+
+	block, exportId, err := p.getExportInfo(volume)
+	if err != nil {
+		glog.Errorf("error reconciling export of PV %s: %v", volume.Name, err)
+		return false, ""
+	}
+	if exportId != 0 {
+		p.reserveExportId(exportId)
+	}
+
+	if exported {
+		return true, ""
+	}
+	config := p.exporter.GetConfig()
+	glog.Infof("export of PV %s is missing from config file %s, re-adding it", volume.Name, config)
+	if err := p.addToConfig(block); err != nil {
+		glog.Errorf("error re-adding export block of PV %s to config %s: %v", volume.Name, config, err)
+		p.recordEvent(volume, v1.EventTypeWarning, "ExportFailed", fmt.Sprintf("Export was missing from config file %s, error re-adding it: %v", config, err))
+		return true, ""
+	}
+	p.audit(auditAdd, "reconcile", volume.Name, volumeClaim(volume), volume.Spec.NFS.Path, block)
+	if batch {
+		return true, block
+	}
+	if err := p.exporter.Export(block); err != nil {
+		glog.Errorf("error re-exporting PV %s: %v", volume.Name, err)
+		p.recordEvent(volume, v1.EventTypeWarning, "ExportFailed", fmt.Sprintf("Export was missing from config file %s, re-added it but error exporting it: %v", config, err))
+		return true, ""
+	}
+	p.recordEvent(volume, v1.EventTypeWarning, "ExportMissing", fmt.Sprintf("Export was missing from config file %s, re-added and exported it", config))
+
+	return true, ""
+}
+
+// reserveExportId marks the given exportId as used.
+func (p *nfsProvisioner) reserveExportId(exportId uint16) {
+	p.mapMutex.Lock()
+	defer p.mapMutex.Unlock()
+	if p.exportIds[exportId] {
+		return
+	}
+	p.exportIds[exportId] = true
+	if err := p.stateStore.saveExportIds(p.exportIds); err != nil {
+		glog.Errorf("error persisting export id %d: %v", exportId, err)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/wongma7/nfs-provisioner/controller"
+)
+
+// secretParameters are the class parameters a Secret referenced by the class's
+// secretName parameter can contain instead, so that export settings that
+// reveal who can access the exports don't have to be in the class, which every
+// user can read.
+var secretParameters = []string{"clients", "sec", "squash", "anonuid", "anongid"}
+
+// resolveSecretParameters returns the given options with the parameters in the
+// Secret named by the class's secretName parameter, in the namespace of its
+// secretNamespace parameter or else the provisioner's, merged into its
+// parameters. A parameter can't be both in the class and the Secret.
+func (p *nfsProvisioner) resolveSecretParameters(options controller.VolumeOptions) (controller.VolumeOptions, error) {
+	name, namespace := "", os.Getenv(p.namespaceEnv)
+	parameters := map[string]string{}
+	for k, v := range options.Parameters {
+		switch strings.ToLower(k) {
+		case "secretname":
+			name = v
+		case "secretnamespace":
+			namespace = v
+		default:
+			parameters[k] = v
+		}
+	}
+	if name == "" {
+		return options, nil
+	}
+	if namespace == "" {
+		return controller.VolumeOptions{}, fmt.Errorf("parameter secretName is set but neither is secretNamespace nor namespace env %s; no namespace to get the secret from", p.namespaceEnv)
+	}
+
+	secret, err := p.client.Core().Secrets(namespace).Get(name)
+	if err != nil {
+		return controller.VolumeOptions{}, fmt.Errorf("error getting secret %s/%s: %v", namespace, name, err)
+	}
+	for k, v := range secret.Data {
+		key := strings.ToLower(k)
+		if !containsString(secretParameters, key) {
+			return controller.VolumeOptions{}, fmt.Errorf("secret %s/%s has invalid key %q, valid keys are: %s", namespace, name, k, strings.Join(secretParameters, ", "))
+		}
+		for param := range parameters {
+			if strings.ToLower(param) == key {
+				return controller.VolumeOptions{}, fmt.Errorf("parameter %s is set in both the class and secret %s/%s", key, namespace, name)
+			}
+		}
+		parameters[key] = string(v)
+	}
+
+	options.Parameters = parameters
+	return options, nil
+}
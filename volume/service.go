@@ -0,0 +1,114 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/client-go/1.4/kubernetes"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/fields"
+	"k8s.io/client-go/1.4/pkg/runtime"
+	"k8s.io/client-go/1.4/pkg/watch"
+	"k8s.io/client-go/1.4/tools/cache"
+)
+
+// serviceResyncPeriod is how often the service cache is fully resynced, on top
+// of being kept up to date by watches.
+const serviceResyncPeriod = 5 * time.Minute
+
+// serviceCache caches the service fronting the provisioner and its endpoints,
+// so that getServer doesn't need to get them from the API server on every
+// provision.
+type serviceCache struct {
+	services  cache.Store
+	endpoints cache.Store
+}
+
+// newServiceCache starts watching the service and endpoints with the given
+// name in the given namespace until stopCh is closed.
+func newServiceCache(client kubernetes.Interface, namespace, name string, stopCh <-chan struct{}) *serviceCache {
+	c := &serviceCache{
+		services:  cache.NewStore(cache.MetaNamespaceKeyFunc),
+		endpoints: cache.NewStore(cache.MetaNamespaceKeyFunc),
+	}
+
+	selector := fields.OneTermEqualSelector("metadata.name", name)
+	serviceSource := &cache.ListWatch{
+		ListFunc: func(options api.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			return client.Core().Services(namespace).List(options)
+		},
+		WatchFunc: func(options api.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return client.Core().Services(namespace).Watch(options)
+		},
+	}
+	endpointsSource := &cache.ListWatch{
+		ListFunc: func(options api.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			return client.Core().Endpoints(namespace).List(options)
+		},
+		WatchFunc: func(options api.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return client.Core().Endpoints(namespace).Watch(options)
+		},
+	}
+	cache.NewReflector(serviceSource, &v1.Service{}, c.services, serviceResyncPeriod).RunUntil(stopCh)
+	cache.NewReflector(endpointsSource, &v1.Endpoints{}, c.endpoints, serviceResyncPeriod).RunUntil(stopCh)
+
+	return c
+}
+
+// getService gets the given service from the service cache or, if there is no
+// cache or it doesn't have the service yet, from the API server.
+func (p *nfsProvisioner) getService(namespace, name string) (*v1.Service, error) {
+	if p.serviceCache != nil {
+		obj, exists, err := p.serviceCache.services.GetByKey(namespace + "/" + name)
+		if err == nil && exists {
+			if service, ok := obj.(*v1.Service); ok {
+				return service, nil
+			}
+		}
+	}
+	service, err := p.client.Core().Services(namespace).Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("error getting service %s=%s in namespace %s=%s: %v", p.serviceEnv, name, p.namespaceEnv, namespace, err)
+	}
+	return service, nil
+}
+
+// getEndpoints gets the given service's endpoints from the service cache or,
+// if there is no cache or it doesn't have the endpoints yet, from the API
+// server.
+func (p *nfsProvisioner) getEndpoints(namespace, name string) (*v1.Endpoints, error) {
+	if p.serviceCache != nil {
+		obj, exists, err := p.serviceCache.endpoints.GetByKey(namespace + "/" + name)
+		if err == nil && exists {
+			if endpoints, ok := obj.(*v1.Endpoints); ok {
+				return endpoints, nil
+			}
+		}
+	}
+	endpoints, err := p.client.Core().Endpoints(namespace).Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("error getting endpoints of service %s=%s in namespace %s=%s: %v", p.serviceEnv, name, p.namespaceEnv, namespace, err)
+	}
+	return endpoints, nil
+}
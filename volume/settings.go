@@ -0,0 +1,80 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"reflect"
+
+	"github.com/golang/glog"
+)
+
+// Settings are the settings of a provisioner that can be changed while it
+// runs, e.g. from a reloaded config file. Changing them only affects volumes
+// provisioned afterwards; existing exports and PVs are left as they are.
+type Settings struct {
+	ExportClients  []string
+	ServiceCIDR    string
+	AllowAnyClient bool
+	ServerHostname string
+	UseServiceDNS  bool
+}
+
+// Reconfigurer is implemented by provisioners whose Settings can be changed
+// while they run.
+type Reconfigurer interface {
+	Reconfigure(Settings)
+}
+
+var _ Reconfigurer = &nfsProvisioner{}
+
+// settings returns a copy of the provisioner's settings, so that callers can
+// use them, e.g. while calling the API server, without holding the settings
+// lock and blocking Reconfigure.
+func (p *nfsProvisioner) settings() Settings {
+	p.settingsMutex.RLock()
+	defer p.settingsMutex.RUnlock()
+	return Settings{
+		ExportClients:  p.exportClients,
+		ServiceCIDR:    p.serviceCIDR,
+		AllowAnyClient: p.allowAnyClient,
+		ServerHostname: p.serverHostname,
+		UseServiceDNS:  p.useServiceDNS,
+	}
+}
+
+// Reconfigure replaces the provisioner's settings with the given ones.
+func (p *nfsProvisioner) Reconfigure(settings Settings) {
+	p.settingsMutex.Lock()
+	defer p.settingsMutex.Unlock()
+
+	old := Settings{
+		ExportClients:  p.exportClients,
+		ServiceCIDR:    p.serviceCIDR,
+		AllowAnyClient: p.allowAnyClient,
+		ServerHostname: p.serverHostname,
+		UseServiceDNS:  p.useServiceDNS,
+	}
+	if reflect.DeepEqual(old, settings) {
+		return
+	}
+	glog.Infof("settings changed from %+v to %+v, volumes provisioned from now on get the new ones", old, settings)
+	p.exportClients = settings.ExportClients
+	p.serviceCIDR = settings.ServiceCIDR
+	p.allowAnyClient = settings.AllowAnyClient
+	p.serverHostname = settings.ServerHostname
+	p.useServiceDNS = settings.UseServiceDNS
+}
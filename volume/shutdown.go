@@ -0,0 +1,58 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+)
+
+// Unexporter is implemented by provisioners that can take down all of their
+// exports at once, e.g. when shutting down.
+type Unexporter interface {
+	UnexportAll() error
+}
+
+var _ Unexporter = &nfsProvisioner{}
+
+// UnexportAll unexports every export of the provisioner's, leaving them in the
+// config file so that they are re-exported when the provisioner restarts. It
+// tries every export and returns the last error encountered, if any.
+func (p *nfsProvisioner) UnexportAll() error {
+	config := p.exporter.GetConfig()
+	exports, err := p.exporter.GetConfigExports()
+	if err != nil {
+		return fmt.Errorf("error getting exports in config file %s: %v", config, err)
+	}
+
+	var lastErr error
+	for _, export := range exports {
+		if !p.inExportDirs(export.path) {
+			continue
+		}
+		glog.Infof("unexporting %s", export.path)
+		if err := p.exporter.Unexport(export.block); err != nil {
+			glog.Errorf("error unexporting %s: %v", export.path, err)
+			lastErr = err
+			continue
+		}
+		p.audit(auditUnexport, "shutdown", "", "", export.path, export.block)
+	}
+
+	return lastErr
+}
@@ -0,0 +1,511 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/wongma7/nfs-provisioner/controller"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/util/validation"
+)
+
+const (
+	// A PV annotation for the comma-separated names of the snapshots the PV's
+	// directory should have. Adding a name snapshots the directory and exports
+	// the snapshot read-only, removing one unexports and deletes the snapshot.
+	annSnapshots = "nfs-provisioner.kubernetes.io/snapshots"
+
+	// A PV annotation for the exports of the PV's snapshots, recorded by the
+	// provisioner as a JSON object of snapshotExports by snapshot name.
+	annSnapshotExports = "nfs-provisioner.kubernetes.io/snapshot-exports"
+
+	// A PV annotation for the name of a snapshot to restore the PV's directory
+	// to. The provisioner removes it once the snapshot is restored.
+	annRestoreSnapshot = "nfs-provisioner.kubernetes.io/restore-snapshot"
+
+	// The directory in exportDir btrfs snapshots are kept in
+	snapshotsDir = ".snapshots"
+
+	// The f_type statfs returns for btrfs and the inode number of the root of
+	// a btrfs subvolume
+	btrfsSuperMagic  = 0x9123683E
+	btrfsSubvolInode = 256
+)
+
+// snapshotExport is an export of a snapshot of a PV's directory.
+type snapshotExport struct {
+	Path     string `json:"path"`
+	ExportId uint16 `json:"exportId"`
+	Block    string `json:"block"`
+}
+
+// snapshotter is implemented by the filesystems exportDir can be on whose
+// snapshots can be taken of a PV's directory. A snapshot is of the whole
+// filesystem, which copy-on-write makes cheap, but only the PV's directory in
+// it is exported.
+type snapshotter interface {
+	// snapshot takes a read-only snapshot with the given id and returns the
+	// path of the given PV's directory in it.
+	snapshot(pvName, id string) (string, error)
+	// deleteSnapshot deletes the snapshot with the given id.
+	deleteSnapshot(id string) error
+}
+
+// newSnapshotter returns the snapshotter of the given backend, btrfs or zfs,
+// for the given exportDir, or nil if the backend is empty.
+func newSnapshotter(backend, exportDir string) (snapshotter, error) {
+	switch backend {
+	case "":
+		return nil, nil
+	case "btrfs":
+		return newBtrfsSnapshotter(exportDir)
+	case "zfs":
+		return newZFSSnapshotter(exportDir)
+	}
+	return nil, fmt.Errorf("unknown snapshot backend %q, must be btrfs or zfs", backend)
+}
+
+// ParseSnapshotBackend returns an error if the given snapshot backend isn't
+// empty, btrfs or zfs.
+func ParseSnapshotBackend(backend string) error {
+	if backend != "" && backend != "btrfs" && backend != "zfs" {
+		return fmt.Errorf("unknown snapshot backend %q, must be btrfs or zfs", backend)
+	}
+	return nil
+}
+
+// btrfsSnapshotter snapshots exportDir, which must be the root of a btrfs
+// subvolume, into snapshotsDir. Snapshots don't include the subvolumes nested
+// in exportDir, such as earlier snapshots.
+type btrfsSnapshotter struct {
+	exportDir string
+}
+
+func newBtrfsSnapshotter(exportDir string) (*btrfsSnapshotter, error) {
+	var statfs syscall.Statfs_t
+	if err := syscall.Statfs(exportDir, &statfs); err != nil {
+		return nil, fmt.Errorf("error getting filesystem of %s: %v", exportDir, err)
+	}
+	var stat syscall.Stat_t
+	if err := syscall.Stat(exportDir, &stat); err != nil {
+		return nil, fmt.Errorf("error stating %s: %v", exportDir, err)
+	}
+	if uint64(statfs.Type) != btrfsSuperMagic || stat.Ino != btrfsSubvolInode {
+		return nil, fmt.Errorf("%s isn't the root of a btrfs subvolume", exportDir)
+	}
+	return &btrfsSnapshotter{exportDir: exportDir}, nil
+}
+
+func (s *btrfsSnapshotter) snapshot(pvName, id string) (string, error) {
+	dir := filepath.Join(s.exportDir, snapshotsDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("error creating snapshot directory %s: %v", dir, err)
+	}
+	path := filepath.Join(dir, id)
+	if out, err := exec.Command("btrfs", "subvolume", "snapshot", "-r", s.exportDir, path).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("btrfs subvolume snapshot failed with error: %v, output: %s", err, out)
+	}
+	return filepath.Join(path, pvName), nil
+}
+
+func (s *btrfsSnapshotter) deleteSnapshot(id string) error {
+	path := filepath.Join(s.exportDir, snapshotsDir, id)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	if out, err := exec.Command("btrfs", "subvolume", "delete", path).CombinedOutput(); err != nil {
+		return fmt.Errorf("btrfs subvolume delete failed with error: %v, output: %s", err, out)
+	}
+	return nil
+}
+
+// zfsSnapshotter snapshots the ZFS dataset exportDir is in. A snapshot is
+// reachable in the .zfs/snapshot directory of the dataset's mountpoint.
+type zfsSnapshotter struct {
+	exportDir  string
+	dataset    string
+	mountpoint string
+}
+
+func newZFSSnapshotter(exportDir string) (*zfsSnapshotter, error) {
+	out, err := exec.Command("zfs", "list", "-H", "-o", "name,mountpoint", exportDir).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("zfs list %s failed with error: %v, output: %s", exportDir, err, out)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 || !strings.HasPrefix(fields[1], "/") {
+		return nil, fmt.Errorf("%s isn't in a mounted ZFS dataset, zfs list output: %s", exportDir, out)
+	}
+	return &zfsSnapshotter{exportDir: exportDir, dataset: fields[0], mountpoint: fields[1]}, nil
+}
+
+func (s *zfsSnapshotter) snapshot(pvName, id string) (string, error) {
+	if out, err := exec.Command("zfs", "snapshot", s.dataset+"@"+id).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("zfs snapshot failed with error: %v, output: %s", err, out)
+	}
+	rel, err := filepath.Rel(s.mountpoint, s.exportDir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.mountpoint, ".zfs", "snapshot", id, rel, pvName), nil
+}
+
+func (s *zfsSnapshotter) deleteSnapshot(id string) error {
+	if out, err := exec.Command("zfs", "destroy", s.dataset+"@"+id).CombinedOutput(); err != nil {
+		if strings.Contains(string(out), "could not find") {
+			return nil
+		}
+		return fmt.Errorf("zfs destroy failed with error: %v, output: %s", err, out)
+	}
+	return nil
+}
+
+// snapshotId returns the id of the given PV's snapshot of the given name,
+// unique among every PV's snapshots.
+func snapshotId(pvName, name string) string {
+	return pvName + "." + name
+}
+
+// getSnapshotNames gets the names of the snapshots the given PV should have
+// from its annotation annSnapshots.
+func getSnapshotNames(volume *v1.PersistentVolume) ([]string, error) {
+	names := []string{}
+	for _, name := range strings.Split(volume.Annotations[annSnapshots], ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if errs := validation.IsDNS1123Label(name); len(errs) != 0 {
+			return nil, fmt.Errorf("invalid snapshot name %q in annotation %s: %s", name, annSnapshots, strings.Join(errs, ", "))
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// getSnapshotExports gets the exports of the given PV's snapshots from its
+// annotation annSnapshotExports.
+func getSnapshotExports(volume *v1.PersistentVolume) (map[string]snapshotExport, error) {
+	exports := map[string]snapshotExport{}
+	ann, ok := volume.Annotations[annSnapshotExports]
+	if !ok {
+		return exports, nil
+	}
+	if err := json.Unmarshal([]byte(ann), &exports); err != nil {
+		return nil, fmt.Errorf("error parsing annotation %s: %v", annSnapshotExports, err)
+	}
+	return exports, nil
+}
+
+// updateSnapshots takes, exports, restores and deletes the snapshots of the
+// given PV's directory to match its annotations annSnapshots and
+// annRestoreSnapshot. A snapshot is restored after new ones are taken, so a
+// snapshot of the data about to be overwritten can be asked for along with
+// the restore, and before unwanted ones are deleted. Whatever was done is
+// recorded in the PV's annotations even if something else failed. The caller
+// must hold the PV's volume lock.
+func (p *nfsProvisioner) updateSnapshots(volume *v1.PersistentVolume) (err error) {
+	names, err := getSnapshotNames(volume)
+	if err != nil {
+		return err
+	}
+	exports, err := getSnapshotExports(volume)
+	if err != nil {
+		return err
+	}
+	restore := strings.TrimSpace(volume.Annotations[annRestoreSnapshot])
+	if p.snapshotter == nil {
+		if len(names) != 0 || restore != "" {
+			return fmt.Errorf("snapshots aren't enabled, ignoring annotations %s and %s", annSnapshots, annRestoreSnapshot)
+		}
+		return nil
+	}
+
+	changed, restored := false, false
+	defer func() {
+		if !changed && !restored {
+			return
+		}
+		if recordErr := p.recordSnapshots(volume.Name, exports, restored); recordErr != nil {
+			glog.Errorf("error recording snapshots of PV %s: %v", volume.Name, recordErr)
+			if err == nil {
+				err = recordErr
+			}
+		}
+	}()
+
+	for _, name := range names {
+		if _, ok := exports[name]; ok {
+			continue
+		}
+		export, err := p.createSnapshot(volume, name)
+		if err != nil {
+			return err
+		}
+		exports[name] = export
+		changed = true
+	}
+
+	if restore != "" {
+		export, ok := exports[restore]
+		if !ok {
+			return fmt.Errorf("can't restore snapshot %q named by annotation %s, the PV has no such snapshot", restore, annRestoreSnapshot)
+		}
+		if err := restoreDirectory(export.Path, p.volumePath(volume)); err != nil {
+			return fmt.Errorf("error restoring snapshot %s: %v", restore, err)
+		}
+		restored = true
+		p.recordEvent(volume, v1.EventTypeNormal, "SnapshotRestored", fmt.Sprintf("Restored the volume's directory to snapshot %s", restore))
+	}
+
+	for _, name := range sortedSnapshotNames(exports) {
+		if containsString(names, name) {
+			continue
+		}
+		if err := p.deleteSnapshot(volume, name, exports[name]); err != nil {
+			return err
+		}
+		delete(exports, name)
+		changed = true
+	}
+
+	return nil
+}
+
+// createSnapshot takes a snapshot of the given name of the given PV's
+// directory and exports it read-only to the clients of the PV's annotation
+// annClients or, failing that, the provisioner's default clients.
+func (p *nfsProvisioner) createSnapshot(volume *v1.PersistentVolume, name string) (snapshotExport, error) {
+	dir := p.volumePath(volume)
+	if src, err := os.Stat(dir); err != nil || !src.IsDir() {
+		return snapshotExport{}, fmt.Errorf("can't snapshot volume, its directory %s doesn't exist", dir)
+	}
+	if p.exportDirOf(dir) != p.exportDir {
+		return snapshotExport{}, fmt.Errorf("can't snapshot volume, its directory %s isn't in export directory %s, the only one snapshots are taken of", dir, p.exportDir)
+	}
+	_, clients, err := getExportOptions(volume)
+	if err != nil {
+		return snapshotExport{}, err
+	}
+	if len(clients) == 0 {
+		if clients, err = p.getExportClients(controller.VolumeOptions{}); err != nil {
+			return snapshotExport{}, fmt.Errorf("error getting clients for snapshot: %v", err)
+		}
+	}
+
+	id := snapshotId(volume.Name, name)
+	path, err := p.snapshotter.snapshot(volume.Name, id)
+	if err != nil {
+		return snapshotExport{}, fmt.Errorf("error taking snapshot %s: %v", name, err)
+	}
+
+	exportId, err := p.generateExportId()
+	if err != nil {
+		p.snapshotter.deleteSnapshot(id)
+		return snapshotExport{}, fmt.Errorf("error generating export id for snapshot %s: %v", name, err)
+	}
+	// The snapshot is exported through the exporter its volume is
+	volumeBlock, _ := p.getAnnotation(volume, annBlock)
+	block, err := p.exporterOf(volumeBlock).CreateBlock(strconv.FormatUint(uint64(exportId), 10), path, exportParams{clients: clients, readOnly: true})
+	if err != nil {
+		p.deleteExportId(exportId)
+		p.snapshotter.deleteSnapshot(id)
+		return snapshotExport{}, fmt.Errorf("error creating export block of snapshot %s: %v", name, err)
+	}
+	if err := p.addToConfig(block); err != nil {
+		p.deleteExportId(exportId)
+		p.snapshotter.deleteSnapshot(id)
+		return snapshotExport{}, fmt.Errorf("error adding export of snapshot %s to config %s: %v", name, p.exporter.GetConfig(), err)
+	}
+	if err := p.exporter.Export(block); err != nil {
+		p.removeFromConfig(block)
+		p.deleteExportId(exportId)
+		p.snapshotter.deleteSnapshot(id)
+		return snapshotExport{}, fmt.Errorf("error exporting snapshot %s: %v", name, err)
+	}
+	p.audit(auditAdd, "snapshot", volume.Name, volumeClaim(volume), path, block)
+
+	server := ""
+	if volume.Spec.NFS != nil {
+		server = volume.Spec.NFS.Server + ":"
+	}
+	p.recordEvent(volume, v1.EventTypeNormal, "SnapshotCreated", fmt.Sprintf("Took snapshot %s of the volume's directory, exported read-only at %s%s", name, server, path))
+	return snapshotExport{Path: path, ExportId: exportId, Block: block}, nil
+}
+
+// deleteSnapshot unexports and deletes the given PV's snapshot of the given
+// name.
+func (p *nfsProvisioner) deleteSnapshot(volume *v1.PersistentVolume, name string, export snapshotExport) error {
+	if err := p.removeFromConfig(export.Block); err != nil {
+		return fmt.Errorf("error removing export of snapshot %s from config %s: %v", name, p.exporter.GetConfig(), err)
+	}
+	p.audit(auditRemove, "snapshot", volume.Name, volumeClaim(volume), export.Path, export.Block)
+	if err := p.exporter.Unexport(export.Block); err != nil {
+		return fmt.Errorf("error unexporting snapshot %s: %v", name, err)
+	}
+	p.deleteExportId(export.ExportId)
+
+	if p.snapshotter == nil {
+		glog.Warningf("snapshots aren't enabled, leaving snapshot %s of PV %s in place after unexporting it", name, volume.Name)
+	} else if err := p.snapshotter.deleteSnapshot(snapshotId(volume.Name, name)); err != nil {
+		return fmt.Errorf("error deleting snapshot %s: %v", name, err)
+	}
+	p.recordEvent(volume, v1.EventTypeNormal, "SnapshotDeleted", fmt.Sprintf("Deleted snapshot %s", name))
+	return nil
+}
+
+// deleteSnapshots unexports and deletes all of the given PV's snapshots.
+func (p *nfsProvisioner) deleteSnapshots(volume *v1.PersistentVolume) error {
+	exports, err := getSnapshotExports(volume)
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedSnapshotNames(exports) {
+		if err := p.deleteSnapshot(volume, name, exports[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordSnapshots records the given exports of the given PV's snapshots in the
+// PV's annotation annSnapshotExports and, if a snapshot was restored, removes
+// its annotation annRestoreSnapshot.
+func (p *nfsProvisioner) recordSnapshots(pvName string, exports map[string]snapshotExport, restored bool) error {
+	volume, err := p.client.Core().PersistentVolumes().Get(pvName)
+	if err != nil {
+		return fmt.Errorf("error getting PV: %v", err)
+	}
+	if volume.Annotations == nil {
+		volume.Annotations = map[string]string{}
+	}
+	if len(exports) == 0 {
+		delete(volume.Annotations, annSnapshotExports)
+	} else {
+		data, err := json.Marshal(exports)
+		if err != nil {
+			return err
+		}
+		volume.Annotations[annSnapshotExports] = string(data)
+	}
+	if restored {
+		delete(volume.Annotations, annRestoreSnapshot)
+	}
+	if _, err := p.client.Core().PersistentVolumes().Update(volume); err != nil {
+		return fmt.Errorf("error updating PV annotation %s: %v", annSnapshotExports, err)
+	}
+	return nil
+}
+
+// sortedSnapshotNames returns the names of the given snapshot exports, sorted.
+func sortedSnapshotNames(exports map[string]snapshotExport) []string {
+	names := []string{}
+	for name := range exports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// readdSnapshotExports re-adds to the config file and re-exports the exports
+// of the given PV's snapshots whose paths aren't in exported, reserving their
+// exportIds, and marks the paths of those whose snapshots exist as wanted.
+func (p *nfsProvisioner) readdSnapshotExports(volume *v1.PersistentVolume, exported, wanted map[string]bool) {
+	p.volumeMutex.Lock(volume.Name)
+	defer p.volumeMutex.Unlock(volume.Name)
+
+	exports, err := getSnapshotExports(volume)
+	if err != nil {
+		glog.Errorf("error reconciling snapshot exports of PV %s: %v", volume.Name, err)
+		return
+	}
+	config := p.exporter.GetConfig()
+	for _, name := range sortedSnapshotNames(exports) {
+		export := exports[name]
+		if _, err := os.Stat(export.Path); err != nil {
+			continue
+		}
+		wanted[export.Path] = true
+		p.reserveExportId(export.ExportId)
+		if exported[export.Path] {
+			continue
+		}
+		glog.Infof("export of snapshot %s of PV %s is missing from config file %s, re-adding it", name, volume.Name, config)
+		if err := p.addToConfig(export.Block); err != nil {
+			glog.Errorf("error re-adding export block of snapshot %s of PV %s to config %s: %v", name, volume.Name, config, err)
+			continue
+		}
+		p.audit(auditAdd, "reconcile", volume.Name, volumeClaim(volume), export.Path, export.Block)
+		if err := p.exporter.Export(export.Block); err != nil {
+			glog.Errorf("error re-exporting snapshot %s of PV %s: %v", name, volume.Name, err)
+			p.recordEvent(volume, v1.EventTypeWarning, "ExportFailed", fmt.Sprintf("Export of snapshot %s was missing from config file %s, re-added it but error exporting it: %v", name, config, err))
+			continue
+		}
+		p.recordEvent(volume, v1.EventTypeWarning, "ExportMissing", fmt.Sprintf("Export of snapshot %s was missing from config file %s, re-added and exported it", name, config))
+	}
+}
+
+// restoreDirectory replaces the contents of the given directory with those of
+// the given snapshot of it, keeping the directory itself, and so the export
+// of it and its ownership and permissions, in place.
+func restoreDirectory(snapshot, path string) error {
+	if _, err := os.Stat(snapshot); err != nil {
+		return fmt.Errorf("error stating snapshot directory: %v", err)
+	}
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if err := os.RemoveAll(filepath.Join(path, info.Name())); err != nil {
+			return fmt.Errorf("error removing current contents: %v", err)
+		}
+	}
+	return copyDirectory(snapshot, path)
+}
+
+// copyDirectory copies the contents of the given source directory into the
+// given directory, but not the source's ownership and permissions. Files are
+// copied with reflinks where the filesystem supports them, which makes copying
+// from a btrfs snapshot cheap.
+func copyDirectory(src, path string) error {
+	infos, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	if len(infos) == 0 {
+		return nil
+	}
+	args := []string{"-a", "--reflink=auto"}
+	for _, info := range infos {
+		args = append(args, filepath.Join(src, info.Name()))
+	}
+	if out, err := exec.Command("cp", append(args, path+"/")...).CombinedOutput(); err != nil {
+		return fmt.Errorf("cp failed with error: %v, output: %s", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"k8s.io/client-go/1.4/pkg/util/uuid"
+)
+
+// stateFile is the name of the file in exportDir that the provisioner's state
+// is persisted to: the identity of the storage and the filesystem it's on, the
+// allocated exportIds, so that they stay unique across restarts even if the
+// config file they were originally written to is pruned or split up, and, unless another ExportStore is used, the record of every
+// export, with its gid and block of options. Since it's on the export
+// filesystem itself, a replacement pod, even on another node, that mounts the
+// same filesystem recovers the state.
+const stateFile = ".state"
+
+// legacyExportIdsFile is the name of the file the allocated exportIds were
+// persisted to before the state file, which is read if there's no state file.
+const legacyExportIdsFile = ".exportIds"
+
+// stateVersion is the version of the state file's format. A state file of a
+// later version, written by a newer provisioner, isn't read.
+const stateVersion = 1
+
+// state is the content of the state file.
+type state struct {
+	Version    int          `json:"version"`
+	Identity   string       `json:"identity,omitempty"`
+	Filesystem string       `json:"filesystem,omitempty"`
+	ExportIds  []uint16     `json:"exportIds"`
+	Exports    []*NFSExport `json:"exports"`
+}
+
+// stateStore persists the provisioner's state to a small file, rewritten
+// atomically on every change.
+type stateStore struct {
+	path       string
+	legacyPath string
+	mutex      sync.Mutex
+}
+
+var _ ExportStore = &stateStore{}
+
+func newStateStore(exportDir string) *stateStore {
+	return &stateStore{path: exportDir + stateFile, legacyPath: exportDir + legacyExportIdsFile}
+}
+
+// read reads the state file. A missing file is not an error, it just means
+// nothing has been persisted yet, unless there's a legacy exportIds file.
+// The caller must hold mutex.
+func (s *stateStore) read() (*state, error) {
+	st := &state{Version: stateVersion, ExportIds: []uint16{}, Exports: []*NFSExport{}}
+
+	read, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s.readLegacy(st)
+	}
+	if err != nil {
+		return st, err
+	}
+
+	var persisted state
+	if err := json.Unmarshal(read, &persisted); err != nil {
+		return st, fmt.Errorf("error parsing state file %s: %v", s.path, err)
+	}
+	if persisted.Version > stateVersion {
+		return st, fmt.Errorf("state file %s has version %d, this provisioner only knows up to version %d", s.path, persisted.Version, stateVersion)
+	}
+	st.Identity = persisted.Identity
+	st.Filesystem = persisted.Filesystem
+	if persisted.ExportIds != nil {
+		st.ExportIds = persisted.ExportIds
+	}
+	if persisted.Exports != nil {
+		st.Exports = persisted.Exports
+	}
+
+	return st, nil
+}
+
+// readLegacy reads the exportIds of the legacy exportIds file into the given
+// empty state.
+func (s *stateStore) readLegacy(st *state) (*state, error) {
+	read, err := ioutil.ReadFile(s.legacyPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return st, nil
+		}
+		return st, err
+	}
+
+	if err := json.Unmarshal(read, &st.ExportIds); err != nil {
+		return st, fmt.Errorf("error parsing exportIds file %s: %v", s.legacyPath, err)
+	}
+	return st, nil
+}
+
+// write overwrites the state file with the given state. The caller must hold
+// mutex.
+func (s *stateStore) write(st *state) error {
+	st.Version = stateVersion
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0600)
+}
+
+// modify applies the given change to the persisted state.
+func (s *stateStore) modify(change func(st *state) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	st, err := s.read()
+	if err != nil {
+		return err
+	}
+	if err := change(st); err != nil {
+		return err
+	}
+	return s.write(st)
+}
+
+// loadIdentity returns the identity persisted in the state file. If there's
+// none yet, it's empty or, if generate is true, one is generated and persisted
+// first.
+func (s *stateStore) loadIdentity(generate bool) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	st, err := s.read()
+	if err != nil {
+		return "", err
+	}
+	if st.Identity != "" || !generate {
+		return st.Identity, nil
+	}
+	st.Identity = string(uuid.NewUUID())
+	if st.Filesystem, err = filesystemId(filepath.Dir(s.path)); err != nil {
+		return "", err
+	}
+	if err := s.write(st); err != nil {
+		return "", err
+	}
+	return st.Identity, nil
+}
+
+// loadFilesystem returns the id of the filesystem persisted in the state file,
+// empty if there's no identity yet. A state file with an identity but without
+// a filesystem, e.g. written by an older version, gets the given one.
+func (s *stateStore) loadFilesystem(fsid string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	st, err := s.read()
+	if err != nil {
+		return "", err
+	}
+	if st.Identity == "" || st.Filesystem != "" {
+		return st.Filesystem, nil
+	}
+	st.Filesystem = fsid
+	if err := s.write(st); err != nil {
+		return "", err
+	}
+	return fsid, nil
+}
+
+// loadExportIds reads the persisted exportIds.
+func (s *stateStore) loadExportIds() (map[uint16]bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	exportIds := map[uint16]bool{}
+	st, err := s.read()
+	if err != nil {
+		return exportIds, err
+	}
+	for _, id := range st.ExportIds {
+		exportIds[id] = true
+	}
+	return exportIds, nil
+}
+
+// saveExportIds overwrites the persisted exportIds with the given ones.
+func (s *stateStore) saveExportIds(exportIds map[uint16]bool) error {
+	ids := make([]int, 0, len(exportIds))
+	for id := range exportIds {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	return s.modify(func(st *state) error {
+		st.ExportIds = make([]uint16, 0, len(ids))
+		for _, id := range ids {
+			st.ExportIds = append(st.ExportIds, uint16(id))
+		}
+		return nil
+	})
+}
+
+func (s *stateStore) Get(pvName string) (*NFSExport, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	st, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	for _, export := range st.Exports {
+		if export.PV == pvName {
+			return export, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *stateStore) Create(export *NFSExport) error {
+	return s.modify(func(st *state) error {
+		for _, existing := range st.Exports {
+			if existing.PV == export.PV {
+				return fmt.Errorf("state file %s already has a record of PV %s", s.path, export.PV)
+			}
+		}
+		st.Exports = append(st.Exports, export)
+		return nil
+	})
+}
+
+func (s *stateStore) Update(export *NFSExport) error {
+	return s.modify(func(st *state) error {
+		for i, existing := range st.Exports {
+			if existing.PV == export.PV {
+				st.Exports[i] = export
+				return nil
+			}
+		}
+		return fmt.Errorf("state file %s has no record of PV %s", s.path, export.PV)
+	})
+}
+
+func (s *stateStore) Delete(pvName string) error {
+	return s.modify(func(st *state) error {
+		exports := []*NFSExport{}
+		for _, existing := range st.Exports {
+			if existing.PV != pvName {
+				exports = append(exports, existing)
+			}
+		}
+		st.Exports = exports
+		return nil
+	})
+}
+
+func (s *stateStore) List() ([]*NFSExport, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	st, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	return st.Exports, nil
+}
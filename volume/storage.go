@@ -0,0 +1,89 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// filesystemId returns the id of the filesystem the given path is on, as
+// reported by statfs, which for most filesystems is derived from their UUID.
+func filesystemId(path string) (string, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return "", fmt.Errorf("error calling statfs on %v: %v", path, err)
+	}
+	return fmt.Sprintf("%08x%08x", uint32(stat.Fsid.X__val[0]), uint32(stat.Fsid.X__val[1])), nil
+}
+
+// verifyStorage checks that exportDir is the storage this provisioner's PVs
+// were provisioned in, rather than a different or empty volume it was
+// accidentally pointed at, in which case provisioning would orphan them. The
+// filesystem exportDir is on must be the one recorded in the state file, and
+// the PVs served from exportDir, i.e. with this provisioner's server and a
+// path in exportDir, must be stamped with the identity in the state file. An
+// event is emitted on every PV that isn't.
+func (p *nfsProvisioner) verifyStorage() error {
+	fsid, err := filesystemId(p.exportDir)
+	if err != nil {
+		return err
+	}
+	recorded, err := p.stateStore.loadFilesystem(fsid)
+	if err != nil {
+		return fmt.Errorf("error reading state file: %v", err)
+	}
+	if recorded != "" && recorded != fsid {
+		return fmt.Errorf("export directory %s is on filesystem %s, not filesystem %s its state file was written on", p.exportDir, fsid, recorded)
+	}
+
+	identity, err := p.stateStore.loadIdentity(false)
+	if err != nil {
+		return fmt.Errorf("error reading state file: %v", err)
+	}
+	server, err := p.getServer()
+	if err != nil {
+		glog.Warningf("error getting NFS server, can't check that the PVs it serves are in export directory %s: %v", p.exportDir, err)
+		return nil
+	}
+	volumes, err := p.client.Core().PersistentVolumes().List(api.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error listing PVs: %v", err)
+	}
+
+	mismatched := []string{}
+	for i := range volumes.Items {
+		volume := &volumes.Items[i]
+		if volume.Annotations[annCreatedBy] != createdBy || volume.Spec.NFS == nil || volume.Spec.NFS.Server != server || !strings.HasPrefix(volume.Spec.NFS.Path, p.exportDir) {
+			continue
+		}
+		if stamped, ok := volume.Annotations[annIdentity]; ok && stamped != identity {
+			mismatched = append(mismatched, volume.Name)
+			p.recordEvent(volume, v1.EventTypeWarning, "StorageMismatch", fmt.Sprintf("PV was provisioned in storage with identity %s but export directory %s has identity %q, the provisioner may be pointed at a different or empty volume; it won't provision until it's pointed back", stamped, p.exportDir, identity))
+		}
+	}
+	if len(mismatched) != 0 {
+		return fmt.Errorf("%d PVs served from export directory %s, e.g. %s, were provisioned in storage with another identity than its %q, it may be a different or empty volume", len(mismatched), p.exportDir, mismatched[0], identity)
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// stubExporter records exports in its config file, in the format of
+// /etc/exports, without any NFS server serving them, so that the provisioner
+// can be run where there's none, e.g. on a developer's machine against a
+// remote cluster, to debug provisioning and the controller.
+type stubExporter struct {
+	config string
+}
+
+var _ exporter = &stubExporter{}
+
+func (e *stubExporter) GetConfig() string {
+	return e.config
+}
+
+// GetConfigExportIds gets the exportIds in the config file, none if it
+// doesn't exist yet.
+func (e *stubExporter) GetConfigExportIds() (map[uint16]bool, error) {
+	exportIds, err := getConfigExportIds(e.config, regexp.MustCompile("fsid=([0-9]+)"))
+	if os.IsNotExist(err) {
+		return map[uint16]bool{}, nil
+	}
+	return exportIds, err
+}
+
+// GetConfigExports gets the exports in the config file, none if it doesn't
+// exist yet.
+func (e *stubExporter) GetConfigExports() ([]configExport, error) {
+	exports, err := getConfigExports(e.config, kernelBlockRe)
+	if os.IsNotExist(err) {
+		return []configExport{}, nil
+	}
+	return exports, err
+}
+
+// CreateBlock creates the block kernelExporter's CreateBlock would.
+func (e *stubExporter) CreateBlock(exportId, path string, params exportParams) (string, error) {
+	return (&kernelExporter{}).CreateBlock(exportId, path, params)
+}
+
+// AddToConfig adds the given block to the config file, creating it if it
+// doesn't exist yet.
+func (e *stubExporter) AddToConfig(block string) error {
+	f, err := os.OpenFile(e.config, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("error creating stub exports file %s: %v", e.config, err)
+	}
+	f.Close()
+	return addToFile(e.config, block)
+}
+
+func (e *stubExporter) RemoveFromConfig(block string) error {
+	return removeFromFile(e.config, block)
+}
+
+func (e *stubExporter) Export(block string) error {
+	glog.Infof("stub exporter, not exporting %s", strings.TrimSpace(block))
+	return nil
+}
+
+func (e *stubExporter) Unexport(block string) error {
+	glog.Infof("stub exporter, not unexporting %s", strings.TrimSpace(block))
+	return nil
+}
@@ -0,0 +1,240 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wongma7/nfs-provisioner/controller"
+	"github.com/wongma7/nfs-provisioner/ganesha"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// updater is implemented by exporters that can update an existing export's
+// options in place.
+type updater interface {
+	// UpdateBlock returns the given block with its access type and clients set
+	// to the given ones. No clients means any client.
+	UpdateBlock(block, accessType string, clients []string) (string, error)
+	// UpdateConfig replaces the export in the config file with the same
+	// exportId as the given block with the block.
+	UpdateConfig(block string) error
+	// Update makes the server reload the export of the given block, which must
+	// be in the config file already.
+	Update(block string) error
+}
+
+var _ controller.Updater = &nfsProvisioner{}
+
+// Update updates the export backing the given PV to match the PV's
+// annotations annAccessType and annClients, after updating its snapshots to
+// match its annotations annSnapshots and annRestoreSnapshot. It does nothing if
+// the export and snapshots already match.
+func (p *nfsProvisioner) Update(volume *v1.PersistentVolume) error {
+	if volume.Annotations[annCreatedBy] != createdBy || p.dryRun {
+		return nil
+	}
+
+	p.volumeMutex.Lock(volume.Name)
+	defer p.volumeMutex.Unlock(volume.Name)
+
+	if err := p.updateSnapshots(volume); err != nil {
+		return fmt.Errorf("error updating snapshots of PV: %v", err)
+	}
+
+	// Exporting through both, the export is updated by the one it's
+	// exported through
+	annotated, _ := p.getAnnotation(volume, annBlock)
+	e := p.exporterOf(annotated)
+	updater, ok := e.(updater)
+	if !ok {
+		if _, ok := volume.Annotations[annAccessType]; ok {
+			return fmt.Errorf("updating exports is only supported with ganesha, ignoring annotation %s", annAccessType)
+		}
+		if _, ok := volume.Annotations[annClients]; ok {
+			return fmt.Errorf("updating exports is only supported with ganesha, ignoring annotation %s", annClients)
+		}
+		return nil
+	}
+
+	accessType, clients, err := getExportOptions(volume)
+	if err != nil {
+		return err
+	}
+
+	block, _, err := p.getExportInfo(volume)
+	if err != nil {
+		return err
+	}
+	newBlock, err := updater.UpdateBlock(block, accessType, clients)
+	if err != nil {
+		return fmt.Errorf("error updating export block of PV: %v", err)
+	}
+	if newBlock == block {
+		return nil
+	}
+
+	if err := p.updateConfig(updater, newBlock); err != nil {
+		return fmt.Errorf("error updating the export in the config file %s: %v", e.GetConfig(), err)
+	}
+	p.audit(auditUpdate, "update", volume.Name, volumeClaim(volume), p.volumePath(volume), newBlock)
+
+	if err := updater.Update(newBlock); err != nil {
+		return fmt.Errorf("updated the export in the config file %s but error updating it on the server: %v", e.GetConfig(), err)
+	}
+
+	if err := p.recordBlock(volume.Name, newBlock); err != nil {
+		return fmt.Errorf("updated the export but error recording its new block: %v", err)
+	}
+	p.recordEvent(volume, v1.EventTypeNormal, "ExportUpdated", fmt.Sprintf("Updated export to access type %s for %s", accessType, describeClients(clients)))
+
+	return nil
+}
+
+// describeClients describes the given export clients for an event.
+func describeClients(clients []string) string {
+	if len(clients) == 0 {
+		return "any client"
+	}
+	return "clients " + strings.Join(clients, ", ")
+}
+
+// getExportOptions gets the access type and clients the given PV's export
+// should have from its annotations, defaulting to RW for any client.
+func getExportOptions(volume *v1.PersistentVolume) (string, []string, error) {
+	accessType := "RW"
+	if ann, ok := volume.Annotations[annAccessType]; ok {
+		accessType = strings.ToUpper(strings.TrimSpace(ann))
+		if accessType != "RW" && accessType != "RO" {
+			return "", nil, fmt.Errorf("invalid value %q for annotation %s, must be RW or RO", ann, annAccessType)
+		}
+	}
+
+	clients := SplitClients(volume.Annotations[annClients])
+	if err := ValidateClients(clients); err != nil {
+		return "", nil, fmt.Errorf("invalid value for annotation %s: %v", annClients, err)
+	}
+
+	return accessType, clients, nil
+}
+
+// updateConfig replaces the given block's export in the exporter's config
+// file.
+func (p *nfsProvisioner) updateConfig(updater updater, block string) error {
+	unlock, err := lockFile(p.exporterOf(block).GetConfig())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return updater.UpdateConfig(block)
+}
+
+// recordBlock records the new block of the export backing the given PV in the
+// PV's annotation and, if there is one, the export's record.
+func (p *nfsProvisioner) recordBlock(pvName, block string) error {
+	volume, err := p.client.Core().PersistentVolumes().Get(pvName)
+	if err != nil {
+		return fmt.Errorf("error getting PV: %v", err)
+	}
+	if volume.Annotations == nil {
+		volume.Annotations = map[string]string{}
+	}
+	volume.Annotations[p.annotationKey(annBlock)] = block
+	if p.annotationDomain != "" {
+		delete(volume.Annotations, annBlock)
+	}
+	if _, err := p.client.Core().PersistentVolumes().Update(volume); err != nil {
+		return fmt.Errorf("error updating PV annotation %s: %v", p.annotationKey(annBlock), err)
+	}
+
+	if p.exportStore != nil {
+		export, err := p.exportStore.Get(pvName)
+		if err != nil {
+			return fmt.Errorf("error getting the export record for PV: %v", err)
+		}
+		if export != nil {
+			export.Block = block
+			if err := p.exportStore.Update(export); err != nil {
+				return fmt.Errorf("error updating the export record for PV: %v", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+var _ updater = &ganeshaExporter{}
+
+// UpdateBlock sets the Access_Type of the given EXPORT block. If there are
+// clients, the EXPORT's own Access_Type is None and a CLIENT block grants the
+// access type to only the clients instead.
+func (e *ganeshaExporter) UpdateBlock(block, accessType string, clients []string) (string, error) {
+	exports, err := parseExportBlock(block)
+	if err != nil {
+		return "", err
+	}
+	export := exports[0]
+
+	export.RemoveBlocks(func(b *ganesha.Block) bool {
+		return strings.EqualFold(b.Name, "CLIENT")
+	})
+	if len(clients) == 0 {
+		export.Set("Access_Type", accessType)
+	} else {
+		export.Set("Access_Type", "None")
+		export.AddBlock(ganesha.NewBlock("CLIENT",
+			"Clients", strings.Join(clients, ", "),
+			"Access_Type", accessType))
+	}
+
+	return "\n" + export.String(), nil
+}
+
+// UpdateConfig replaces the EXPORT in the ganesha config file with the same
+// Export_Id as the given EXPORT block with the block, keeping its position.
+func (e *ganeshaExporter) UpdateConfig(block string) error {
+	exports, err := parseExportBlock(block)
+	if err != nil {
+		return err
+	}
+
+	return e.index.modify(e.GetConfig(), func(x *ganeshaIndex) error {
+		if err := x.replace(exports[0]); err != nil {
+			return fmt.Errorf("error updating export block %s: %v", block, err)
+		}
+		return nil
+	})
+}
+
+// Update makes NFS Ganesha reload the EXPORT with the Export_Id of the given
+// EXPORT block from the config file, using D-Bus.
+func (e *ganeshaExporter) Update(block string) error {
+	exports, err := parseExportBlock(block)
+	if err != nil {
+		return err
+	}
+	id, _ := exports[0].ExportId()
+
+	// Call UpdateExport using dbus
+	call := ganesha.Call(ganesha.ExportMgrPath, "org.ganesha.nfsd.exportmgr.UpdateExport", e.ganeshaConfig, fmt.Sprintf("export(export_id = %d)", id))
+	if call.Err != nil {
+		return fmt.Errorf("error calling org.ganesha.nfsd.exportmgr.UpdateExport: %v", call.Err)
+	}
+
+	return nil
+}
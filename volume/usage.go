@@ -0,0 +1,134 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/wongma7/nfs-provisioner/logging"
+	"github.com/wongma7/nfs-provisioner/metrics"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// UsageUpdater is implemented by provisioners that can measure how much of
+// their storage each of their PVs uses. Measuring walks every PV's directory,
+// so it's done periodically rather than on every scrape of the metrics.
+type UsageUpdater interface {
+	UpdateUsage() error
+}
+
+var _ UsageUpdater = &nfsProvisioner{}
+
+// volumeUsage is how much a PV's directory uses, labeled by the PV and the
+// claim it's bound to, if any.
+type volumeUsage struct {
+	pv        string
+	pvc       string
+	namespace string
+	capacity  int64
+	bytes     uint64
+	inodes    uint64
+}
+
+// UpdateUsage measures the bytes and inodes used by the directory of every PV
+// this provisioner created, for collectUsage to collect.
+func (p *nfsProvisioner) UpdateUsage() error {
+	volumes, err := p.client.Core().PersistentVolumes().List(api.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error listing PVs: %v", err)
+	}
+
+	usage := []volumeUsage{}
+	for i := range volumes.Items {
+		volume := &volumes.Items[i]
+		if volume.Annotations[annCreatedBy] != createdBy || volume.Spec.NFS == nil {
+			continue
+		}
+		path := volume.Spec.NFS.Path
+		if !p.inExportDirs(path) {
+			continue
+		}
+		bytes, inodes, err := directoryUsage(path)
+		if err != nil {
+			logging.Error("error measuring usage", logging.Fields{logging.Operation: "usage", logging.PV: volume.Name, logging.Err: err})
+			continue
+		}
+		u := volumeUsage{pv: volume.Name, bytes: bytes, inodes: inodes}
+		if capacity, ok := volume.Spec.Capacity[v1.ResourceStorage]; ok {
+			u.capacity = capacity.Value()
+		}
+		if ref := volume.Spec.ClaimRef; ref != nil {
+			u.pvc = ref.Name
+			u.namespace = ref.Namespace
+		}
+		usage = append(usage, u)
+	}
+
+	p.usageMutex.Lock()
+	defer p.usageMutex.Unlock()
+	p.usage = usage
+	return nil
+}
+
+// directoryUsage returns the bytes allocated to and the number of inodes of
+// everything in the given directory, counting hard links once.
+func directoryUsage(path string) (uint64, uint64, error) {
+	var bytes, inodes uint64
+	seen := map[uint64]bool{}
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Files may be deleted by clients while the directory is walked
+			if os.IsNotExist(err) && file != path {
+				return nil
+			}
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok || seen[stat.Ino] {
+			return nil
+		}
+		seen[stat.Ino] = true
+		bytes += uint64(stat.Blocks) * 512
+		inodes++
+		return nil
+	})
+	return bytes, inodes, err
+}
+
+// collectUsage returns the usage of every PV as of the last UpdateUsage as
+// metrics.
+func (p *nfsProvisioner) collectUsage() []metrics.Family {
+	p.usageMutex.Lock()
+	defer p.usageMutex.Unlock()
+
+	families := []metrics.Family{
+		{Name: "nfs_provisioner_volume_capacity_bytes", Help: "Capacity of a PV.", Type: metrics.Gauge},
+		{Name: "nfs_provisioner_volume_used_bytes", Help: "Bytes allocated to the files in the directory of a PV.", Type: metrics.Gauge},
+		{Name: "nfs_provisioner_volume_used_inodes", Help: "Inodes used by the files in the directory of a PV.", Type: metrics.Gauge},
+	}
+	for _, u := range p.usage {
+		labels := metrics.Labels{"pv": u.pv, "pvc": u.pvc, "namespace": u.namespace}
+		for i, v := range []float64{float64(u.capacity), float64(u.bytes), float64(u.inodes)} {
+			families[i].Samples = append(families[i].Samples, metrics.Sample{Labels: labels, Value: v})
+		}
+	}
+	return families
+}
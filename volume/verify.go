@@ -0,0 +1,177 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/wongma7/nfs-provisioner/ganesha"
+	"github.com/wongma7/nfs-provisioner/logging"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// ExportVerifier is implemented by provisioners that can check that their
+// exports are still active, e.g. because something else may run exportfs.
+type ExportVerifier interface {
+	VerifyExports() error
+}
+
+var _ ExportVerifier = &nfsProvisioner{}
+
+// VerifyExports re-adds the exports of PVs that are missing from the config
+// file, then checks that every export in the config is still served and
+// exports it again if it isn't. With the kernel, an export must be active with
+// its options, as listed by exportfs -v, e.g. in case another agent ran
+// exportfs -r or -u. With ganesha, its Export_Id must be shown over D-Bus,
+// e.g. in case it was removed with RemoveExport. An event is emitted on the PV
+// of every export found missing.
+func (p *nfsProvisioner) VerifyExports() error {
+	if err := p.ReexportMissing(); err != nil {
+		return err
+	}
+
+	for _, e := range p.exporters() {
+		if err := p.verifyExporterExports(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyExporterExports checks that each export in the config file of the
+// given exporter is served by its NFS server and exports it again if it isn't.
+func (p *nfsProvisioner) verifyExporterExports(e exporter) error {
+	exports, err := e.GetConfigExports()
+	if err != nil {
+		return fmt.Errorf("error getting exports in config file %s: %v", e.GetConfig(), err)
+	}
+
+	if _, ok := e.(*ganeshaExporter); ok {
+		return p.verifyGaneshaExports(exports)
+	}
+	if _, ok := e.(*stubExporter); ok {
+		// No server serves the exports
+		return nil
+	}
+
+	active, err := exportfsList()
+	if err != nil {
+		return err
+	}
+
+	for _, export := range exports {
+		if !p.inExportDirs(export.path) {
+			continue
+		}
+		missing, err := missingKernelClients(export.block, active)
+		if err != nil {
+			glog.Errorf("error verifying export of %s: %v", export.path, err)
+			continue
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		p.reexport(export.path, export.block, fmt.Sprintf("isn't active to clients %s with its options", strings.Join(missing, ", ")))
+	}
+
+	return nil
+}
+
+// verifyGaneshaExports exports the given exports again if NFS Ganesha doesn't
+// show their Export_Ids.
+func (p *nfsProvisioner) verifyGaneshaExports(exports []configExport) error {
+	infos, err := ganesha.ShowExports()
+	if err != nil {
+		return err
+	}
+	shown := map[uint16]bool{}
+	for _, info := range infos {
+		shown[info.ExportId] = true
+	}
+
+	for _, export := range exports {
+		if !p.inExportDirs(export.path) || shown[export.exportId] {
+			continue
+		}
+		p.reexport(export.path, export.block, fmt.Sprintf("with Export_Id %d isn't served by NFS Ganesha", export.exportId))
+	}
+
+	return nil
+}
+
+// missingKernelClients returns the clients of the given /etc/exports block that
+// aren't among the active exports with all of their options.
+func missingKernelClients(block string, active []exportfsEntry) ([]string, error) {
+	path, clients, err := parseKernelBlock(block)
+	if err != nil {
+		return nil, err
+	}
+
+	missing := []string{}
+	for _, client := range clients {
+		found := false
+		for _, entry := range active {
+			if entry.path == path && entry.host == client.host && hasOptions(entry.options, client.options) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, client.host)
+		}
+	}
+	return missing, nil
+}
+
+// hasOptions returns whether the given comma-separated options are all among
+// the listed ones.
+func hasOptions(listed []string, options string) bool {
+	for _, option := range strings.Split(options, ",") {
+		if option != "" && !containsString(listed, option) {
+			return false
+		}
+	}
+	return true
+}
+
+// reexport exports the given block of the export of the given PV directory
+// again because it wasn't served for the given reason, emitting an event on
+// the PV.
+func (p *nfsProvisioner) reexport(path, block, reason string) {
+	pvName := filepath.Base(path)
+	p.volumeMutex.Lock(pvName)
+	defer p.volumeMutex.Unlock(pvName)
+
+	msg := fmt.Sprintf("export of PV %s %s, it may have been removed outside the provisioner; exporting it again", pvName, reason)
+	fields := logging.Fields{logging.Operation: "verify", logging.PV: pvName}
+	logging.Warning("export isn't served, exporting it again", fields.With(logging.Fields{"reason": reason}))
+	err := p.exporter.Export(block)
+	if err != nil {
+		logging.Error("error exporting again", fields.With(logging.Fields{logging.Err: err}))
+	} else {
+		p.audit(auditAdd, "verify", pvName, "", path, block)
+	}
+
+	if err != nil {
+		p.recordEventByName(pvName, v1.EventTypeWarning, "ExportFailed", fmt.Sprintf("%s failed, will retry: %v", msg, err))
+	} else {
+		p.recordEventByName(pvName, v1.EventTypeWarning, "ExportMissing", msg)
+	}
+}
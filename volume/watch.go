@@ -0,0 +1,326 @@
+/*
+Copyright 2016 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// configWatchDelay is how long the watcher waits after a config file changes
+// for more changes, e.g. the rest of an editing session, before reconciling.
+const configWatchDelay = 2 * time.Second
+
+// ConfigWatcher is implemented by provisioners that can watch their config
+// files for edits made outside the provisioner.
+type ConfigWatcher interface {
+	WatchConfig(stopCh <-chan struct{}) error
+}
+
+var _ ConfigWatcher = &nfsProvisioner{}
+
+// entryLister is implemented by exporters that can list every entry of their
+// config files, including ones edited outside the provisioner, which
+// GetConfigExports misses or lists in a form that can't be compared with the
+// blocks CreateBlock creates.
+type entryLister interface {
+	// listEntries returns the normalized entries of each path.
+	listEntries() (map[string][]string, error)
+	// normalize returns the given block the way listEntries would list it.
+	normalize(block string) string
+}
+
+// WatchConfig watches the config files with inotify and, once they've stopped
+// changing for configWatchDelay, reconciles the exports of PVs with them, so
+// that an edit made outside the provisioner doesn't silently break removing an
+// export later. It blocks until stopCh is closed.
+func (p *nfsProvisioner) WatchConfig(stopCh <-chan struct{}) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("error initializing inotify: %v", err)
+	}
+	file := os.NewFile(uintptr(fd), "inotify")
+	defer file.Close()
+
+	dirs := p.watchedDirs()
+	watches := map[int32]string{}
+	for dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("error creating directory %s to watch: %v", dir, err)
+		}
+		wd, err := syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO|syscall.IN_MOVED_FROM|syscall.IN_DELETE)
+		if err != nil {
+			return fmt.Errorf("error watching directory %s: %v", dir, err)
+		}
+		watches[int32(wd)] = dir
+	}
+
+	changed := make(chan struct{}, 1)
+	go p.reapplyOnChange(changed, stopCh)
+	go func() {
+		<-stopCh
+		file.Close()
+	}()
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := file.Read(buf)
+		if err != nil {
+			select {
+			case <-stopCh:
+				return nil
+			default:
+				return fmt.Errorf("error reading inotify events: %v", err)
+			}
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[start:start+int(event.Len)]), "\x00")
+			offset = start + int(event.Len)
+
+			if match, ok := dirs[watches[event.Wd]]; ok && match(name) {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// watchedDirs returns the directories the config files are in, each with a
+// func that returns whether a file in it is a config file. Directories are
+// watched rather than the files, which are replaced on every write.
+func (p *nfsProvisioner) watchedDirs() map[string]func(string) bool {
+	dirs := map[string]func(string) bool{}
+	for _, e := range p.exporters() {
+		config := e.GetConfig()
+		if isConfig, ok := dirs[filepath.Dir(config)]; ok {
+			dirs[filepath.Dir(config)] = func(name string) bool { return isConfig(name) || name == filepath.Base(config) }
+		} else {
+			dirs[filepath.Dir(config)] = func(name string) bool { return name == filepath.Base(config) }
+		}
+		if kernel, ok := e.(*kernelExporter); ok && kernel.exportsDir != "" {
+			dirs[kernel.exportsDir] = func(name string) bool { return strings.HasSuffix(name, ".exports") }
+		}
+	}
+	return dirs
+}
+
+// reapplyOnChange reconciles the exports with the config files once they've
+// stopped changing for configWatchDelay after being signaled on changed.
+func (p *nfsProvisioner) reapplyOnChange(changed <-chan struct{}, stopCh <-chan struct{}) {
+	conflicts := map[string]string{}
+	for {
+		select {
+		case <-changed:
+		case <-stopCh:
+			return
+		}
+	settle:
+		for {
+			select {
+			case <-changed:
+			case <-time.After(configWatchDelay):
+				break settle
+			case <-stopCh:
+				return
+			}
+		}
+		var err error
+		if conflicts, err = p.reapplyConfig(conflicts); err != nil {
+			glog.Errorf("error reconciling exports with edited config file %s: %v", p.exporter.GetConfig(), err)
+		}
+	}
+}
+
+// reapplyConfig makes the config files match the exports of the PVs this
+// provisioner created again after they were edited outside it: it re-adds
+// the exports of PVs that have no entry and warns about conflicts, i.e.
+// entries of PVs other than the ones the provisioner recorded, which it would
+// fail to remove when their PVs are deleted, and entries in exportDir that are
+// no PV's. Conflicting entries are left for the admin to fix. It returns the
+// conflicts, by path, and only warns about those not among the given previous
+// ones.
+func (p *nfsProvisioner) reapplyConfig(previous map[string]string) (map[string]string, error) {
+	lister, ok := p.exporter.(entryLister)
+	if !ok {
+		return previous, p.ReexportMissing()
+	}
+
+	volumes, err := p.client.Core().PersistentVolumes().List(api.ListOptions{})
+	if err != nil {
+		return previous, fmt.Errorf("error listing PVs: %v", err)
+	}
+	entries, err := lister.listEntries()
+	if err != nil {
+		return previous, fmt.Errorf("error reading config files: %v", err)
+	}
+
+	config := p.exporter.GetConfig()
+	conflicts := map[string]string{}
+	exported := map[string]bool{}
+	for i := range volumes.Items {
+		volume := &volumes.Items[i]
+		if volume.Annotations[annCreatedBy] != createdBy || volume.Spec.NFS == nil {
+			continue
+		}
+		path := volume.Spec.NFS.Path
+		if !p.inExportDirs(path) {
+			continue
+		}
+		exported[path] = len(entries[path]) != 0
+		conflict, expected := p.conflictingEntries(volume, lister, entries[path])
+		if conflict == "" {
+			continue
+		}
+		conflicts[path] = conflict
+		if previous[path] != conflict {
+			glog.Warningf("entries of PV %s in config file %s were edited outside the provisioner: %s", volume.Name, config, conflict)
+			p.recordEvent(volume, v1.EventTypeWarning, "ExportConflict", fmt.Sprintf("Entries of this PV's export in config file %s were edited outside the provisioner and won't be removed when it's deleted unless they're restored to %q: %s", config, expected, conflict))
+		}
+	}
+
+	p.readdMissingExports(volumes.Items, exported, false)
+
+	for path, pathEntries := range entries {
+		if _, ok := exported[path]; ok || !p.inExportDirs(path) {
+			continue
+		}
+		// A volume being provisioned has an export but no PV yet
+		if _, partial, err := p.journal.get(filepath.Base(path)); err == nil && partial {
+			continue
+		}
+		conflict := strings.Join(pathEntries, "; ")
+		conflicts[path] = conflict
+		if previous[path] != conflict {
+			glog.Warningf("config file %s has entries of %s in the export directory, which is no PV's: %s", config, path, conflict)
+		}
+	}
+
+	return conflicts, nil
+}
+
+// conflictingEntries returns the given entries of the given PV's path joined,
+// if they aren't just the block recorded for its export, and otherwise empty,
+// along with the recorded block, normalized. The entries are listed again
+// under the PV's lock if they're conflicting, since the export may have been
+// updated after they were listed.
+func (p *nfsProvisioner) conflictingEntries(volume *v1.PersistentVolume, lister entryLister, entries []string) (string, string) {
+	p.volumeMutex.Lock(volume.Name)
+	defer p.volumeMutex.Unlock(volume.Name)
+
+	block, _, err := p.getExportInfo(volume)
+	if err != nil {
+		glog.Errorf("error getting export of PV %s to compare with the config file: %v", volume.Name, err)
+		return "", ""
+	}
+	expected := lister.normalize(block)
+	conflicting := func(entries []string) bool {
+		return len(entries) > 1 || (len(entries) == 1 && entries[0] != expected)
+	}
+	if !conflicting(entries) {
+		return "", expected
+	}
+	relisted, err := lister.listEntries()
+	if err != nil {
+		glog.Errorf("error reading config files: %v", err)
+		return "", expected
+	}
+	entries = relisted[volume.Spec.NFS.Path]
+	if !conflicting(entries) {
+		return "", expected
+	}
+	return strings.Join(entries, "; "), expected
+}
+
+var _ entryLister = &kernelExporter{}
+
+// listEntries lists the lines of /etc/exports and the drop-in files, by the
+// path they export or, under the NFSv4 pseudo-root, by the path of the
+// directory bind-mounted there, with their whitespace normalized.
+func (e *kernelExporter) listEntries() (map[string][]string, error) {
+	files, err := e.configFiles()
+	if err != nil {
+		return nil, err
+	}
+	entries := map[string][]string{}
+	for _, file := range files {
+		read, err := ioutil.ReadFile(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, line := range strings.Split(string(read), "\n") {
+			entry := e.normalize(line)
+			if entry == "" || strings.HasPrefix(entry, "#") {
+				continue
+			}
+			path := e.fromRootPath(strings.Fields(entry)[0])
+			entries[path] = append(entries[path], entry)
+		}
+	}
+	return entries, nil
+}
+
+// normalize returns the given /etc/exports line with its whitespace
+// normalized.
+func (e *kernelExporter) normalize(block string) string {
+	return strings.Join(strings.Fields(block), " ")
+}
+
+var _ entryLister = &ganeshaExporter{}
+
+// listEntries lists the EXPORT blocks of the ganesha config file, by their
+// Pseudo or, if they have none, Path, serialized on a single line.
+func (e *ganeshaExporter) listEntries() (map[string][]string, error) {
+	entries := map[string][]string{}
+	err := e.index.view(e.GetConfig(), func(x *ganeshaIndex) {
+		for _, export := range x.config.Exports() {
+			path, ok := export.Get("Pseudo")
+			if !ok {
+				path, _ = export.Get("Path")
+			}
+			entries[path] = append(entries[path], strings.Join(strings.Fields(export.String()), " "))
+		}
+	})
+	return entries, err
+}
+
+// normalize returns the EXPORT of the given block serialized on a single line
+// the way listEntries lists it, so that blocks that only differ in formatting
+// are the same.
+func (e *ganeshaExporter) normalize(block string) string {
+	exports, err := parseExportBlock(block)
+	if err != nil || len(exports) != 1 {
+		return strings.Join(strings.Fields(block), " ")
+	}
+	return strings.Join(strings.Fields(exports[0].String()), " ")
+}